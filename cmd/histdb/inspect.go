@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/leveln"
+	"github.com/histdb/histdb/memindex"
+	"github.com/histdb/histdb/query"
+	"github.com/histdb/histdb/rwutils"
+	"github.com/histdb/histdb/store"
+)
+
+// stdout is where the inspection commands write their output.
+var stdout io.Writer = os.Stdout
+
+// levelName returns the name of a level as it appears in its file names.
+func levelName(lr store.LevelRange) string {
+	name, _, _ := strings.Cut(filesystem.File{Low: lr.Low, High: lr.High}.String(), ".")
+	return name
+}
+
+func parseLevelName(name string) (store.LevelRange, error) {
+	file, ok := filesystem.ParseFile(name + ".keys")
+	lr := store.LevelRange{Low: file.Low, High: file.High}
+	if !ok || levelName(lr) != strings.ToUpper(name) {
+		return lr, errs.Errorf("invalid level name: %q", name)
+	}
+	return lr, nil
+}
+
+// inspectFlags returns a flag set for an inspection command with a -dir flag
+// and, if level is set, a -level flag.
+func inspectFlags(name string, level bool) (fset *flag.FlagSet, dir, lname *string) {
+	fset = flag.NewFlagSet(name, flag.ExitOnError)
+	dir = fset.String("dir", "", "store directory (required)")
+	if level {
+		lname = fset.String("level", "", "level name as printed by levels (required)")
+	}
+	return fset, dir, lname
+}
+
+// openLevel opens the level named by the flags after they are parsed.
+func openLevel(fset *flag.FlagSet, dir, lname *string) (*store.Level, error) {
+	if *dir == "" || *lname == "" {
+		fset.Usage()
+		return nil, errs.Errorf("-dir and -level are required")
+	}
+	lr, err := parseLevelName(*lname)
+	if err != nil {
+		return nil, err
+	}
+	l, err := store.OpenLevel(&filesystem.T{Base: *dir}, lr)
+	if err != nil {
+		return nil, errs.Errorf("unable to open level: %w", err)
+	}
+	return l, nil
+}
+
+func runLevels(args []string) (err error) {
+	fset, dir, _ := inspectFlags("levels", false)
+	_ = fset.Parse(args)
+
+	if *dir == "" {
+		fset.Usage()
+		return errs.Errorf("-dir is required")
+	}
+
+	fs := &filesystem.T{Base: *dir}
+	lrs, err := store.ListLevels(fs)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	defer func() { err = errors.Join(err, errs.Wrap(tw.Flush())) }()
+
+	fmt.Fprintln(tw, "level\tlow\thigh\tdepth\tkeys\tmetrics\ttmin\ttmax\tindx bytes\tkeys bytes\tvals bytes\t")
+
+	for _, lr := range lrs {
+		if err := func() error {
+			l, err := store.OpenLevel(fs, lr)
+			if err != nil {
+				return errs.Errorf("unable to open level %s: %w", levelName(lr), err)
+			}
+			defer func() { _ = l.Close() }()
+
+			keys := 0
+			var it leveln.Iterator
+			for l.Iterator(&it); it.Next(); {
+				keys++
+			}
+			if err := it.Err(); err != nil {
+				return errs.Errorf("unable to iterate level %s: %w", levelName(lr), err)
+			}
+
+			indx, ksize, vsize, err := l.Sizes()
+			if err != nil {
+				return err
+			}
+
+			tmin, tmax := "-", "-"
+			if lo, hi := l.TimeRange(); lo <= hi {
+				tmin, tmax = fmt.Sprint(lo), fmt.Sprint(hi)
+			}
+
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%d\t%d\t%d\t\n",
+				levelName(lr), lr.Low, lr.High, l.Depth(), keys, l.Index().Cardinality(),
+				tmin, tmax, indx, ksize, vsize)
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runIndex(args []string) error {
+	fset, dir, lname := inspectFlags("index", true)
+	_ = fset.Parse(args)
+
+	l, err := openLevel(fset, dir, lname)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = l.Close() }()
+
+	idx := l.Index()
+
+	var tkeys []string
+	idx.TagKeys(func(tkey []byte) bool {
+		tkeys = append(tkeys, string(tkey))
+		return true
+	})
+	slices.Sort(tkeys)
+
+	fmt.Fprintf(stdout, "metrics %d\n", idx.Cardinality())
+
+	for _, tkey := range tkeys {
+		var values []string
+		idx.TagValues([]byte(tkey), func(value []byte) bool {
+			values = append(values, string(value))
+			return true
+		})
+		slices.Sort(values)
+
+		fmt.Fprintf(stdout, "%s\tvalues %d\tmetrics %d\n", tkey, len(values), cardinality(idx.QueryTrue, []byte(tkey)))
+
+		for _, value := range values {
+			tag := tkey
+			if value != "" {
+				tag += "=" + value
+			}
+			fmt.Fprintf(stdout, "\t%s\tmetrics %d\n", value, cardinality(idx.QueryEqual, []byte(tag)))
+		}
+	}
+
+	return nil
+}
+
+func cardinality(query func([]byte, func(*memindex.Bitmap)), arg []byte) (n uint64) {
+	query(arg, func(bm *memindex.Bitmap) { n = bm.GetCardinality() })
+	return n
+}
+
+func runKeys(args []string) error {
+	fset, dir, lname := inspectFlags("keys", true)
+	graph := fset.Bool("graph", false, "write a dot graph of the key pages instead")
+	_ = fset.Parse(args)
+
+	l, err := openLevel(fset, dir, lname)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = l.Close() }()
+
+	if *graph {
+		return leveln.Dump(stdout, l.Keys())
+	}
+
+	var it leveln.Iterator
+	var name []byte
+
+	for l.Iterator(&it); it.Next(); {
+		key := it.Key()
+		name, _ = l.Index().AppendNameByHash(key.Hash(), name[:0])
+		fmt.Fprintf(stdout, "%v\t%d\t%d\t%d\t%s\n", key.Hash(), key.Timestamp(), key.Duration(), len(it.Value()), name)
+	}
+	return errs.Wrap(it.Err())
+}
+
+func runValues(args []string) error {
+	fset, dir, lname := inspectFlags("values", true)
+	q := fset.String("q", "", "only print the metrics matching the query")
+	buckets := fset.Bool("buckets", false, "print every bucket of the histograms")
+	_ = fset.Parse(args)
+
+	l, err := openLevel(fset, dir, lname)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = l.Close() }()
+
+	var match *memindex.Bitmap
+	if *q != "" {
+		var qq query.Q
+		if err := query.Parse([]byte(*q), &qq); err != nil {
+			return errs.Errorf("invalid query: %w", err)
+		}
+		match = qq.Eval(l.Index())
+	}
+
+	var it leveln.Iterator
+	var name []byte
+	var st flathist.S
+	h := st.New()
+
+	for l.Iterator(&it); it.Next(); {
+		key := it.Key()
+		if match != nil {
+			id, ok := l.Index().GetIdByHash(key.Hash())
+			if !ok || !match.Contains(uint32(id)) {
+				continue
+			}
+		}
+
+		var r rwutils.R
+		r.Init(buffer.OfLen(it.Value()))
+		st.Reset(h)
+		flathist.ReadFrom(&st, h, &r)
+		if _, err := r.Done(); err != nil {
+			return errs.Errorf("unable to decode value for %v: %w", key, err)
+		}
+
+		name, _ = l.Index().AppendNameByHash(key.Hash(), name[:0])
+		total, sum, _, _ := st.Summary(h)
+
+		fmt.Fprintf(stdout, "%s\t%d\t%d\ttotal=%d sum=%g", name, key.Timestamp(), key.Duration(), total, sum)
+		if total > 0 {
+			fmt.Fprintf(stdout, " min=%g p50=%g p90=%g p99=%g max=%g",
+				st.Min(h), st.Quantile(h, .5), st.Quantile(h, .9), st.Quantile(h, .99), st.Max(h))
+		}
+		fmt.Fprintln(stdout)
+
+		if *buckets {
+			var last uint64
+			st.Distribution(h, func(value float32, count, total uint64) {
+				fmt.Fprintf(stdout, "\t%g\t%d\n", value, count-last)
+				last = count
+			})
+		}
+	}
+	return errs.Wrap(it.Err())
+}
+
+func runExplain(args []string) (err error) {
+	fset, dir, _ := inspectFlags("explain", false)
+	q := fset.String("q", "", "query to explain (required)")
+	from := fset.Uint("from", 0, "start of the time range")
+	to := fset.Uint("to", math.MaxUint32, "end of the time range")
+	_ = fset.Parse(args)
+
+	if *dir == "" || *q == "" {
+		fset.Usage()
+		return errs.Errorf("-dir and -q are required")
+	} else if *to > math.MaxUint32 || *from > *to {
+		return errs.Errorf("invalid time range: [%d, %d)", *from, *to)
+	}
+
+	var qq query.Q
+	if err := query.Parse([]byte(*q), &qq); err != nil {
+		return errs.Errorf("invalid query: %w", err)
+	}
+
+	st, err := openStore(*dir, store.Config{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, errs.Wrap(st.Close())) }()
+
+	qx, err := st.ExplainData(&qq, uint32(*from), uint32(*to))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "query %s\n", qq.Format())
+	for _, lx := range qx.Levels {
+		fmt.Fprintf(stdout, "\nlevel %s\n%s", levelName(lx.Range), lx.Explanation)
+	}
+	fmt.Fprintf(stdout, "\nlevels %d\tmetrics %d\tkeys %d\tvalue bytes %d\telapsed %v\n",
+		qx.Stats.Levels, qx.Stats.Metrics, qx.Stats.Keys, qx.Stats.ValueBytes, qx.Elapsed)
+	return nil
+}
+
+func runVerify(args []string) error {
+	fset, dir, _ := inspectFlags("verify", false)
+	_ = fset.Parse(args)
+
+	if *dir == "" {
+		fset.Usage()
+		return errs.Errorf("-dir is required")
+	}
+
+	fs := &filesystem.T{Base: *dir}
+	lrs, err := store.ListLevels(fs)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	report := func(lr store.LevelRange, err error) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(stdout, "%s\t%v\n", levelName(lr), err)
+		} else {
+			fmt.Fprintf(stdout, "%s\tok\n", levelName(lr))
+		}
+	}
+
+	var next uint32
+	for _, lr := range lrs {
+		// expired levels leave gaps, but levels must not overlap.
+		if lr.Low < next {
+			failed++
+			fmt.Fprintf(stdout, "%s\toverlaps generation %d\n", levelName(lr), next-1)
+		}
+		next = lr.High
+
+		l, err := store.OpenLevel(fs, lr)
+		if err != nil {
+			report(lr, err)
+			continue
+		}
+		report(lr, l.Verify())
+		_ = l.Close()
+	}
+
+	if failed > 0 {
+		return errs.Errorf("%d problems found", failed)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/store"
+	"github.com/histdb/histdb/testhelp"
+)
+
+func TestInspect(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	st, err := openStore(fs.Base, store.Config{})
+	assert.NoError(t, err)
+	st.Observe([]byte("service=api,host=a"), 1)
+	st.Observe([]byte("service=api,host=b"), 2)
+	assert.NoError(t, st.WriteLevel(10, 10))
+	st.Observe([]byte("service=web,host=a"), 3)
+	st.Observe([]byte("service=web,host=a"), 4)
+	assert.NoError(t, st.WriteLevel(20, 10))
+	assert.NoError(t, st.Close())
+
+	var out strings.Builder
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+
+	inspect := func(args ...string) string {
+		t.Helper()
+		out.Reset()
+		assert.NoError(t, run(append(args, "-dir", fs.Base)))
+		return out.String()
+	}
+
+	t.Run("Levels", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(inspect("levels")), "\n")
+		assert.Equal(t, len(lines), 3)
+		assert.Equal(t, strings.Fields(lines[1])[:8], []string{"00000000-00000001", "0", "1", "1", "2", "2", "10", "10"})
+		assert.Equal(t, strings.Fields(lines[2])[:8], []string{"00000001-00000002", "1", "2", "1", "1", "1", "20", "20"})
+	})
+
+	t.Run("Index", func(t *testing.T) {
+		assert.Equal(t, inspect("index", "-level", "00000000-00000001"), ""+
+			"metrics 2\n"+
+			"host\tvalues 2\tmetrics 2\n"+
+			"\ta\tmetrics 1\n"+
+			"\tb\tmetrics 1\n"+
+			"service\tvalues 1\tmetrics 2\n"+
+			"\tapi\tmetrics 2\n")
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(inspect("keys", "-level", "00000001-00000002")), "\n")
+		assert.Equal(t, len(lines), 1)
+		fields := strings.Split(lines[0], "\t")
+		assert.Equal(t, fields[1:3], []string{"20", "10"})
+		assert.Equal(t, fields[4], "host=a,service=web")
+
+		assert.That(t, strings.HasPrefix(inspect("keys", "-level", "00000001-00000002", "-graph"), "digraph"))
+	})
+
+	t.Run("Values", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(inspect("values", "-level", "00000000-00000001", "-q", "host=b")), "\n")
+		assert.Equal(t, len(lines), 1)
+		assert.That(t, strings.HasPrefix(lines[0], "host=b,service=api\t10\t10\ttotal=1 sum=2"))
+
+		// values are printed as the midpoints of their buckets.
+		lines = strings.Split(strings.TrimSpace(inspect("values", "-level", "00000001-00000002", "-buckets")), "\n")
+		assert.Equal(t, len(lines), 3)
+		assert.That(t, strings.HasPrefix(lines[0], "host=a,service=web\t20\t10\ttotal=2 sum=7"))
+		assert.That(t, strings.HasPrefix(lines[1], "\t3"))
+		assert.That(t, strings.HasSuffix(lines[1], "\t1"))
+	})
+
+	t.Run("Explain", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(inspect("explain", "-q", "host=a", "-to", "15")), "\n")
+		assert.Equal(t, lines[0], `query {host == "a"}`)
+		assert.Equal(t, lines[2], "level 00000000-00000001")
+		assert.Equal(t, strings.Fields(lines[3]), []string{"metrics", "estimate", "scanned", "elapsed", "node"})
+		assert.Equal(t, strings.Fields(lines[4])[:3], []string{"1", "1", "0"})
+		assert.Equal(t, strings.Fields(lines[4])[4:], []string{"(sel", "eq", "host", "a)"})
+		assert.That(t, strings.HasPrefix(lines[6], "levels 1\tmetrics 1\tkeys 1\tvalue bytes "))
+
+		assert.Error(t, run([]string{"explain", "-dir", fs.Base}))
+		assert.Error(t, run([]string{"explain", "-dir", fs.Base, "-q", "host=a", "-from", "2", "-to", "1"}))
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		assert.Equal(t, inspect("verify"), "00000000-00000001\tok\n00000001-00000002\tok\n")
+
+		name := filesystem.File{Low: 1, High: 2, Kind: filesystem.KindVals}.String()
+		fh, err := fs.OpenWrite(name)
+		assert.NoError(t, err)
+		_, err = fh.WriteAt([]byte{0xff}, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fh.Close())
+
+		out.Reset()
+		assert.Error(t, run([]string{"verify", "-dir", fs.Base}))
+		assert.That(t, strings.HasPrefix(out.String(), "00000000-00000001\tok\n00000001-00000002\tcorrupt level file "+name))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Error(t, run([]string{"keys", "-dir", fs.Base, "-level", "bogus"}))
+		assert.Error(t, run([]string{"keys", "-dir", fs.Base, "-level", "00000002-00000003"}))
+	})
+}
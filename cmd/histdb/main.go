@@ -0,0 +1,52 @@
+// Command histdb serves a histdb store over HTTP and inspects store
+// directories.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "serve a store over http", runServe},
+	{"levels", "list the levels of a store", runLevels},
+	{"index", "dump the memindex of a level", runIndex},
+	{"keys", "list the keys of a level", runKeys},
+	{"values", "print the histograms of a level", runValues},
+	{"explain", "explain how a query runs against a store", runExplain},
+	{"verify", "check the levels of a store for corruption", runVerify},
+	{"snapshot", "snapshot the levels of a store", runSnapshot},
+	{"restore", "restore a store from a snapshot", runRestore},
+	{"migrate", "rewrite levels from older versions in the current layout", runMigrate},
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) > 0 {
+		for _, cmd := range commands {
+			if cmd.name == args[0] {
+				return cmd.run(args[1:])
+			}
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "usage: histdb <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+	os.Exit(2)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/store"
+)
+
+func runMigrate(args []string) error {
+	fset := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dir := fset.String("dir", "", "store directory that is not open (required)")
+	_ = fset.Parse(args)
+
+	if *dir == "" {
+		fset.Usage()
+		return errs.Errorf("-dir is required")
+	}
+
+	n, err := store.Migrate(&filesystem.T{Base: *dir})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "migrated %d levels in %s\n", n, *dir)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/store"
+)
+
+func runRestore(args []string) error {
+	fset := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fset.String("dir", "", "empty store directory to restore into (required)")
+	snapshot := fset.String("snapshot", "", "snapshot directory to restore from (required)")
+	_ = fset.Parse(args)
+
+	if *dir == "" || *snapshot == "" {
+		fset.Usage()
+		return errs.Errorf("-dir and -snapshot are required")
+	}
+
+	if err := store.Restore(&filesystem.T{Base: *dir}, *snapshot); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "restored %s into %s\n", *snapshot, *dir)
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb/store"
+	"github.com/histdb/histdb/testhelp"
+)
+
+func TestRestore(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+	sfs, scleanup := testhelp.FS(t)
+	defer scleanup()
+	rfs, rcleanup := testhelp.FS(t)
+	defer rcleanup()
+
+	st, err := openStore(fs.Base, store.Config{})
+	assert.NoError(t, err)
+	st.Observe([]byte("service=api"), 1)
+	assert.NoError(t, st.WriteLevel(10, 10))
+	assert.NoError(t, st.Close())
+
+	var out strings.Builder
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+
+	assert.Error(t, run([]string{"snapshot", "-dir", fs.Base + "-missing", "-out", sfs.Base}))
+	assert.NoError(t, run([]string{"snapshot", "-dir", fs.Base, "-out", sfs.Base}))
+	assert.Error(t, run([]string{"snapshot", "-dir", fs.Base, "-out", sfs.Base}))
+
+	assert.Error(t, run([]string{"restore", "-dir", fs.Base, "-snapshot", sfs.Base}))
+	assert.NoError(t, run([]string{"restore", "-dir", rfs.Base, "-snapshot", sfs.Base}))
+
+	out.Reset()
+	assert.NoError(t, run([]string{"verify", "-dir", rfs.Base}))
+	assert.Equal(t, out.String(), "00000000-00000001\tok\n")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/openmetrics"
+	"github.com/histdb/histdb/statsd"
+	"github.com/histdb/histdb/store"
+)
+
+// nativeMaxBuckets limits the native histogram buckets of each sign on
+// /metrics to the default OpenTelemetry limit.
+const nativeMaxBuckets = 160
+
+func runServe(args []string) (err error) {
+	fset := flag.NewFlagSet("serve", flag.ExitOnError)
+	dir := fset.String("dir", "", "store directory (required)")
+	addr := fset.String("addr", ":8080", "address to listen on")
+	interval := fset.Duration("interval", 10*time.Second, "how often to write and compact levels")
+	wal := fset.Bool("wal", true, "append observations to a write-ahead log")
+	walSync := fset.Duration("wal-sync", time.Second, "how often to sync the write-ahead log")
+	statsdAddr := fset.String("statsd", "", "udp address to receive statsd timings on")
+	buckets := fset.String("buckets", "", "comma separated upper bounds of the buckets exposed on /metrics")
+	native := fset.Bool("native", false, "expose native histogram buckets on /metrics")
+	schema := fset.Int("schema", 3, "largest schema of the native histogram buckets")
+	memSoft := fset.Uint64("memory-soft", 0, "bytes of memory after which a level is written early")
+	memHard := fset.Uint64("memory-hard", 0, "bytes of memory after which new metrics are dropped")
+	_ = fset.Parse(args)
+
+	if *dir == "" {
+		fset.Usage()
+		return errs.Errorf("-dir is required")
+	}
+
+	bounds, err := parseBounds(*buckets)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(*dir, store.Config{
+		WAL:             *wal,
+		WALSyncInterval: *walSync,
+		FlushInterval:   *interval,
+		MemorySoftLimit: *memSoft,
+		MemoryHardLimit: *memHard,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, st.Close()) }()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	srv := newServer(st, openmetrics.Config{
+		Bounds:     bounds,
+		Native:     *native,
+		Schema:     int32(*schema),
+		MaxBuckets: nativeMaxBuckets,
+	})
+	hs := &http.Server{Addr: *addr, Handler: srv}
+
+	if *statsdAddr != "" {
+		conn, err := net.ListenPacket("udp", *statsdAddr)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		defer func() { _ = conn.Close() }()
+
+		var sd statsd.T
+		sd.Init(st)
+
+		go func() {
+			if err := sd.Serve(conn); err != nil {
+				log.Printf("statsd: %v", err)
+			}
+		}()
+		log.Printf("receiving statsd on %s", conn.LocalAddr())
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		sctx, scancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer scancel()
+
+		_ = hs.Shutdown(sctx)
+	}()
+
+	log.Printf("serving %s on %s", *dir, *addr)
+	if err := hs.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return errs.Wrap(err)
+	}
+
+	return nil
+}
+
+func openStore(dir string, cfg store.Config) (*store.T, error) {
+	fs := &filesystem.T{Base: dir}
+	if cfg.ReadOnly {
+		// the directory is not created so that a typo is an error.
+	} else if err := fs.Mkdir(""); err != nil {
+		return nil, errs.Errorf("unable to create store directory: %w", err)
+	}
+
+	st := new(store.T)
+	if err := st.Init(fs, cfg); err != nil {
+		return nil, errs.Errorf("unable to open store: %w", err)
+	}
+	return st, nil
+}
+
+func parseBounds(s string) ([]float64, error) {
+	var bounds []float64
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		b, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, errs.Errorf("invalid bucket bound: %q", field)
+		}
+		bounds = append(bounds, b)
+	}
+	return bounds, nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/openmetrics"
+	"github.com/histdb/histdb/otlp"
+	"github.com/histdb/histdb/promwrite"
+	"github.com/histdb/histdb/query"
+	"github.com/histdb/histdb/rwutils"
+	"github.com/histdb/histdb/store"
+)
+
+// binaryContentType is the content type of the compact responses. Every
+// response is a sequence of records, each serialized with rwutils:
+//
+//	metrics:   [name: varint len + bytes]
+//	data:      [name: varint len + bytes] [key] [histogram]
+//	aggregate: [group: varint len + bytes] [start: u32] [duration: u32] [histogram]
+//
+// where the histogram is serialized with flathist.AppendTo.
+const binaryContentType = "application/x-histdb"
+
+// the exponential histograms of format=otlp responses use the finest scale
+// that is still coarser than flathist and the default OpenTelemetry limit on
+// the number of buckets.
+const (
+	otlpScale      = 7
+	otlpMaxBuckets = 160
+)
+
+// defaultDataLimit is the number of values returned by /api/data when the
+// request has no limit. If more values match, the response is cut short and
+// has the truncatedHeader set.
+const (
+	defaultDataLimit = 10000
+	truncatedHeader  = "Histdb-Truncated"
+)
+
+type server struct {
+	_ [0]func() // no equality
+
+	st   *store.T
+	mux  *http.ServeMux
+	prom promwrite.T
+	otlp otlp.T
+	om   openmetrics.Exporter
+}
+
+func newServer(st *store.T, om openmetrics.Config) *server {
+	s := &server{
+		st:  st,
+		mux: http.NewServeMux(),
+	}
+
+	s.prom.Init(st)
+	s.otlp.Init(st)
+	s.om.Init(st, om)
+
+	s.mux.HandleFunc("POST /api/observe", s.handleObserve)
+	s.mux.Handle("POST /api/v1/write", &s.prom)
+	s.mux.Handle("POST /v1/metrics", &s.otlp)
+	s.mux.HandleFunc("GET /api/metrics", s.handleMetrics)
+	s.mux.HandleFunc("GET /api/data", s.handleData)
+	s.mux.HandleFunc("GET /api/aggregate", s.handleAggregate)
+	s.mux.HandleFunc("GET /api/explain", s.handleExplain)
+	s.mux.Handle("GET /metrics", &s.om)
+	s.mux.HandleFunc("GET /api/health", s.handleHealth)
+
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(w, req)
+}
+
+// handleHealth reports the last error from writing or compacting levels.
+func (s *server) handleHealth(w http.ResponseWriter, req *http.Request) {
+	if err := s.st.LastError(); err != nil {
+		httpError(w, http.StatusServiceUnavailable, "%v", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// ingest
+//
+
+// handleObserve accepts lines of the form "<metric> <value> [<value>...]".
+// The values must be finite.
+func (s *server) handleObserve(w http.ResponseWriter, req *http.Request) {
+	var vals []float32
+
+	sc := bufio.NewScanner(req.Body)
+	for line := 1; sc.Scan(); line++ {
+		metric, rest, ok := bytes.Cut(bytes.TrimSpace(sc.Bytes()), []byte(" "))
+		if len(metric) == 0 {
+			continue
+		} else if !ok {
+			httpError(w, http.StatusBadRequest, "line %d: missing value", line)
+			return
+		}
+
+		vals = vals[:0]
+		for _, field := range bytes.Fields(rest) {
+			val, err := strconv.ParseFloat(string(field), 32)
+			if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+				httpError(w, http.StatusBadRequest, "line %d: invalid value: %q", line, field)
+				return
+			}
+			vals = append(vals, float32(val))
+		}
+
+		if len(vals) == 1 {
+			s.st.Observe(metric, vals[0])
+		} else {
+			s.st.ObserveMany(metric, vals)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		httpError(w, http.StatusBadRequest, "reading body: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// queries
+//
+
+func (s *server) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	var q query.Q
+	if err := query.Parse([]byte(req.FormValue("q")), &q); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid query: %v", err)
+		return
+	}
+
+	if wantsBinary(req) {
+		var rw rwutils.W
+		if _, err := s.st.QueryMetrics(&q, func(hash histdb.Hash, name []byte) bool {
+			appendBytes(&rw, name)
+			return true
+		}); err != nil {
+			httpError(w, http.StatusInternalServerError, "query failed: %v", err)
+			return
+		}
+		writeBinary(w, &rw)
+		return
+	}
+
+	metrics := []string{}
+	if _, err := s.st.QueryMetrics(&q, func(hash histdb.Hash, name []byte) bool {
+		metrics = append(metrics, string(name))
+		return true
+	}); err != nil {
+		httpError(w, http.StatusInternalServerError, "query failed: %v", err)
+		return
+	}
+	writeJSON(w, struct {
+		Metrics []string `json:"metrics"`
+	}{metrics})
+}
+
+type jsonValue struct {
+	Name      string `json:"name"`
+	Timestamp uint32 `json:"timestamp"`
+	Duration  uint32 `json:"duration"`
+	jsonHistogram
+}
+
+func (s *server) handleData(w http.ResponseWriter, req *http.Request) {
+	var q query.Q
+	if err := query.Parse([]byte(req.FormValue("q")), &q); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid query: %v", err)
+		return
+	}
+	from, to, err := parseWindow(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	qs, err := parseQuantiles(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	limit, err := parseUint32(req, "limit", defaultDataLimit)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%v", err)
+		return
+	} else if limit == 0 {
+		httpError(w, http.StatusBadRequest, "invalid limit: 0")
+		return
+	}
+
+	var rw rwutils.W
+	var exp otlp.Exporter
+	var count uint32
+	values := []jsonValue{}
+	binary := wantsBinary(req)
+	export := req.FormValue("format") == "otlp"
+	exp.Init(otlpScale, otlpMaxBuckets)
+
+	done, err := s.st.QueryData(&q, from, to, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+		if count == limit {
+			return false
+		}
+		count++
+
+		if binary {
+			appendBytes(&rw, name)
+			key.AppendTo(&rw)
+			flathist.AppendTo(st, h, &rw)
+		} else if export {
+			exp.Add(name, key.Timestamp(), key.Duration(), st, h)
+		} else {
+			values = append(values, jsonValue{
+				Name:          string(name),
+				Timestamp:     key.Timestamp(),
+				Duration:      key.Duration(),
+				jsonHistogram: newJSONHistogram(st, h, qs),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "query failed: %v", err)
+		return
+	}
+	if !done {
+		w.Header().Set(truncatedHeader, "true")
+	}
+
+	if binary {
+		writeBinary(w, &rw)
+		return
+	} else if export {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(exp.AppendTo(nil))
+		return
+	}
+	writeJSON(w, struct {
+		Values []jsonValue `json:"values"`
+	}{values})
+}
+
+type jsonBucket struct {
+	Group    string `json:"group"`
+	Start    uint32 `json:"start"`
+	Duration uint32 `json:"duration"`
+	jsonHistogram
+}
+
+func (s *server) handleAggregate(w http.ResponseWriter, req *http.Request) {
+	var q query.Q
+	if err := query.Parse([]byte(req.FormValue("q")), &q); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid query: %v", err)
+		return
+	}
+	from, to, err := parseWindow(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	qs, err := parseQuantiles(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	step, err := parseUint32(req, "step", 0)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	var by [][]byte
+	for _, tkey := range req.Form["by"] {
+		by = append(by, []byte(tkey))
+	}
+
+	agg, err := s.st.QueryAggregate(&q, from, to, step, by)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "query failed: %v", err)
+		return
+	}
+
+	duration := step
+	if step == 0 {
+		duration = to - from
+	}
+
+	if wantsBinary(req) {
+		var rw rwutils.W
+		for _, b := range agg.Buckets {
+			appendBytes(&rw, b.Group)
+			rw.Uint32(b.Start)
+			rw.Uint32(duration)
+			flathist.AppendTo(&agg.S, b.H, &rw)
+		}
+		writeBinary(w, &rw)
+		return
+	}
+
+	buckets := []jsonBucket{}
+	for _, b := range agg.Buckets {
+		buckets = append(buckets, jsonBucket{
+			Group:         string(b.Group),
+			Start:         b.Start,
+			Duration:      duration,
+			jsonHistogram: newJSONHistogram(&agg.S, b.H, qs),
+		})
+	}
+	writeJSON(w, struct {
+		Buckets []jsonBucket `json:"buckets"`
+	}{buckets})
+}
+
+type jsonStep struct {
+	Depth     int    `json:"depth"`
+	Node      string `json:"node"`
+	Estimate  int    `json:"estimate"`
+	Metrics   int    `json:"metrics"`
+	Scanned   int    `json:"scanned"`
+	ElapsedNS int64  `json:"elapsed_ns"`
+	Filtered  bool   `json:"filtered,omitempty"`
+	Reused    bool   `json:"reused,omitempty"`
+	Skipped   bool   `json:"skipped,omitempty"`
+}
+
+type jsonLevel struct {
+	Level string     `json:"level"`
+	Steps []jsonStep `json:"steps"`
+}
+
+type jsonStats struct {
+	Levels     int   `json:"levels"`
+	Metrics    int   `json:"metrics"`
+	Keys       int   `json:"keys"`
+	ValueBytes int64 `json:"value_bytes"`
+	ElapsedNS  int64 `json:"elapsed_ns"`
+}
+
+// handleExplain reports how the query is evaluated against every level that
+// /api/data would scan and how much work the scan does.
+func (s *server) handleExplain(w http.ResponseWriter, req *http.Request) {
+	var q query.Q
+	if err := query.Parse([]byte(req.FormValue("q")), &q); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid query: %v", err)
+		return
+	}
+	from, to, err := parseWindow(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	qx, err := s.st.ExplainData(&q, from, to)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "query failed: %v", err)
+		return
+	}
+
+	levels := []jsonLevel{}
+	for _, lx := range qx.Levels {
+		steps := []jsonStep{}
+		for _, st := range lx.Explanation.Steps {
+			steps = append(steps, jsonStep{
+				Depth:     st.Depth,
+				Node:      st.Node,
+				Estimate:  st.Estimate,
+				Metrics:   st.Metrics,
+				Scanned:   st.Scanned,
+				ElapsedNS: st.Elapsed.Nanoseconds(),
+				Filtered:  st.Filtered,
+				Reused:    st.Reused,
+				Skipped:   st.Skipped,
+			})
+		}
+		levels = append(levels, jsonLevel{Level: levelName(lx.Range), Steps: steps})
+	}
+
+	writeJSON(w, struct {
+		Query  string      `json:"query"`
+		Levels []jsonLevel `json:"levels"`
+		Stats  jsonStats   `json:"stats"`
+	}{
+		Query:  q.Format(),
+		Levels: levels,
+		Stats: jsonStats{
+			Levels:     qx.Stats.Levels,
+			Metrics:    qx.Stats.Metrics,
+			Keys:       qx.Stats.Keys,
+			ValueBytes: qx.Stats.ValueBytes,
+			ElapsedNS:  qx.Elapsed.Nanoseconds(),
+		},
+	})
+}
+
+//
+// helpers
+//
+
+type jsonHistogram struct {
+	Total     uint64             `json:"total"`
+	Sum       float64            `json:"sum"`
+	Min       float32            `json:"min"`
+	Max       float32            `json:"max"`
+	Quantiles map[string]float32 `json:"quantiles,omitempty"`
+}
+
+func newJSONHistogram(st *flathist.S, h flathist.H, qs []float64) (jh jsonHistogram) {
+	jh.Total, jh.Sum, _, _ = st.Summary(h)
+	if jh.Total == 0 {
+		return jh
+	}
+
+	jh.Min, jh.Max = st.Min(h), st.Max(h)
+	if len(qs) > 0 {
+		jh.Quantiles = make(map[string]float32, len(qs))
+		for _, q := range qs {
+			jh.Quantiles[strconv.FormatFloat(q, 'f', -1, 64)] = st.Quantile(h, q)
+		}
+	}
+	return jh
+}
+
+func parseUint32(req *http.Request, name string, def uint32) (uint32, error) {
+	val := req.FormValue(name)
+	if val == "" {
+		return def, nil
+	}
+	x, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return 0, errs.Errorf("invalid %s: %q", name, val)
+	}
+	return uint32(x), nil
+}
+
+func parseWindow(req *http.Request) (from, to uint32, err error) {
+	if from, err = parseUint32(req, "from", 0); err != nil {
+		return 0, 0, err
+	}
+	if to, err = parseUint32(req, "to", math.MaxUint32); err != nil {
+		return 0, 0, err
+	}
+	if to < from {
+		return 0, 0, errs.Errorf("invalid window: to %d is before from %d", to, from)
+	}
+	return from, to, nil
+}
+
+func parseQuantiles(req *http.Request) ([]float64, error) {
+	_ = req.ParseForm()
+
+	var qs []float64
+	for _, val := range req.Form["quantile"] {
+		q, err := strconv.ParseFloat(val, 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, errs.Errorf("invalid quantile: %q", val)
+		}
+		qs = append(qs, q)
+	}
+	return qs, nil
+}
+
+func wantsBinary(req *http.Request) bool {
+	return req.FormValue("format") == "binary" || req.Header.Get("Accept") == binaryContentType
+}
+
+func appendBytes(rw *rwutils.W, buf []byte) {
+	rw.Varint(uint64(len(buf)))
+	rw.Bytes(buf)
+}
+
+func writeBinary(w http.ResponseWriter, rw *rwutils.W) {
+	w.Header().Set("Content-Type", binaryContentType)
+	_, _ = w.Write(rw.Done().Prefix())
+}
+
+// writeJSON encodes the whole response before writing any of it so that an
+// error encoding it is reported instead of sending a truncated body.
+func writeJSON(w http.ResponseWriter, v any) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "encoding response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(buf, '\n'))
+}
+
+func httpError(w http.ResponseWriter, code int, format string, args ...any) {
+	http.Error(w, fmt.Sprintf(format, args...), code)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/openmetrics"
+	"github.com/histdb/histdb/rwutils"
+	"github.com/histdb/histdb/store"
+	"github.com/histdb/histdb/testhelp"
+)
+
+func newTestServer(t *testing.T) (*server, func()) {
+	fs, cleanup := testhelp.FS(t)
+
+	st, err := openStore(fs.Base, store.Config{})
+	assert.NoError(t, err)
+
+	srv := newServer(st, openmetrics.Config{Bounds: []float64{1, 10}})
+
+	return srv, func() {
+		assert.NoError(t, st.Close())
+		cleanup()
+	}
+}
+
+func do(t *testing.T, srv *server, method, path string, vals url.Values, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path+"?"+vals.Encode(), strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func readBytes(r *rwutils.R) []byte {
+	return r.Bytes(int(r.Varint()))
+}
+
+func newReader(t *testing.T, rec *httptest.ResponseRecorder) *rwutils.R {
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Header().Get("Content-Type"), binaryContentType)
+
+	body, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+
+	var r rwutils.R
+	r.Init(buffer.OfLen(body))
+	return &r
+}
+
+func TestServer_NonFinite(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, val := range []string{"NaN", "Inf", "-Inf", "1e39"} {
+		rec := do(t, srv, "POST", "/api/observe", nil, "a=b 1 "+val+"\n")
+		assert.Equal(t, rec.Code, http.StatusBadRequest)
+	}
+
+	// a response that can not be encoded is an error instead of a cut short
+	// body.
+	rec := httptest.NewRecorder()
+	writeJSON(rec, struct{ Sum float64 }{math.NaN()})
+	assert.Equal(t, rec.Code, http.StatusInternalServerError)
+	assert.That(t, strings.Contains(rec.Body.String(), "encoding response"))
+}
+
+func TestServer(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	rec := do(t, srv, "POST", "/api/observe", nil, ""+
+		"service=api,host=a 1 2 3\n"+
+		"\n"+
+		"service=api,host=b 4\n"+
+		"service=web,host=a 5 6\n")
+	assert.Equal(t, rec.Code, http.StatusNoContent)
+	assert.NoError(t, srv.st.WriteLevel(1000, 10))
+
+	t.Run("Metrics", func(t *testing.T) {
+		rec := do(t, srv, "GET", "/api/metrics", url.Values{"q": {"service=api"}}, "")
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var resp struct{ Metrics []string }
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, len(resp.Metrics), 2)
+
+		rec = do(t, srv, "GET", "/api/metrics", url.Values{"q": {"service=web"}, "format": {"binary"}}, "")
+		r := newReader(t, rec)
+		assert.Equal(t, string(readBytes(r)), "host=a,service=web")
+		assert.Equal(t, r.Remaining(), uintptr(0))
+	})
+
+	t.Run("Data", func(t *testing.T) {
+		rec := do(t, srv, "GET", "/api/data", url.Values{
+			"q":        {"host=a"},
+			"quantile": {"0", "1"},
+		}, "")
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var resp struct {
+			Values []struct {
+				Name      string
+				Timestamp uint32
+				Duration  uint32
+				Total     uint64
+				Min, Max  float32
+				Quantiles map[string]float32
+			}
+		}
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, len(resp.Values), 2)
+
+		var total uint64
+		for _, v := range resp.Values {
+			assert.Equal(t, v.Timestamp, 1000)
+			assert.Equal(t, v.Duration, 10)
+			assert.Equal(t, int(v.Quantiles["0"]), int(v.Min))
+			assert.Equal(t, int(v.Quantiles["1"]), int(v.Max))
+			total += v.Total
+		}
+		assert.Equal(t, total, 5)
+
+		rec = do(t, srv, "GET", "/api/data", url.Values{"q": {"host=b"}, "format": {"binary"}}, "")
+		r := newReader(t, rec)
+
+		var key histdb.Key
+		var st flathist.S
+		assert.Equal(t, string(readBytes(r)), "host=b,service=api")
+		key.ReadFrom(r)
+		h := st.New()
+		flathist.ReadFrom(&st, h, r)
+		assert.Equal(t, r.Remaining(), uintptr(0))
+		_, err := r.Done()
+		assert.NoError(t, err)
+
+		assert.Equal(t, key.Timestamp(), 1000)
+		total, _, _, _ = st.Summary(h)
+		assert.Equal(t, total, 1)
+		assert.Equal(t, int(st.Max(h)), 4)
+
+		rec = do(t, srv, "GET", "/api/data", url.Values{"q": {"host=a"}, "from": {"2000"}}, "")
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, len(resp.Values), 0)
+
+		// the limit cuts the response short and says so.
+		rec = do(t, srv, "GET", "/api/data", url.Values{"q": {"host=a"}, "limit": {"1"}}, "")
+		assert.Equal(t, rec.Header().Get(truncatedHeader), "true")
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, len(resp.Values), 1)
+
+		rec = do(t, srv, "GET", "/api/data", url.Values{"q": {"host=a"}, "limit": {"2"}}, "")
+		assert.Equal(t, rec.Header().Get(truncatedHeader), "")
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, len(resp.Values), 2)
+
+		rec = do(t, srv, "GET", "/api/data", url.Values{"q": {"host=a"}, "limit": {"0"}}, "")
+		assert.Equal(t, rec.Code, http.StatusBadRequest)
+	})
+
+	t.Run("Aggregate", func(t *testing.T) {
+		rec := do(t, srv, "GET", "/api/aggregate", url.Values{
+			"q":    {"{service|}"},
+			"from": {"0"},
+			"to":   {"2000"},
+			"by":   {"service"},
+		}, "")
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var resp struct {
+			Buckets []struct {
+				Group    string
+				Start    uint32
+				Duration uint32
+				Total    uint64
+			}
+		}
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, len(resp.Buckets), 2)
+		assert.Equal(t, resp.Buckets[0].Group, "service=api")
+		assert.Equal(t, resp.Buckets[0].Total, 4)
+		assert.Equal(t, resp.Buckets[0].Duration, 2000)
+		assert.Equal(t, resp.Buckets[1].Group, "service=web")
+		assert.Equal(t, resp.Buckets[1].Total, 2)
+
+		rec = do(t, srv, "GET", "/api/aggregate", url.Values{
+			"q":      {"{service|}"},
+			"step":   {"100"},
+			"format": {"binary"},
+		}, "")
+		r := newReader(t, rec)
+
+		var st flathist.S
+		var groups []string
+		for r.Remaining() > 0 {
+			groups = append(groups, string(readBytes(r)))
+			assert.Equal(t, r.Uint32(), 1000)
+			assert.Equal(t, r.Uint32(), 100)
+			flathist.ReadFrom(&st, st.New(), r)
+		}
+		_, err := r.Done()
+		assert.NoError(t, err)
+		assert.Equal(t, groups, []string{""})
+	})
+
+	t.Run("Explain", func(t *testing.T) {
+		rec := do(t, srv, "GET", "/api/explain", url.Values{"q": {"{host =~ 'a|b'} & {service = api}"}}, "")
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var resp struct {
+			Query  string
+			Levels []struct {
+				Level string
+				Steps []struct {
+					Depth    int
+					Node     string
+					Metrics  int
+					Scanned  int
+					Filtered bool
+				}
+			}
+			Stats struct {
+				Levels, Metrics, Keys int
+				ValueBytes            int64 `json:"value_bytes"`
+			}
+		}
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, resp.Query, `{host =~ "a|b"} & {service == "api"}`)
+		assert.Equal(t, len(resp.Levels), 1)
+
+		steps := resp.Levels[0].Steps
+		assert.Equal(t, len(steps), 3)
+		assert.Equal(t, steps[0].Node, "inter")
+		assert.Equal(t, steps[0].Metrics, 2)
+		assert.Equal(t, steps[2].Node, "(sel re host a|b)")
+		assert.Equal(t, steps[2].Depth, 1)
+		assert.Equal(t, steps[2].Scanned, 2)
+		assert.That(t, steps[2].Filtered)
+
+		assert.Equal(t, resp.Stats.Levels, 1)
+		assert.Equal(t, resp.Stats.Metrics, 2)
+		assert.Equal(t, resp.Stats.Keys, 2)
+		assert.That(t, resp.Stats.ValueBytes > 0)
+	})
+
+	t.Run("OpenMetrics", func(t *testing.T) {
+		rec := do(t, srv, "GET", "/metrics", url.Values{"q": {"service=api"}}, "")
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		body := rec.Body.String()
+		assert.That(t, strings.HasPrefix(body, "# TYPE histdb histogram\n"))
+		assert.That(t, strings.Contains(body, `histdb_bucket{host="a",service="api",le="10"} 3`+"\n"))
+		assert.That(t, strings.Contains(body, `histdb_count{host="b",service="api"} 1`+"\n"))
+		assert.That(t, strings.HasSuffix(body, "# EOF\n"))
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		assert.Equal(t, do(t, srv, "GET", "/api/health", nil, "").Code, http.StatusNoContent)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Equal(t, do(t, srv, "POST", "/api/observe", nil, "m\n").Code, http.StatusBadRequest)
+		assert.Equal(t, do(t, srv, "POST", "/api/observe", nil, "m x\n").Code, http.StatusBadRequest)
+		assert.Equal(t, do(t, srv, "GET", "/api/metrics", url.Values{"q": {"service"}}, "").Code, http.StatusBadRequest)
+		assert.Equal(t, do(t, srv, "GET", "/api/data", url.Values{"q": {"a=b"}, "from": {"2"}, "to": {"1"}}, "").Code, http.StatusBadRequest)
+		assert.Equal(t, do(t, srv, "GET", "/api/data", url.Values{"q": {"a=b"}, "quantile": {"2"}}, "").Code, http.StatusBadRequest)
+		assert.Equal(t, do(t, srv, "GET", "/api/explain", url.Values{"q": {"a=b"}, "from": {"2"}, "to": {"1"}}, "").Code, http.StatusBadRequest)
+		assert.Equal(t, do(t, srv, "GET", "/api/observe", nil, "").Code, http.StatusMethodNotAllowed)
+	})
+}
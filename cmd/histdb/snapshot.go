@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/store"
+)
+
+func runSnapshot(args []string) (err error) {
+	fset := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	dir := fset.String("dir", "", "store directory that is not being written (required)")
+	out := fset.String("out", "", "empty directory on the same filesystem to write the snapshot into (required)")
+	_ = fset.Parse(args)
+
+	if *dir == "" || *out == "" {
+		fset.Usage()
+		return errs.Errorf("-dir and -out are required")
+	}
+
+	st, err := openStore(*dir, store.Config{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, errs.Wrap(st.Close())) }()
+
+	if err := st.Snapshot(*out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "wrote snapshot of %s to %s\n", *dir, *out)
+	return nil
+}
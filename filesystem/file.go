@@ -25,19 +25,35 @@ func (f File) String() string {
 	return string(buf[:])
 }
 
+func (f File) TempString() string {
+	return f.String() + TempSuffix
+}
+
 const (
 	KindIndx = 1
 	KindKeys = 2
 	KindVals = 3
+	KindWlog = 4
+	KindCmpt = 5
+	KindTomb = 6
+	KindMnft = 7
 )
 
+// TempSuffix is appended to the name of a file while it is being written so
+// that it is not mistaken for a complete file after a crash.
+const TempSuffix = ".tmp"
+
 var (
-	rkinds = [256]byte{'i': 1, 'k': 2, 'v': 3}
-	kinds  = [4][4]byte{
+	rkinds = [256]byte{'i': 1, 'k': 2, 'v': 3, 'w': 4, 'c': 5, 't': 6, 'm': 7}
+	kinds  = [8][4]byte{
 		{'x', 'x', 'x', 'x'},
 		{'i', 'n', 'd', 'x'},
 		{'k', 'e', 'y', 's'},
 		{'v', 'a', 'l', 's'},
+		{'w', 'l', 'o', 'g'},
+		{'c', 'm', 'p', 't'},
+		{'t', 'o', 'm', 'b'},
+		{'m', 'n', 'f', 't'},
 	}
 )
 
@@ -50,7 +66,7 @@ func writeFile(buf *[22]byte, f File) {
 
 	be.PutUint64(buf[0:8], hexx.Put32(f.Low))
 	be.PutUint64(buf[9:17], hexx.Put32(f.High))
-	*(*[4]byte)(buf[18:22]) = kinds[f.Kind%4]
+	*(*[4]byte)(buf[18:22]) = kinds[f.Kind%8]
 }
 
 func ParseFile(name string) (f File, ok bool) {
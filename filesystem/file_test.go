@@ -20,6 +20,10 @@ func TestFileName(t *testing.T) {
 		{"00000000-00000000.indx", File{Kind: KindIndx}},
 		{"00000000-00000000.keys", File{Kind: KindKeys}},
 		{"00000000-00000000.vals", File{Kind: KindVals}},
+		{"00000000-00000000.wlog", File{Kind: KindWlog}},
+		{"00000000-00000000.cmpt", File{Kind: KindCmpt}},
+		{"00000000-00000000.tomb", File{Kind: KindTomb}},
+		{"00000000-00000000.mnft", File{Kind: KindMnft}},
 
 		{"00000000-00000000.xxxx", File{}},
 		{"FFFFFFFF-FFFFFFFF.vals", File{
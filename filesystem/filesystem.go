@@ -81,6 +81,17 @@ func (t *T) Symlink(old, new string) (err error) {
 	return errs.Wrap(os.Symlink(old, new))
 }
 
+// SyncDir syncs the directory so that any files created, renamed or removed
+// in it are durable.
+func (t *T) SyncDir(path string) (err error) {
+	path = t.child(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	return errs.Wrap(errs.Combine(f.Sync(), f.Close()))
+}
+
 func (t *T) Link(old, new string) (err error) {
 	old = t.child(old)
 	new = t.child(new)
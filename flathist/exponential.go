@@ -0,0 +1,143 @@
+package flathist
+
+import "math"
+
+// Exponential is an exponential histogram in the layout used by
+// OpenTelemetry. With base = 2^(2^-Scale), index i of Positive counts values
+// in (base^i, base^(i+1)] and index i of Negative counts values in
+// [-base^(i+1), -base^i).
+type Exponential struct {
+	Scale     int32
+	ZeroCount uint64
+	Positive  ExponentialBuckets
+	Negative  ExponentialBuckets
+}
+
+// ExponentialBuckets are the counts for consecutive indexes starting at
+// Offset.
+type ExponentialBuckets struct {
+	Offset int32
+	Counts []uint64
+}
+
+// Total returns the number of values counted by the exponential histogram.
+func (e *Exponential) Total() (total uint64) {
+	total = e.ZeroCount
+	for _, c := range e.Positive.Counts {
+		total += c
+	}
+	for _, c := range e.Negative.Counts {
+		total += c
+	}
+	return total
+}
+
+const (
+	// exponential scales supported by OpenTelemetry.
+	minExpScale = -10
+	maxExpScale = 20
+
+	// minNormal is the smallest normal float32. smaller values are counted as
+	// zero by Exponential.
+	minNormal = 0x1p-126
+)
+
+// ObserveExponential adds every count in the exponential histogram to the
+// histogram. Each count is observed at the geometric midpoint of its bucket,
+// which is within a factor of 2^(2^-Scale/2) of every value in the bucket, and
+// is then stored with the usual relative error of at most 2^-8. Buckets beyond
+// the range of a normal float32 are observed at the largest or smallest one.
+//
+// It is safe to be called concurrently.
+func (s *S) ObserveExponential(h H, e *Exponential) {
+	if e.ZeroCount > 0 {
+		s.ObserveN(h, 0, e.ZeroCount)
+	}
+	width := math.Exp2(-float64(e.Scale))
+	for sign, bs := range [2]*ExponentialBuckets{&e.Negative, &e.Positive} {
+		for i, count := range bs.Counts {
+			if count == 0 {
+				continue
+			}
+			v := math.Exp2((float64(bs.Offset) + float64(i) + 0.5) * width)
+			v = min(max(v, minNormal), math.MaxFloat32)
+			if sign == 0 {
+				v = -v
+			}
+			s.ObserveN(h, float32(v), count)
+		}
+	}
+}
+
+// Exponential returns the histogram as an exponential histogram with the
+// largest scale up to scale that needs at most maxBuckets buckets for each
+// sign, or any number of buckets if maxBuckets is zero. Each bucket of the
+// histogram is counted in the exponential bucket containing its midpoint, so
+// every value is counted in a bucket that it is within a relative error of
+// 2^-8 of, except that values smaller than the smallest normal float32 are
+// counted as zero. Scales larger than 7 are finer than the histogram and
+// leave empty buckets between the counted ones.
+//
+// It is safe to be called concurrently with Observe.
+func (s *S) Exponential(h H, scale int32, maxBuckets int) (e Exponential) {
+	scale = min(max(scale, minExpScale), maxExpScale)
+
+	type entry struct {
+		idx   int64
+		count uint64
+	}
+	var neg, pos []entry
+
+	var last uint64
+	s.Distribution(h, func(value float32, count, total uint64) {
+		n := count - last
+		last = count
+
+		if math.Abs(float64(value)) < minNormal {
+			e.ZeroCount += n
+			return
+		}
+
+		idx := int64(math.Ceil(math.Log2(math.Abs(float64(value)))*math.Exp2(float64(scale)))) - 1
+		if value < 0 {
+			neg = append(neg, entry{idx, n})
+		} else {
+			pos = append(pos, entry{idx, n})
+		}
+	})
+
+	// lowering the scale by one merges pairs of buckets, which is a shift of
+	// the index.
+	span := func(es []entry, shift int32) int64 {
+		if len(es) == 0 {
+			return 0
+		}
+		lo, hi := es[0].idx>>shift, es[len(es)-1].idx>>shift
+		return max(hi-lo, lo-hi) + 1
+	}
+	shift := int32(0)
+	for maxBuckets > 0 && scale-shift > minExpScale &&
+		max(span(neg, shift), span(pos, shift)) > int64(maxBuckets) {
+		shift++
+	}
+	e.Scale = scale - shift
+
+	fill := func(bs *ExponentialBuckets, es []entry) {
+		if len(es) == 0 {
+			return
+		}
+		lo, hi := es[0].idx>>shift, es[0].idx>>shift
+		for _, en := range es {
+			lo, hi = min(lo, en.idx>>shift), max(hi, en.idx>>shift)
+		}
+		bs.Offset = int32(lo)
+		bs.Counts = make([]uint64, hi-lo+1)
+		for _, en := range es {
+			bs.Counts[en.idx>>shift-lo] += en.count
+		}
+	}
+	fill(&e.Negative, neg)
+	fill(&e.Positive, pos)
+
+	return e
+}
@@ -0,0 +1,78 @@
+package flathist
+
+import (
+	"math"
+	"testing"
+
+	"github.com/zeebo/assert"
+	"github.com/zeebo/mwc"
+)
+
+func TestExponential(t *testing.T) {
+	t.Run("Import", func(t *testing.T) {
+		var s S
+		h := s.New()
+
+		// scale 0 has base 2, so bucket 1 is (2, 4] and bucket 2 is (4, 8].
+		s.ObserveExponential(h, &Exponential{
+			Scale:     0,
+			ZeroCount: 3,
+			Positive:  ExponentialBuckets{Offset: 1, Counts: []uint64{5, 0, 7}},
+			Negative:  ExponentialBuckets{Offset: 0, Counts: []uint64{2}},
+		})
+
+		assert.Equal(t, s.Total(h), 17)
+		assert.That(t, s.Min(h) >= -2 && s.Min(h) < -1)
+		assert.That(t, s.Max(h) > 8 && s.Max(h) <= 16)
+		assert.Equal(t, s.Quantile(h, 0.2), float32(0))
+		assert.That(t, s.Quantile(h, 0.5) > 2 && s.Quantile(h, 0.5) <= 4)
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		var s S
+		h := s.New()
+
+		rng := mwc.Rand()
+		for range 10000 {
+			v := float32(math.Exp(rng.Float64()*20 - 10))
+			if rng.Uint64()%4 == 0 {
+				v = -v
+			}
+			s.Observe(h, v)
+		}
+		s.Observe(h, 0)
+
+		e := s.Exponential(h, 7, 0)
+		assert.Equal(t, e.Scale, int32(7))
+		assert.Equal(t, e.Total(), s.Total(h))
+		assert.Equal(t, e.ZeroCount, 1)
+
+		var r S
+		g := r.New()
+		r.ObserveExponential(g, &e)
+		assert.Equal(t, r.Total(g), s.Total(h))
+
+		// the bucket midpoints move values by at most 2^(1/256) and each store
+		// adds a relative error of 2^-8.
+		for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99} {
+			want, got := float64(s.Quantile(h, q)), float64(r.Quantile(g, q))
+			assert.That(t, math.Abs(got-want) <= 0.02*math.Abs(want))
+		}
+	})
+
+	t.Run("MaxBuckets", func(t *testing.T) {
+		var s S
+		h := s.New()
+		for v := float32(1); v < 1e6; v *= 1.01 {
+			s.Observe(h, v)
+		}
+
+		e := s.Exponential(h, 20, 160)
+		assert.That(t, len(e.Positive.Counts) <= 160)
+		assert.That(t, e.Scale < 7)
+		assert.Equal(t, e.Total(), s.Total(h))
+
+		// one more scale would need too many buckets.
+		assert.That(t, len(s.Exponential(h, e.Scale+1, 0).Positive.Counts) > 160)
+	})
+}
@@ -25,16 +25,20 @@ func NewHistogram() *Histogram {
 
 func (h *Histogram) Finalize() { h.s.Finalize() }
 
-func (h *Histogram) Merge(other *Histogram)      { Merge(h.s, h.h, other.s, other.h) }
-func (h *Histogram) Equal(other *Histogram) bool { return Equal(h.s, h.h, other.s, other.h) }
-func (h *Histogram) Clone() *Histogram           { c := NewHistogram(); c.Merge(h); return c }
-func (h *Histogram) Observe(v float32)           { h.s.Observe(h.h, v) }
-func (h *Histogram) Min() float32                { return h.s.Min(h.h) }
-func (h *Histogram) Max() float32                { return h.s.Max(h.h) }
-func (h *Histogram) Reset()                      { h.s.Reset(h.h) }
-func (h *Histogram) Total() uint64               { return h.s.Total(h.h) }
-func (h *Histogram) Quantile(q float64) float32  { return h.s.Quantile(h.h, q) }
-func (h *Histogram) CDF(q float32) float64       { return h.s.CDF(h.h, q) }
+// Handle returns the store and handle holding the histogram's data.
+func (h *Histogram) Handle() (*S, H) { return h.s, h.h }
+
+func (h *Histogram) Merge(other *Histogram)       { Merge(h.s, h.h, other.s, other.h) }
+func (h *Histogram) Equal(other *Histogram) bool  { return Equal(h.s, h.h, other.s, other.h) }
+func (h *Histogram) Clone() *Histogram            { c := NewHistogram(); c.Merge(h); return c }
+func (h *Histogram) Observe(v float32)            { h.s.Observe(h.h, v) }
+func (h *Histogram) ObserveN(v float32, n uint64) { h.s.ObserveN(h.h, v, n) }
+func (h *Histogram) Min() float32                 { return h.s.Min(h.h) }
+func (h *Histogram) Max() float32                 { return h.s.Max(h.h) }
+func (h *Histogram) Reset()                       { h.s.Reset(h.h) }
+func (h *Histogram) Total() uint64                { return h.s.Total(h.h) }
+func (h *Histogram) Quantile(q float64) float32   { return h.s.Quantile(h.h, q) }
+func (h *Histogram) CDF(q float32) float64        { return h.s.CDF(h.h, q) }
 
 func (h *Histogram) Summary() (total uint64, sum, avg, vari float64) {
 	return h.s.Summary(h.h)
@@ -261,7 +261,23 @@ func Equal(s *S, h H, t *S, g H) bool {
 // Observe adds the value to the histogram.
 //
 // It is safe to be called concurrently.
-func (s *S) Observe(h H, v float32) {
+func (s *S) Observe(h H, v float32) { s.observe(h, v, 1) }
+
+// ObserveN adds the value to the histogram n times.
+//
+// It is safe to be called concurrently.
+func (s *S) ObserveN(h H, v float32, n uint64) {
+	// add in chunks small enough that a small counter that crosses the grow
+	// threshold can not overflow before it is grown.
+	for ; n > l2GrowAt; n -= l2GrowAt {
+		s.observe(h, v, l2GrowAt)
+	}
+	if n > 0 {
+		s.observe(h, v, uint32(n))
+	}
+}
+
+func (s *S) observe(h H, v float32, n uint32) {
 	if v != v || v > math.MaxFloat32 || v < -math.MaxFloat32 {
 		return
 	}
@@ -295,7 +311,7 @@ func (s *S) Observe(h H, v float32) {
 	switch addrTag(l2a) {
 	case l2TagSmall:
 		l2s := s.getL2S(l2a)
-		if atomic.AddUint32(&l2s.cs[l2i], 1) > l2GrowAt {
+		if atomic.AddUint32(&l2s.cs[l2i], n) > l2GrowAt {
 			l2aSlot := &l1.l2[l1i]
 			if atomic.CompareAndSwapUint32(l2aSlot, l2a, l2a|(l2TagGrowing<<29)) {
 				s.growLayer2(l2s, l2a, l2aSlot)
@@ -303,10 +319,10 @@ func (s *S) Observe(h H, v float32) {
 		}
 
 	case l2TagGrowing:
-		atomic.AddUint32(&s.getL2S(l2a).cs[l2i], 1)
+		atomic.AddUint32(&s.getL2S(l2a).cs[l2i], n)
 
 	case l2TagLarge:
-		atomic.AddUint64(&s.getL2L(l2a).cs[l2i], 1)
+		atomic.AddUint64(&s.getL2L(l2a).cs[l2i], uint64(n))
 	}
 }
 
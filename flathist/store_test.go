@@ -150,6 +150,24 @@ func TestStore(t *testing.T) {
 		assert.That(t, !Equal(&s1, h1, &s2, h2))
 	})
 
+	t.Run("ObserveN", func(t *testing.T) {
+		var s S
+
+		h1, h2 := s.New(), s.New()
+		for i := range 100 {
+			s.ObserveN(h1, float32(i), uint64(i))
+			for range i {
+				s.Observe(h2, float32(i))
+			}
+		}
+		assert.That(t, Equal(&s, h1, &s, h2))
+
+		// large counts are split so that the counters grow
+		s.ObserveN(h1, 1, 3*l2GrowAt+1)
+		s.Finalize()
+		assert.Equal(t, s.Total(h1), s.Total(h2)+3*l2GrowAt+1)
+	})
+
 	t.Run("Iterate", func(t *testing.T) {
 		var s S
 
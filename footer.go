@@ -0,0 +1,53 @@
+package histdb
+
+import (
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/rwutils"
+)
+
+// Footer is a fixed size block written at the end of every level file so that
+// a partially written file can be detected. It records the kind of the file,
+// the length of the data before the footer, and the xxh3 hash of that data.
+type Footer struct {
+	Kind     uint8
+	Length   uint64
+	Checksum uint64
+}
+
+const (
+	FooterSize    = 4 + 2 + 1 + 1 + 8 + 8 // magic + version + kind + reserved + length + checksum
+	FooterVersion = 0
+)
+
+var footerMagic = [4]byte{'h', 'd', 'b', 'f'}
+
+// IsFooter returns true if buf starts with the magic of a footer. Files
+// written before footers existed do not end with one.
+func IsFooter(buf []byte) bool {
+	return len(buf) >= FooterSize && [4]byte(buf[:4]) == footerMagic
+}
+
+func (f Footer) AppendTo(w *rwutils.W) {
+	w.Bytes4(footerMagic)
+	w.Uint16(FooterVersion)
+	w.Uint8(f.Kind)
+	w.Uint8(0)
+	w.Uint64(f.Length)
+	w.Uint64(f.Checksum)
+}
+
+func (f *Footer) ReadFrom(r *rwutils.R) {
+	if r.Bytes4() != footerMagic {
+		r.Invalid(errs.Errorf("footer has invalid magic"))
+		return
+	}
+	if version := r.Uint16(); version != FooterVersion {
+		r.Invalid(errs.Errorf("footer has unknown version: %d", version))
+		return
+	}
+	f.Kind = r.Uint8()
+	_ = r.Uint8()
+	f.Length = r.Uint64()
+	f.Checksum = r.Uint64()
+}
@@ -1,55 +1,49 @@
 package leveln
 
 import (
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
-	"log"
 
 	"github.com/zeebo/errs/v2"
 
+	"github.com/histdb/histdb"
 	"github.com/histdb/histdb/filesystem"
 )
 
-// dump constructs a dot graph of the node layout in an index
-func dump(fh filesystem.H) { //nolint
-	check := func(err error) {
-		if err != nil {
-			log.Fatalf("%+v", errs.Wrap(err))
-		}
+// Dump writes a dot graph of the page layout of the keys file to w.
+func Dump(w io.Writer, keys filesystem.H) error {
+	size, err := keys.Size()
+	if err != nil {
+		return errs.Wrap(err)
 	}
 
-	var buf [4096]byte
-	var hdr kwPageHeader
+	// the trailer and footer are smaller than a page
+	npages := uint32((size - histdb.FooterSize - kwTrailerSize) / kwPageSize)
 
-	_, err := fh.Seek(0, io.SeekStart)
-	check(err)
+	var page kwPage
 
-	fmt.Fprintln(fh, "digraph btree { node[shape=box]; spline=line;")
+	fmt.Fprintln(w, "digraph btree { node[shape=box]; spline=line;")
 
-	for i := 0; ; i++ {
-		_, err := io.ReadFull(fh, buf[:])
-		if errors.Is(err, io.EOF) {
-			break
+	for i := range npages {
+		if _, err := keys.ReadAt(page.Buf()[:], int64(i)*kwPageSize); err != nil {
+			return errs.Wrap(err)
 		}
-		check(err)
 
-		copy(hdr[:], buf[0:kwHeaderSize])
-		fmt.Fprintf(fh, "node%d [label=\"n%d (%d)\"]\n", i, i, hdr.Count())
+		fmt.Fprintf(w, "node%d [label=\"n%d (%d)\"]\n", i, i, page.hdr.Count())
 
-		if !hdr.Leaf() {
-			for j := uint16(0); j < hdr.Count(); j++ {
-				// TODO: what are these constants?
-				child := binary.BigEndian.Uint32(buf[16+24*j+20:])
-				fmt.Fprintf(fh, "node%d -> node%d;\n", i, child)
+		if !page.hdr.Leaf() {
+			for j := range min(page.hdr.Count(), kwEntries) {
+				fmt.Fprintf(w, "node%d -> node%d;\n", i, page.ents[j].Child())
 			}
-		} else {
-			fmt.Fprintf(fh, "{rank=same node%d node%d}\n", i, hdr.Next())
+		} else if next := page.hdr.Next(); next < npages {
+			fmt.Fprintf(w, "{rank=same node%d node%d}\n", i, next)
 		}
 
-		fmt.Fprintf(fh, "node%d -> node%d;\n", i, hdr.Next())
+		if next := page.hdr.Next(); next < npages {
+			fmt.Fprintf(w, "node%d -> node%d;\n", i, next)
+		}
 	}
 
-	fmt.Fprintln(fh, "}")
+	_, err = fmt.Fprintln(w, "}")
+	return errs.Wrap(err)
 }
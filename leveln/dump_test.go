@@ -0,0 +1,33 @@
+package leveln
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb/testhelp"
+)
+
+func TestDump(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	kfh, cleanup := testhelp.Tempfile(t, fs)
+	defer cleanup()
+	vfh, cleanup := testhelp.Tempfile(t, fs)
+	defer cleanup()
+
+	writeLevel(t, kfh, vfh, createMetrics(1000))
+
+	var buf strings.Builder
+	assert.NoError(t, Dump(&buf, kfh))
+
+	out := buf.String()
+	assert.That(t, strings.HasPrefix(out, "digraph btree {"))
+	assert.That(t, strings.HasSuffix(out, "}\n"))
+
+	// 1000 keys fill 3 leaves under a single root.
+	assert.That(t, strings.Contains(out, "node3 -> node0;\n"))
+	assert.That(t, strings.Contains(out, "node0 -> node1;\n"))
+}
@@ -20,6 +20,7 @@ type Iterator struct {
 	err    error
 	kr     keyReader
 	values filesystem.H
+	vlen   int64 // length of the values before the footer
 	off    uint32
 
 	key   histdb.Key
@@ -39,6 +40,7 @@ func (it *Iterator) Init(keys, values filesystem.H) {
 	it.err = nil
 	it.kr.Init(keys)
 	it.values = values
+	it.vlen = 0
 	it.off = 0
 
 	it.key = histdb.Key{}
@@ -48,6 +50,14 @@ func (it *Iterator) Init(keys, values filesystem.H) {
 	it.sboff = 0
 	it.cpos = 0
 	it.sblen = 0
+
+	if size, err := values.Size(); err != nil {
+		it.err = errs.Wrap(err)
+	} else if size < histdb.FooterSize {
+		it.err = errs.Errorf("values file too small for footer: %d", size)
+	} else {
+		it.vlen = size - histdb.FooterSize
+	}
 }
 
 func (it *Iterator) Key() histdb.Key { return it.key }
@@ -78,10 +88,15 @@ again:
 	chi := clo + 2
 
 	if sblo > clo || chi > sbhi {
-		// we need to load the span into the buffer
+		// we need to load the span into the buffer, stopping before the footer
+		off := int64(it.coff) * vwSpanAlign
+		if off >= it.vlen {
+			it.err = io.EOF
+			return false
+		}
 		var n int
 		it.stats.valueReads++
-		n, it.err = it.values.ReadAt(it.sbuf[:], int64(it.coff*vwSpanAlign))
+		n, it.err = it.values.ReadAt(it.sbuf[:min(vwSpanSize, it.vlen-off)], off)
 		if errors.Is(it.err, io.EOF) {
 			if n == 0 {
 				return false
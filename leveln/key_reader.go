@@ -141,3 +141,26 @@ func (k *keyReader) Search(key histdb.Key) (ent kwEntry, ok bool, err error) {
 corrupt:
 	return kwEntry{}, false, errs.Errorf("corrupt key reader")
 }
+
+// ReadTimeRange returns the smallest and largest timestamps of the keys in the
+// keys file. If the file has no keys, min is larger than max. It returns an
+// error if the keys file has a layout version it does not know, including the
+// layout from before the trailer.
+func ReadTimeRange(keys filesystem.H) (min, max uint32, err error) {
+	size, err := keys.Size()
+	if err != nil {
+		return 0, 0, errs.Wrap(err)
+	} else if size >= histdb.FooterSize && (size-histdb.FooterSize)%kwPageSize == 0 {
+		return 0, 0, errs.Errorf("unsupported keys layout: written before the time range trailer")
+	} else if size < kwTrailerSize+histdb.FooterSize {
+		return 0, 0, errs.Errorf("keys file too small for trailer: %d", size)
+	}
+
+	var trailer [kwTrailerSize]byte
+	if _, err := keys.ReadAt(trailer[:], size-histdb.FooterSize-kwTrailerSize); err != nil {
+		return 0, 0, errs.Wrap(err)
+	} else if version := le.Uint32(trailer[8:12]); version != kwVersion {
+		return 0, 0, errs.Errorf("keys file has unknown version: %d", version)
+	}
+	return le.Uint32(trailer[0:4]), le.Uint32(trailer[4:8]), nil
+}
@@ -5,6 +5,7 @@ import (
 	"unsafe"
 
 	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
 
 	"github.com/histdb/histdb"
 	"github.com/histdb/histdb/filesystem"
@@ -25,10 +26,19 @@ const (
 	// of memory used in caches and potentially increases read latencies.
 	//
 	// The memory usage is because we keep a page per depth in both the reader and writer.
-	kwPageSize   = 4096 * 4
-	kwEntrySize  = histdb.KeySize + 4 + 1
-	kwHeaderSize = 30 // 11 used
-	kwEntries    = (kwPageSize - kwHeaderSize) / kwEntrySize
+	//
+	// The file ends with a trailer holding the time range of the keys and the version
+	// of the layout, and a histdb.Footer which together must be smaller than a page so
+	// that the number of pages is still the file size divided by the page size. The
+	// version is the last field of the trailer so that it is found even if the rest of
+	// the trailer changes. Files from before the trailer have no version and are told
+	// apart by their size: without a trailer, the pages and footer leave no remainder.
+	kwPageSize    = 4096 * 4
+	kwTrailerSize = 4 + 4 + 4 // min timestamp + max timestamp + version
+	kwVersion     = 1
+	kwEntrySize   = histdb.KeySize + 4 + 1
+	kwHeaderSize  = 30 // 11 used
+	kwEntries     = (kwPageSize - kwHeaderSize) / kwEntrySize
 
 	_ uintptr = (kwHeaderSize + kwEntries*kwEntrySize) - kwPageSize
 	_ uintptr = kwPageSize - (kwHeaderSize + kwEntries*kwEntrySize)
@@ -131,20 +141,32 @@ type keyWriter struct {
 	_ [0]func() // no equality
 
 	fh    filesystem.H
+	hash  xxh3.Hasher
 	pages []*kwPage
 	id    uint32
 	count uint16
 	page  kwPage
+	tmin  uint32
+	tmax  uint32
 }
 
 // Init resets the keyWriter to write to the provided file handle.
 func (k *keyWriter) Init(fh filesystem.H) {
 	k.fh = fh
+	k.hash.Reset()
 	k.pages = nil
 	k.id = 0
 	k.count = 0
 	k.page.hdr = kwPageHeader{}
 	k.page.hdr.SetPrev(^uint32(0))
+	k.tmin = math.MaxUint32
+	k.tmax = 0
+}
+
+// Timestamp includes the timestamp in the time range written by Finish.
+func (k *keyWriter) Timestamp(ts uint32) {
+	k.tmin = min(k.tmin, ts)
+	k.tmax = max(k.tmax, ts)
 }
 
 func (k *keyWriter) Append(ent kwEntry) error {
@@ -217,9 +239,9 @@ func (k *keyWriter) appendSlow(ent kwEntry) error {
 	return nil
 }
 
-// Finish flushes any partial pages. No more Append or Finish calls should be
-// made after a call to Finish. No calls to Append or Finish should be made
-// after either returns an error.
+// Finish flushes any partial pages, the time range and the footer. No more Append or Finish
+// calls should be made after a call to Finish. No calls to Append or Finish
+// should be made after either returns an error.
 func (k *keyWriter) Finish() error {
 	// write the leaf
 	k.page.hdr.SetNext(math.MaxUint32)
@@ -239,10 +261,26 @@ func (k *keyWriter) Finish() error {
 		k.id++
 	}
 
-	return nil
+	// write the time range trailer. it is smaller than a page so it does not
+	// change the location of the root.
+	var trailer [kwTrailerSize]byte
+	le.PutUint32(trailer[0:4], k.tmin)
+	le.PutUint32(trailer[4:8], k.tmax)
+	le.PutUint32(trailer[8:12], kwVersion)
+	_, _ = k.hash.Write(trailer[:])
+	if _, err := k.fh.Write(trailer[:]); err != nil {
+		return errs.Wrap(err)
+	}
+
+	return writeFooter(k.fh, histdb.Footer{
+		Kind:     filesystem.KindKeys,
+		Length:   uint64(k.id)*kwPageSize + kwTrailerSize,
+		Checksum: k.hash.Sum64(),
+	})
 }
 
 func (k *keyWriter) writePage(page *kwPage) error {
+	_, _ = k.hash.Write(page.Buf()[:])
 	_, err := k.fh.Write(page.Buf()[:])
 	return err
 }
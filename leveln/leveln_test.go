@@ -1,12 +1,14 @@
 package leveln
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/zeebo/assert"
 	"github.com/zeebo/mwc"
 
 	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/filesystem"
 	"github.com/histdb/histdb/testhelp"
 )
 
@@ -33,12 +35,17 @@ func TestLevelNWriterReader(t *testing.T) {
 		for i := range 8 {
 			val := testhelp.Value(mwc.Intn(32))
 			values = append(values, val)
-			key.SetTimestamp(uint32(i))
+			key.SetTimestamp(uint32(i) + 10)
 			assert.NoError(t, lnw.Append(key, val))
 		}
 	}
 	assert.NoError(t, lnw.Finish())
 
+	tmin, tmax, err := ReadTimeRange(kfh)
+	assert.NoError(t, err)
+	assert.Equal(t, tmin, 10)
+	assert.Equal(t, tmax, 17)
+
 	var it Iterator
 	it.Init(kfh, vfh)
 
@@ -48,7 +55,7 @@ func TestLevelNWriterReader(t *testing.T) {
 				t.Fatalf("next failed: %+v", it.Err())
 			}
 			assert.Equal(t, metric.hash, it.Key().Hash())
-			assert.Equal(t, uint32(i), it.Key().Timestamp())
+			assert.Equal(t, uint32(i)+10, it.Key().Timestamp())
 			assert.Equal(t, 1, it.Key().Duration())
 			assert.Equal(t, values[0], it.Value())
 			values = values[1:]
@@ -71,3 +78,34 @@ func TestLevelNWriterReader(t *testing.T) {
 		}
 	}
 }
+
+func TestReadTimeRangeNoTrailer(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	kfh, cleanup := testhelp.Tempfile(t, fs)
+	defer cleanup()
+	vfh, cleanup := testhelp.Tempfile(t, fs)
+	defer cleanup()
+	ofh, cleanup := testhelp.Tempfile(t, fs)
+	defer cleanup()
+
+	writeLevel(t, kfh, vfh, createMetrics(100))
+
+	// the keys file as it was written before the trailer: the pages and then
+	// the footer.
+	size, err := kfh.Size()
+	assert.NoError(t, err)
+	buf := make([]byte, size)
+	_, err = kfh.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	pages := buf[:size-histdb.FooterSize-kwTrailerSize]
+	_, err = ofh.Write(pages)
+	assert.NoError(t, err)
+	assert.NoError(t, writeFooter(ofh, histdb.Footer{Kind: filesystem.KindKeys, Length: uint64(len(pages))}))
+
+	_, _, err = ReadTimeRange(ofh)
+	assert.Error(t, err)
+	assert.That(t, strings.Contains(err.Error(), "unsupported keys layout"))
+	assert.Error(t, Verify(ofh, vfh))
+}
@@ -40,6 +40,7 @@ func (w *Writer) Append(key histdb.Key, value []byte) error {
 	if w.err != nil {
 		return w.err
 	}
+	w.kw.Timestamp(key.Timestamp())
 
 	// if not first, we may either append or finish an old span
 	if !w.first {
@@ -79,6 +80,10 @@ func (w *Writer) Append(key histdb.Key, value []byte) error {
 	return w.storeErr(errs.Errorf("value too large: %d", len(value)))
 }
 
+// TimeRange returns the smallest and largest timestamps of the appended keys.
+// If no keys were appended, min is larger than max.
+func (w *Writer) TimeRange() (min, max uint32) { return w.kw.tmin, w.kw.tmax }
+
 func (w *Writer) Finish() error {
 	if w.err != nil {
 		return w.err
@@ -100,5 +105,8 @@ func (w *Writer) Finish() error {
 	if err := w.kw.Finish(); err != nil {
 		return w.storeErr(err)
 	}
+	if err := w.vw.Finish(); err != nil {
+		return w.storeErr(err)
+	}
 	return nil
 }
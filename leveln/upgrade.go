@@ -0,0 +1,97 @@
+package leveln
+
+import (
+	"io"
+	"math"
+
+	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/filesystem"
+)
+
+// LegacyKeys returns true if the keys file was written before it had a footer
+// or a time range trailer. Such files are rewritten by UpgradeKeys. The layouts
+// are told apart by the size of the file so that a truncated file is not
+// mistaken for a legacy one.
+func LegacyKeys(keys filesystem.H) (bool, error) {
+	size, footer, err := readTail(keys)
+	if err != nil {
+		return false, err
+	} else if footer {
+		return (size-histdb.FooterSize)%kwPageSize == 0, nil
+	}
+	return size%kwPageSize == 0, nil
+}
+
+// LegacyValues returns true if the values file was written before it had a
+// footer. Such files only need a footer added.
+func LegacyValues(values filesystem.H) (bool, error) {
+	size, footer, err := readTail(values)
+	if err != nil {
+		return false, err
+	}
+	return !footer && size%vwSpanAlign == 0, nil
+}
+
+// readTail returns the size of the file and if it ends with a footer.
+func readTail(fh filesystem.H) (size int64, footer bool, err error) {
+	size, err = fh.Size()
+	if err != nil {
+		return 0, false, errs.Wrap(err)
+	} else if size < histdb.FooterSize {
+		return size, false, nil
+	}
+
+	var buf [histdb.FooterSize]byte
+	if _, err := fh.ReadAt(buf[:], size-histdb.FooterSize); err != nil {
+		return 0, false, errs.Wrap(err)
+	}
+	return size, histdb.IsFooter(buf[:]), nil
+}
+
+// UpgradeKeys writes the keys file, which must be a legacy one, into dst in
+// the current layout. The pages are unchanged, so only the time range trailer
+// and the footer are added. The values file must already have a footer.
+func UpgradeKeys(keys, values, dst filesystem.H) error {
+	size, err := keys.Size()
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	// the footer, if any, is smaller than a page.
+	npages := size / kwPageSize
+
+	hash := xxh3.New()
+	w := io.MultiWriter(dst, hash)
+	if _, err := io.Copy(w, io.NewSectionReader(keys, 0, npages*kwPageSize)); err != nil {
+		return errs.Wrap(err)
+	}
+
+	tmin, tmax := uint32(math.MaxUint32), uint32(0)
+	if npages > 0 {
+		var it Iterator
+		for it.Init(keys, values); it.Next(); {
+			tmin = min(tmin, it.Key().Timestamp())
+			tmax = max(tmax, it.Key().Timestamp())
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+
+	var trailer [kwTrailerSize]byte
+	le.PutUint32(trailer[0:4], tmin)
+	le.PutUint32(trailer[4:8], tmax)
+	le.PutUint32(trailer[8:12], kwVersion)
+	if _, err := w.Write(trailer[:]); err != nil {
+		return errs.Wrap(err)
+	}
+
+	return errs.Wrap(writeFooter(dst, histdb.Footer{
+		Kind:     filesystem.KindKeys,
+		Length:   uint64(npages)*kwPageSize + kwTrailerSize,
+		Checksum: hash.Sum64(),
+	}))
+}
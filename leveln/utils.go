@@ -1,8 +1,23 @@
 package leveln
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/rwutils"
+)
 
 var (
 	le = binary.LittleEndian
 	be = binary.BigEndian
 )
+
+func writeFooter(fh filesystem.H, f histdb.Footer) error {
+	var w rwutils.W
+	w.Init(buffer.OfCap(make([]byte, 0, histdb.FooterSize)))
+	f.AppendTo(&w)
+	_, err := fh.Write(w.Done().Prefix())
+	return err
+}
@@ -2,6 +2,7 @@ package leveln
 
 import (
 	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
 
 	"github.com/histdb/histdb"
 	"github.com/histdb/histdb/filesystem"
@@ -20,6 +21,7 @@ type valueWriter struct {
 	_ [0]func() // no equality
 
 	fh   filesystem.H
+	hash xxh3.Hasher
 	n    uint64
 	sn   uint
 	span [vwSpanSize]byte
@@ -27,6 +29,7 @@ type valueWriter struct {
 
 func (v *valueWriter) Init(fh filesystem.H) {
 	v.fh = fh
+	v.hash.Reset()
 	v.n = 0
 	v.sn = 0
 }
@@ -81,6 +84,7 @@ func (v *valueWriter) FinishSpan() (offset uint32, length uint8, err error) {
 		for i := range r {
 			r[i] = 0
 		}
+		_, _ = v.hash.Write(v.span[:sn])
 		_, err = v.fh.Write(v.span[:sn])
 	} else {
 		err = errs.Errorf("value writer corruption: vsn:%d sn:%d", vsn, sn)
@@ -88,3 +92,12 @@ func (v *valueWriter) FinishSpan() (offset uint32, length uint8, err error) {
 
 	return offset, uint8(sn / vwSpanAlign), errs.Wrap(err)
 }
+
+// Finish writes the footer. No more calls should be made after Finish.
+func (v *valueWriter) Finish() error {
+	return writeFooter(v.fh, histdb.Footer{
+		Kind:     filesystem.KindVals,
+		Length:   v.n,
+		Checksum: v.hash.Sum64(),
+	})
+}
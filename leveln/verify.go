@@ -0,0 +1,181 @@
+package leveln
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/filesystem"
+)
+
+// Verify reads the keys and values files in order, a page and a span at a
+// time so that large files are not held in memory, and checks that the leaf
+// pages link together and hold strictly increasing keys, that every key
+// points at the next span of values, that every span is framed correctly
+// and starts with the value for its key, that the spans cover the values
+// file, and that the time range trailer matches the values.
+func Verify(keys, values filesystem.H) error {
+	ksize, err := keys.Size()
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	klen := ksize - histdb.FooterSize - kwTrailerSize
+	if klen < 0 || klen%kwPageSize != 0 {
+		return errs.Errorf("keys file has invalid size: %d", ksize)
+	}
+
+	vsize, err := values.Size()
+	if err != nil {
+		return errs.Wrap(err)
+	} else if vsize < histdb.FooterSize {
+		return errs.Errorf("values file too small for footer: %d", vsize)
+	}
+	vlen := uint64(vsize - histdb.FooterSize)
+
+	// the spans are checked to be contiguous, so they can be read in order.
+	vals := bufio.NewReaderSize(io.NewSectionReader(values, 0, int64(vlen)), verifyBufferSize)
+	var span []byte
+
+	var (
+		page    kwPage
+		last    histdb.Key
+		voff    uint64
+		first   = true
+		tmin    = uint32(math.MaxUint32)
+		tmax    = uint32(0)
+		prev    = ^uint32(0)
+		next    = ^uint32(0)
+		npages  = uint32(klen / kwPageSize)
+		entries = 0
+	)
+
+	for id := range npages {
+		if _, err := keys.ReadAt(page.Buf()[:], int64(id)*kwPageSize); err != nil {
+			return errs.Wrap(err)
+		}
+
+		count := page.hdr.Count()
+		if count > kwEntries {
+			return errs.Errorf("page %d: invalid count: %d", id, count)
+		}
+
+		if !page.hdr.Leaf() {
+			for i := range count {
+				if child := page.ents[i].Child(); child >= id {
+					return errs.Errorf("page %d: child %d is not before its parent", id, child)
+				}
+			}
+			continue
+		}
+
+		if page.hdr.Prev() != prev {
+			return errs.Errorf("page %d: prev is %d instead of %d", id, page.hdr.Prev(), prev)
+		} else if prev != ^uint32(0) && next != id {
+			return errs.Errorf("page %d: prev leaf points at %d", id, next)
+		}
+		prev, next = id, page.hdr.Next()
+
+		for i := range count {
+			ent := &page.ents[i]
+			key := *ent.Key()
+
+			if !first && string(key[:]) <= string(last[:]) {
+				return errs.Errorf("page %d entry %d: key %v is not after %v", id, i, key, last)
+			}
+
+			off := uint64(ent.ValOffset()) * vwSpanAlign
+			length := uint64(ent.ValLength()) * vwSpanAlign
+			if off != voff {
+				return errs.Errorf("page %d entry %d: span at %d instead of %d", id, i, off, voff)
+			} else if length == 0 || off+length > vlen {
+				return errs.Errorf("page %d entry %d: span [%d, %d) out of range", id, i, off, off+length)
+			}
+
+			span = slices.Grow(span[:0], int(length))[:length]
+			if _, err := io.ReadFull(vals, span); err != nil {
+				return errs.Wrap(err)
+			}
+
+			last, err = verifySpan(span, key, &tmin, &tmax)
+			if err != nil {
+				return errs.Errorf("page %d entry %d: %w", id, i, err)
+			}
+
+			voff = off + length
+			first = false
+			entries++
+		}
+	}
+
+	if prev != ^uint32(0) && next != math.MaxUint32 {
+		return errs.Errorf("last leaf points at %d", next)
+	} else if voff != vlen {
+		return errs.Errorf("values file has %d bytes after the last span", vlen-voff)
+	}
+
+	rmin, rmax, err := ReadTimeRange(keys)
+	if err != nil {
+		return err
+	} else if entries > 0 && (rmin != tmin || rmax != tmax) {
+		return errs.Errorf("time range is [%d, %d] instead of [%d, %d]", rmin, rmax, tmin, tmax)
+	} else if entries == 0 && rmin <= rmax {
+		return errs.Errorf("time range is [%d, %d] without any keys", rmin, rmax)
+	}
+
+	return nil
+}
+
+// verifyBufferSize is the size of the reads of the values file by Verify.
+const verifyBufferSize = 1 << 20
+
+// verifySpan checks the framing of the span starting with the value for
+// first and returns the key of its last value.
+func verifySpan(span []byte, first histdb.Key, tmin, tmax *uint32) (key histdb.Key, err error) {
+	if len(span) < histdb.HashSize {
+		return key, errs.Errorf("span too small for hash: %d", len(span))
+	}
+	hash := histdb.Hash(span[:histdb.HashSize])
+	if hash != first.Hash() {
+		return key, errs.Errorf("span hash %v does not match key %v", hash, first)
+	}
+	*key.HashPtr() = hash
+
+	pos, n := histdb.HashSize, 0
+	for {
+		if pos+2 > len(span) {
+			return key, errs.Errorf("span is not terminated")
+		}
+		elen := int(be.Uint16(span[pos:]))
+		if elen == 0 {
+			break
+		} else if elen < vwEntryHeaderSize || pos+elen > len(span) {
+			return key, errs.Errorf("value at %d has invalid length: %d", pos, elen)
+		}
+
+		prev := key
+		key.SetTimestamp(be.Uint32(span[pos+2:]))
+		key.SetDuration(be.Uint32(span[pos+6:]))
+		if n == 0 && key != first {
+			return key, errs.Errorf("first value %v does not match key %v", key, first)
+		} else if n > 0 && string(key[:]) <= string(prev[:]) {
+			return key, errs.Errorf("value %v is not after %v", key, prev)
+		}
+
+		*tmin = min(*tmin, key.Timestamp())
+		*tmax = max(*tmax, key.Timestamp())
+		pos += elen
+		n++
+	}
+
+	for _, b := range span[pos:] {
+		if b != 0 {
+			return key, errs.Errorf("span has data after its terminator")
+		}
+	}
+
+	return key, nil
+}
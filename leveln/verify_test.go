@@ -0,0 +1,75 @@
+package leveln
+
+import (
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/testhelp"
+)
+
+func writeLevel(t *testing.T, kfh, vfh filesystem.H, metrics []hashedMetric) {
+	var lnw Writer
+	lnw.Init(kfh, vfh)
+
+	for _, metric := range metrics {
+		var key histdb.Key
+		*key.HashPtr() = metric.hash
+		key.SetDuration(1)
+		for i := range 4 {
+			key.SetTimestamp(uint32(i) + 10)
+			assert.NoError(t, lnw.Append(key, testhelp.Value(16)))
+		}
+	}
+	assert.NoError(t, lnw.Finish())
+}
+
+func TestVerify(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	t.Run("Empty", func(t *testing.T) {
+		kfh, cleanup := testhelp.Tempfile(t, fs)
+		defer cleanup()
+		vfh, cleanup := testhelp.Tempfile(t, fs)
+		defer cleanup()
+
+		writeLevel(t, kfh, vfh, nil)
+		assert.NoError(t, Verify(kfh, vfh))
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		kfh, cleanup := testhelp.Tempfile(t, fs)
+		defer cleanup()
+		vfh, cleanup := testhelp.Tempfile(t, fs)
+		defer cleanup()
+
+		writeLevel(t, kfh, vfh, createMetrics(5000))
+		assert.NoError(t, Verify(kfh, vfh))
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		for _, corrupt := range []func(kfh, vfh filesystem.H){
+			func(kfh, vfh filesystem.H) { _, _ = vfh.WriteAt([]byte{0xff, 0xff}, 0) },
+			func(kfh, vfh filesystem.H) { _, _ = vfh.WriteAt([]byte{0xff}, vwSpanAlign-1) },
+			func(kfh, vfh filesystem.H) { _, _ = kfh.WriteAt([]byte{0xff, 0xff}, countStart) },
+			func(kfh, vfh filesystem.H) { _, _ = kfh.WriteAt([]byte{0xff}, kwHeaderSize+kwEntrySize) },
+			func(kfh, vfh filesystem.H) {
+				// the last byte of the last span, read after many others.
+				size, _ := vfh.Size()
+				_, _ = vfh.WriteAt([]byte{0xff}, size-histdb.FooterSize-1)
+			},
+		} {
+			kfh, cleanup := testhelp.Tempfile(t, fs)
+			defer cleanup()
+			vfh, cleanup := testhelp.Tempfile(t, fs)
+			defer cleanup()
+
+			writeLevel(t, kfh, vfh, createMetrics(100))
+			corrupt(kfh, vfh)
+			assert.Error(t, Verify(kfh, vfh))
+		}
+	})
+}
@@ -259,6 +259,10 @@ func (n *node[K, V]) find(k K, h uint64, t *T[K, V]) (V, bool) {
 
 	next := n.getNextRef()
 	nextRef := load(next)
+	if nextRef == tag(t) {
+		// the end of the chain, so the key is not present.
+		return *new(V), false
+	}
 	if tagged(nextRef) {
 		prevTable := untag[K, V](nextRef)
 		for prevTable.prev != nil && prevTable.prev != t {
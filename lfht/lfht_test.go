@@ -33,6 +33,22 @@ func TestTable(t *testing.T) {
 	}
 }
 
+func TestTable_Missing(t *testing.T) {
+	var ta T[int, int]
+	for i := range uint32(100) {
+		if _, ok := ta.Find(getKey(i), getHash(i)); ok {
+			t.Fatal(i)
+		}
+		ta.Insert(getKey(i), getHash(i), getValue)
+	}
+	for i := range uint32(100) {
+		if _, ok := ta.Find(getKey(i+100), getHash(i+100)); ok {
+			ta.Dump(os.Stderr)
+			t.Fatal(i)
+		}
+	}
+}
+
 func TestTable_Iterator(t *testing.T) {
 	for range 1 {
 		var ta T[int, int]
@@ -238,6 +238,24 @@ func (t *T) HighCardinalityTagKeys(over int, cb func([]byte) bool) {
 	}
 }
 
+// TagKeyCardinality returns the number of metrics with the tag key.
+func (t *T) TagKeyCardinality(tkey []byte) int {
+	tkeyn, ok := t.tkey_names.Find(histdb.NewTagKeyHash(tkey))
+	if !ok {
+		return 0
+	}
+	return int(t.tkey_to_metrics[tkeyn].GetCardinality())
+}
+
+// TagCardinality returns the number of metrics with the tag.
+func (t *T) TagCardinality(tag []byte) int {
+	tagn, ok := t.tag_names.Find(histdb.NewTagHash(tag))
+	if !ok {
+		return 0
+	}
+	return int(t.tag_to_metrics[tagn].GetCardinality())
+}
+
 func (t *T) QueryTrue(tkeys []byte, cb func(*Bitmap)) {
 	if bytes.IndexByte(tkeys, ',') == -1 {
 		tkeyn, ok := t.tkey_names.Find(histdb.NewTagKeyHash(tkeys))
@@ -335,3 +353,45 @@ func (t *T) QueryFilterNot(tkey []byte, fn func([]byte) bool, cb func(*Bitmap))
 
 	cb(bitmapOr(bms...))
 }
+
+// AndFilter removes the metrics from m that QueryFilter would not include. It
+// only calls fn for the values of the tag key that some metric in m has, so
+// it is cheaper than QueryFilter when m is small.
+func (t *T) AndFilter(m *Bitmap, tkey []byte, fn func([]byte) bool) {
+	t.andFilter(m, tkey, fn, true)
+}
+
+// AndFilterNot removes the metrics from m that QueryFilterNot would not
+// include. It only calls fn for the values of the tag key that some metric in
+// m has, so it is cheaper than QueryFilterNot when m is small.
+func (t *T) AndFilterNot(m *Bitmap, tkey []byte, fn func([]byte) bool) {
+	if fn == nil {
+		m.Clear()
+		return
+	}
+	t.andFilter(m, tkey, fn, false)
+}
+
+func (t *T) andFilter(m *Bitmap, tkey []byte, fn func([]byte) bool, want bool) {
+	tkeyn, ok := t.tkey_names.Find(histdb.NewTagKeyHash(tkey))
+	if !ok {
+		m.Clear()
+		return
+	}
+
+	keep := bitmapAcquire()
+	defer bitmapReplace(keep)
+
+	Iter(t.tkey_to_tvals[tkeyn], func(tagn Id) bool {
+		bm := t.tag_to_metrics[tagn]
+		if !bm.Intersects(m) {
+			return true
+		}
+		if fn == nil || fn(tagValue(tkey, t.tag_names.Get(RWId(tagn)))) == want {
+			keep.Or(bitmapAnd2(bm, m))
+		}
+		return true
+	})
+
+	m.And(keep)
+}
@@ -128,6 +128,41 @@ func TestMemindex(t *testing.T) {
 		)
 	})
 
+	t.Run("AndFilter", func(t *testing.T) {
+		var idx T
+
+		idx.Add(bs("k0=v0"), nil, nil)
+		idx.Add(bs("k0=v1"), nil, nil)
+		idx.Add(bs("k0=v2"), nil, nil)
+		idx.Add(bs("k1=v0"), nil, nil)
+		idx.Add(bs("k0=v1,k0=v3"), nil, nil)
+
+		assert.Equal(t, idx.TagKeyCardinality(bs("k0")), 4)
+		assert.Equal(t, idx.TagKeyCardinality(bs("k2")), 0)
+		assert.Equal(t, idx.TagCardinality(bs("k0=v1")), 2)
+		assert.Equal(t, idx.TagCardinality(bs("k0=v4")), 0)
+
+		var called []string
+		fn := func(b []byte) bool {
+			called = append(called, string(b))
+			return string(b) != "v1"
+		}
+
+		m := newBitmap()
+		m.AddMany([]Id{0, 3, 4})
+		idx.AndFilter(m, bs("k0"), fn)
+		assert.Equal(t, m.String(), "{0,4}")
+		assert.Equal(t, called, []string{"v0", "v1", "v3"})
+
+		m.AddMany([]Id{0, 1, 3, 4})
+		idx.AndFilterNot(m, bs("k0"), fn)
+		assert.Equal(t, m.String(), "{1,4}")
+
+		m.AddMany([]Id{0, 1})
+		idx.AndFilter(m, bs("k2"), nil)
+		assert.That(t, m.IsEmpty())
+	})
+
 	t.Run("Serialize", func(t *testing.T) {
 		var idx T
 		for range 1000 {
@@ -5,7 +5,10 @@ import (
 	"math/bits"
 
 	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
 
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/filesystem"
 	"github.com/histdb/histdb/hashtbl"
 	"github.com/histdb/histdb/petname"
 	"github.com/histdb/histdb/rwutils"
@@ -17,6 +20,8 @@ func (rw *RW) AppendTo(w *rwutils.W) { AppendTo((*T)(rw), w) }
 func (rw *RW) ReadFrom(r *rwutils.R) { ReadFrom((*T)(rw), r) }
 
 func AppendTo(t *T, w *rwutils.W) {
+	start := w.Done().Pos()
+
 	w.Uint64(0) // version
 
 	hashtbl.AppendTo(&t.metrics, w)
@@ -39,9 +44,20 @@ func AppendTo(t *T, w *rwutils.W) {
 	appendBitmaps(t.tag_to_metrics)
 	appendBitmaps(t.tkey_to_metrics)
 	appendBitmaps(t.tkey_to_tvals)
+
+	data := w.Done().Prefix()[start:]
+	histdb.Footer{
+		Kind:     filesystem.KindIndx,
+		Length:   uint64(len(data)),
+		Checksum: xxh3.Hash(data),
+	}.AppendTo(w)
 }
 
+// ReadFrom reads the index and its footer. It checks that the footer matches
+// the amount of data read, but the checksum must be verified by the caller.
 func ReadFrom(t *T, r *rwutils.R) {
+	start := r.Remaining()
+
 	// version
 	if r.Uint64() != 0 {
 		r.Invalid(errs.Errorf("memindex has unknown version"))
@@ -78,4 +94,14 @@ func ReadFrom(t *T, r *rwutils.R) {
 	t.tag_to_metrics = readBitmaps()
 	t.tkey_to_metrics = readBitmaps()
 	t.tkey_to_tvals = readBitmaps()
+
+	length := uint64(start - r.Remaining())
+
+	var f histdb.Footer
+	f.ReadFrom(r)
+	if f.Kind != filesystem.KindIndx {
+		r.Invalid(errs.Errorf("memindex footer has wrong kind: %d", f.Kind))
+	} else if f.Length != length {
+		r.Invalid(errs.Errorf("memindex footer has wrong length: %d != %d", f.Length, length))
+	}
 }
@@ -24,6 +24,7 @@ type (
 func newBitmap() *Bitmap               { return roaring.New() }
 func bitmapOr(bms ...*Bitmap) *Bitmap  { return roaring.ParOr(0, bms...) }
 func bitmapAnd(bms ...*Bitmap) *Bitmap { return roaring.ParAnd(0, bms...) }
+func bitmapAnd2(a, b *Bitmap) *Bitmap  { return roaring.And(a, b) }
 
 //
 //
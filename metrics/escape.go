@@ -0,0 +1,41 @@
+package metrics
+
+// AppendTag appends the tag key and value as a tag, escaping them so that
+// PopTag splits the tag at the right '=' and does not end it early at a ','.
+func AppendTag(dst, tkey, value []byte) []byte {
+	dst = appendEscaped(dst, tkey, true)
+	dst = append(dst, '=')
+	return appendEscaped(dst, value, false)
+}
+
+// AppendTagKey appends the tag key escaped like AppendTag does.
+func AppendTagKey(dst, tkey []byte) []byte {
+	return appendEscaped(dst, tkey, true)
+}
+
+// AppendTagValue appends the tag value escaped like AppendTag does.
+func AppendTagValue(dst, value []byte) []byte {
+	return appendEscaped(dst, value, false)
+}
+
+func appendEscaped(dst, buf []byte, eq bool) []byte {
+	for _, b := range buf {
+		if b == '\\' || b == ',' || (eq && b == '=') {
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+// AppendUnescaped appends the tag key or value with the escaping added by
+// AppendTag removed.
+func AppendUnescaped(dst, buf []byte) []byte {
+	for i := 0; i < len(buf); i++ {
+		if buf[i] == '\\' && i+1 < len(buf) {
+			i++
+		}
+		dst = append(dst, buf[i])
+	}
+	return dst
+}
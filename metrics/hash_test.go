@@ -32,3 +32,27 @@ func TestPopTags(t *testing.T) {
 
 	check(`0\=0\=0,00,0`, `0\=0\=0`, `0\=0\=0`, "00,0")
 }
+
+func TestAppendTag(t *testing.T) {
+	check := func(tkey, value string, etkey, tag string) {
+		t.Helper()
+		got := AppendTag(nil, []byte(tkey), []byte(value))
+		assert.Equal(t, string(got), tag)
+
+		gtkey, gtag, rest := PopTag(append(got, ",next=tag"...))
+		assert.Equal(t, string(gtkey), etkey)
+		assert.Equal(t, string(gtag), tag)
+		assert.Equal(t, string(rest), "next=tag")
+
+		assert.Equal(t, string(AppendUnescaped(nil, gtkey)), tkey)
+		assert.Equal(t, string(AppendUnescaped(nil, gtag[len(gtkey)+1:])), value)
+
+		assert.Equal(t, string(AppendTagKey(nil, []byte(tkey))), etkey)
+		assert.Equal(t, string(AppendTagValue(nil, []byte(value))), tag[len(etkey)+1:])
+	}
+
+	check("foo", "bar", "foo", "foo=bar")
+	check("foo=", "bar,baz", `foo\=`, `foo\==bar\,baz`)
+	check(`foo\`, `bar\`, `foo\\`, `foo\\=bar\\`)
+	check("foo", "a=b", "foo", "foo=a=b")
+}
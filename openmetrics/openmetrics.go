@@ -0,0 +1,240 @@
+// Package openmetrics exposes the newest interval of histograms in a store
+// for Prometheus compatible scrapers.
+//
+// Every metric matching a query with a value at the newest timestamp of the
+// store becomes a histogram named by its `__name__` tag, or "histdb" if it
+// does not have one, with a label for every other tag. Names and labels are
+// changed to be valid by replacing invalid characters with '_'.
+//
+// The histograms count the values of a single interval rather than every
+// value since the series started, so each one has a created timestamp at the
+// start of the interval so that scrapers see the reset.
+package openmetrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/metrics"
+	"github.com/histdb/histdb/query"
+	"github.com/histdb/histdb/store"
+)
+
+const (
+	textContentType  = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	protoContentType = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+)
+
+// native histogram schemas supported by Prometheus.
+const (
+	minSchema = -4
+	maxSchema = 8
+)
+
+// Config controls the buckets of the exposed histograms.
+type Config struct {
+	// Bounds are the upper bounds of the classic buckets. Each bucket counts
+	// the values estimated by flathist.S.CDF to be smaller than its bound. A
+	// +Inf bucket is always included.
+	Bounds []float64
+
+	// Native adds sparse native histogram buckets with the largest schema up
+	// to Schema that needs at most MaxBuckets buckets for each sign, or any
+	// number of buckets if MaxBuckets is zero. Native buckets are only
+	// exposed in the protobuf format.
+	Native     bool
+	Schema     int32
+	MaxBuckets int
+}
+
+// Exporter renders the histograms of a store.
+type Exporter struct {
+	_ [0]func() // no equality
+
+	st  *store.T
+	cfg Config
+}
+
+// Init sets the store and the bucket configuration. The bounds are sorted and
+// any NaN or infinite bounds are removed.
+func (x *Exporter) Init(st *store.T, cfg Config) {
+	var bounds []float64
+	for _, b := range cfg.Bounds {
+		if !math.IsNaN(b) && !math.IsInf(b, 0) {
+			bounds = append(bounds, b)
+		}
+	}
+	slices.Sort(bounds)
+	cfg.Bounds = slices.Compact(bounds)
+	cfg.Schema = min(max(cfg.Schema, minSchema), maxSchema)
+
+	x.st = st
+	x.cfg = cfg
+}
+
+// ServeHTTP renders the histograms matching the query in the "q" parameter
+// as protobuf if the request accepts it and as OpenMetrics text otherwise.
+func (x *Exporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var q query.Q
+	if err := query.Parse([]byte(req.FormValue("q")), &q); err != nil {
+		http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	proto := strings.Contains(req.Header.Get("Accept"), "proto=io.prometheus.client.MetricFamily")
+
+	var buf []byte
+	var err error
+	if proto {
+		buf, err = x.AppendProto(nil, &q)
+	} else {
+		buf, err = x.AppendText(nil, &q)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if proto {
+		w.Header().Set("Content-Type", protoContentType)
+	} else {
+		w.Header().Set("Content-Type", textContentType)
+	}
+	_, _ = w.Write(buf)
+}
+
+type label struct {
+	name  []byte
+	value []byte
+}
+
+type series struct {
+	labels  []label
+	created uint32
+	total   uint64
+	sum     float64
+	buckets []uint64 // cumulative counts for each bound
+	exp     flathist.Exponential
+}
+
+type family struct {
+	name   []byte
+	series []series
+}
+
+// collect returns the families of the histograms matching the query at the
+// newest timestamp sorted by name, with their series sorted by labels.
+func (x *Exporter) collect(q *query.Q) ([]*family, error) {
+	ts, ok := x.st.Latest()
+	if !ok {
+		return nil, nil
+	}
+
+	var fams []*family
+	names := make(map[string]*family)
+
+	_, err := x.st.QueryData(q, ts, ts+1, func(key histdb.Key, metric []byte, s *flathist.S, h flathist.H) bool {
+		name, labels := splitMetric(metric)
+
+		fam, ok := names[string(name)]
+		if !ok {
+			fam = &family{name: name}
+			names[string(name)] = fam
+			fams = append(fams, fam)
+		}
+
+		ser := series{labels: labels, created: key.Timestamp()}
+		ser.total, ser.sum, _, _ = s.Summary(h)
+
+		var last uint64
+		for _, b := range x.cfg.Bounds {
+			if ser.total > 0 {
+				last = max(last, uint64(math.Round(s.CDF(h, float32(b))*float64(ser.total))))
+			}
+			ser.buckets = append(ser.buckets, last)
+		}
+
+		if x.cfg.Native {
+			ser.exp = s.Exponential(h, x.cfg.Schema, x.cfg.MaxBuckets)
+			if ser.exp.Scale < minSchema {
+				ser.exp = s.Exponential(h, minSchema, 0)
+			}
+		}
+
+		fam.series = append(fam.series, ser)
+		return true
+	})
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	slices.SortFunc(fams, func(a, b *family) int { return bytes.Compare(a.name, b.name) })
+	for _, fam := range fams {
+		slices.SortFunc(fam.series, func(a, b series) int {
+			return slices.CompareFunc(a.labels, b.labels, compareLabels)
+		})
+	}
+	return fams, nil
+}
+
+func compareLabels(a, b label) int {
+	if c := bytes.Compare(a.name, b.name); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.value, b.value)
+}
+
+// splitMetric returns the valid name and labels of the metric.
+func splitMetric(metric []byte) (name []byte, labels []label) {
+	for rest := metric; len(rest) > 0; {
+		var tkey, tag []byte
+		tkey, tag, rest = metrics.PopTag(rest)
+		if len(tag) == 0 {
+			continue
+		}
+
+		var value []byte
+		if len(tag) > len(tkey) {
+			value = tag[len(tkey)+1:]
+		}
+		if string(tkey) == "__name__" {
+			name = sanitize(metrics.AppendUnescaped(nil, value), true)
+			continue
+		}
+
+		lname := sanitize(metrics.AppendUnescaped(nil, tkey), false)
+		if string(lname) == "le" || bytes.HasPrefix(lname, []byte("__")) {
+			lname = append([]byte("tag_"), lname...)
+		}
+		labels = append(labels, label{
+			name:  lname,
+			value: metrics.AppendUnescaped(nil, value),
+		})
+	}
+	if len(name) == 0 {
+		name = []byte("histdb")
+	}
+	return name, labels
+}
+
+// sanitize replaces the characters that are not valid in a metric name, or
+// label name if colons are not allowed, with '_'.
+func sanitize(buf []byte, colon bool) []byte {
+	for i, c := range buf {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		case c == ':' && colon:
+		default:
+			buf[i] = '_'
+		}
+	}
+	return buf
+}
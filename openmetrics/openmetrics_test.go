@@ -0,0 +1,292 @@
+package openmetrics
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb/pbwire"
+	"github.com/histdb/histdb/query"
+	"github.com/histdb/histdb/store"
+	"github.com/histdb/histdb/testhelp"
+)
+
+func newTestStore(t *testing.T) (*store.T, func()) {
+	fs, cleanup := testhelp.FS(t)
+
+	st := new(store.T)
+	assert.NoError(t, st.Init(fs, store.Config{}))
+
+	// the older level is never exposed.
+	st.Observe([]byte(`__name__=rpc.latency,path=/old`), 1)
+	assert.NoError(t, st.WriteLevel(10, 10))
+
+	for i := range 100 {
+		st.Observe([]byte(`__name__=rpc.latency,path=/a\,b,host=x`), float32(i))
+	}
+	st.Observe([]byte(`__name__=rpc.latency,path="q"`), 1000)
+	st.Observe([]byte(`__name__=1queue,le=5`), -2)
+	st.Observe([]byte(`other`), 0)
+	assert.NoError(t, st.WriteLevel(20, 10))
+
+	return st, func() {
+		assert.NoError(t, st.Close())
+		cleanup()
+	}
+}
+
+var sumRe = regexp.MustCompile(`(?m)^(\S+_sum\S*) (\S+)$`)
+
+func parseQuery(t *testing.T, q string) *query.Q {
+	var qq query.Q
+	assert.NoError(t, query.Parse([]byte(q), &qq))
+	return &qq
+}
+
+func TestText(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var x Exporter
+	x.Init(st, Config{Bounds: []float64{50, 10, 10, 1e6}})
+
+	buf, err := x.AppendText(nil, parseQuery(t, "{__name__|}"))
+	assert.NoError(t, err)
+
+	// sums are estimates, so they are checked separately.
+	sums := sumRe.FindAllStringSubmatch(string(buf), -1)
+	assert.Equal(t, len(sums), 3)
+	for i, want := range []float64{-2, 4950, 1000} {
+		got, err := strconv.ParseFloat(sums[i][2], 64)
+		assert.NoError(t, err)
+		assert.That(t, math.Abs(got-want) <= math.Abs(want)/100)
+	}
+
+	assert.Equal(t, sumRe.ReplaceAllString(string(buf), "$1 SUM"), ""+
+		"# TYPE _queue histogram\n"+
+		"_queue_bucket{tag_le=\"5\",le=\"10\"} 1\n"+
+		"_queue_bucket{tag_le=\"5\",le=\"50\"} 1\n"+
+		"_queue_bucket{tag_le=\"5\",le=\"1e+06\"} 1\n"+
+		"_queue_bucket{tag_le=\"5\",le=\"+Inf\"} 1\n"+
+		"_queue_count{tag_le=\"5\"} 1\n"+
+		"_queue_sum{tag_le=\"5\"} SUM\n"+
+		"_queue_created{tag_le=\"5\"} 20\n"+
+		"# TYPE rpc_latency histogram\n"+
+		"rpc_latency_bucket{host=\"x\",path=\"/a,b\",le=\"10\"} 10\n"+
+		"rpc_latency_bucket{host=\"x\",path=\"/a,b\",le=\"50\"} 50\n"+
+		"rpc_latency_bucket{host=\"x\",path=\"/a,b\",le=\"1e+06\"} 100\n"+
+		"rpc_latency_bucket{host=\"x\",path=\"/a,b\",le=\"+Inf\"} 100\n"+
+		"rpc_latency_count{host=\"x\",path=\"/a,b\"} 100\n"+
+		"rpc_latency_sum{host=\"x\",path=\"/a,b\"} SUM\n"+
+		"rpc_latency_created{host=\"x\",path=\"/a,b\"} 20\n"+
+		"rpc_latency_bucket{path=\"\\\"q\\\"\",le=\"10\"} 0\n"+
+		"rpc_latency_bucket{path=\"\\\"q\\\"\",le=\"50\"} 0\n"+
+		"rpc_latency_bucket{path=\"\\\"q\\\"\",le=\"1e+06\"} 1\n"+
+		"rpc_latency_bucket{path=\"\\\"q\\\"\",le=\"+Inf\"} 1\n"+
+		"rpc_latency_count{path=\"\\\"q\\\"\"} 1\n"+
+		"rpc_latency_sum{path=\"\\\"q\\\"\"} SUM\n"+
+		"rpc_latency_created{path=\"\\\"q\\\"\"} 20\n"+
+		"# EOF\n")
+
+	// metrics without a name use the default name.
+	buf, err = x.AppendText(nil, parseQuery(t, "{other|}"))
+	assert.NoError(t, err)
+	assert.That(t, strings.HasPrefix(string(buf), "# TYPE histdb histogram\nhistdb_bucket{other=\"\",le=\"10\"} 1\n"))
+}
+
+type protoHistogram struct {
+	labels    []string
+	count     uint64
+	sum       float64
+	bounds    []float64
+	created   uint64
+	schema    int64
+	zero      uint64
+	spans     int
+	positive  uint64
+	negative  uint64
+	hasSchema bool
+}
+
+func parseProto(t *testing.T, buf []byte) map[string][]protoHistogram {
+	t.Helper()
+
+	out := make(map[string][]protoHistogram)
+	for len(buf) > 0 {
+		n, w := binary.Uvarint(buf)
+		assert.That(t, w > 0 && uint64(len(buf)-w) >= n)
+		msg := buf[w : w+int(n)]
+		buf = buf[w+int(n):]
+
+		var name string
+		var hists []protoHistogram
+
+		var r pbwire.Reader
+		for r.Init(msg); r.More(); {
+			switch num, wire := r.Field(); num {
+			case 1:
+				name = string(r.Bytes())
+			case 3:
+				assert.Equal(t, r.Varint(), uint64(metricTypeHistogram))
+			case 4:
+				hists = append(hists, parseMetric(t, r.Bytes()))
+			default:
+				r.Skip(wire)
+			}
+		}
+		assert.NoError(t, r.Err())
+		out[name] = hists
+	}
+	return out
+}
+
+func parseMetric(t *testing.T, buf []byte) (h protoHistogram) {
+	var r pbwire.Reader
+	for r.Init(buf); r.More(); {
+		switch num, wire := r.Field(); num {
+		case 1:
+			var lr pbwire.Reader
+			for lr.Init(r.Bytes()); lr.More(); {
+				_, _ = lr.Field()
+				h.labels = append(h.labels, string(lr.Bytes()))
+			}
+		case 7:
+			var deltas []int64
+			var hr pbwire.Reader
+			for hr.Init(r.Bytes()); hr.More(); {
+				switch num, wire := hr.Field(); num {
+				case 1:
+					h.count = hr.Varint()
+				case 2:
+					h.sum = hr.Double()
+				case 3:
+					var br pbwire.Reader
+					for br.Init(hr.Bytes()); br.More(); {
+						if num, wire := br.Field(); num == 2 {
+							h.bounds = append(h.bounds, br.Double())
+						} else {
+							br.Skip(wire)
+						}
+					}
+				case 5:
+					h.schema, h.hasSchema = hr.Zigzag(), true
+				case 7:
+					h.zero = hr.Varint()
+				case 9, 12:
+					h.spans++
+					hr.Skip(wire)
+				case 10, 13:
+					deltas = hr.Zigzags(deltas[:0], wire)
+					var count int64
+					for _, d := range deltas {
+						count += d
+						if num == 10 {
+							h.negative += uint64(count)
+						} else {
+							h.positive += uint64(count)
+						}
+					}
+				case 15:
+					var cr pbwire.Reader
+					for cr.Init(hr.Bytes()); cr.More(); {
+						_, _ = cr.Field()
+						h.created = cr.Varint()
+					}
+				default:
+					hr.Skip(wire)
+				}
+			}
+			assert.NoError(t, hr.Err())
+		default:
+			r.Skip(wire)
+		}
+	}
+	assert.NoError(t, r.Err())
+	return h
+}
+
+func TestProto(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var x Exporter
+	x.Init(st, Config{Bounds: []float64{10}, Native: true, Schema: 20, MaxBuckets: 10})
+
+	buf, err := x.AppendProto(nil, parseQuery(t, "{__name__|}"))
+	assert.NoError(t, err)
+
+	fams := parseProto(t, buf)
+	assert.Equal(t, len(fams), 2)
+
+	queue := fams["_queue"]
+	assert.Equal(t, len(queue), 1)
+	assert.Equal(t, queue[0].labels, []string{"tag_le", "5"})
+	assert.Equal(t, queue[0].negative, 1)
+	assert.Equal(t, queue[0].positive, 0)
+
+	rpc := fams["rpc_latency"]
+	assert.Equal(t, len(rpc), 2)
+
+	h := rpc[0]
+	assert.Equal(t, h.labels, []string{"host", "x", "path", "/a,b"})
+	assert.Equal(t, h.count, 100)
+	assert.That(t, math.Abs(h.sum-4950) < 50)
+	assert.Equal(t, h.bounds, []float64{10})
+	assert.Equal(t, h.created, 20)
+	assert.That(t, h.hasSchema && h.schema >= minSchema && h.schema < maxSchema)
+	assert.Equal(t, h.zero, 1)
+	assert.Equal(t, h.positive, 99)
+	assert.That(t, h.spans >= 1)
+
+	// without native buckets there is no schema.
+	x.Init(st, Config{Bounds: []float64{10}})
+	buf, err = x.AppendProto(nil, parseQuery(t, "{__name__|}"))
+	assert.NoError(t, err)
+	assert.That(t, !parseProto(t, buf)["rpc_latency"][0].hasSchema)
+}
+
+func TestServeHTTP(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var x Exporter
+	x.Init(st, Config{Native: true, Schema: 3})
+
+	srv := httptest.NewServer(&x)
+	defer srv.Close()
+
+	get := func(q, accept string) (int, string, []byte) {
+		t.Helper()
+		req, err := http.NewRequest("GET", srv.URL+"?q="+url.QueryEscape(q), nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), body
+	}
+
+	code, ct, body := get("__name__=rpc.latency", "application/openmetrics-text")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, ct, textContentType)
+	assert.That(t, strings.Contains(string(body), "rpc_latency_count{host=\"x\",path=\"/a,b\"} 100\n"))
+
+	code, ct, body = get("__name__=rpc.latency", protoContentType+";q=0.9,text/plain;q=0.1")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, ct, protoContentType)
+	assert.Equal(t, len(parseProto(t, body)["rpc_latency"]), 2)
+
+	code, _, _ = get("{", "")
+	assert.Equal(t, code, http.StatusBadRequest)
+}
@@ -0,0 +1,117 @@
+package openmetrics
+
+import (
+	"encoding/binary"
+
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/pbwire"
+	"github.com/histdb/histdb/query"
+)
+
+// metricTypeHistogram is the HISTOGRAM value of io.prometheus.client.MetricType.
+const metricTypeHistogram = 4
+
+// zeroThreshold is the width of the zero bucket of native histograms. It is
+// the smallest normal float32, below which flathist.S.Exponential counts
+// values as zero.
+const zeroThreshold = 0x1p-126
+
+// AppendProto appends the histograms matching the query as length delimited
+// io.prometheus.client.MetricFamily messages with their classic buckets and,
+// if configured, their native buckets.
+func (x *Exporter) AppendProto(dst []byte, q *query.Q) ([]byte, error) {
+	fams, err := x.collect(q)
+	if err != nil {
+		return dst, err
+	}
+
+	for _, fam := range fams {
+		msg := pbwire.AppendBytes(nil, 1, fam.name)
+		msg = pbwire.AppendVarint(msg, 3, metricTypeHistogram)
+		for _, ser := range fam.series {
+			msg = pbwire.AppendMessage(msg, 4, func(b []byte) []byte {
+				for _, l := range ser.labels {
+					b = pbwire.AppendMessage(b, 1, func(b []byte) []byte {
+						b = pbwire.AppendBytes(b, 1, l.name)
+						return pbwire.AppendBytes(b, 2, l.value)
+					})
+				}
+				return pbwire.AppendMessage(b, 7, func(b []byte) []byte {
+					return x.appendHistogram(b, &ser)
+				})
+			})
+		}
+
+		dst = binary.AppendUvarint(dst, uint64(len(msg)))
+		dst = append(dst, msg...)
+	}
+
+	return dst, nil
+}
+
+func (x *Exporter) appendHistogram(dst []byte, ser *series) []byte {
+	dst = pbwire.AppendVarint(dst, 1, ser.total)
+	dst = pbwire.AppendDouble(dst, 2, ser.sum)
+	for i, bound := range x.cfg.Bounds {
+		dst = pbwire.AppendMessage(dst, 3, func(b []byte) []byte {
+			b = pbwire.AppendVarint(b, 1, ser.buckets[i])
+			return pbwire.AppendDouble(b, 2, bound)
+		})
+	}
+	dst = pbwire.AppendMessage(dst, 15, func(b []byte) []byte {
+		return pbwire.AppendVarint(b, 1, uint64(ser.created))
+	})
+
+	if !x.cfg.Native {
+		return dst
+	}
+
+	dst = pbwire.AppendZigzag(dst, 5, int64(ser.exp.Scale))
+	dst = pbwire.AppendDouble(dst, 6, zeroThreshold)
+	dst = pbwire.AppendVarint(dst, 7, ser.exp.ZeroCount)
+	dst = appendSparse(dst, 9, &ser.exp.Negative)
+	dst = appendSparse(dst, 12, &ser.exp.Positive)
+
+	// an empty native histogram needs a span so that it is not taken for a
+	// classic histogram.
+	if len(ser.exp.Negative.Counts) == 0 && len(ser.exp.Positive.Counts) == 0 {
+		dst = pbwire.AppendMessage(dst, 12, func(b []byte) []byte { return b })
+	}
+
+	return dst
+}
+
+// appendSparse appends the buckets as spans of non-empty buckets with the
+// span field number and the deltas between their counts with the next field
+// number. Prometheus bucket i counts the values in OpenTelemetry bucket i-1.
+func appendSparse(dst []byte, num uint64, bs *flathist.ExponentialBuckets) []byte {
+	var deltas []uint64
+	var prev, next int64 // the first span is offset from index 0
+
+	for i := 0; i < len(bs.Counts); {
+		if bs.Counts[i] == 0 {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(bs.Counts) && bs.Counts[i] != 0 {
+			delta := int64(bs.Counts[i]) - prev
+			deltas = append(deltas, uint64(delta<<1^delta>>63))
+			prev = int64(bs.Counts[i])
+			i++
+		}
+
+		idx := int64(bs.Offset) + 1 + int64(start)
+		dst = pbwire.AppendMessage(dst, num, func(b []byte) []byte {
+			b = pbwire.AppendZigzag(b, 1, idx-next)
+			return pbwire.AppendVarint(b, 2, uint64(i-start))
+		})
+		next = idx + int64(i-start)
+	}
+
+	if len(deltas) > 0 {
+		dst = pbwire.AppendPackedVarints(dst, num+1, deltas)
+	}
+	return dst
+}
@@ -0,0 +1,91 @@
+package openmetrics
+
+import (
+	"strconv"
+
+	"github.com/histdb/histdb/query"
+)
+
+// AppendText appends the histograms matching the query in the OpenMetrics
+// text format with their classic buckets.
+func (x *Exporter) AppendText(dst []byte, q *query.Q) ([]byte, error) {
+	fams, err := x.collect(q)
+	if err != nil {
+		return dst, err
+	}
+
+	for _, fam := range fams {
+		dst = append(dst, "# TYPE "...)
+		dst = append(dst, fam.name...)
+		dst = append(dst, " histogram\n"...)
+
+		for _, ser := range fam.series {
+			for i, b := range x.cfg.Bounds {
+				dst = appendSample(dst, fam.name, "_bucket", ser.labels, strconv.FormatFloat(b, 'g', -1, 64))
+				dst = strconv.AppendUint(dst, ser.buckets[i], 10)
+				dst = append(dst, '\n')
+			}
+			dst = appendSample(dst, fam.name, "_bucket", ser.labels, "+Inf")
+			dst = strconv.AppendUint(dst, ser.total, 10)
+			dst = append(dst, '\n')
+
+			dst = appendSample(dst, fam.name, "_count", ser.labels, "")
+			dst = strconv.AppendUint(dst, ser.total, 10)
+			dst = append(dst, '\n')
+
+			dst = appendSample(dst, fam.name, "_sum", ser.labels, "")
+			dst = strconv.AppendFloat(dst, ser.sum, 'g', -1, 64)
+			dst = append(dst, '\n')
+
+			dst = appendSample(dst, fam.name, "_created", ser.labels, "")
+			dst = strconv.AppendUint(dst, uint64(ser.created), 10)
+			dst = append(dst, '\n')
+		}
+	}
+
+	return append(dst, "# EOF\n"...), nil
+}
+
+// appendSample appends the name and labels of a sample up to its value,
+// including an le label if le is not empty.
+func appendSample(dst, name []byte, suffix string, labels []label, le string) []byte {
+	dst = append(dst, name...)
+	dst = append(dst, suffix...)
+
+	if len(labels) > 0 || le != "" {
+		dst = append(dst, '{')
+		for i, l := range labels {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendLabel(dst, l.name, l.value)
+		}
+		if le != "" {
+			if len(labels) > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendLabel(dst, []byte("le"), []byte(le))
+		}
+		dst = append(dst, '}')
+	}
+
+	return append(dst, ' ')
+}
+
+func appendLabel(dst, name, value []byte) []byte {
+	dst = append(dst, name...)
+	dst = append(dst, '=', '"')
+	for _, c := range value {
+		switch c {
+		case '\\':
+			dst = append(dst, '\\', '\\')
+		case '"':
+			dst = append(dst, '\\', '"')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, '"')
+}
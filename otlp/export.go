@@ -0,0 +1,124 @@
+package otlp
+
+import (
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/metrics"
+	"github.com/histdb/histdb/pbwire"
+)
+
+// Exporter encodes histograms as an ExportMetricsServiceRequest of delta
+// exponential histograms. Metrics are split back into a name from their
+// `__name__` tag, or "histdb" if they do not have one, and an attribute for
+// every other tag. The conversion from histograms is described by
+// flathist.S.Exponential.
+type Exporter struct {
+	_ [0]func() // no equality
+
+	scale      int32
+	maxBuckets int
+
+	names   map[string]int
+	metrics []exportMetric
+}
+
+type exportMetric struct {
+	name   []byte
+	points []byte // encoded data points
+}
+
+// Init sets the largest scale and the most buckets of each sign used for the
+// exponential histograms and removes every added histogram.
+func (x *Exporter) Init(scale int32, maxBuckets int) {
+	x.scale = scale
+	x.maxBuckets = maxBuckets
+	x.names = make(map[string]int)
+	x.metrics = x.metrics[:0]
+}
+
+// Add adds the histogram for the metric covering [ts, ts+dur) seconds.
+func (x *Exporter) Add(metric []byte, ts, dur uint32, s *flathist.S, h flathist.H) {
+	name := []byte("histdb")
+	var attrs []byte
+
+	for rest := metric; len(rest) > 0; {
+		var tkey, tag []byte
+		tkey, tag, rest = metrics.PopTag(rest)
+		if len(tag) == 0 {
+			continue
+		}
+
+		var value []byte
+		if len(tag) > len(tkey) {
+			value = tag[len(tkey)+1:]
+		}
+		if string(tkey) == "__name__" {
+			name = metrics.AppendUnescaped(nil, value)
+			continue
+		}
+
+		attrs = pbwire.AppendMessage(attrs, 1, func(b []byte) []byte {
+			b = pbwire.AppendBytes(b, 1, metrics.AppendUnescaped(nil, tkey))
+			return pbwire.AppendMessage(b, 2, func(b []byte) []byte {
+				return pbwire.AppendBytes(b, 1, metrics.AppendUnescaped(nil, value))
+			})
+		})
+	}
+
+	i, ok := x.names[string(name)]
+	if !ok {
+		i = len(x.metrics)
+		x.names[string(name)] = i
+		x.metrics = append(x.metrics, exportMetric{name: name})
+	}
+
+	exp := s.Exponential(h, x.scale, x.maxBuckets)
+	total, sum, _, _ := s.Summary(h)
+
+	x.metrics[i].points = pbwire.AppendMessage(x.metrics[i].points, 1, func(b []byte) []byte {
+		b = append(b, attrs...)
+		b = pbwire.AppendFixed64(b, 2, uint64(ts)*1e9)
+		b = pbwire.AppendFixed64(b, 3, (uint64(ts)+uint64(dur))*1e9)
+		b = pbwire.AppendFixed64(b, 4, total)
+		b = pbwire.AppendDouble(b, 5, sum)
+		b = pbwire.AppendZigzag(b, 6, int64(exp.Scale))
+		b = pbwire.AppendFixed64(b, 7, exp.ZeroCount)
+		b = appendBuckets(b, 8, &exp.Positive)
+		b = appendBuckets(b, 9, &exp.Negative)
+		if total > 0 {
+			b = pbwire.AppendDouble(b, 12, float64(s.Min(h)))
+			b = pbwire.AppendDouble(b, 13, float64(s.Max(h)))
+		}
+		return b
+	})
+}
+
+func appendBuckets(dst []byte, num uint64, bs *flathist.ExponentialBuckets) []byte {
+	if len(bs.Counts) == 0 {
+		return dst
+	}
+	return pbwire.AppendMessage(dst, num, func(b []byte) []byte {
+		b = pbwire.AppendZigzag(b, 1, int64(bs.Offset))
+		return pbwire.AppendPackedVarints(b, 2, bs.Counts)
+	})
+}
+
+// AppendTo appends the request with every added histogram.
+func (x *Exporter) AppendTo(dst []byte) []byte {
+	return pbwire.AppendMessage(dst, 1, func(b []byte) []byte { // resource metrics
+		return pbwire.AppendMessage(b, 2, func(b []byte) []byte { // scope metrics
+			b = pbwire.AppendMessage(b, 1, func(b []byte) []byte {
+				return pbwire.AppendBytes(b, 1, []byte("histdb"))
+			})
+			for _, m := range x.metrics {
+				b = pbwire.AppendMessage(b, 2, func(b []byte) []byte {
+					b = pbwire.AppendBytes(b, 1, m.name)
+					return pbwire.AppendMessage(b, 10, func(b []byte) []byte {
+						b = append(b, m.points...)
+						return pbwire.AppendVarint(b, 2, temporalityDelta)
+					})
+				})
+			}
+			return b
+		})
+	})
+}
@@ -0,0 +1,236 @@
+// Package otlp receives and exports OpenTelemetry exponential histograms with
+// the OTLP/HTTP protobuf encoding.
+//
+// Received metrics become histdb metrics with a `__name__` tag holding the
+// metric name and a tag for every scalar resource and data point attribute,
+// where data point attributes replace resource attributes with the same key.
+// Only exponential histograms are received. Delta data points are observed as
+// they are. For cumulative data points, the counts of the previous data point
+// of every series are remembered and only the increase is observed: the first
+// data point of a series only records its counts, and a changed start time or
+// a count that decreases starts the series over and observes the whole data
+// point. The conversion into histograms is described by
+// flathist.S.ObserveExponential.
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/metrics"
+	"github.com/histdb/histdb/store"
+)
+
+// maxRequestLen bounds the size of a decoded request.
+const maxRequestLen = 64 << 20
+
+const protobufContentType = "application/x-protobuf"
+
+// T receives OTLP metrics into a store. It is an http.Handler for the
+// OTLP/HTTP metrics path.
+type T struct {
+	_ [0]func() // no equality
+
+	st *store.T
+
+	mu   sync.Mutex
+	last map[string]cumulative // last data point of cumulative series
+}
+
+type cumulative struct {
+	start uint64
+	exp   flathist.Exponential
+}
+
+// Init sets the store observations are added to and forgets every series.
+func (t *T) Init(st *store.T) {
+	t.st = st
+	t.last = make(map[string]cumulative)
+}
+
+func (t *T) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt != protobufContentType {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body io.Reader = req.Body
+	switch enc := req.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "gzip":
+		gr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer func() { _ = gr.Close() }()
+		body = gr
+	default:
+		http.Error(w, "unsupported content encoding: "+enc, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(body, maxRequestLen+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(buf) > maxRequestLen {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := t.Write(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// an empty ExportMetricsServiceResponse means everything was accepted.
+	w.Header().Set("Content-Type", protobufContentType)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Write receives an ExportMetricsServiceRequest.
+func (t *T) Write(buf []byte) error {
+	rms, err := parseRequest(buf)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	var name []byte
+	for _, rm := range rms {
+		for _, m := range rm.metrics {
+			for i := range m.points {
+				p := &m.points[i]
+				if p.flags&flagNoRecordedValue != 0 {
+					continue
+				}
+				name = appendMetric(name[:0], m.name, rm.attrs, p.attrs)
+				t.observe(name, p, m.temporality == temporalityCumulative)
+			}
+		}
+	}
+
+	return nil
+}
+
+// observe adds the data point to the store, or the increase since the last
+// data point if it is cumulative.
+func (t *T) observe(metric []byte, p *expPoint, cumul bool) {
+	exp := &p.exp
+
+	if cumul {
+		t.mu.Lock()
+		last, ok := t.last[string(metric)]
+		t.last[string(metric)] = cumulative{start: p.start, exp: p.exp}
+		t.mu.Unlock()
+
+		if !ok {
+			return
+		} else if last.start == p.start {
+			if delta, ok := subtract(&p.exp, &last.exp); ok {
+				exp = &delta
+			}
+		}
+	}
+
+	if exp.Total() == 0 {
+		return
+	}
+
+	hist := flathist.NewHistogram()
+	hs, hh := hist.Handle()
+	hs.ObserveExponential(hh, exp)
+	t.st.ObserveHistogram(metric, hist)
+}
+
+// appendMetric appends the metric for the name and attributes.
+func appendMetric(dst, name []byte, rattrs, pattrs []attr) []byte {
+	dst = metrics.AppendTag(dst, []byte("__name__"), name)
+
+outer:
+	for _, a := range rattrs {
+		for _, pa := range pattrs {
+			if bytes.Equal(a.key, pa.key) {
+				continue outer
+			}
+		}
+		dst = append(dst, ',')
+		dst = metrics.AppendTag(dst, a.key, a.value)
+	}
+	for _, a := range pattrs {
+		dst = append(dst, ',')
+		dst = metrics.AppendTag(dst, a.key, a.value)
+	}
+
+	return dst
+}
+
+// subtract returns cur - last after lowering both to the same scale. It
+// returns false if any count in cur is smaller than in last.
+func subtract(cur, last *flathist.Exponential) (d flathist.Exponential, ok bool) {
+	d.Scale = min(cur.Scale, last.Scale)
+	if cur.ZeroCount < last.ZeroCount {
+		return d, false
+	}
+	d.ZeroCount = cur.ZeroCount - last.ZeroCount
+
+	if d.Positive, ok = subtractBuckets(
+		downscale(cur.Positive, cur.Scale-d.Scale),
+		downscale(last.Positive, last.Scale-d.Scale),
+	); !ok {
+		return d, false
+	}
+	if d.Negative, ok = subtractBuckets(
+		downscale(cur.Negative, cur.Scale-d.Scale),
+		downscale(last.Negative, last.Scale-d.Scale),
+	); !ok {
+		return d, false
+	}
+	return d, true
+}
+
+// downscale merges the buckets into the buckets of a scale lower by shift.
+func downscale(b flathist.ExponentialBuckets, shift int32) flathist.ExponentialBuckets {
+	if shift == 0 || len(b.Counts) == 0 {
+		return b
+	}
+
+	lo := b.Offset >> shift
+	hi := (b.Offset + int32(len(b.Counts)) - 1) >> shift
+
+	d := flathist.ExponentialBuckets{Offset: lo, Counts: make([]uint64, hi-lo+1)}
+	for i, c := range b.Counts {
+		d.Counts[(b.Offset+int32(i))>>shift-lo] += c
+	}
+	return d
+}
+
+// subtractBuckets returns cur - last for buckets at the same scale.
+func subtractBuckets(cur, last flathist.ExponentialBuckets) (d flathist.ExponentialBuckets, ok bool) {
+	d = flathist.ExponentialBuckets{
+		Offset: cur.Offset,
+		Counts: append([]uint64(nil), cur.Counts...),
+	}
+	for i, c := range last.Counts {
+		if c == 0 {
+			continue
+		}
+		j := last.Offset + int32(i) - d.Offset
+		if j < 0 || int(j) >= len(d.Counts) || d.Counts[j] < c {
+			return d, false
+		}
+		d.Counts[j] -= c
+	}
+	return d, true
+}
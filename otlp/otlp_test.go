@@ -0,0 +1,266 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/pbwire"
+	"github.com/histdb/histdb/query"
+	"github.com/histdb/histdb/store"
+	"github.com/histdb/histdb/testhelp"
+)
+
+//
+// encoding helpers
+//
+
+func pbAttr(dst []byte, num uint64, key, value string) []byte {
+	return pbwire.AppendMessage(dst, num, func(b []byte) []byte {
+		b = pbwire.AppendBytes(b, 1, []byte(key))
+		return pbwire.AppendMessage(b, 2, func(b []byte) []byte {
+			return pbwire.AppendBytes(b, 1, []byte(value))
+		})
+	})
+}
+
+type testPoint struct {
+	attrs []string
+	start uint64
+	exp   flathist.Exponential
+}
+
+func pbRequest(resource []string, name string, temporality uint64, points ...testPoint) []byte {
+	return pbwire.AppendMessage(nil, 1, func(b []byte) []byte {
+		b = pbwire.AppendMessage(b, 1, func(b []byte) []byte {
+			for i := 0; i < len(resource); i += 2 {
+				b = pbAttr(b, 1, resource[i], resource[i+1])
+			}
+			return b
+		})
+		return pbwire.AppendMessage(b, 2, func(b []byte) []byte {
+			return pbwire.AppendMessage(b, 2, func(b []byte) []byte {
+				b = pbwire.AppendBytes(b, 1, []byte(name))
+				return pbwire.AppendMessage(b, 10, func(b []byte) []byte {
+					b = pbwire.AppendVarint(b, 2, temporality)
+					for _, p := range points {
+						b = pbwire.AppendMessage(b, 1, func(b []byte) []byte {
+							for i := 0; i < len(p.attrs); i += 2 {
+								b = pbAttr(b, 1, p.attrs[i], p.attrs[i+1])
+							}
+							b = pbwire.AppendFixed64(b, 2, p.start)
+							b = pbwire.AppendZigzag(b, 6, int64(p.exp.Scale))
+							b = pbwire.AppendFixed64(b, 7, p.exp.ZeroCount)
+							b = appendBuckets(b, 8, &p.exp.Positive)
+							return appendBuckets(b, 9, &p.exp.Negative)
+						})
+					}
+					return b
+				})
+			})
+		})
+	})
+}
+
+//
+// store helpers
+//
+
+func newTestStore(t *testing.T) (*store.T, func()) {
+	fs, cleanup := testhelp.FS(t)
+
+	st := new(store.T)
+	assert.NoError(t, st.Init(fs, store.Config{}))
+
+	return st, func() {
+		assert.NoError(t, st.Close())
+		cleanup()
+	}
+}
+
+// collect writes a level and returns the histogram of every metric in it.
+func collect(t *testing.T, st *store.T, ts uint32) map[string]*flathist.Histogram {
+	assert.NoError(t, st.WriteLevel(ts, 1))
+
+	var q query.Q
+	assert.NoError(t, query.Parse([]byte("{__name__|}"), &q))
+
+	out := make(map[string]*flathist.Histogram)
+	_, err := st.QueryData(&q, ts, ts+1, func(key histdb.Key, name []byte, s *flathist.S, h flathist.H) bool {
+		hist := flathist.NewHistogram()
+		hs, hh := hist.Handle()
+		flathist.Merge(hs, hh, s, h)
+		out[string(name)] = hist
+		return true
+	})
+	assert.NoError(t, err)
+	return out
+}
+
+//
+// tests
+//
+
+func TestReceive(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var rcv T
+	rcv.Init(st)
+
+	srv := httptest.NewServer(&rcv)
+	defer srv.Close()
+
+	post := func(body []byte, gz bool) int {
+		t.Helper()
+		if gz {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			_, _ = w.Write(body)
+			assert.NoError(t, w.Close())
+			body = buf.Bytes()
+		}
+		req, err := http.NewRequest("POST", srv.URL, bytes.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		if gz {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	resource := []string{"service.name", "api", "host", "a"}
+
+	// delta points are observed as they are, and point attributes replace
+	// resource attributes.
+	assert.Equal(t, post(pbRequest(resource, "rpc.duration", temporalityDelta, testPoint{
+		attrs: []string{"host", "b", "path", "/x,y"},
+		exp: flathist.Exponential{
+			Scale:     1,
+			ZeroCount: 1,
+			Positive:  flathist.ExponentialBuckets{Offset: 2, Counts: []uint64{3, 4}},
+		},
+	}), true), http.StatusOK)
+
+	hists := collect(t, st, 10)
+	assert.Equal(t, len(hists), 1)
+	hist := hists[`__name__=rpc.duration,host=b,path=/x\,y,service.name=api`]
+	assert.Equal(t, hist.Total(), 8)
+	assert.Equal(t, hist.Min(), float32(0))
+
+	// cumulative points only observe the increase.
+	cumul := func(start uint64, scale int32, counts ...uint64) {
+		t.Helper()
+		assert.Equal(t, post(pbRequest(resource, "queue", temporalityCumulative, testPoint{
+			start: start,
+			exp: flathist.Exponential{
+				Scale:    scale,
+				Positive: flathist.ExponentialBuckets{Offset: 0, Counts: counts},
+			},
+		}), false), http.StatusOK)
+	}
+	const queue = "__name__=queue,host=a,service.name=api"
+
+	cumul(1, 1, 1, 1)
+	assert.Equal(t, len(collect(t, st, 11)), 0)
+
+	cumul(1, 1, 2, 3, 4)
+	assert.Equal(t, collect(t, st, 12)[queue].Total(), 7)
+
+	// a lower scale merges the previous buckets before subtracting.
+	cumul(1, 0, 6, 5)
+	assert.Equal(t, collect(t, st, 13)[queue].Total(), 2)
+
+	// a new start time observes everything.
+	cumul(2, 0, 1)
+	assert.Equal(t, collect(t, st, 14)[queue].Total(), 1)
+
+	// a decreasing count observes everything.
+	cumul(2, 0, 0, 1)
+	assert.Equal(t, collect(t, st, 15)[queue].Total(), 1)
+
+	assert.Equal(t, post([]byte{0xff}, false), http.StatusBadRequest)
+}
+
+func TestExport(t *testing.T) {
+	var s flathist.S
+	h1, h2 := s.New(), s.New()
+	for i := range 100 {
+		s.Observe(h1, float32(i))
+		s.Observe(h2, -float32(i))
+	}
+
+	var x Exporter
+	x.Init(7, 20)
+	x.Add([]byte(`__name__=rpc,path=/x\,y`), 10, 5, &s, h1)
+	x.Add([]byte(`__name__=rpc,path=z`), 10, 5, &s, h2)
+	x.Add([]byte(`other=1`), 10, 5, &s, h1)
+
+	rms, err := parseRequest(x.AppendTo(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, len(rms), 1)
+	assert.Equal(t, len(rms[0].metrics), 2)
+
+	m := rms[0].metrics[0]
+	assert.Equal(t, string(m.name), "rpc")
+	assert.Equal(t, m.temporality, uint64(temporalityDelta))
+	assert.Equal(t, len(m.points), 2)
+
+	p := m.points[0]
+	assert.Equal(t, len(p.attrs), 1)
+	assert.Equal(t, string(p.attrs[0].key), "path")
+	assert.Equal(t, string(p.attrs[0].value), "/x,y")
+	assert.Equal(t, p.start, uint64(10e9))
+	assert.Equal(t, p.time, uint64(15e9))
+	assert.Equal(t, p.exp.Total(), 100)
+	assert.Equal(t, p.exp.ZeroCount, 1)
+	assert.That(t, len(p.exp.Positive.Counts) <= 20)
+	assert.That(t, p.exp.Scale < 7)
+
+	p = m.points[1]
+	assert.Equal(t, len(p.exp.Negative.Counts) > 0, true)
+	assert.Equal(t, len(p.exp.Positive.Counts), 0)
+
+	m = rms[0].metrics[1]
+	assert.Equal(t, string(m.name), "histdb")
+	assert.Equal(t, string(m.points[0].attrs[0].key), "other")
+
+	// the exported histogram can be observed back.
+	var r flathist.S
+	g := r.New()
+	r.ObserveExponential(g, &p.exp)
+	assert.Equal(t, r.Total(g), s.Total(h2))
+}
+
+func TestSubtract(t *testing.T) {
+	cur := flathist.Exponential{
+		Scale:     0,
+		ZeroCount: 2,
+		Positive:  flathist.ExponentialBuckets{Offset: -1, Counts: []uint64{4, 5, 6}},
+	}
+	last := flathist.Exponential{
+		Scale:     1,
+		ZeroCount: 1,
+		Positive:  flathist.ExponentialBuckets{Offset: -1, Counts: []uint64{1, 1, 1, 1}},
+	}
+
+	// at scale 0, last has indexes -1, 0, 0 and 1.
+	d, ok := subtract(&cur, &last)
+	assert.That(t, ok)
+	assert.Equal(t, d.Scale, int32(0))
+	assert.Equal(t, d.ZeroCount, 1)
+	assert.Equal(t, d.Positive.Offset, int32(-1))
+	assert.Equal(t, d.Positive.Counts, []uint64{3, 3, 5})
+
+	_, ok = subtract(&last, &cur)
+	assert.That(t, !ok)
+}
@@ -0,0 +1,226 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"strconv"
+
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/pbwire"
+)
+
+// the subset of the OTLP metrics protobuf messages that is used. field
+// numbers are from opentelemetry/proto/metrics/v1/metrics.proto and
+// common/v1/common.proto.
+
+const (
+	temporalityUnspecified = 0
+	temporalityDelta       = 1
+	temporalityCumulative  = 2
+)
+
+// flagNoRecordedValue marks a data point that only signals a missing value.
+const flagNoRecordedValue = 1
+
+type attr struct {
+	key   []byte
+	value []byte
+}
+
+type expPoint struct {
+	attrs []attr
+	start uint64
+	time  uint64
+	flags uint64
+	exp   flathist.Exponential
+}
+
+type metric struct {
+	name        []byte
+	temporality uint64
+	points      []expPoint
+}
+
+type resourceMetrics struct {
+	attrs   []attr
+	metrics []metric
+}
+
+// parseRequest parses an ExportMetricsServiceRequest. Only metrics that are
+// exponential histograms are returned.
+func parseRequest(buf []byte) ([]resourceMetrics, error) {
+	var out []resourceMetrics
+
+	var r pbwire.Reader
+	r.Init(buf)
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Bytes:
+			sr := r.Sub()
+			out = append(out, parseResourceMetrics(&sr))
+			r.Merge(&sr)
+		default:
+			r.Skip(wire)
+		}
+	}
+
+	return out, r.Err()
+}
+
+func parseResourceMetrics(r *pbwire.Reader) (rm resourceMetrics) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Bytes: // resource
+			sr := r.Sub()
+			for sr.More() {
+				switch num, wire := sr.Field(); {
+				case num == 1 && wire == pbwire.Bytes:
+					rm.attrs = appendAttr(rm.attrs, &sr)
+				default:
+					sr.Skip(wire)
+				}
+			}
+			r.Merge(&sr)
+		case num == 2 && wire == pbwire.Bytes: // scope metrics
+			sr := r.Sub()
+			for sr.More() {
+				switch num, wire := sr.Field(); {
+				case num == 2 && wire == pbwire.Bytes:
+					msr := sr.Sub()
+					if m, ok := parseMetric(&msr); ok {
+						rm.metrics = append(rm.metrics, m)
+					}
+					sr.Merge(&msr)
+				default:
+					sr.Skip(wire)
+				}
+			}
+			r.Merge(&sr)
+		default:
+			r.Skip(wire)
+		}
+	}
+	return rm
+}
+
+func parseMetric(r *pbwire.Reader) (m metric, ok bool) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Bytes:
+			m.name = r.Bytes()
+		case num == 10 && wire == pbwire.Bytes: // exponential histogram
+			ok = true
+			sr := r.Sub()
+			for sr.More() {
+				switch num, wire := sr.Field(); {
+				case num == 1 && wire == pbwire.Bytes:
+					psr := sr.Sub()
+					m.points = append(m.points, parseExpPoint(&psr))
+					sr.Merge(&psr)
+				case num == 2 && wire == pbwire.Varint:
+					m.temporality = sr.Varint()
+				default:
+					sr.Skip(wire)
+				}
+			}
+			r.Merge(&sr)
+		default:
+			r.Skip(wire)
+		}
+	}
+	return m, ok
+}
+
+func parseExpPoint(r *pbwire.Reader) (p expPoint) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Bytes:
+			p.attrs = appendAttr(p.attrs, r)
+		case num == 2 && wire == pbwire.Fixed64:
+			p.start = r.Fixed64()
+		case num == 3 && wire == pbwire.Fixed64:
+			p.time = r.Fixed64()
+		case num == 6 && wire == pbwire.Varint:
+			p.exp.Scale = int32(r.Zigzag())
+		case num == 7 && wire == pbwire.Fixed64:
+			p.exp.ZeroCount = r.Fixed64()
+		case num == 8 && wire == pbwire.Bytes:
+			sr := r.Sub()
+			p.exp.Positive = parseBuckets(&sr)
+			r.Merge(&sr)
+		case num == 9 && wire == pbwire.Bytes:
+			sr := r.Sub()
+			p.exp.Negative = parseBuckets(&sr)
+			r.Merge(&sr)
+		case num == 10 && wire == pbwire.Varint:
+			p.flags = r.Varint()
+		default:
+			r.Skip(wire)
+		}
+	}
+	return p
+}
+
+func parseBuckets(r *pbwire.Reader) (b flathist.ExponentialBuckets) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Varint:
+			b.Offset = int32(r.Zigzag())
+		case num == 2 && (wire == pbwire.Varint || wire == pbwire.Bytes):
+			b.Counts = r.Varints(b.Counts, wire)
+		default:
+			r.Skip(wire)
+		}
+	}
+	return b
+}
+
+// appendAttr parses a KeyValue and appends it if the value is a scalar.
+func appendAttr(attrs []attr, r *pbwire.Reader) []attr {
+	var a attr
+	var ok bool
+
+	sr := r.Sub()
+	for sr.More() {
+		switch num, wire := sr.Field(); {
+		case num == 1 && wire == pbwire.Bytes:
+			a.key = sr.Bytes()
+		case num == 2 && wire == pbwire.Bytes:
+			vsr := sr.Sub()
+			a.value, ok = parseAnyValue(&vsr)
+			sr.Merge(&vsr)
+		default:
+			sr.Skip(wire)
+		}
+	}
+	r.Merge(&sr)
+
+	if !ok || len(a.key) == 0 {
+		return attrs
+	}
+	return append(attrs, a)
+}
+
+// parseAnyValue formats a scalar AnyValue. Arrays and key value lists are not
+// supported.
+func parseAnyValue(r *pbwire.Reader) (value []byte, ok bool) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Bytes:
+			value, ok = r.Bytes(), true
+		case num == 2 && wire == pbwire.Varint:
+			value, ok = strconv.AppendBool(nil, r.Varint() != 0), true
+		case num == 3 && wire == pbwire.Varint:
+			value, ok = strconv.AppendInt(nil, int64(r.Varint()), 10), true
+		case num == 4 && wire == pbwire.Fixed64:
+			value, ok = strconv.AppendFloat(nil, r.Double(), 'g', -1, 64), true
+		case num == 7 && wire == pbwire.Bytes:
+			value, ok = hex.AppendEncode(nil, r.Bytes()), true
+		case num == 5 || num == 6:
+			r.Skip(wire)
+			value, ok = nil, false
+		default:
+			r.Skip(wire)
+		}
+	}
+	return value, ok
+}
@@ -0,0 +1,230 @@
+// Package pbwire reads and appends the protobuf wire format without generated
+// code, for the handful of messages the ingestion adapters need.
+package pbwire
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/zeebo/errs/v2"
+)
+
+// wire types
+const (
+	Varint  = 0
+	Fixed64 = 1
+	Bytes   = 2
+	Fixed32 = 5
+)
+
+// Reader reads fields from a buffer. The first error is kept and every read
+// after it returns zero values.
+type Reader struct {
+	_ [0]func() // no equality
+
+	buf []byte
+	err error
+}
+
+func (r *Reader) Init(buf []byte) { r.buf, r.err = buf, nil }
+
+// Err returns the first error encountered while reading.
+func (r *Reader) Err() error { return r.err }
+
+// More returns true if there are more fields to read.
+func (r *Reader) More() bool { return r.err == nil && len(r.buf) > 0 }
+
+func (r *Reader) fail(msg string) {
+	if r.err == nil {
+		r.err = errs.Errorf("protobuf: %s", msg)
+	}
+	r.buf = nil
+}
+
+// Field reads the key of the next field.
+func (r *Reader) Field() (num uint64, wire uint64) {
+	key := r.Varint()
+	return key >> 3, key & 7
+}
+
+func (r *Reader) Varint() uint64 {
+	x, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail("invalid varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+// Zigzag reads a sint32 or sint64.
+func (r *Reader) Zigzag() int64 {
+	x := r.Varint()
+	return int64(x>>1) ^ -int64(x&1)
+}
+
+func (r *Reader) Fixed64() uint64 {
+	if len(r.buf) < 8 {
+		r.fail("truncated fixed64")
+		return 0
+	}
+	x := binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return x
+}
+
+func (r *Reader) Double() float64 { return math.Float64frombits(r.Fixed64()) }
+
+// Bytes reads a length delimited field. It aliases the buffer.
+func (r *Reader) Bytes() []byte {
+	n := r.Varint()
+	if n > uint64(len(r.buf)) {
+		r.fail("truncated bytes")
+		return nil
+	}
+	x := r.buf[:n]
+	r.buf = r.buf[n:]
+	return x
+}
+
+// Skip reads and discards a field with the wire type.
+func (r *Reader) Skip(wire uint64) {
+	switch wire {
+	case Varint:
+		r.Varint()
+	case Fixed64:
+		r.Fixed64()
+	case Bytes:
+		r.Bytes()
+	case Fixed32:
+		if len(r.buf) < 4 {
+			r.fail("truncated fixed32")
+			return
+		}
+		r.buf = r.buf[4:]
+	default:
+		r.fail("invalid wire type")
+	}
+}
+
+// Sub returns a reader for an embedded message. Merge should be called with
+// it once it is read.
+func (r *Reader) Sub() (sr Reader) {
+	sr.buf = r.Bytes()
+	return sr
+}
+
+// Merge keeps the error from a reader returned by Sub.
+func (r *Reader) Merge(sr *Reader) {
+	if sr.err != nil && r.err == nil {
+		r.err = sr.err
+		r.buf = nil
+	}
+}
+
+// Varints appends a possibly packed repeated varint field.
+func (r *Reader) Varints(dst []uint64, wire uint64) []uint64 {
+	if wire != Bytes {
+		return append(dst, r.Varint())
+	}
+	sr := r.Sub()
+	for sr.More() {
+		dst = append(dst, sr.Varint())
+	}
+	r.Merge(&sr)
+	return dst
+}
+
+// Zigzags appends a possibly packed repeated sint64 field.
+func (r *Reader) Zigzags(dst []int64, wire uint64) []int64 {
+	if wire != Bytes {
+		return append(dst, r.Zigzag())
+	}
+	sr := r.Sub()
+	for sr.More() {
+		dst = append(dst, sr.Zigzag())
+	}
+	r.Merge(&sr)
+	return dst
+}
+
+// Fixed64s appends a possibly packed repeated fixed64 field.
+func (r *Reader) Fixed64s(dst []uint64, wire uint64) []uint64 {
+	if wire != Bytes {
+		return append(dst, r.Fixed64())
+	}
+	sr := r.Sub()
+	for sr.More() {
+		dst = append(dst, sr.Fixed64())
+	}
+	r.Merge(&sr)
+	return dst
+}
+
+// Doubles appends a possibly packed repeated double field.
+func (r *Reader) Doubles(dst []float64, wire uint64) []float64 {
+	if wire != Bytes {
+		return append(dst, r.Double())
+	}
+	sr := r.Sub()
+	for sr.More() {
+		dst = append(dst, sr.Double())
+	}
+	r.Merge(&sr)
+	return dst
+}
+
+//
+// appending
+//
+
+func AppendTag(dst []byte, num, wire uint64) []byte {
+	return binary.AppendUvarint(dst, num<<3|wire)
+}
+
+func AppendVarint(dst []byte, num, x uint64) []byte {
+	return binary.AppendUvarint(AppendTag(dst, num, Varint), x)
+}
+
+// AppendZigzag appends a sint32 or sint64.
+func AppendZigzag(dst []byte, num uint64, x int64) []byte {
+	return AppendVarint(dst, num, uint64(x<<1^x>>63))
+}
+
+func AppendFixed64(dst []byte, num, x uint64) []byte {
+	return binary.LittleEndian.AppendUint64(AppendTag(dst, num, Fixed64), x)
+}
+
+func AppendDouble(dst []byte, num uint64, x float64) []byte {
+	return AppendFixed64(dst, num, math.Float64bits(x))
+}
+
+func AppendBytes(dst []byte, num uint64, x []byte) []byte {
+	return append(binary.AppendUvarint(AppendTag(dst, num, Bytes), uint64(len(x))), x...)
+}
+
+// AppendPackedVarints appends a packed repeated varint field.
+func AppendPackedVarints(dst []byte, num uint64, xs []uint64) []byte {
+	n := 0
+	for _, x := range xs {
+		n += uvarintLen(x)
+	}
+	dst = binary.AppendUvarint(AppendTag(dst, num, Bytes), uint64(n))
+	for _, x := range xs {
+		dst = binary.AppendUvarint(dst, x)
+	}
+	return dst
+}
+
+// AppendMessage appends an embedded message by calling fn to append its
+// fields.
+func AppendMessage(dst []byte, num uint64, fn func([]byte) []byte) []byte {
+	return AppendBytes(dst, num, fn(nil))
+}
+
+func uvarintLen(x uint64) (n int) {
+	for n = 1; x >= 0x80; n++ {
+		x >>= 7
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+package pbwire
+
+import (
+	"testing"
+
+	"github.com/zeebo/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf []byte
+	buf = AppendVarint(buf, 1, 300)
+	buf = AppendZigzag(buf, 2, -5)
+	buf = AppendFixed64(buf, 3, 7)
+	buf = AppendDouble(buf, 4, 1.5)
+	buf = AppendBytes(buf, 5, []byte("hi"))
+	buf = AppendPackedVarints(buf, 6, []uint64{1, 200, 1 << 40})
+	buf = AppendVarint(buf, 6, 3) // unpacked elements of a packed field
+	buf = AppendMessage(buf, 7, func(b []byte) []byte { return AppendVarint(b, 1, 9) })
+	buf = AppendTag(buf, 8, Fixed32)
+	buf = append(buf, 1, 2, 3, 4)
+
+	var r Reader
+	r.Init(buf)
+
+	var vs []uint64
+	for r.More() {
+		switch num, wire := r.Field(); num {
+		case 1:
+			assert.Equal(t, r.Varint(), 300)
+		case 2:
+			assert.Equal(t, r.Zigzag(), -5)
+		case 3:
+			assert.Equal(t, r.Fixed64(), 7)
+		case 4:
+			assert.Equal(t, r.Double(), 1.5)
+		case 5:
+			assert.Equal(t, string(r.Bytes()), "hi")
+		case 6:
+			vs = r.Varints(vs, wire)
+		case 7:
+			sr := r.Sub()
+			num, _ := sr.Field()
+			assert.Equal(t, num, 1)
+			assert.Equal(t, sr.Varint(), 9)
+			r.Merge(&sr)
+		default:
+			r.Skip(wire)
+		}
+	}
+	assert.NoError(t, r.Err())
+	assert.Equal(t, vs, []uint64{1, 200, 1 << 40, 3})
+
+	// truncated inputs are errors.
+	r.Init(AppendBytes(nil, 1, []byte("abc"))[:3])
+	r.Field()
+	r.Bytes()
+	assert.Error(t, r.Err())
+	assert.That(t, !r.More())
+
+	r.Init(AppendFixed64(nil, 1, 1)[:5])
+	r.Skip(Fixed64)
+	assert.Error(t, r.Err())
+}
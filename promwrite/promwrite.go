@@ -0,0 +1,376 @@
+// Package promwrite ingests Prometheus remote write requests into a store.
+//
+// Only histograms are ingested: native histograms and classic histograms made
+// of `_bucket` series with an `le` label. Every other series is ignored. Label
+// sets become metrics with one tag per label, including `__name__`. Classic
+// histograms have the `le` label removed and the `_bucket` suffix trimmed from
+// their name.
+//
+// Remote write sends cumulative counts, so the counts of the previous sample
+// of every series are remembered and only the increase is observed. The first
+// sample of a series only records its counts. A count that decreases, or a
+// native histogram with a reset hint, starts the series over and the whole
+// sample is observed. Gauge histograms are observed in full every time. A
+// series that is not written for staleAfter is forgotten, so if it comes back
+// its first sample only records its counts again.
+//
+// Every bucket's count is observed at a single value inside of the bucket:
+// the geometric midpoint of native buckets, which is off by at most a factor
+// of sqrt(base) from any value in the bucket, and the arithmetic midpoint of
+// classic buckets. The zero bucket is observed at 0, the first classic bucket
+// at the midpoint between 0 and its bound if the bound is positive, and the
+// +Inf bucket at the largest finite bound. Sample timestamps are ignored: the
+// observations land in the next level written by the store.
+package promwrite
+
+import (
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/metrics"
+	"github.com/histdb/histdb/pdqsort"
+	"github.com/histdb/histdb/store"
+)
+
+// staleNaN is the value Prometheus uses to mark a series as stale.
+const staleNaN = 0x7ff0000000000002
+
+// staleAfter is how long the counts of a series are remembered after its last
+// sample. It is longer than the scrape interval of any reasonable setup.
+const staleAfter = 15 * time.Minute
+
+// T ingests remote write requests into a store. It is an http.Handler.
+type T struct {
+	_ [0]func() // no equality
+
+	st  *store.T
+	now func() time.Time
+
+	mu    sync.Mutex
+	last  map[string]lastSample // counts of the last sample of every series
+	swept time.Time             // when stale series were last removed
+}
+
+// lastSample is the per bucket counts of the last sample of a series and when
+// it was written.
+type lastSample struct {
+	counts map[float64]float64
+	seen   time.Time
+}
+
+// Init sets the store observations are added to and forgets every series.
+func (t *T) Init(st *store.T) {
+	t.st = st
+	t.last = make(map[string]lastSample)
+	if t.now == nil {
+		t.now = time.Now
+	}
+	t.swept = t.now()
+}
+
+func (t *T) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		if _, params, err := mime.ParseMediaType(ct); err == nil {
+			if proto := params["proto"]; proto != "" && proto != "prometheus.WriteRequest" {
+				http.Error(w, "unsupported proto: "+proto, http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxDecodedLen+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(body) > maxDecodedLen {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := t.Write(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Write ingests a snappy compressed WriteRequest.
+func (t *T) Write(body []byte) error {
+	buf, err := decodeSnappy(nil, body)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	sers, err := parseWriteRequest(buf)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	t.sweep()
+
+	var metric []byte
+	var bs []bucket
+	var classic []classicSample
+
+	for i := range sers {
+		s := &sers[i]
+
+		if len(s.histograms) > 0 {
+			metric = appendMetric(metric[:0], s.labels, false)
+			for j := range s.histograms {
+				h := &s.histograms[j]
+				if math.Float64bits(h.sum) == staleNaN || h.schema < -4 || h.schema > 8 {
+					continue
+				}
+				bs = nativeBuckets(bs[:0], h)
+				t.observe(metric, bs, h.resetHint == resetHintYes, h.resetHint == resetHintGauge)
+			}
+		}
+
+		if le, ok := classicBound(s.labels); ok && len(s.samples) > 0 {
+			metric = appendMetric(metric[:0], s.labels, true)
+			for _, smp := range s.samples {
+				if smp.value != smp.value {
+					continue
+				}
+				classic = append(classic, classicSample{
+					metric: string(metric),
+					ts:     smp.timestamp,
+					le:     le,
+					count:  smp.value,
+				})
+			}
+		}
+	}
+
+	// the bucket series of a classic histogram are separate series, so they
+	// are sorted into one group per metric and timestamp ordered by le.
+	pdqsort.Less(classic, func(i, j int) bool {
+		ci, cj := &classic[i], &classic[j]
+		if ci.metric != cj.metric {
+			return ci.metric < cj.metric
+		} else if ci.ts != cj.ts {
+			return ci.ts < cj.ts
+		}
+		return ci.le < cj.le
+	})
+
+	for len(classic) > 0 {
+		n := 1
+		for n < len(classic) && classic[n].metric == classic[0].metric && classic[n].ts == classic[0].ts {
+			n++
+		}
+		bs = classicBuckets(bs[:0], classic[:n])
+		t.observe([]byte(classic[0].metric), bs, false, false)
+		classic = classic[n:]
+	}
+
+	return nil
+}
+
+// bucket is a count for every value in a bucket observed at value.
+type bucket struct {
+	value float64
+	count float64
+}
+
+type classicSample struct {
+	metric string
+	ts     int64
+	le     float64
+	count  float64
+}
+
+// sweep forgets the series that have not been written for staleAfter. It only
+// walks every series once per staleAfter.
+func (t *T) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if now.Sub(t.swept) < staleAfter {
+		return
+	}
+	t.swept = now
+
+	for metric, ser := range t.last {
+		if now.Sub(ser.seen) >= staleAfter {
+			delete(t.last, metric)
+		}
+	}
+}
+
+// observe adds the increase in the counts of the buckets since the last sample
+// of the metric to the store.
+func (t *T) observe(metric []byte, bs []bucket, reset, gauge bool) {
+	if !gauge {
+		t.mu.Lock()
+		ser, ok := t.last[string(metric)]
+		last := ser.counts
+
+		counts := make(map[float64]float64, len(bs))
+		for _, b := range bs {
+			counts[b.value] = b.count
+		}
+		t.last[string(metric)] = lastSample{counts: counts, seen: t.now()}
+
+		if !reset && ok {
+			// a counter reset shows up as some bucket going down.
+			for value, count := range last {
+				if counts[value] < count {
+					reset = true
+					break
+				}
+			}
+		}
+		if !reset && ok {
+			for i := range bs {
+				bs[i].count -= last[bs[i].value]
+			}
+		}
+		t.mu.Unlock()
+
+		if !reset && !ok {
+			return
+		}
+	}
+
+	var hist *flathist.Histogram
+	for _, b := range bs {
+		if n := math.Round(b.count); n >= 1 {
+			if hist == nil {
+				hist = flathist.NewHistogram()
+			}
+			hist.ObserveN(float32(max(min(b.value, math.MaxFloat32), -math.MaxFloat32)), uint64(n))
+		}
+	}
+	if hist != nil {
+		t.st.ObserveHistogram(metric, hist)
+	}
+}
+
+// appendMetric appends the labels as a metric. If classic is true, the le
+// label is dropped and the _bucket suffix is trimmed from the name.
+func appendMetric(dst []byte, labels []label, classic bool) []byte {
+	for _, l := range labels {
+		value := l.value
+		if classic {
+			if string(l.name) == "le" {
+				continue
+			} else if string(l.name) == "__name__" {
+				value = value[:len(value)-len("_bucket")]
+			}
+		}
+		if len(dst) > 0 {
+			dst = append(dst, ',')
+		}
+		dst = metrics.AppendTag(dst, l.name, value)
+	}
+	return dst
+}
+
+// classicBound returns the le label of a classic histogram bucket series.
+func classicBound(labels []label) (le float64, ok bool) {
+	var name, bound []byte
+	for _, l := range labels {
+		switch string(l.name) {
+		case "__name__":
+			name = l.value
+		case "le":
+			bound = l.value
+		}
+	}
+
+	const suffix = "_bucket"
+	if bound == nil || len(name) <= len(suffix) || string(name[len(name)-len(suffix):]) != suffix {
+		return 0, false
+	}
+
+	le, err := strconv.ParseFloat(string(bound), 64)
+	if err != nil || le != le {
+		return 0, false
+	}
+	return le, true
+}
+
+// classicBuckets appends the counts of the buckets of a classic histogram
+// from the cumulative counts of its bucket series sorted by le.
+func classicBuckets(dst []bucket, cs []classicSample) []bucket {
+	prevLe, prevCount := math.Inf(-1), 0.
+	for _, c := range cs {
+		var value float64
+		switch {
+		case math.IsInf(c.le, 1):
+			if !math.IsInf(prevLe, -1) {
+				value = prevLe
+			}
+		case math.IsInf(prevLe, -1):
+			value = c.le
+			if c.le > 0 {
+				value = c.le / 2
+			}
+		default:
+			value = prevLe + (c.le-prevLe)/2
+		}
+
+		dst = append(dst, bucket{value: value, count: max(c.count-prevCount, 0)})
+		prevLe, prevCount = c.le, max(c.count, prevCount)
+	}
+	return dst
+}
+
+// nativeBuckets appends the counts of the buckets of a native histogram.
+func nativeBuckets(dst []bucket, h *histogram) []bucket {
+	if h.zeroCount > 0 {
+		dst = append(dst, bucket{value: 0, count: h.zeroCount})
+	}
+	dst = appendNative(dst, h.schema, h.negSpans, h.negDeltas, h.negCounts, -1)
+	dst = appendNative(dst, h.schema, h.posSpans, h.posDeltas, h.posCounts, 1)
+	return dst
+}
+
+func appendNative(dst []bucket, schema int32, spans []span, deltas []int64, counts []float64, sign float64) []bucket {
+	width := math.Exp2(-float64(schema)) // log2 of the bucket base
+
+	var idx int32
+	var pos int
+	var count int64
+	for i, sp := range spans {
+		if i == 0 {
+			idx = sp.offset
+		} else {
+			idx += sp.offset
+		}
+
+		for range sp.length {
+			var c float64
+			if pos < len(counts) {
+				c = counts[pos]
+			} else if pos < len(deltas) {
+				count += deltas[pos]
+				c = float64(count)
+			} else {
+				return dst
+			}
+			pos++
+
+			// bucket idx holds values in (base^(idx-1), base^idx].
+			value := sign * math.Exp2((float64(idx)-0.5)*width)
+			dst = append(dst, bucket{value: value, count: c})
+			idx++
+		}
+	}
+	return dst
+}
@@ -0,0 +1,304 @@
+package promwrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/pbwire"
+	"github.com/histdb/histdb/query"
+	"github.com/histdb/histdb/store"
+	"github.com/histdb/histdb/testhelp"
+)
+
+//
+// encoding helpers
+//
+
+func pbSeries(labels []string, body []byte) []byte {
+	var s []byte
+	for i := 0; i < len(labels); i += 2 {
+		var l []byte
+		l = pbwire.AppendBytes(l, 1, []byte(labels[i]))
+		l = pbwire.AppendBytes(l, 2, []byte(labels[i+1]))
+		s = pbwire.AppendBytes(s, 1, l)
+	}
+	return pbwire.AppendBytes(nil, 1, append(s, body...))
+}
+
+func pbSample(value float64, ts int64) []byte {
+	var s []byte
+	s = pbwire.AppendDouble(s, 1, value)
+	s = pbwire.AppendVarint(s, 2, uint64(ts))
+	return pbwire.AppendBytes(nil, 2, s)
+}
+
+// pbNative encodes a native histogram with integer counts for a single span
+// of positive buckets starting at offset.
+func pbNative(schema int32, zero uint64, offset int32, counts []int64, hint uint64) []byte {
+	var sp, deltas, h []byte
+	sp = pbwire.AppendZigzag(sp, 1, int64(offset))
+	sp = pbwire.AppendVarint(sp, 2, uint64(len(counts)))
+
+	prev := int64(0)
+	for _, c := range counts {
+		x := c - prev
+		deltas = binary.AppendUvarint(deltas, uint64(x<<1^x>>63))
+		prev = c
+	}
+
+	h = pbwire.AppendZigzag(h, 4, int64(schema))
+	h = pbwire.AppendVarint(h, 6, zero)
+	h = pbwire.AppendBytes(h, 11, sp)
+	h = pbwire.AppendBytes(h, 12, deltas)
+	h = pbwire.AppendVarint(h, 14, hint)
+	return pbwire.AppendBytes(nil, 4, h)
+}
+
+// snappyLiteral encodes buf as a snappy block made only of literals.
+func snappyLiteral(buf []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(buf)))
+	for len(buf) > 0 {
+		n := min(len(buf), 1<<16)
+		out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		out = append(out, buf[:n]...)
+		buf = buf[n:]
+	}
+	return out
+}
+
+//
+// store helpers
+//
+
+func newTestStore(t *testing.T) (*store.T, func()) {
+	fs, cleanup := testhelp.FS(t)
+
+	st := new(store.T)
+	assert.NoError(t, st.Init(fs, store.Config{}))
+
+	return st, func() {
+		assert.NoError(t, st.Close())
+		cleanup()
+	}
+}
+
+// collect writes a level and returns the histogram of every metric in it.
+func collect(t *testing.T, st *store.T, ts uint32) map[string]*flathist.Histogram {
+	assert.NoError(t, st.WriteLevel(ts, 1))
+
+	var q query.Q
+	assert.NoError(t, query.Parse([]byte("{__name__|}"), &q))
+
+	out := make(map[string]*flathist.Histogram)
+	_, err := st.QueryData(&q, ts, ts+1, func(key histdb.Key, name []byte, s *flathist.S, h flathist.H) bool {
+		hist := flathist.NewHistogram()
+		hs, hh := hist.Handle()
+		flathist.Merge(hs, hh, s, h)
+		out[string(name)] = hist
+		return true
+	})
+	assert.NoError(t, err)
+	return out
+}
+
+//
+// tests
+//
+
+func TestSnappy(t *testing.T) {
+	dec, err := decodeSnappy(nil, []byte{
+		16,                         // length
+		3 << 2, 'a', 'b', 'c', 'd', // literal
+		1 | 4<<2, 4, // copy 8 bytes from offset 4
+		2 | 3<<2, 2, 0, // copy 4 bytes from offset 2
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, string(dec), "abcdabcdabcdcdcd")
+
+	buf := bytes.Repeat([]byte("histdb"), 20000)
+	dec, err = decodeSnappy(nil, snappyLiteral(buf))
+	assert.NoError(t, err)
+	assert.Equal(t, dec, buf)
+
+	for _, bad := range [][]byte{
+		{},
+		{4, 3 << 2, 'a'},                // truncated literal
+		{8, 0 << 2, 'a', 1 | 4<<2, 2},   // offset past start
+		{5, 3 << 2, 'a', 'b', 'c', 'd'}, // short
+		{3, 3 << 2, 'a', 'b', 'c', 'd'}, // long
+	} {
+		_, err := decodeSnappy(nil, bad)
+		assert.Error(t, err)
+	}
+}
+
+func TestProto(t *testing.T) {
+	req := pbSeries([]string{"__name__", "x"}, append(pbSample(1, 2), pbNative(3, 4, -1, []int64{5, 6}, 1)...))
+	req = append(req, pbwire.AppendVarint(nil, 7, 99)...) // unknown field
+
+	sers, err := parseWriteRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, len(sers), 1)
+
+	s := sers[0]
+	assert.Equal(t, len(s.labels), 1)
+	assert.Equal(t, string(s.labels[0].name), "__name__")
+	assert.Equal(t, string(s.labels[0].value), "x")
+	assert.Equal(t, len(s.samples), 1)
+	assert.Equal(t, s.samples[0].value, 1.)
+	assert.Equal(t, s.samples[0].timestamp, int64(2))
+	assert.Equal(t, len(s.histograms), 1)
+
+	h := s.histograms[0]
+	assert.Equal(t, h.schema, int32(3))
+	assert.Equal(t, h.zeroCount, 4.)
+	assert.Equal(t, h.posSpans, []span{{offset: -1, length: 2}})
+	assert.Equal(t, h.posDeltas, []int64{5, 1})
+	assert.Equal(t, h.resetHint, resetHintYes)
+
+	_, err = parseWriteRequest(req[:len(req)-3])
+	assert.Error(t, err)
+}
+
+func TestNative(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var pw T
+	pw.Init(st)
+
+	srv := httptest.NewServer(&pw)
+	defer srv.Close()
+
+	write := func(body []byte) {
+		t.Helper()
+		req, err := http.NewRequest("POST", srv.URL, bytes.NewReader(snappyLiteral(body)))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+	}
+
+	labels := []string{"__name__", "rpc_seconds", "path", "/a,b"}
+	const name = `__name__=rpc_seconds,path=/a\,b`
+
+	// the first sample only records the counts.
+	write(pbSeries(labels, pbNative(0, 1, 1, []int64{1, 2, 3}, 0)))
+	assert.Equal(t, len(collect(t, st, 10)), 0)
+
+	// the second sample observes the increase. with schema 0, bucket 2 holds
+	// (2, 4] and bucket 3 holds (4, 8].
+	write(pbSeries(labels, pbNative(0, 1, 1, []int64{1, 4, 13}, 0)))
+	hists := collect(t, st, 11)
+	assert.Equal(t, len(hists), 1)
+	hist := hists[name]
+	assert.Equal(t, hist.Total(), 12)
+	assert.That(t, hist.Min() > 2 && hist.Min() <= 4)
+	assert.That(t, hist.Max() > 4 && hist.Max() <= 8)
+
+	// a count going down is a reset and observes everything.
+	write(pbSeries(labels, pbNative(0, 2, 1, []int64{1}, 0)))
+	hist = collect(t, st, 12)[name]
+	assert.Equal(t, hist.Total(), 3)
+	assert.Equal(t, hist.Min(), float32(0))
+
+	// gauge histograms are always observed in full.
+	gauge := []string{"__name__", "queue_depth"}
+	write(pbSeries(gauge, pbNative(0, 0, 1, []int64{5}, resetHintGauge)))
+	write(pbSeries(gauge, pbNative(0, 0, 1, []int64{5}, resetHintGauge)))
+	hist = collect(t, st, 13)["__name__=queue_depth"]
+	assert.Equal(t, hist.Total(), 10)
+}
+
+func TestClassic(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var pw T
+	pw.Init(st)
+
+	write := func(ts int64, counts ...float64) {
+		t.Helper()
+		var req []byte
+		for i, le := range []string{"1", "10", "+Inf"} {
+			req = append(req, pbSeries(
+				[]string{"__name__", "req_seconds_bucket", "le", le, "job", "api"},
+				pbSample(counts[i], ts),
+			)...)
+		}
+		// series that are not histograms are ignored.
+		req = append(req, pbSeries([]string{"__name__", "req_seconds_count"}, pbSample(counts[2], ts))...)
+		assert.NoError(t, pw.Write(snappyLiteral(req)))
+	}
+
+	write(1, 1, 2, 3)
+	write(2, 2, 5, 9)
+
+	hists := collect(t, st, 10)
+	assert.Equal(t, len(hists), 1)
+	for name, hist := range hists {
+		assert.Equal(t, name, "__name__=req_seconds,job=api")
+
+		// 1 at 0.5, 2 at 5.5 and 3 at 10.
+		total, sum, _, _ := hist.Summary()
+		assert.Equal(t, total, 6)
+		assert.That(t, math.Abs(sum-(0.5+2*5.5+3*10)) < 1)
+	}
+
+	// the same buckets spread over the samples of one request.
+	var req []byte
+	for i, le := range []string{"1", "+Inf"} {
+		req = append(req, pbSeries(
+			[]string{"__name__", "lat_bucket", "le", le},
+			append(pbSample(float64(i+1), 1), pbSample(float64(i+3), 2)...),
+		)...)
+	}
+	assert.NoError(t, pw.Write(snappyLiteral(req)))
+
+	hist := collect(t, st, 11)["__name__=lat"]
+	assert.Equal(t, hist.Total(), 2)
+}
+
+func TestStale(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	now := time.Unix(1000, 0)
+	pw := T{now: func() time.Time { return now }}
+	pw.Init(st)
+
+	write := func(name string, counts ...int64) {
+		t.Helper()
+		body := pbSeries([]string{"__name__", name}, pbNative(0, 0, 1, counts, 0))
+		assert.NoError(t, pw.Write(snappyLiteral(body)))
+	}
+
+	write("a", 1)
+	write("b", 1)
+	assert.Equal(t, len(pw.last), 2)
+
+	// b keeps being written while a goes quiet.
+	now = now.Add(staleAfter / 2)
+	write("b", 2)
+	now = now.Add(staleAfter / 2)
+	write("b", 3)
+	assert.Equal(t, len(pw.last), 1)
+
+	// a is forgotten, so its next sample only records the counts.
+	write("a", 5)
+	hists := collect(t, st, 10)
+	assert.Equal(t, len(hists), 1)
+	assert.Equal(t, hists["__name__=b"].Total(), 2)
+}
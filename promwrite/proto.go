@@ -0,0 +1,179 @@
+package promwrite
+
+import "github.com/histdb/histdb/pbwire"
+
+// the subset of the remote write protobuf messages that is used. field
+// numbers are from prometheus/prompb/types.proto and remote.proto.
+
+type label struct {
+	name  []byte
+	value []byte
+}
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+type span struct {
+	offset int32
+	length uint32
+}
+
+const (
+	resetHintUnknown = 0
+	resetHintYes     = 1
+	resetHintNo      = 2
+	resetHintGauge   = 3
+)
+
+type histogram struct {
+	count         float64
+	sum           float64
+	schema        int32
+	zeroThreshold float64
+	zeroCount     float64
+	negSpans      []span
+	negDeltas     []int64
+	negCounts     []float64
+	posSpans      []span
+	posDeltas     []int64
+	posCounts     []float64
+	resetHint     int
+	timestamp     int64
+}
+
+type series struct {
+	labels     []label
+	samples    []sample
+	histograms []histogram
+}
+
+// parseWriteRequest parses the time series out of a WriteRequest. The
+// returned values alias buf.
+func parseWriteRequest(buf []byte) ([]series, error) {
+	var out []series
+
+	var r pbwire.Reader
+	r.Init(buf)
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Bytes:
+			sr := r.Sub()
+			out = append(out, parseSeries(&sr))
+			r.Merge(&sr)
+		default:
+			r.Skip(wire)
+		}
+	}
+
+	return out, r.Err()
+}
+
+func parseSeries(r *pbwire.Reader) (s series) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Bytes:
+			sr := r.Sub()
+			s.labels = append(s.labels, parseLabel(&sr))
+			r.Merge(&sr)
+		case num == 2 && wire == pbwire.Bytes:
+			sr := r.Sub()
+			s.samples = append(s.samples, parseSample(&sr))
+			r.Merge(&sr)
+		case num == 4 && wire == pbwire.Bytes:
+			sr := r.Sub()
+			s.histograms = append(s.histograms, parseHistogram(&sr))
+			r.Merge(&sr)
+		default:
+			r.Skip(wire)
+		}
+	}
+	return s
+}
+
+func parseLabel(r *pbwire.Reader) (l label) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Bytes:
+			l.name = r.Bytes()
+		case num == 2 && wire == pbwire.Bytes:
+			l.value = r.Bytes()
+		default:
+			r.Skip(wire)
+		}
+	}
+	return l
+}
+
+func parseSample(r *pbwire.Reader) (s sample) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Fixed64:
+			s.value = r.Double()
+		case num == 2 && wire == pbwire.Varint:
+			s.timestamp = int64(r.Varint())
+		default:
+			r.Skip(wire)
+		}
+	}
+	return s
+}
+
+func parseSpan(r *pbwire.Reader) (s span) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Varint:
+			s.offset = int32(r.Zigzag())
+		case num == 2 && wire == pbwire.Varint:
+			s.length = uint32(r.Varint())
+		default:
+			r.Skip(wire)
+		}
+	}
+	return s
+}
+
+func parseHistogram(r *pbwire.Reader) (h histogram) {
+	for r.More() {
+		switch num, wire := r.Field(); {
+		case num == 1 && wire == pbwire.Varint:
+			h.count = float64(r.Varint())
+		case num == 2 && wire == pbwire.Fixed64:
+			h.count = r.Double()
+		case num == 3 && wire == pbwire.Fixed64:
+			h.sum = r.Double()
+		case num == 4 && wire == pbwire.Varint:
+			h.schema = int32(r.Zigzag())
+		case num == 5 && wire == pbwire.Fixed64:
+			h.zeroThreshold = r.Double()
+		case num == 6 && wire == pbwire.Varint:
+			h.zeroCount = float64(r.Varint())
+		case num == 7 && wire == pbwire.Fixed64:
+			h.zeroCount = r.Double()
+		case num == 8 && wire == pbwire.Bytes:
+			sr := r.Sub()
+			h.negSpans = append(h.negSpans, parseSpan(&sr))
+			r.Merge(&sr)
+		case num == 9 && (wire == pbwire.Varint || wire == pbwire.Bytes):
+			h.negDeltas = r.Zigzags(h.negDeltas, wire)
+		case num == 10 && (wire == pbwire.Fixed64 || wire == pbwire.Bytes):
+			h.negCounts = r.Doubles(h.negCounts, wire)
+		case num == 11 && wire == pbwire.Bytes:
+			sr := r.Sub()
+			h.posSpans = append(h.posSpans, parseSpan(&sr))
+			r.Merge(&sr)
+		case num == 12 && (wire == pbwire.Varint || wire == pbwire.Bytes):
+			h.posDeltas = r.Zigzags(h.posDeltas, wire)
+		case num == 13 && (wire == pbwire.Fixed64 || wire == pbwire.Bytes):
+			h.posCounts = r.Doubles(h.posCounts, wire)
+		case num == 14 && wire == pbwire.Varint:
+			h.resetHint = int(r.Varint())
+		case num == 15 && wire == pbwire.Varint:
+			h.timestamp = int64(r.Varint())
+		default:
+			r.Skip(wire)
+		}
+	}
+	return h
+}
@@ -0,0 +1,97 @@
+package promwrite
+
+import (
+	"encoding/binary"
+
+	"github.com/zeebo/errs/v2"
+)
+
+// maxDecodedLen bounds the size of a decoded request.
+const maxDecodedLen = 64 << 20
+
+// decodeSnappy decodes a snappy block (not the framed stream format) into dst
+// and returns it.
+func decodeSnappy(dst, src []byte) ([]byte, error) {
+	n, w := binary.Uvarint(src)
+	if w <= 0 {
+		return nil, errs.Errorf("snappy: invalid length")
+	} else if n > maxDecodedLen {
+		return nil, errs.Errorf("snappy: decoded length too large: %d", n)
+	}
+	src = src[w:]
+
+	if uint64(cap(dst)) < n {
+		dst = make([]byte, 0, n)
+	}
+	dst = dst[:0]
+
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+
+		var length, offset int
+
+		switch tag & 3 {
+		case 0: // literal
+			length = int(tag >> 2)
+			if length >= 60 {
+				nb := length - 59
+				if len(src) < nb {
+					return nil, errs.Errorf("snappy: truncated literal length")
+				}
+				length = 0
+				for i := range nb {
+					length |= int(src[i]) << (8 * i)
+				}
+				src = src[nb:]
+			}
+			length++
+
+			if len(src) < length || uint64(len(dst)+length) > n {
+				return nil, errs.Errorf("snappy: invalid literal")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+
+		case 1: // copy with 1 byte offset
+			if len(src) < 1 {
+				return nil, errs.Errorf("snappy: truncated copy")
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag>>5)<<8 | int(src[0])
+			src = src[1:]
+
+		case 2: // copy with 2 byte offset
+			if len(src) < 2 {
+				return nil, errs.Errorf("snappy: truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src))
+			src = src[2:]
+
+		case 3: // copy with 4 byte offset
+			if len(src) < 4 {
+				return nil, errs.Errorf("snappy: truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src))
+			src = src[4:]
+		}
+
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, errs.Errorf("snappy: invalid copy")
+		}
+
+		// copies may overlap the bytes they produce, so go byte by byte.
+		for pos := len(dst) - offset; length > 0; length-- {
+			dst = append(dst, dst[pos])
+			pos++
+		}
+	}
+
+	if uint64(len(dst)) != n {
+		return nil, errs.Errorf("snappy: decoded %d bytes but expected %d", len(dst), n)
+	}
+	return dst, nil
+}
@@ -0,0 +1,171 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/histdb/histdb/memindex"
+)
+
+// Step is a node of the plan that Explain evaluated.
+type Step struct {
+	_ [0]func() // no equality
+
+	// Depth is the number of nodes above the step in the plan.
+	Depth int
+	// Node describes the instruction of the node.
+	Node string
+	// Estimate is the upper bound on Metrics used to order intersections.
+	Estimate int
+	// Metrics is the number of metrics the node returned. If Filtered, it is
+	// the number of metrics remaining in the intersection after the node.
+	Metrics int
+	// Scanned is the number of tag values the regexes, globs and orderings of
+	// the step and the steps below it checked.
+	Scanned int
+	// Elapsed includes the time of the steps below it.
+	Elapsed time.Duration
+
+	// Filtered is set when the node only checked the values of the metrics
+	// remaining in an intersection.
+	Filtered bool
+	// Reused is set when the result of the node was kept from an earlier step.
+	Reused bool
+	// Skipped is set when the node was not evaluated because the result could
+	// not depend on it.
+	Skipped bool
+}
+
+// Explanation is the steps of an evaluation in the order they started.
+type Explanation struct {
+	_ [0]func() // no equality
+
+	Steps []Step
+}
+
+// Explain evaluates the query against the index like Eval and records how
+// long every node of the plan took and how many metrics it returned.
+func (q *Q) Explain(m *memindex.T) Explanation {
+	var x Explanation
+	if q.proot < 0 || int(q.proot) >= len(q.plan) {
+		return x
+	}
+	e := newEvaluator(q, m)
+	e.x = &x
+	e.eval(q.proot)
+	return x
+}
+
+func (x Explanation) String() string {
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "metrics\testimate\tscanned\telapsed\t  node")
+
+	for _, st := range x.Steps {
+		metrics, scanned, elapsed, note := "-", "-", "-", ""
+		switch {
+		case st.Skipped:
+			note = " (skipped)"
+		case st.Reused:
+			metrics, note = fmt.Sprint(st.Metrics), " (reused)"
+		default:
+			metrics, scanned, elapsed = fmt.Sprint(st.Metrics), fmt.Sprint(st.Scanned), st.Elapsed.String()
+			if st.Filtered {
+				note = " (filtered)"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t  %s%s%s\n",
+			metrics, st.Estimate, scanned, elapsed,
+			strings.Repeat("  ", st.Depth), st.Node, note)
+	}
+
+	_ = tw.Flush()
+	return b.String()
+}
+
+// span is a step that has started but not yet ended.
+type span struct {
+	i     int
+	start time.Time
+	scans int
+}
+
+func (e *evaluator) step(n int16) Step {
+	pn := &e.q.plan[n]
+
+	var b strings.Builder
+	if pn.kids == nil {
+		e.q.writeInst(&b, pn.op, pn.s1, pn.s2)
+	} else {
+		b.WriteString(opName(pn.op))
+	}
+
+	return Step{
+		Depth:    e.depth,
+		Node:     b.String(),
+		Estimate: e.estimate(n),
+	}
+}
+
+func (e *evaluator) begin(n int16) span {
+	if e.x == nil {
+		return span{i: -1}
+	}
+	e.x.Steps = append(e.x.Steps, e.step(n))
+	e.depth++
+	return span{i: len(e.x.Steps) - 1, start: time.Now(), scans: e.scans}
+}
+
+func (e *evaluator) end(sp span, bm *memindex.Bitmap) {
+	if sp.i < 0 {
+		return
+	}
+	e.depth--
+	st := &e.x.Steps[sp.i]
+	st.Elapsed = time.Since(sp.start)
+	st.Metrics = int(bm.GetCardinality())
+	st.Scanned = e.scans - sp.scans
+}
+
+func (e *evaluator) endFilter(sp span, bm *memindex.Bitmap) {
+	if sp.i >= 0 {
+		e.x.Steps[sp.i].Filtered = true
+	}
+	e.end(sp, bm)
+}
+
+// reuse records a step for a node whose result was kept from an earlier step.
+func (e *evaluator) reuse(n int16, bm *memindex.Bitmap) {
+	if e.x == nil {
+		return
+	}
+	st := e.step(n)
+	st.Metrics = int(bm.GetCardinality())
+	st.Reused = true
+	e.x.Steps = append(e.x.Steps, st)
+}
+
+// skip records a step for a node that was not evaluated.
+func (e *evaluator) skip(n int16) {
+	if e.x == nil {
+		return
+	}
+	st := e.step(n)
+	st.Skipped = true
+	e.x.Steps = append(e.x.Steps, st)
+}
+
+// fn returns the matcher of the selector, counting the values it checks if
+// the evaluation is being explained.
+func (e *evaluator) fn(pn *pnode) func([]byte) bool {
+	fn := e.q.mchs[pn.s2].fn
+	if e.x == nil || fn == nil {
+		return fn
+	}
+	return func(v []byte) bool {
+		e.scans++
+		return fn(v)
+	}
+}
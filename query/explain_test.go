@@ -0,0 +1,81 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb/memindex"
+)
+
+func TestExplain(t *testing.T) {
+	var idx memindex.T
+	for i := range 100 {
+		idx.Add(fmt.Appendf(nil, "host=h%d,svc=s%d", i, i%10), nil, nil)
+	}
+
+	// explain returns the steps without their timings.
+	explain := func(query string) []string {
+		var q Q
+		assert.NoError(t, Parse([]byte(query), &q))
+
+		x := q.Explain(&idx)
+		assert.Equal(t, x.Steps[0].Metrics, int(q.Eval(&idx).GetCardinality()))
+
+		var steps []string
+		for _, st := range x.Steps {
+			s := fmt.Sprintf("%s%s %d/%d", strings.Repeat(" ", st.Depth), st.Node, st.Metrics, st.Estimate)
+			switch {
+			case st.Filtered:
+				s += fmt.Sprintf(" filtered scanned=%d", st.Scanned)
+			case st.Reused:
+				s += " reused"
+			case st.Skipped:
+				s += " skipped"
+			case st.Scanned > 0:
+				s += fmt.Sprintf(" scanned=%d", st.Scanned)
+			}
+			steps = append(steps, s)
+		}
+		return steps
+	}
+
+	check := func(query string, exp ...string) {
+		t.Helper()
+		assert.Equal(t, explain(query), exp)
+	}
+
+	check(`svc=s1`,
+		`(sel eq svc s1) 10/10`)
+	check(`{host =~ 'h1.*'}`,
+		`(sel re host h1.*) 11/100 scanned=100`)
+	check(`{host =~ 'h1.*'} & {svc = s1}`,
+		`inter 2/10 scanned=10`,
+		` (sel eq svc s1) 10/10`,
+		` (sel re host h1.*) 2/100 filtered scanned=10`)
+	check(`{svc = s1} | {svc = s1 & host = h1}`,
+		`union 10/11`,
+		` (sel eq svc s1) 10/10`,
+		` inter 1/1`,
+		`  (sel eq host h1) 1/1`,
+		`  (sel eq svc s1) 10/10 reused`)
+	check(`{svc = missing} & {host =~ 'h'}`,
+		`inter 0/0`,
+		` (sel eq svc missing) 0/0 skipped`,
+		` (sel re host h) 0/100 skipped`)
+	check(`{svc = s1} % {svc = missing}`,
+		`modulo 10/10`,
+		` (sel eq svc s1) 10/10`,
+		` (sel eq svc missing) 0/0 skipped`)
+
+	var q Q
+	assert.Equal(t, len(q.Explain(&idx).Steps), 0)
+
+	assert.NoError(t, Parse([]byte(`{host =~ 'h1.*'} & {svc = s1}`), &q))
+	lines := strings.Split(strings.TrimSpace(q.Explain(&idx).String()), "\n")
+	assert.Equal(t, len(lines), 4)
+	assert.That(t, strings.HasSuffix(lines[0], "elapsed  node"))
+	assert.That(t, strings.HasSuffix(lines[3], "    (sel re host h1.*) (filtered)"))
+}
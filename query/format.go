@@ -0,0 +1,285 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/histdb/histdb/metrics"
+)
+
+// fnode is an instruction of the program with the instructions that computed
+// its operands.
+type fnode struct {
+	_ [0]func() // no equality
+
+	inst inst
+	l, r *fnode
+}
+
+// Format returns the query in a canonical form: every selection has braces,
+// every tag key has its special characters escaped, and every value is
+// quoted. Parsing the result gives back the same program.
+func (q *Q) Format() string {
+	stack := make([]*fnode, 0, 8)
+	for _, i := range q.prog {
+		n := &fnode{inst: i}
+
+		switch i.op {
+		case inst_nop:
+			continue
+
+		case inst_union, inst_inter, inst_symdiff, inst_modulo:
+			if len(stack) < 2 {
+				return ""
+			}
+			n.l, n.r = stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+
+		case inst_not:
+			if len(stack) < 1 {
+				return ""
+			}
+			n.l = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		}
+
+		stack = append(stack, n)
+	}
+	if len(stack) != 1 {
+		return ""
+	}
+
+	var b strings.Builder
+	q.formatSel(&b, stack[0])
+	return b.String()
+}
+
+func (q *Q) formatSel(b *strings.Builder, n *fnode) {
+	switch op := n.inst.op; {
+	case op == inst_tags:
+		b.WriteByte('{')
+		q.formatKeys(b, q.strs.list[n.inst.s1])
+		if len(q.strs.list[n.inst.s1]) > 0 {
+			b.WriteString(" |")
+		}
+		b.WriteByte('}')
+
+	case q.isSelExpr(n):
+		// the tag keys are inferred if they are the ones the expression
+		// uses in the order it uses them.
+		tkeys := q.strs.list[n.r.inst.s1]
+		b.WriteByte('{')
+		if !bytes.Equal(bytes.Join(q.exprKeys(nil, n.l), []byte{','}), tkeys) {
+			q.formatKeys(b, tkeys)
+			b.WriteString(" | ")
+		}
+		q.formatExpr(b, n.l)
+		b.WriteByte('}')
+
+	case q.isExpr(n) && len(q.exprKeys(nil, n)) == 0:
+		b.WriteByte('{')
+		q.formatExpr(b, n)
+		b.WriteByte('}')
+
+	case op == inst_not:
+		b.WriteByte('!')
+		q.formatSelOperand(b, n.l)
+
+	case op == inst_union || op == inst_inter || op == inst_symdiff || op == inst_modulo:
+		q.formatSel(b, n.l)
+		switch op {
+		case inst_union:
+			b.WriteString(" | ")
+		case inst_inter:
+			b.WriteString(" & ")
+		case inst_symdiff:
+			b.WriteString(" ^ ")
+		case inst_modulo:
+			b.WriteString(" % ")
+		}
+		q.formatSelOperand(b, n.r)
+
+	default:
+		// a comparison outside of a selection is not produced by Parse.
+		b.WriteByte('{')
+		q.formatExpr(b, n)
+		b.WriteByte('}')
+	}
+}
+
+// formatSelOperand formats a selection that follows an operator, which binds
+// to the smallest selection after it.
+func (q *Q) formatSelOperand(b *strings.Builder, n *fnode) {
+	switch n.inst.op {
+	case inst_union, inst_inter, inst_symdiff, inst_modulo:
+		if !q.isSelExpr(n) && (!q.isExpr(n) || len(q.exprKeys(nil, n)) > 0) {
+			b.WriteByte('(')
+			q.formatSel(b, n)
+			b.WriteByte(')')
+			return
+		}
+	}
+	q.formatSel(b, n)
+}
+
+// isSelExpr returns true if the node is an expression intersected with the
+// metrics that have the tag keys of its selection.
+func (q *Q) isSelExpr(n *fnode) bool {
+	return n.inst.op == inst_inter &&
+		n.r.inst.op == inst_tags &&
+		len(q.strs.list[n.r.inst.s1]) > 0 &&
+		q.isExpr(n.l)
+}
+
+func (q *Q) formatExpr(b *strings.Builder, n *fnode) {
+	switch op := n.inst.op; op {
+	case inst_union, inst_inter:
+		q.formatExpr(b, n.l)
+		if op == inst_union {
+			b.WriteString(" | ")
+		} else {
+			b.WriteString(" & ")
+		}
+		if n.r.inst.op == inst_union || n.r.inst.op == inst_inter {
+			b.WriteByte('(')
+			q.formatExpr(b, n.r)
+			b.WriteByte(')')
+		} else {
+			q.formatExpr(b, n.r)
+		}
+
+	case inst_not:
+		b.WriteByte('!')
+		switch {
+		case q.isAbsence(n):
+			// keep a key starting with ~ or * from reading as !~ or !*.
+			if tkey := q.strs.list[n.l.inst.s1]; tkey[0] == '~' || tkey[0] == '*' {
+				b.WriteByte(' ')
+			}
+			appendKey(b, q.strs.list[n.l.inst.s1])
+		case n.l.inst.op == inst_not:
+			q.formatExpr(b, n.l)
+		default:
+			b.WriteByte('(')
+			q.formatExpr(b, n.l)
+			b.WriteByte(')')
+		}
+
+	case inst_eq, inst_neq:
+		appendKey(b, q.strs.list[n.inst.s1])
+		if op == inst_eq {
+			b.WriteString(" == ")
+		} else {
+			b.WriteString(" != ")
+		}
+		appendQuoted(b, metrics.AppendUnescaped(nil, q.strs.list[n.inst.s2]))
+
+	case inst_re, inst_nre, inst_glob, inst_nglob, inst_lt, inst_lte, inst_gt, inst_gte:
+		appendKey(b, q.strs.list[n.inst.s1])
+		switch op {
+		case inst_re:
+			b.WriteString(" =~ ")
+		case inst_nre:
+			b.WriteString(" !~ ")
+		case inst_glob:
+			b.WriteString(" =* ")
+		case inst_nglob:
+			b.WriteString(" !* ")
+		case inst_lt:
+			b.WriteString(" < ")
+		case inst_lte:
+			b.WriteString(" <= ")
+		case inst_gt:
+			b.WriteString(" > ")
+		case inst_gte:
+			b.WriteString(" >= ")
+		}
+		appendQuoted(b, []byte(q.mchs[n.inst.s2].q))
+	}
+}
+
+// isAbsence returns true if the node requires a single tag key to be absent.
+func (q *Q) isAbsence(n *fnode) bool {
+	if n.inst.op != inst_not || n.l.inst.op != inst_tags {
+		return false
+	}
+	tkeys := q.strs.list[n.l.inst.s1]
+	tkey, _, rest := metrics.PopTag(tkeys)
+	return len(tkeys) > 0 && len(tkey) == len(tkeys) && len(rest) == 0
+}
+
+// isExpr returns true if the node can be written as an expression inside of
+// a selection.
+func (q *Q) isExpr(n *fnode) bool {
+	switch n.inst.op {
+	case inst_eq, inst_neq, inst_re, inst_nre, inst_glob, inst_nglob,
+		inst_lt, inst_lte, inst_gt, inst_gte:
+		return true
+	case inst_not:
+		return q.isAbsence(n) || q.isExpr(n.l)
+	case inst_union, inst_inter:
+		return q.isExpr(n.l) && q.isExpr(n.r)
+	default:
+		return false
+	}
+}
+
+// exprKeys appends the tag keys the expression infers for its selection in
+// the order that Parse adds them.
+func (q *Q) exprKeys(tkeys [][]byte, n *fnode) [][]byte {
+	switch n.inst.op {
+	case inst_eq, inst_neq, inst_re, inst_nre, inst_glob, inst_nglob,
+		inst_lt, inst_lte, inst_gt, inst_gte:
+		tkey := q.strs.list[n.inst.s1]
+		for _, u := range tkeys {
+			if bytes.Equal(u, tkey) {
+				return tkeys
+			}
+		}
+		return append(tkeys, tkey)
+	case inst_not:
+		if q.isAbsence(n) {
+			return tkeys
+		}
+		return q.exprKeys(tkeys, n.l)
+	case inst_union, inst_inter:
+		return q.exprKeys(q.exprKeys(tkeys, n.l), n.r)
+	default:
+		return tkeys
+	}
+}
+
+// formatKeys writes the comma separated tag keys as they are stored in the
+// program as a list of literals.
+func (q *Q) formatKeys(b *strings.Builder, tkeys []byte) {
+	for first := true; len(tkeys) > 0; first = false {
+		var tkey []byte
+		tkey, _, tkeys = metrics.PopTag(tkeys)
+		if !first {
+			b.WriteByte(',')
+		}
+		appendKey(b, tkey)
+	}
+}
+
+// appendKey writes the tag key stored in the program as an unquoted literal.
+func appendKey(b *strings.Builder, tkey []byte) {
+	for _, c := range metrics.AppendUnescaped(nil, tkey) {
+		if isSpecial(c) {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+}
+
+// appendQuoted writes the value as a double quoted literal.
+func appendQuoted(b *strings.Builder, value []byte) {
+	b.WriteByte('"')
+	for _, c := range value {
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+}
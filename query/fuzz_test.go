@@ -3,21 +3,72 @@ package query
 import (
 	"testing"
 
+	"github.com/zeebo/assert"
+
 	"github.com/histdb/histdb/memindex"
+	"github.com/histdb/histdb/metrics"
 )
 
 func FuzzParseQuery(f *testing.F) {
 	f.Add(b(`(foo=foo & bar=wif) | (baz=baz & bar=baz)`))
 	f.Add(b(`{foo=foo & bar=wif} | ({baz,bar | baz=baz} & {baz,bar | bar=baz})`))
 	f.Add(b(`|`))
+	f.Add(b(`{status >= 500, version < 1.12.0}`))
+	f.Add(b(`!{svc=api & !canary} | !(!{a|})`))
+	f.Add(b(`{foo =~ '^(foo|wif)$' & bar=baz} | {foo=foo & foo=foo} % {bar !* a}`))
+	f.Add(b(`{foo =~ ^baz$ | bar =~ 'a|b'} ^ {foo,bar|} & !{baz|}`))
 
 	var idx memindex.T
+	for _, foo := range []string{"", "foo", "wif", "baz"} {
+		for _, bar := range []string{"", "wif", "baz", "a"} {
+			for _, baz := range []string{"", "baz", "b"} {
+				var metric []byte
+				for _, tag := range [][2]string{{"foo", foo}, {"bar", bar}, {"baz", baz}} {
+					if tag[1] == "" {
+						continue
+					} else if len(metric) > 0 {
+						metric = append(metric, ',')
+					}
+					metric = metrics.AppendTag(metric, []byte(tag[0]), []byte(tag[1]))
+				}
+				idx.Add(metric, nil, nil)
+			}
+		}
+	}
+	idx.Add([]byte("foo=foo,foo=wif,status=500,version=1.12.0"), nil, nil)
+	idx.Add([]byte("svc=api,canary=true,a=1"), nil, nil)
+
 	var q Q
 
 	f.Fuzz(func(t *testing.T, query []byte) {
-		err := Parse(query, &q)
-		if err == nil {
-			_ = q.Eval(&idx)
+		if Parse(query, &q) == nil {
+			assert.That(t, q.Eval(&idx).Equals(q.run(&idx)))
 		}
 	})
 }
+
+func FuzzFormatQuery(f *testing.F) {
+	f.Add(b(`(foo=foo & bar=wif) | (baz=baz & bar=baz)`))
+	f.Add(b(`{foo=foo & bar=wif} | ({baz,bar | baz=baz} & {baz,bar | bar=baz})`))
+	f.Add(b(`{status >= 500, version < 1.12.0}`))
+	f.Add(b(`!{svc=api & !canary} | !(!{a|})`))
+	f.Add(b(`name = \(*Dir\).Commit & path =~ "^/api/v1/\\w+"`))
+	f.Add(b(`{foo\= | foo\= = 'a,b' | ! ~x} % {x\,y,z|}`))
+
+	var q, r Q
+
+	f.Fuzz(func(t *testing.T, query []byte) {
+		if Parse(query, &q) != nil {
+			return
+		}
+
+		formatted := q.Format()
+		if len(formatted) > 1<<15 {
+			return
+		}
+
+		assert.NoError(t, Parse([]byte(formatted), &r))
+		assert.Equal(t, r.String(), q.String())
+		assert.Equal(t, r.Format(), formatted)
+	})
+}
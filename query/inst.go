@@ -29,36 +29,52 @@ const (
 	inst_glob  // push(sel(glob,  strs[i.arg1], strs[i.arg2]))
 	inst_nglob // push(sel(nglob, strs[i.arg1], strs[i.arg2]))
 
+	inst_lt  // push(sel(lt,  strs[i.arg1], mchs[i.arg2]))
+	inst_lte // push(sel(lte, strs[i.arg1], mchs[i.arg2]))
+	inst_gt  // push(sel(gt,  strs[i.arg1], mchs[i.arg2]))
+	inst_gte // push(sel(gte, strs[i.arg1], mchs[i.arg2]))
+
 	// binary operators
 	inst_union   // push(pop() | pop())
 	inst_inter   // push(pop() & pop())
 	inst_symdiff // push(pop() ^ pop())
 	inst_modulo  // push(pop() % pop())
-)
 
-func (i inst) String() string {
-	var prefix string
+	// unary operators
+	inst_not // push(all &^ pop())
+)
 
-	switch i.op {
+// opName returns the name of the operator of an instruction.
+func opName(op byte) string {
+	switch op {
 	case inst_nop:
 		return "nop"
 	case inst_tags:
-		return fmt.Sprintf("(tags %d)", i.s1)
+		return "tags"
 
 	case inst_eq:
-		prefix = "(sel eq "
+		return "eq"
 	case inst_neq:
-		prefix = "(sel neq "
+		return "neq"
 
 	case inst_re:
-		prefix = "(sel re "
+		return "re"
 	case inst_nre:
-		prefix = "(sel nre "
+		return "nre"
 
 	case inst_glob:
-		prefix = "(sel glob "
+		return "glob"
 	case inst_nglob:
-		prefix = "(sel nglob "
+		return "nglob"
+
+	case inst_lt:
+		return "lt"
+	case inst_lte:
+		return "lte"
+	case inst_gt:
+		return "gt"
+	case inst_gte:
+		return "gte"
 
 	case inst_union:
 		return "union"
@@ -68,10 +84,23 @@ func (i inst) String() string {
 		return "symdiff"
 	case inst_modulo:
 		return "modulo"
+	case inst_not:
+		return "not"
 
 	default:
-		prefix = fmt.Sprintf("(op%d ", i.op)
+		return fmt.Sprintf("op%d", op)
 	}
+}
 
-	return fmt.Sprintf("%s%d %d)", prefix, i.s1, i.s2)
+func (i inst) String() string {
+	switch i.op {
+	case inst_nop, inst_union, inst_inter, inst_symdiff, inst_modulo, inst_not:
+		return opName(i.op)
+	case inst_tags:
+		return fmt.Sprintf("(tags %d)", i.s1)
+	case inst_eq, inst_neq, inst_re, inst_nre, inst_glob, inst_nglob, inst_lt, inst_lte, inst_gt, inst_gte:
+		return fmt.Sprintf("(sel %s %d %d)", opName(i.op), i.s1, i.s2)
+	default:
+		return fmt.Sprintf("(%s %d %d)", opName(i.op), i.s1, i.s2)
+	}
 }
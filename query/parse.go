@@ -5,6 +5,8 @@ import (
 	"regexp"
 
 	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/val"
 )
 
 type parseState struct {
@@ -81,6 +83,7 @@ func Parse(query []byte, into *Q) error {
 	into.prog = into.prog[:0]
 	into.strs.reset()
 	into.mchs = into.mchs[:0]
+	into.tkeys.reset()
 
 	ps := &parseState{
 		query: query,
@@ -91,8 +94,7 @@ func Parse(query []byte, into *Q) error {
 		return errs.Errorf("bad parse: %q", query)
 	}
 
-	// TODO: escaping values is problematic. {name = \(*Dir\).Commit} vs {name = "\(*Dir\).Commit"}
-	// TODO: escaping tkeys is problematic.  {foo\= = 'bar'}
+	into.optimize()
 
 	return nil
 }
@@ -136,6 +138,15 @@ func (ps *parseState) peekSelConjugate() (op byte) {
 func (ps *parseState) parseSel() (ok bool) {
 	skipInter := false
 
+	if ps.peek() == token_not {
+		ps.tokn++
+		if !ps.parseSel() {
+			return false
+		}
+		ps.pushOp(inst_not)
+		return true
+	}
+
 	if ps.peek() == token_lparen {
 		return ps.parseSelGroup()
 	}
@@ -192,6 +203,12 @@ done:
 
 	ps.tlock = false
 
+	// an expression of only absences and negations requires no tag keys, so
+	// there is nothing to intersect it with.
+	if !skipInter && len(ps.into.tkeys.list) == 0 {
+		return true
+	}
+
 	// store and reset tags for next selection
 	tn := ps.into.strs.add(bytes.Join(ps.into.tkeys.list, []byte{','}))
 	ps.into.tkeys.reset()
@@ -255,6 +272,11 @@ func (ps *parseState) peekCompConjugate() (op byte) {
 }
 
 func (ps *parseState) parseComp() bool {
+	if ps.peek() == token_not {
+		ps.tokn++
+		return ps.parseNegatedComp()
+	}
+
 	if ps.peek() == token_lparen {
 		return ps.parseCompGroup()
 	}
@@ -276,6 +298,8 @@ func (ps *parseState) parseComp() bool {
 		val, ok = ps.parseRegexp()
 	case inst_glob, inst_nglob:
 		val, ok = ps.parseGlob()
+	case inst_lt, inst_lte, inst_gt, inst_gte:
+		val, ok = ps.parseOrdered(op)
 	default:
 		val, ok = ps.parseValue()
 	}
@@ -287,6 +311,39 @@ func (ps *parseState) parseComp() bool {
 	return true
 }
 
+// parseNegatedComp parses what follows a '!' in an expression: either a
+// group that is negated, or a tag key that must be absent. the tag key is not
+// added to the tag keys of the selection because metrics without it are the
+// ones that match.
+func (ps *parseState) parseNegatedComp() bool {
+	switch tok := ps.peek(); {
+	case tok == token_not:
+		ps.tokn++
+		if !ps.parseNegatedComp() {
+			return false
+		}
+
+	case tok == token_lparen:
+		if !ps.parseCompGroup() {
+			return false
+		}
+
+	case tok.isLiteral() && !tok.isQuoted():
+		lit := tok.literal(ps.query)
+		if len(lit) == 0 {
+			return false
+		}
+		ps.tokn++
+		ps.pushInst(inst_tags, ps.into.strs.add(indexKey(lit)), -1)
+
+	default:
+		return false
+	}
+
+	ps.pushOp(inst_not)
+	return true
+}
+
 func (ps *parseState) parseCompComparison() (op byte) {
 	switch tok := ps.next(); tok {
 	case token_eq1, token_eq2:
@@ -304,6 +361,15 @@ func (ps *parseState) parseCompComparison() (op byte) {
 	case token_nglob:
 		return inst_nglob
 
+	case token_lt:
+		return inst_lt
+	case token_lte:
+		return inst_lte
+	case token_gt:
+		return inst_gt
+	case token_gte:
+		return inst_gte
+
 	default:
 		return 0
 	}
@@ -335,7 +401,7 @@ func (ps *parseState) parseGlob() (int16, bool) {
 	if len(lit) == 0 {
 		return 0, false
 	}
-	lits := string(lit)
+	lits := string(unescape(lit))
 
 	glob, ok := makeGlob(lits)
 	if !ok {
@@ -343,7 +409,7 @@ func (ps *parseState) parseGlob() (int16, bool) {
 	}
 
 	ps.into.mchs = append(ps.into.mchs, matcher{
-		fn: glob,
+		fn: unescaped(glob),
 		k:  "glob",
 		q:  lits,
 	})
@@ -361,7 +427,7 @@ func (ps *parseState) parseRegexp() (int16, bool) {
 	if len(lit) == 0 {
 		return 0, false
 	}
-	lits := string(lit)
+	lits := string(unescape(lit))
 
 	re, err := regexp.Compile(lits)
 	if err != nil {
@@ -369,7 +435,7 @@ func (ps *parseState) parseRegexp() (int16, bool) {
 	}
 
 	ps.into.mchs = append(ps.into.mchs, matcher{
-		fn: re.Match,
+		fn: unescaped(re.Match),
 		k:  "re",
 		q:  lits,
 	})
@@ -377,6 +443,50 @@ func (ps *parseState) parseRegexp() (int16, bool) {
 	return int16(len(ps.into.mchs) - 1), true
 }
 
+// parseOrdered types the literal with val.ParseLiteral and adds a matcher for
+// the values of the tag that compare to it with the operator. Values that can
+// not be compared to the literal, like words when the literal is a number, do
+// not match.
+func (ps *parseState) parseOrdered(op byte) (int16, bool) {
+	tok := ps.next()
+	if !tok.isLiteral() {
+		return 0, false
+	}
+
+	lit := tok.literal(ps.query)
+	if len(lit) == 0 {
+		return 0, false
+	}
+	lits := string(unescape(lit))
+
+	var k string
+	var cmp func(x, y val.T) bool
+	switch op {
+	case inst_lt:
+		k, cmp = "lt", val.LT
+	case inst_lte:
+		k, cmp = "lte", val.LTE
+	case inst_gt:
+		k, cmp = "gt", val.GT
+	case inst_gte:
+		k, cmp = "gte", val.GTE
+	default:
+		return 0, false
+	}
+
+	like := val.ParseLiteral([]byte(lits))
+	ps.into.mchs = append(ps.into.mchs, matcher{
+		fn: unescaped(func(value []byte) bool {
+			v, l, ok := val.ParseLike(value, like)
+			return ok && cmp(v, l)
+		}),
+		k: k,
+		q: lits,
+	})
+
+	return int16(len(ps.into.mchs) - 1), true
+}
+
 func (ps *parseState) parseValue() (int16, bool) {
 	tok := ps.next()
 	if !tok.isLiteral() {
@@ -388,13 +498,11 @@ func (ps *parseState) parseValue() (int16, bool) {
 		return 0, false
 	}
 
-	// N.B.: could parse numeric values out here and put them into a val set so
-	// that we can do numeric comparisons, but that can't really be done
-	// efficiently: we have to iterate over every other tag, parse them and
-	// compare them so it's skipped in the name of avoiding performance
-	// footguns, though it would be useful so just left a note here about it.
+	// N.B.: numeric comparisons are handled by parseOrdered. equality stays a
+	// byte comparison so that it can use the index directly instead of
+	// parsing and comparing every value of the tag key.
 
-	return ps.into.strs.add(lit), true
+	return ps.into.strs.add(indexValue(lit)), true
 }
 
 func (ps *parseState) peekIdent() (int16, bool) {
@@ -407,6 +515,7 @@ func (ps *parseState) peekIdent() (int16, bool) {
 	if len(lit) == 0 {
 		return 0, false
 	}
+	lit = indexKey(lit)
 
 	if !ps.tkey(lit) {
 		return 0, false
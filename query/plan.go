@@ -0,0 +1,517 @@
+package query
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/histdb/histdb/memindex"
+	"github.com/histdb/histdb/metrics"
+)
+
+// the plan is the program as a tree that Eval can run in whatever order is
+// cheapest for the index it is given. it is built once by Parse:
+//
+//	- nested unions and intersections are flattened into one node
+//	- duplicate selectors become one node that is only evaluated once
+//	- tag keys intersected with a selector on the same key are dropped
+//	- regexes matching one of a set of whole literals become equalities
+//
+// Eval then runs the operands of intersections from the smallest estimated
+// cardinality to the largest, stops at the first empty result, and filters
+// the values of regexes and globs only for the metrics still remaining.
+
+type pnode struct {
+	_ [0]func() // no equality
+
+	op   byte
+	s1   int16
+	s2   int16
+	kids []int16
+	refs int16
+}
+
+func isFilter(op byte) bool {
+	switch op {
+	case inst_re, inst_nre, inst_glob, inst_nglob, inst_lt, inst_lte, inst_gt, inst_gte:
+		return true
+	default:
+		return false
+	}
+}
+
+func isSelector(op byte) bool {
+	return op == inst_eq || op == inst_neq || isFilter(op)
+}
+
+// optimize builds the plan from the program.
+func (q *Q) optimize() {
+	q.plan = q.plan[:0]
+	q.pkids = q.pkids[:0]
+	q.proot = -1
+	q.pshare = false
+	if q.pcons == nil {
+		q.pcons = make(map[string]int16)
+	}
+	clear(q.pcons)
+
+	stack := q.pstack[:0]
+	pop := func() (n int16) {
+		n, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		return n
+	}
+
+	for _, i := range q.prog {
+		switch i.op {
+		case inst_nop:
+
+		case inst_re:
+			alts, ok := literalAlternation(q.mchs[i.s2].q)
+			if !ok {
+				stack = append(stack, q.pleaf(i.op, i.s1, i.s2))
+				break
+			}
+			kids := make([]int16, 0, len(alts))
+			for _, alt := range alts {
+				s2 := q.strs.add(metrics.AppendTagValue(nil, []byte(alt)))
+				kids = append(kids, q.pleaf(inst_eq, i.s1, s2))
+			}
+			stack = append(stack, q.pbranch(inst_union, kids...))
+
+		case inst_union, inst_inter, inst_symdiff, inst_modulo:
+			r, l := pop(), pop()
+			stack = append(stack, q.pbranch(i.op, l, r))
+
+		case inst_not:
+			n := pop()
+			if q.plan[n].op == inst_not {
+				stack = append(stack, q.plan[n].kids[0])
+			} else {
+				stack = append(stack, q.pbranch(i.op, n))
+			}
+
+		default:
+			stack = append(stack, q.pleaf(i.op, i.s1, i.s2))
+		}
+	}
+	q.pstack = stack
+
+	if len(stack) != 1 {
+		return
+	}
+	q.proot = stack[0]
+
+	// count the references so that Eval knows which nodes to keep results for.
+	var count func(n int16)
+	count = func(n int16) {
+		if q.plan[n].refs++; q.plan[n].refs > 1 {
+			q.pshare = true
+			return
+		}
+		for _, k := range q.plan[n].kids {
+			count(k)
+		}
+	}
+	count(q.proot)
+}
+
+// pleaf returns the node for the selector or tags.
+func (q *Q) pleaf(op byte, s1, s2 int16) int16 {
+	key := make([]byte, 0, 16)
+	key = append(key, op, byte(s1), byte(s1>>8))
+	if isFilter(op) {
+		key = append(key, q.mchs[s2].q...)
+	} else {
+		key = append(key, byte(s2), byte(s2>>8))
+	}
+	return q.intern(key, pnode{op: op, s1: s1, s2: s2})
+}
+
+// pbranch returns the node for the operator applied to the nodes.
+func (q *Q) pbranch(op byte, kids ...int16) int16 {
+	if op == inst_union || op == inst_inter {
+		var flat []int16
+		for _, k := range kids {
+			if q.plan[k].op == op {
+				flat = append(flat, q.plan[k].kids...)
+			} else {
+				flat = append(flat, k)
+			}
+		}
+		slices.Sort(flat)
+		kids = slices.Compact(flat)
+
+		if op == inst_inter {
+			var keep []int16
+			for _, k := range kids {
+				if !q.implied(k, kids) {
+					keep = append(keep, k)
+				}
+			}
+			kids = keep
+		}
+		if len(kids) == 1 {
+			return kids[0]
+		}
+	}
+
+	key := make([]byte, 0, 1+2*len(kids))
+	key = append(key, op)
+	for _, k := range kids {
+		key = append(key, byte(k), byte(k>>8))
+	}
+
+	q.pkids = append(q.pkids, kids...)
+	return q.intern(key, pnode{op: op, kids: q.pkids[len(q.pkids)-len(kids):]})
+}
+
+func (q *Q) intern(key []byte, n pnode) int16 {
+	if k, ok := q.pcons[string(key)]; ok {
+		return k
+	}
+	k := int16(len(q.plan))
+	q.plan = append(q.plan, n)
+	q.pcons[string(key)] = k
+	return k
+}
+
+// implied returns true if the node is a set of tag keys that another node in
+// the intersection only returns metrics with.
+func (q *Q) implied(n int16, kids []int16) bool {
+	if q.plan[n].op != inst_tags {
+		return false
+	}
+	tkeys := q.strs.list[q.plan[n].s1]
+	if len(tkeys) == 0 {
+		return false
+	}
+	for len(tkeys) > 0 {
+		var tkey []byte
+		tkey, _, tkeys = metrics.PopTag(tkeys)
+		if !slices.ContainsFunc(kids, func(k int16) bool {
+			return k != n && q.hasKey(k, tkey)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasKey returns true if every metric the node returns has the tag key.
+func (q *Q) hasKey(n int16, tkey []byte) bool {
+	switch pn := &q.plan[n]; {
+	case isSelector(pn.op):
+		return bytes.Equal(q.strs.list[pn.s1], tkey)
+	case pn.op == inst_inter:
+		return slices.ContainsFunc(pn.kids, func(k int16) bool { return q.hasKey(k, tkey) })
+	case pn.op == inst_union:
+		return !slices.ContainsFunc(pn.kids, func(k int16) bool { return !q.hasKey(k, tkey) })
+	default:
+		return false
+	}
+}
+
+// literalAlternation returns the literals if the regex only matches values
+// equal to one of them, like ^(a|b|c)$. unanchored regexes also match values
+// containing the literals, so they are not rewritten.
+func literalAlternation(re string) (alts []string, ok bool) {
+	switch {
+	case strings.HasPrefix(re, "^(?:") && strings.HasSuffix(re, ")$"):
+		re = re[4 : len(re)-2]
+	case strings.HasPrefix(re, "^(") && strings.HasSuffix(re, ")$"):
+		re = re[2 : len(re)-2]
+	case strings.HasPrefix(re, "^") && strings.HasSuffix(re, "$"):
+		re = re[1 : len(re)-1]
+		if strings.Contains(re, "|") {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	// the replacement character matches invalid utf8 that is not equal.
+	if strings.ContainsRune(re, utf8.RuneError) {
+		return nil, false
+	}
+
+	var alt []byte
+	for i := 0; i <= len(re); i++ {
+		if i == len(re) || re[i] == '|' {
+			if len(alt) == 0 {
+				return nil, false
+			}
+			alts = append(alts, string(alt))
+			alt = alt[:0]
+			continue
+		}
+
+		switch c := re[i]; c {
+		case '\\':
+			i++
+			if i >= len(re) || !isPunct(re[i]) {
+				return nil, false
+			}
+			alt = append(alt, re[i])
+		case '.', '+', '*', '?', '(', ')', '[', ']', '{', '}', '^', '$':
+			return nil, false
+		default:
+			alt = append(alt, c)
+		}
+	}
+
+	return alts, true
+}
+
+func isPunct(c byte) bool {
+	return c < 0x80 && c > ' ' && c != 0x7f &&
+		!('0' <= c && c <= '9') && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z')
+}
+
+// evaluator runs the plan against an index.
+type evaluator struct {
+	_ [0]func() // no equality
+
+	q    *Q
+	m    *memindex.T
+	buf  []byte
+	ests []int
+	memo []*memindex.Bitmap
+
+	// set by Explain to record the steps of the evaluation. see explain.go.
+	x     *Explanation
+	depth int
+	scans int
+}
+
+// Eval returns the metrics in the index that match the query.
+func (q *Q) Eval(m *memindex.T) *memindex.Bitmap {
+	if q.proot < 0 || int(q.proot) >= len(q.plan) {
+		return new(memindex.Bitmap)
+	}
+	e := newEvaluator(q, m)
+	return e.eval(q.proot)
+}
+
+func newEvaluator(q *Q, m *memindex.T) *evaluator {
+	e := &evaluator{
+		q:    q,
+		m:    m,
+		buf:  make([]byte, 0, 32),
+		ests: make([]int, len(q.plan)),
+	}
+	for i := range e.ests {
+		e.ests[i] = -1
+	}
+	if q.pshare {
+		e.memo = make([]*memindex.Bitmap, len(q.plan))
+	}
+	return e
+}
+
+// estimate returns an upper bound on the number of metrics the node returns.
+func (e *evaluator) estimate(n int16) (est int) {
+	if e.ests[n] >= 0 {
+		return e.ests[n]
+	}
+	defer func() { e.ests[n] = est }()
+
+	total := e.m.Cardinality()
+	pn := &e.q.plan[n]
+
+	switch pn.op {
+	case inst_tags:
+		tkeys := e.q.strs.list[pn.s1]
+		if len(tkeys) == 0 {
+			return e.m.TagKeyCardinality(tkeys)
+		}
+		est = total
+		for len(tkeys) > 0 {
+			var tkey []byte
+			tkey, _, tkeys = metrics.PopTag(tkeys)
+			est = min(est, e.m.TagKeyCardinality(tkey))
+		}
+		return est
+
+	case inst_eq:
+		e.buf = appendTag(e.buf[:0], e.q.strs.list[pn.s1], e.q.strs.list[pn.s2])
+		return e.m.TagCardinality(e.buf)
+
+	case inst_inter:
+		est = total
+		for _, k := range pn.kids {
+			est = min(est, e.estimate(k))
+		}
+		return est
+
+	case inst_union, inst_symdiff:
+		for _, k := range pn.kids {
+			est = min(total, est+e.estimate(k))
+		}
+		return est
+
+	case inst_modulo:
+		return e.estimate(pn.kids[0])
+
+	case inst_not:
+		return total
+
+	default:
+		return e.m.TagKeyCardinality(e.q.strs.list[pn.s1])
+	}
+}
+
+// eval returns the metrics of the node in a bitmap the caller owns.
+func (e *evaluator) eval(n int16) *memindex.Bitmap {
+	if e.memo == nil || e.q.plan[n].refs < 2 {
+		return e.compute(n)
+	}
+	if e.memo[n] == nil {
+		e.memo[n] = e.compute(n)
+	} else {
+		e.reuse(n, e.memo[n])
+	}
+	return e.memo[n].Clone()
+}
+
+// view calls cb with the metrics of the node in a bitmap it must not modify.
+func (e *evaluator) view(n int16, cb func(*memindex.Bitmap)) {
+	switch pn := &e.q.plan[n]; {
+	case e.memo != nil && pn.refs > 1:
+		if e.memo[n] == nil {
+			e.memo[n] = e.compute(n)
+		} else {
+			e.reuse(n, e.memo[n])
+		}
+		cb(e.memo[n])
+	case pn.kids == nil && e.x != nil:
+		sp := e.begin(n)
+		e.query(n, func(bm *memindex.Bitmap) {
+			e.end(sp, bm)
+			cb(bm)
+		})
+	case pn.kids == nil:
+		e.query(n, cb)
+	default:
+		cb(e.compute(n))
+	}
+}
+
+func (e *evaluator) compute(n int16) *memindex.Bitmap {
+	sp := e.begin(n)
+	acc := e.exec(n)
+	e.end(sp, acc)
+	return acc
+}
+
+func (e *evaluator) exec(n int16) *memindex.Bitmap {
+	pn := &e.q.plan[n]
+
+	switch pn.op {
+	case inst_inter:
+		return e.inter(pn.kids)
+
+	case inst_union:
+		acc := new(memindex.Bitmap)
+		for _, k := range pn.kids {
+			if e.estimate(k) > 0 {
+				e.view(k, acc.Or)
+			} else {
+				e.skip(k)
+			}
+		}
+		return acc
+
+	case inst_symdiff:
+		acc := e.eval(pn.kids[0])
+		e.view(pn.kids[1], acc.Xor)
+		return acc
+
+	case inst_modulo:
+		acc := e.eval(pn.kids[0])
+		if !acc.IsEmpty() && e.estimate(pn.kids[1]) > 0 {
+			e.view(pn.kids[1], acc.AndNot)
+		} else {
+			e.skip(pn.kids[1])
+		}
+		return acc
+
+	case inst_not:
+		// ids are dense, so every metric is in [0, cardinality).
+		acc := e.eval(pn.kids[0])
+		acc.Flip(0, uint64(e.m.Cardinality()))
+		return acc
+
+	default:
+		acc := new(memindex.Bitmap)
+		e.query(n, acc.Or)
+		return acc
+	}
+}
+
+// inter intersects the nodes from the smallest estimate to the largest.
+func (e *evaluator) inter(kids []int16) *memindex.Bitmap {
+	kids = slices.Clone(kids)
+	slices.SortStableFunc(kids, func(a, b int16) int {
+		return e.estimate(a) - e.estimate(b)
+	})
+
+	if e.estimate(kids[0]) == 0 {
+		for _, k := range kids {
+			e.skip(k)
+		}
+		return new(memindex.Bitmap)
+	}
+
+	acc := e.eval(kids[0])
+	for i, k := range kids[1:] {
+		if acc.IsEmpty() {
+			for _, k := range kids[1+i:] {
+				e.skip(k)
+			}
+			break
+		}
+
+		// filters only need to check the values of the remaining metrics
+		// unless their result is kept for another node.
+		switch pn := &e.q.plan[k]; {
+		case e.memo != nil && pn.refs > 1:
+			e.view(k, acc.And)
+		case pn.op == inst_nre || pn.op == inst_nglob:
+			sp := e.begin(k)
+			e.m.AndFilterNot(acc, e.q.strs.list[pn.s1], e.fn(pn))
+			e.endFilter(sp, acc)
+		case isFilter(pn.op):
+			sp := e.begin(k)
+			e.m.AndFilter(acc, e.q.strs.list[pn.s1], e.fn(pn))
+			e.endFilter(sp, acc)
+		default:
+			e.view(k, acc.And)
+		}
+	}
+	return acc
+}
+
+// query calls cb with the metrics of the selector or tags from the index.
+func (e *evaluator) query(n int16, cb func(*memindex.Bitmap)) {
+	q, pn := e.q, &e.q.plan[n]
+
+	switch pn.op {
+	case inst_tags:
+		e.m.QueryTrue(q.strs.list[pn.s1], cb)
+
+	case inst_eq:
+		e.buf = appendTag(e.buf[:0], q.strs.list[pn.s1], q.strs.list[pn.s2])
+		e.m.QueryEqual(e.buf, cb)
+
+	case inst_neq:
+		e.buf = appendTag(e.buf[:0], q.strs.list[pn.s1], q.strs.list[pn.s2])
+		e.m.QueryNotEqual(q.strs.list[pn.s1], e.buf, cb)
+
+	case inst_re, inst_glob, inst_lt, inst_lte, inst_gt, inst_gte:
+		e.m.QueryFilter(q.strs.list[pn.s1], e.fn(pn), cb)
+
+	case inst_nre, inst_nglob:
+		e.m.QueryFilterNot(q.strs.list[pn.s1], e.fn(pn), cb)
+	}
+}
@@ -0,0 +1,129 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb/memindex"
+)
+
+func TestLiteralAlternation(t *testing.T) {
+	check := func(re string, exp ...string) {
+		t.Helper()
+		alts, ok := literalAlternation(re)
+		assert.Equal(t, ok, exp != nil)
+		assert.Equal(t, alts, exp)
+	}
+
+	check(`^(a|b|c)$`, "a", "b", "c")
+	check(`^(?:api|web)$`, "api", "web")
+	check(`^(*Dir\)\.Commit$`)
+	check(`^\(\*Dir\)\.Commit$`, "(*Dir).Commit")
+	check(`^/api/v1$`, "/api/v1")
+	check(`a|b|c`)
+	check(`^a|b$`)
+	check(`^(a|)$`)
+	check(`^(a|b)|(c)$`)
+	check(`^(a.b)$`)
+	check(`^(\d)$`)
+	check(`^(?i:a)$`)
+	check(`^(a)$|^(b)$`)
+}
+
+func TestPlan(t *testing.T) {
+	var idx memindex.T
+	for _, metric := range []string{
+		"host=a,svc=api",
+		"host=b,svc=api",
+		"host=c,svc=web",
+		"host=d,svc=rare",
+		"host=e",
+	} {
+		idx.Add([]byte(metric), nil, nil)
+	}
+
+	// plan returns the reachable nodes of the plan and the metrics it finds.
+	plan := func(query string) (string, string) {
+		var q Q
+		assert.NoError(t, Parse([]byte(query), &q))
+
+		var b strings.Builder
+		var walk func(n int16)
+		walk = func(n int16) {
+			pn := &q.plan[n]
+			if pn.kids == nil {
+				// leaves print like (sel eq 0 0) or (tags 0).
+				fields := strings.Fields(strings.Trim(inst{op: pn.op}.String(), "()"))
+				if fields[0] == "sel" {
+					fields = fields[1:]
+				}
+				b.WriteString(fields[0])
+				return
+			}
+			fmt.Fprintf(&b, "(%s", inst{op: pn.op})
+			for _, k := range pn.kids {
+				b.WriteByte(' ')
+				walk(k)
+			}
+			b.WriteByte(')')
+		}
+		walk(q.proot)
+
+		bm := q.Eval(&idx)
+		assert.That(t, bm.Equals(q.run(&idx)))
+		return b.String(), bm.String()
+	}
+
+	check := func(query, expPlan, expMetrics string) {
+		t.Helper()
+		gotPlan, gotMetrics := plan(query)
+		assert.Equal(t, gotPlan, expPlan)
+		assert.Equal(t, gotMetrics, expMetrics)
+	}
+
+	check(`svc=api`, `eq`, `{0,1}`)
+	check(`{svc|}`, `tags`, `{0,1,2,3}`)
+	check(`svc=api & svc=api`, `eq`, `{0,1}`)
+	check(`{svc=api} | {svc=api & host=a}`, `(union eq (inter eq eq))`, `{0,1}`)
+	check(`{host =~ '^(a|c)$'}`, `(union eq eq)`, `{0,2}`)
+	check(`{host =~ 'a|c'}`, `re`, `{0,2}`)
+	check(`{host =~ '.*'} & {svc = rare}`, `(inter re eq)`, `{3}`)
+	check(`{host =~ '.*'} & {svc = missing}`, `(inter re eq)`, `{}`)
+	check(`{host,svc | host != a}`, `(inter neq tags)`, `{1,2,3}`)
+	check(`!!{svc=web}`, `eq`, `{2}`)
+	check(`{svc=api} % {host=a}`, `(modulo eq eq)`, `{1}`)
+}
+
+func BenchmarkEval(b *testing.B) {
+	var idx memindex.T
+	for i := range 20000 {
+		idx.Add(fmt.Appendf(nil, "host=h%d,service=s%d", i, i%100), nil, nil)
+	}
+	idx.Add([]byte("host=h0,service=rare"), nil, nil)
+
+	for _, query := range []string{
+		`{host =~ '.*'} & {service = rare}`,
+		`{host =~ '^(h1|h2|h3)$'}`,
+		`{host = h7 & service = s7}`,
+	} {
+		var q Q
+		assert.NoError(b, Parse([]byte(query), &q))
+
+		b.Run(query+"/Prog", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				_ = q.run(&idx)
+			}
+		})
+
+		b.Run(query+"/Plan", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				_ = q.Eval(&idx)
+			}
+		})
+	}
+}
@@ -13,9 +13,17 @@ type Q struct {
 	strs bytesSet
 	mchs []matcher
 
+	// the optimized program that Eval runs. see plan.go.
+	plan   []pnode
+	pkids  []int16
+	proot  int16
+	pshare bool
+
 	// memory cache for parsing
-	toks  []token
-	tkeys bytesSet
+	toks   []token
+	tkeys  bytesSet
+	pcons  map[string]int16
+	pstack []int16
 }
 
 func (q *Q) String() string {
@@ -26,73 +34,47 @@ func (q *Q) String() string {
 		if i > 0 {
 			b.WriteByte(' ')
 		}
-
-		switch inst.op {
-		case inst_nop:
-			b.WriteString("nop")
-		case inst_tags:
-			b.WriteString("(tags ")
-			b.Write(q.strs.list[inst.s1])
-			b.WriteString(")")
-
-		case inst_eq:
-			b.WriteString("(sel eq ")
-			b.Write(q.strs.list[inst.s1])
-			b.WriteByte(' ')
-			b.Write(q.strs.list[inst.s2])
-			b.WriteByte(')')
-		case inst_neq:
-			b.WriteString("(sel neq ")
-			b.Write(q.strs.list[inst.s1])
-			b.WriteByte(' ')
-			b.Write(q.strs.list[inst.s2])
-			b.WriteByte(')')
-
-		case inst_re:
-			b.WriteString("(sel re")
-			b.Write(q.strs.list[inst.s1])
-			b.WriteByte(' ')
-			b.WriteString(q.mchs[inst.s2].q)
-			b.WriteByte(')')
-		case inst_nre:
-			b.WriteString("(sel nre")
-			b.Write(q.strs.list[inst.s1])
-			b.WriteByte(' ')
-			b.WriteString(q.mchs[inst.s2].q)
-			b.WriteByte(')')
-
-		case inst_glob:
-			b.WriteString("(sel glob")
-			b.Write(q.strs.list[inst.s1])
-			b.WriteByte(' ')
-			b.WriteString(q.mchs[inst.s2].q)
-			b.WriteByte(')')
-		case inst_nglob:
-			b.WriteString("(sel nglob")
-			b.Write(q.strs.list[inst.s1])
-			b.WriteByte(' ')
-			b.WriteString(q.mchs[inst.s2].q)
-			b.WriteByte(')')
-
-		case inst_union:
-			b.WriteString("union")
-		case inst_inter:
-			b.WriteString("inter")
-		case inst_symdiff:
-			b.WriteString("symdiff")
-		case inst_modulo:
-			b.WriteString("modulo")
-
-		default:
-			b.WriteString("unknown")
-		}
+		q.writeInst(&b, inst.op, inst.s1, inst.s2)
 	}
 	b.WriteString("))")
 
 	return b.String()
 }
 
-func (q *Q) Eval(m *memindex.T) *memindex.Bitmap {
+// writeInst writes the instruction with the strings and matchers it uses.
+func (q *Q) writeInst(b *strings.Builder, op byte, s1, s2 int16) {
+	switch op {
+	case inst_tags:
+		b.WriteString("(tags ")
+		b.Write(q.strs.list[s1])
+		b.WriteByte(')')
+
+	case inst_eq, inst_neq:
+		b.WriteString("(sel ")
+		b.WriteString(opName(op))
+		b.WriteByte(' ')
+		b.Write(q.strs.list[s1])
+		b.WriteByte(' ')
+		b.Write(q.strs.list[s2])
+		b.WriteByte(')')
+
+	case inst_re, inst_nre, inst_glob, inst_nglob, inst_lt, inst_lte, inst_gt, inst_gte:
+		b.WriteString("(sel ")
+		b.WriteString(opName(op))
+		b.WriteByte(' ')
+		b.Write(q.strs.list[s1])
+		b.WriteByte(' ')
+		b.WriteString(q.mchs[s2].q)
+		b.WriteByte(')')
+
+	default:
+		b.WriteString(opName(op))
+	}
+}
+
+// run evaluates the program as it was parsed, without the plan. Eval returns
+// the same metrics.
+func (q *Q) run(m *memindex.T) *memindex.Bitmap {
 	buf := make([]byte, 0, 32)
 	stack := make([]*memindex.Bitmap, 1, 8)
 	stack[0] = new(memindex.Bitmap)
@@ -128,7 +110,7 @@ func (q *Q) Eval(m *memindex.T) *memindex.Bitmap {
 	}
 
 	for _, i := range q.prog {
-		switch i.op & 15 {
+		switch i.op & 31 {
 		case inst_nop:
 
 		case inst_tags:
@@ -142,7 +124,7 @@ func (q *Q) Eval(m *memindex.T) *memindex.Bitmap {
 			buf = appendTag(buf[:0], q.strs.list[i.s1], q.strs.list[i.s2])
 			m.QueryNotEqual(q.strs.list[i.s1], buf, push().Or)
 
-		case inst_re, inst_glob:
+		case inst_re, inst_glob, inst_lt, inst_lte, inst_gt, inst_gte:
 			m.QueryFilter(q.strs.list[i.s1], q.mchs[i.s2].fn, push().Or)
 		case inst_nre, inst_nglob:
 			m.QueryFilterNot(q.strs.list[i.s1], q.mchs[i.s2].fn, push().Or)
@@ -162,6 +144,10 @@ func (q *Q) Eval(m *memindex.T) *memindex.Bitmap {
 		case inst_modulo:
 			b := pop() // pop() must sequence before top()
 			top().AndNot(b)
+
+		case inst_not:
+			// ids are dense, so every metric is in [0, cardinality).
+			top().Flip(0, uint64(m.Cardinality()))
 		}
 	}
 
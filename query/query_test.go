@@ -1,12 +1,14 @@
 package query
 
 import (
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/zeebo/assert"
 
 	"github.com/histdb/histdb/memindex"
+	"github.com/histdb/histdb/metrics"
 )
 
 func TestQuery(t *testing.T) {
@@ -52,6 +54,192 @@ func TestQuery(t *testing.T) {
 	// })
 }
 
+func TestQueryOrdered(t *testing.T) {
+	var idx memindex.T
+
+	for _, metric := range []string{
+		"status=200,version=1.9.0",
+		"status=404,version=1.12.0",
+		"status=500,version=1.12.3",
+		"status=503,version=v2.0",
+		"status=5.5e2,version=dev",
+		"status=error",
+		"path=a<b",
+		"build=1.9",
+		"build=1.13",
+	} {
+		idx.Add([]byte(metric), nil, nil)
+	}
+
+	run := func(query string) (out []string) {
+		var q Q
+		assert.NoError(t, Parse([]byte(query), &q))
+
+		var name []byte
+		memindex.Iter(q.Eval(&idx), func(id memindex.Id) bool {
+			name, _ = idx.AppendNameById(id, name[:0])
+			out = append(out, string(name))
+			return true
+		})
+		slices.Sort(out)
+		return out
+	}
+
+	assert.Equal(t, run("status >= 500"), []string{
+		"status=5.5e2,version=dev",
+		"status=500,version=1.12.3",
+		"status=503,version=v2.0",
+	})
+	assert.Equal(t, run("status < 404"), []string{"status=200,version=1.9.0"})
+	assert.Equal(t, run("{status <= 404.5}"), []string{
+		"status=200,version=1.9.0",
+		"status=404,version=1.12.0",
+	})
+	assert.Equal(t, run("version >= 1.12.0"), []string{
+		"status=404,version=1.12.0",
+		"status=500,version=1.12.3",
+		"status=503,version=v2.0",
+	})
+	assert.Equal(t, run("version > v1.12 & status < 510"), []string{
+		"status=500,version=1.12.3",
+		"status=503,version=v2.0",
+	})
+	assert.Equal(t, run("status > 'd'"), []string{"status=error"})
+
+	// a two part literal compares as a version to values that can only be
+	// versions, and a leading v makes it a version for every value.
+	assert.Equal(t, run("version >= 1.12"), []string{
+		"status=404,version=1.12.0",
+		"status=500,version=1.12.3",
+		"status=503,version=v2.0",
+	})
+	assert.Equal(t, run("{version < 1.12}"), []string{"status=200,version=1.9.0"})
+	assert.Equal(t, run("build >= v1.12"), []string{"build=1.13"})
+
+	// values are only split at the ordering operators after a tag key.
+	assert.Equal(t, run("path == a<b"), []string{"path=a<b"})
+	assert.Equal(t, run("path<a<c"), []string{"path=a<b"})
+
+	var q Q
+	assert.Error(t, Parse([]byte("status >"), &q))
+	assert.Error(t, Parse([]byte("status < >= 5"), &q))
+}
+
+func TestQueryNegation(t *testing.T) {
+	var idx memindex.T
+
+	for _, metric := range []string{
+		"svc=api,canary=true",
+		"svc=api,host=a",
+		"svc=web,host=a",
+		"svc=web,host=b,canary=false",
+		"other=x",
+	} {
+		idx.Add([]byte(metric), nil, nil)
+	}
+
+	run := func(query string) (out []string) {
+		var q Q
+		assert.NoError(t, Parse([]byte(query), &q))
+
+		var name []byte
+		memindex.Iter(q.Eval(&idx), func(id memindex.Id) bool {
+			name, _ = idx.AppendNameById(id, name[:0])
+			out = append(out, string(name))
+			return true
+		})
+		slices.Sort(out)
+		return out
+	}
+
+	assert.Equal(t, run("!canary"), []string{"host=a,svc=api", "host=a,svc=web", "other=x"})
+	assert.Equal(t, run("{svc | !canary}"), []string{"host=a,svc=api", "host=a,svc=web"})
+	assert.Equal(t, run("svc=web & !canary"), []string{"host=a,svc=web"})
+	assert.Equal(t, run("svc=api & !!canary"), []string{"canary=true,svc=api"})
+	assert.Equal(t, run("{!(svc=api | host=b)}"), []string{"host=a,svc=web"})
+	assert.Equal(t, run("!{svc|}"), []string{"other=x"})
+	assert.Equal(t, run("!({svc=api} | {host=a})"), []string{"canary=false,host=b,svc=web", "other=x"})
+	assert.Equal(t, run("{svc|} & !{host=a}"), []string{"canary=false,host=b,svc=web", "canary=true,svc=api"})
+	assert.Equal(t, run("!{}"), []string{
+		"canary=false,host=b,svc=web",
+		"canary=true,svc=api",
+		"host=a,svc=api",
+		"host=a,svc=web",
+		"other=x",
+	})
+
+	var q Q
+	assert.Error(t, Parse([]byte("!"), &q))
+	assert.Error(t, Parse([]byte("{svc | !'quoted'}"), &q))
+	assert.Error(t, Parse([]byte("{svc | ! = 2}"), &q))
+}
+
+func TestQueryEscaping(t *testing.T) {
+	var idx memindex.T
+
+	for _, tag := range [][2]string{
+		{"name", "(*Dir).Commit"},
+		{"name", "(*File).Sync"},
+		{"path", "/api/v1/users?id=1"},
+		{"path", "/a,b"},
+		{"foo=", "bar"},
+		{"a,b", `c\d`},
+	} {
+		idx.Add(metrics.AppendTag(nil, []byte(tag[0]), []byte(tag[1])), nil, nil)
+	}
+
+	run := func(query string) (out []string) {
+		var q Q
+		assert.NoError(t, Parse([]byte(query), &q))
+
+		var name []byte
+		memindex.Iter(q.Eval(&idx), func(id memindex.Id) bool {
+			name, _ = idx.AppendNameById(id, name[:0])
+			out = append(out, string(name))
+			return true
+		})
+		slices.Sort(out)
+		return out
+	}
+
+	assert.Equal(t, run(`name = \(*Dir\).Commit`), []string{`name=(*Dir).Commit`})
+	assert.Equal(t, run(`name = "(*Dir).Commit"`), []string{`name=(*Dir).Commit`})
+	assert.Equal(t, run(`name =* '\(*'`), []string{`name=(*Dir).Commit`, `name=(*File).Sync`})
+	assert.Equal(t, run(`path = /api/v1/users?id\=1`), []string{`path=/api/v1/users?id=1`})
+	assert.Equal(t, run(`path = "/a,b"`), []string{`path=/a\,b`})
+	assert.Equal(t, run(`path =~ "^/a,"`), []string{`path=/a\,b`})
+	assert.Equal(t, run(`foo\= = bar`), []string{`foo\==bar`})
+	assert.Equal(t, run(`{foo\= |}`), []string{`foo\==bar`})
+	assert.Equal(t, run(`a\,b = 'c\\d'`), []string{`a\,b=c\\d`})
+	assert.Equal(t, run(`{a\,b | !name}`), []string{`a\,b=c\\d`})
+	assert.Equal(t, run(`{path | !a\,b}`), []string{`path=/a\,b`, `path=/api/v1/users?id=1`})
+}
+
+func TestQueryFormat(t *testing.T) {
+	check := func(query, formatted string) {
+		t.Helper()
+
+		var q, r Q
+		assert.NoError(t, Parse([]byte(query), &q))
+		assert.Equal(t, q.Format(), formatted)
+		assert.NoError(t, Parse([]byte(formatted), &r))
+		assert.Equal(t, r.String(), q.String())
+	}
+
+	check(`foo=bar`, `{foo == "bar"}`)
+	check(`a=1 & (b=2 | c=3)`, `{a == "1" & (b == "2" | c == "3")}`)
+	check(`{b,a | a=1}`, `{b,a | a == "1"}`)
+	check(`{a|} | {b|} & {}`, `{a |} | {b |} & {}`)
+	check(`{a|} | ({b|} & {c=1})`, `{a |} | ({b |} & {c == "1"})`)
+	check(`!{a=1} ^ !(!{b|} % {c|})`, `!{a == "1"} ^ !({!b} % {c |})`)
+	check(`{svc,host | !canary & !(host =~ '^a')}`, `{svc,host | !canary & !(host =~ "^a")}`)
+	check(`!!canary`, `{!!canary}`)
+	check(`! ~x`, `{! ~x}`)
+	check(`v >= 1.2.0, s < 500`, `{v >= "1.2.0" & s < "500"}`)
+	check(`name = \(*Dir\).Commit`, `{name == "(*Dir).Commit"}`)
+	check(`foo\= = 'a,"b"\\'`, `{foo\= == "a,\"b\"\\"}`)
+}
+
 func BenchmarkQuery(b *testing.B) {
 	var idx memindex.T
 
@@ -21,6 +21,8 @@ const (
 	token_nre   token = '!'<<8 | '~'
 	token_glob  token = '='<<8 | '*'
 	token_nglob token = '!'<<8 | '*'
+	token_lte   token = '<'<<8 | '='
+	token_gte   token = '>'<<8 | '='
 
 	token_lparen token = '('
 	token_rparen token = ')'
@@ -32,6 +34,9 @@ const (
 	token_mod    token = '%'
 	token_xor    token = '^'
 	token_comma  token = ','
+	token_lt     token = '<'
+	token_gt     token = '>'
+	token_not    token = '!'
 )
 
 func (t token) isLiteral() bool { return t&(1<<31) != 0 }
@@ -64,8 +69,9 @@ func tokens(x []byte, cb func(token)) error {
 	if uint(len(x)) > 1<<15 {
 		return errs.Errorf("query too long")
 	}
+	value := false
 	for pos := uint(0); uint(pos) < uint(len(x)); {
-		t, n := nextToken(pos, x)
+		t, n := nextToken(pos, x, value)
 		if n == 0 {
 			return errs.Errorf("invalid token: %q", x[pos:])
 		} else if t == token_invalid {
@@ -73,11 +79,29 @@ func tokens(x []byte, cb func(token)) error {
 		}
 		cb(t)
 		pos += n
+		value = t.isComparison()
 	}
 	return nil
 }
 
-func nextToken(pos uint, x []byte) (t token, l uint) {
+// isComparison returns true if the token is followed by a tag value.
+func (t token) isComparison() bool {
+	switch t {
+	case
+		token_eq1, token_eq2, token_neq,
+		token_re, token_nre,
+		token_glob, token_nglob,
+		token_lt, token_lte, token_gt, token_gte:
+		return true
+	default:
+		return false
+	}
+}
+
+// nextToken returns the token at pos. If value is true, the token is in the
+// position of a tag value, where the ordering operators are not recognized so
+// that values like a<b or -> did not need escaping before they existed.
+func nextToken(pos uint, x []byte, value bool) (t token, l uint) {
 	if pos >= uint(len(x)) {
 		return token_invalid, 0
 	}
@@ -114,6 +138,11 @@ func nextToken(pos uint, x []byte) (t token, l uint) {
 		return token_invalid, 0
 	}
 
+	// ordering operators are only valid after a tag key
+	if value && (x[0] == '<' || x[0] == '>') {
+		goto literal
+	}
+
 	// length 2 operators
 	if len(x) > 1 {
 		switch u := uint16(x[0])<<8 | uint16(x[1]); u {
@@ -121,7 +150,8 @@ func nextToken(pos uint, x []byte) (t token, l uint) {
 			'&'<<8 | '&', '|'<<8 | '|', // conjunctives
 			'='<<8 | '=', '!'<<8 | '=', // equality
 			'='<<8 | '~', '!'<<8 | '~', // regex
-			'='<<8 | '*', '!'<<8 | '*': // glob
+			'='<<8 | '*', '!'<<8 | '*', // glob
+			'<'<<8 | '=', '>'<<8 | '=': // ordering
 			return token(u), l + 2
 		}
 	}
@@ -134,11 +164,14 @@ func nextToken(pos uint, x []byte) (t token, l uint) {
 		'&', '|', // sel      conjunctives
 		'{', '}', // sel      selection delims
 		'%', '^', // sel      sel operators
+		'<', '>', // expr     ordering
+		'!', /**/ // both     negation and tag key absence
 		',': /**/ // sel      tag key separator & conjunction
 		return token(x[0]), l + 1
 	}
 
-	// tag keys
+literal:
+	// tag keys and values
 	for i := uint(0); i < uint(len(x)); i++ {
 		c := x[i]
 		if c == '\\' {
@@ -163,11 +196,11 @@ func nextToken(pos uint, x []byte) (t token, l uint) {
 		// but we need to parse the escapes out when we pass it
 		// down to the query layer. the decision here is to make
 		// that the job of the parser, not the tokenizer.
-		// that means the tokenizer can assume proper escaping
-		// and the parser is responsible for constructing an
-		// accurate query.
+		// that means the tokenizer only checks that escapes are
+		// well formed and the parser unescapes the literal and
+		// escapes it again the way metrics.AppendTag does.
 
-		if isSpecial(c) {
+		if isSpecial(c) && !(value && (c == '<' || c == '>')) {
 			return token(1<<31 | pos<<16 | i), l + i
 		}
 	}
@@ -184,6 +217,7 @@ func isSpecial(x byte) bool {
 		'{', '}', // selection
 		'(', ')', // grouping
 		'%', '^', // sel operators
+		'<', '>', // ordering
 		',',       // tag key separator
 		'\\',      // escape character
 		'"', '\'': // quoted strings
@@ -22,6 +22,11 @@ var tokenCases = []struct {
 	8:  {`'foo\''` /*                */, []string{`foo\'`}},
 	9:  {`'foo\\'` /*                */, []string{`foo\\`}},
 	10: {`  foo="foo"  ` /*          */, []string{`foo`, `=`, `foo`}},
+	11: {`{a>=5,b<6|c<=7&d>8}` /*    */, []string{`{`, `a`, `>=`, `5`, `,`, `b`, `<`, `6`, `|`, `c`, `<=`, `7`, `&`, `d`, `>`, `8`, `}`}},
+	12: {`!{a!=b & !c}` /*           */, []string{`!`, `{`, `a`, `!=`, `b`, `&`, `!`, `c`, `}`}},
+	13: {`{a == b<c>, d<e}` /*       */, []string{`{`, `a`, `==`, `b<c>`, `,`, `d`, `<`, `e`, `}`}},
+	14: {`a =~ <.*> | b<=->` /*      */, []string{`a`, `=~`, `<.*>`, `|`, `b`, `<=`, `->`}},
+	15: {`a\<b == \>` /*             */, []string{`a\<b`, `==`, `\>`}},
 }
 
 func TestToken(t *testing.T) {
@@ -1,6 +1,11 @@
 package query
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/histdb/histdb/metrics"
+)
 
 func appendTag(buf, tkey, tval []byte) []byte {
 	buf = append(buf, tkey...)
@@ -9,6 +14,43 @@ func appendTag(buf, tkey, tval []byte) []byte {
 	return buf
 }
 
+// unescape returns the literal with the query escapes removed.
+func unescape(lit []byte) []byte {
+	if bytes.IndexByte(lit, '\\') == -1 {
+		return lit
+	}
+	return metrics.AppendUnescaped(nil, lit)
+}
+
+// indexKey returns the literal as a tag key escaped the way the index stores
+// it, which is how metrics.AppendTag escapes it.
+func indexKey(lit []byte) []byte {
+	if bytes.IndexAny(lit, `\,=`) == -1 {
+		return lit
+	}
+	return metrics.AppendTagKey(nil, unescape(lit))
+}
+
+// indexValue returns the literal as a tag value escaped the way the index
+// stores it, which is how metrics.AppendTag escapes it.
+func indexValue(lit []byte) []byte {
+	if bytes.IndexAny(lit, `\,`) == -1 {
+		return lit
+	}
+	return metrics.AppendTagValue(nil, unescape(lit))
+}
+
+// unescaped wraps a matcher so that it sees the tag values from the index
+// without their escapes, like they were observed.
+func unescaped(fn func([]byte) bool) func([]byte) bool {
+	return func(value []byte) bool {
+		if bytes.IndexByte(value, '\\') != -1 {
+			value = metrics.AppendUnescaped(nil, value)
+		}
+		return fn(value)
+	}
+}
+
 type matcher struct {
 	_ [0]func() // no equality
 
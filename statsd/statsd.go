@@ -0,0 +1,176 @@
+// Package statsd receives StatsD and DogStatsD timings and histograms over
+// UDP into a store.
+//
+// Lines have the form
+//
+//	<name>:<value>[:<value>...]|<type>[|@<rate>][|#<tag>[:<value>],...][|<field>...]
+//
+// and a packet holds any number of lines separated by newlines. Only the ms,
+// h and d types are observed; counters, gauges, sets, events and service
+// checks are ignored. A line becomes a metric with a `__name__` tag holding
+// its name and a tag for every DogStatsD tag, split at the first ':'. Unknown
+// DogStatsD fields like container ids and timestamps are ignored.
+//
+// A value sent with a sample rate stands for 1/rate values, so it is observed
+// that many times. Fractional weights are rounded up or down at random so
+// that the expected count is exact.
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/metrics"
+	"github.com/histdb/histdb/store"
+)
+
+// maxPacketSize is the largest UDP payload.
+const maxPacketSize = 64 << 10
+
+// T observes the timings in StatsD packets into a store.
+type T struct {
+	_ [0]func() // no equality
+
+	st *store.T
+
+	invalid atomic.Uint64
+}
+
+// Init sets the store observations are added to.
+func (t *T) Init(st *store.T) {
+	t.st = st
+	t.invalid.Store(0)
+}
+
+// Invalid returns the number of lines that could not be parsed.
+func (t *T) Invalid() uint64 { return t.invalid.Load() }
+
+// Serve reads packets from the connection until it is closed. It returns nil
+// if the connection was closed.
+func (t *T) Serve(conn net.PacketConn) error {
+	buf := make([]byte, maxPacketSize)
+	var metric []byte
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if n > 0 {
+			metric = t.handle(buf[:n], metric)
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return errs.Wrap(err)
+		}
+	}
+}
+
+// Handle observes every line in the packet.
+func (t *T) Handle(packet []byte) { t.handle(packet, nil) }
+
+func (t *T) handle(packet, metric []byte) []byte {
+	for len(packet) > 0 {
+		var line []byte
+		line, packet, _ = bytes.Cut(packet, []byte("\n"))
+
+		var ok bool
+		if metric, ok = t.line(bytes.TrimSpace(line), metric[:0]); !ok {
+			t.invalid.Add(1)
+		}
+	}
+	return metric
+}
+
+// line observes the values in the line using metric as scratch space. It
+// returns false if the line is invalid.
+func (t *T) line(line, metric []byte) ([]byte, bool) {
+	if len(line) == 0 || line[0] == '_' { // events and service checks
+		return metric, true
+	}
+
+	head, fields, ok := bytes.Cut(line, []byte("|"))
+	if !ok {
+		return metric, false
+	}
+	name, values, ok := bytes.Cut(head, []byte(":"))
+	if !ok || len(name) == 0 || len(values) == 0 {
+		return metric, false
+	}
+
+	typ, fields, _ := bytes.Cut(fields, []byte("|"))
+	switch string(typ) {
+	case "ms", "h", "d":
+	case "c", "g", "s":
+		return metric, true
+	default:
+		return metric, false
+	}
+
+	rate := 1.
+	metric = metrics.AppendTag(metric, []byte("__name__"), name)
+
+	for len(fields) > 0 {
+		var field []byte
+		field, fields, _ = bytes.Cut(fields, []byte("|"))
+
+		switch {
+		case len(field) > 0 && field[0] == '@':
+			r, err := strconv.ParseFloat(string(field[1:]), 64)
+			if err != nil || !(r > 0 && r <= 1) {
+				return metric, false
+			}
+			rate = r
+
+		case len(field) > 0 && field[0] == '#':
+			for tags := field[1:]; len(tags) > 0; {
+				var tag []byte
+				tag, tags, _ = bytes.Cut(tags, []byte(","))
+				if len(tag) == 0 {
+					continue
+				}
+				tkey, value, _ := bytes.Cut(tag, []byte(":"))
+				metric = append(metric, ',')
+				metric = metrics.AppendTag(metric, tkey, value)
+			}
+		}
+	}
+
+	// check every value before observing any so an invalid line is dropped
+	// as a whole.
+	for pass := range 2 {
+		for rest := values; len(rest) > 0; {
+			var value []byte
+			value, rest, _ = bytes.Cut(rest, []byte(":"))
+			v, err := strconv.ParseFloat(string(value), 32)
+			if err != nil {
+				return metric, false
+			} else if pass == 0 {
+				continue
+			}
+
+			if rate == 1 {
+				t.st.Observe(metric, float32(v))
+			} else if w := weight(rate); w > 0 {
+				t.st.ObserveN(metric, float32(v), w)
+			}
+		}
+	}
+
+	return metric, true
+}
+
+// weight returns the number of times to observe a value sent with the sample
+// rate, rounding at random so that its expected value is 1/rate.
+func weight(rate float64) uint64 {
+	w, frac := math.Modf(1 / rate)
+	if rand.Float64() < frac {
+		w++
+	}
+	return uint64(w)
+}
@@ -0,0 +1,142 @@
+package statsd
+
+import (
+	"math"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/zeebo/assert"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/query"
+	"github.com/histdb/histdb/store"
+	"github.com/histdb/histdb/testhelp"
+)
+
+func newTestStore(t *testing.T) (*store.T, func()) {
+	fs, cleanup := testhelp.FS(t)
+
+	st := new(store.T)
+	assert.NoError(t, st.Init(fs, store.Config{}))
+
+	return st, func() {
+		assert.NoError(t, st.Close())
+		cleanup()
+	}
+}
+
+// totals writes a level and returns the total and sum of every metric in it.
+func totals(t *testing.T, st *store.T, ts uint32) (map[string]uint64, map[string]float64) {
+	assert.NoError(t, st.WriteLevel(ts, 1))
+
+	var q query.Q
+	assert.NoError(t, query.Parse([]byte("{__name__|}"), &q))
+
+	counts := make(map[string]uint64)
+	sums := make(map[string]float64)
+	_, err := st.QueryData(&q, ts, ts+1, func(key histdb.Key, name []byte, s *flathist.S, h flathist.H) bool {
+		counts[string(name)], sums[string(name)], _, _ = s.Summary(h)
+		return true
+	})
+	assert.NoError(t, err)
+	return counts, sums
+}
+
+func TestHandle(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var sd T
+	sd.Init(st)
+
+	sd.Handle([]byte("" +
+		"rpc.latency:10|ms\n" +
+		"rpc.latency:20:30|ms|#env:prod,route:/a=b,canary\n" +
+		"rpc.latency:4|h|@0.5|#env:prod,route:/a=b,canary|c:abc|T1656581400\n" +
+		"queue.size:7|d|@0.25\r\n" +
+		"\n" +
+		"requests:1|c\n" +
+		"depth:3|g|#env:prod\n" +
+		"users:bob|s\n" +
+		"_e{5,4}:title|text\n" +
+		"_sc|check|0\n"))
+	assert.Equal(t, sd.Invalid(), 0)
+
+	for _, bad := range []string{
+		"rpc.latency",
+		"rpc.latency:10",
+		"rpc.latency:|ms",
+		"rpc.latency:x|ms",
+		"rpc.latency:1:x|ms",
+		"rpc.latency:1|zz",
+		"rpc.latency:1|ms|@0",
+		"rpc.latency:1|ms|@2",
+		":1|ms",
+	} {
+		sd.Handle([]byte(bad))
+	}
+	assert.Equal(t, sd.Invalid(), 9)
+
+	counts, sums := totals(t, st, 1)
+	assert.Equal(t, len(counts), 3)
+
+	const tagged = "__name__=rpc.latency,canary,env=prod,route=/a=b"
+	assert.Equal(t, counts["__name__=rpc.latency"], 1)
+	assert.Equal(t, counts[tagged], 4)
+	assert.That(t, math.Abs(sums[tagged]-58) < 1)
+	assert.Equal(t, counts["__name__=queue.size"], 4)
+}
+
+func TestWeight(t *testing.T) {
+	assert.Equal(t, weight(1), 1)
+	assert.Equal(t, weight(0.5), 2)
+	assert.Equal(t, weight(0.125), 8)
+
+	var total uint64
+	for range 10000 {
+		w := weight(0.4)
+		assert.That(t, w == 2 || w == 3)
+		total += w
+	}
+	assert.That(t, math.Abs(float64(total)/10000-2.5) < 0.05)
+}
+
+func TestServe(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var sd T
+	sd.Init(st)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() { done <- sd.Serve(conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer func() { _ = client.Close() }()
+
+	for range 10 {
+		_, err = client.Write([]byte("rpc:1|ms\nrpc:2|ms|#env:prod"))
+		assert.NoError(t, err)
+	}
+
+	// the packets are handled in order, so once the invalid line is counted
+	// every packet before it has been observed.
+	_, err = client.Write([]byte("invalid"))
+	assert.NoError(t, err)
+	for sd.Invalid() == 0 {
+		runtime.Gosched()
+	}
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, <-done)
+
+	counts, _ := totals(t, st, 1)
+	assert.Equal(t, counts["__name__=rpc"], 10)
+	assert.Equal(t, counts["__name__=rpc,env=prod"], 10)
+}
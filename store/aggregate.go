@@ -0,0 +1,106 @@
+package store
+
+import (
+	"bytes"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/metrics"
+	"github.com/histdb/histdb/pdqsort"
+	"github.com/histdb/histdb/query"
+)
+
+// Aggregation holds the merged histograms returned by QueryAggregate. The
+// histograms are stored in S so the usual flathist functions like Quantile
+// can be used on them.
+type Aggregation struct {
+	_ [0]func() // no equality
+
+	S       flathist.S
+	Buckets []Bucket // sorted by group and then start
+}
+
+// Bucket is the histogram of every value in a group with a timestamp in
+// [Start, Start+step).
+type Bucket struct {
+	Group []byte // the tags of the group by tag keys in order, comma separated
+	Start uint32
+	H     flathist.H
+}
+
+type bucketKey struct {
+	group string
+	start uint32
+}
+
+// QueryAggregate merges every value matching the query with a timestamp in
+// [from, to) into one histogram per group and step sized bucket. Values are
+// grouped by the tags of the metric with the tag keys in by, and a metric
+// without one of the tag keys has an empty entry in its group. A step of zero
+// puts every value in a single bucket starting at from.
+func (t *T) QueryAggregate(q *query.Q, from, to, step uint32, by [][]byte) (*Aggregation, error) {
+	agg := new(Aggregation)
+	buckets := make(map[bucketKey]int)
+
+	var lname, group []byte
+	_, err := t.QueryData(q, from, to, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+		// values for a metric are delivered together, so the group only has
+		// to be computed when the name changes.
+		if lname == nil || !bytes.Equal(name, lname) {
+			lname = append(lname[:0], name...)
+			group = appendGroup(group[:0], name, by)
+		}
+
+		start := from
+		if step > 0 {
+			start += (key.Timestamp() - from) / step * step
+		}
+
+		bk := bucketKey{group: string(group), start: start}
+		i, ok := buckets[bk]
+		if !ok {
+			i = len(agg.Buckets)
+			buckets[bk] = i
+			agg.Buckets = append(agg.Buckets, Bucket{
+				Group: []byte(bk.group),
+				Start: start,
+				H:     agg.S.New(),
+			})
+		}
+
+		flathist.Merge(&agg.S, agg.Buckets[i].H, st, h)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	agg.S.Finalize()
+
+	pdqsort.Less(agg.Buckets, func(i, j int) bool {
+		bi, bj := &agg.Buckets[i], &agg.Buckets[j]
+		if c := bytes.Compare(bi.Group, bj.Group); c != 0 {
+			return c < 0
+		}
+		return bi.Start < bj.Start
+	})
+
+	return agg, nil
+}
+
+// appendGroup appends the tags in the metric with the tag keys in by.
+func appendGroup(group, metric []byte, by [][]byte) []byte {
+	for i, tkey := range by {
+		if i > 0 {
+			group = append(group, ',')
+		}
+		for rest := metric; len(rest) > 0; {
+			var mtkey, tag []byte
+			mtkey, tag, rest = metrics.PopTag(rest)
+			if bytes.Equal(mtkey, tkey) {
+				group = append(group, tag...)
+				break
+			}
+		}
+	}
+	return group
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"slices"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/card"
+	"github.com/histdb/histdb/leveln"
+	"github.com/histdb/histdb/memindex"
+	"github.com/histdb/histdb/metrics"
+	"github.com/histdb/histdb/pdqsort"
+)
+
+// fixedHash returns the hash of the metric with every tag passed through the
+// fixer and empty tags removed. It hashes the same as adding the metric to a
+// memindex with the fixer, so the tag key hash is of the tag key before it is
+// fixed even if the fixer rewrites the tag to have a different key.
+func fixedHash(metric []byte, cf *card.Fixer, seen []histdb.TagHash) (histdb.Hash, []histdb.TagHash) {
+	var hash histdb.Hash
+	tagPtr := hash.TagHashPtr()
+	tkeyPtr := hash.TagKeyHashPtr()
+
+	seen = seen[:0]
+	for rest := metric; len(rest) > 0; {
+		var tkey, tag []byte
+		tkey, tag, rest = metrics.PopTag(rest)
+		if tag = cf.Fix(tkey, tag); len(tag) == 0 {
+			continue
+		}
+
+		// duplicate tags are only added once.
+		tagh := histdb.NewTagHash(tag)
+		if slices.Contains(seen, tagh) {
+			continue
+		}
+		seen = append(seen, tagh)
+
+		tkeyPtr.Add(histdb.NewTagKeyHash(tkey))
+		tagPtr.Add(tagh)
+	}
+	return hash, seen
+}
+
+type fixSeries struct {
+	hash histdb.Hash // hash after fixing
+	old  histdb.Hash // hash in the level
+	iter int         // index of the level
+}
+
+// fixRemap returns the hash every series in the levels has after passing its
+// name through the fixer and the series sorted by that hash. The map is nil if
+// no hashes change, in which case the levels can be merged in order.
+func fixRemap(lns []*levelN, cf *card.Fixer) (map[histdb.Hash]histdb.Hash, []fixSeries, error) {
+	remap := make(map[histdb.Hash]histdb.Hash)
+	var series []fixSeries
+	var name []byte
+	var seen []histdb.TagHash
+	changed := false
+
+	for i, ln := range lns {
+		if !ln.idx.Iterate(func(id memindex.Id) bool {
+			old, ok := ln.idx.GetHashById(id)
+			if !ok {
+				return false
+			}
+			hash, ok := remap[old]
+			if !ok {
+				name, ok = ln.idx.AppendNameById(id, name[:0])
+				if !ok {
+					return false
+				}
+				hash, seen = fixedHash(name, cf, seen)
+				remap[old] = hash
+				changed = changed || hash != old
+			}
+			series = append(series, fixSeries{hash: hash, old: old, iter: i})
+			return true
+		}) {
+			return nil, nil, errs.Errorf("memindex inconsistent")
+		}
+	}
+	if !changed {
+		return nil, nil, nil
+	}
+
+	pdqsort.Less(series, func(i, j int) bool {
+		si, sj := &series[i], &series[j]
+		if si.hash != sj.hash {
+			return string(si.hash[:]) < string(sj.hash[:])
+		} else if si.iter != sj.iter {
+			return si.iter < sj.iter
+		}
+		return string(si.old[:]) < string(sj.old[:])
+	})
+
+	return remap, series, nil
+}
+
+type fixEntry struct {
+	key  histdb.Key
+	iter int
+	voff int
+	vlen int
+}
+
+// fixIter iterates over the values in the levels in the order of the fixed
+// hashes. The keys still have the hash from their level. All of the values
+// for series that are fixed into the same hash are read into memory and sorted
+// by timestamp so that they can be merged.
+type fixIter struct {
+	_ [0]func() // no equality
+
+	its    []leveln.Iterator
+	series []fixSeries
+	ents   []fixEntry
+	vals   []byte
+	pos    int
+	err    error
+}
+
+func (f *fixIter) Init(lns []*levelN, series []fixSeries) {
+	f.its = make([]leveln.Iterator, len(lns))
+	for i := range lns {
+		f.its[i].Init(lns[i].fh.keys, lns[i].fh.vals)
+	}
+	f.series = series
+	f.ents = f.ents[:0]
+	f.vals = f.vals[:0]
+	f.pos = 0
+	f.err = nil
+}
+
+func (f *fixIter) Err() error      { return f.err }
+func (f *fixIter) Iter() int       { return f.ents[f.pos].iter }
+func (f *fixIter) Key() histdb.Key { return f.ents[f.pos].key }
+
+func (f *fixIter) Value() []byte {
+	ent := &f.ents[f.pos]
+	return f.vals[ent.voff : ent.voff+ent.vlen]
+}
+
+func (f *fixIter) Next() bool {
+	if f.err != nil {
+		return false
+	}
+	if f.pos++; f.pos < len(f.ents) {
+		return true
+	}
+
+	f.ents, f.vals, f.pos = f.ents[:0], f.vals[:0], 0
+	for len(f.ents) == 0 && len(f.series) > 0 {
+		hash := f.series[0].hash
+		for len(f.series) > 0 && f.series[0].hash == hash {
+			if err := f.load(f.series[0]); err != nil {
+				f.err = err
+				return false
+			}
+			f.series = f.series[1:]
+		}
+	}
+
+	pdqsort.Less(f.ents, func(i, j int) bool {
+		ki, kj := &f.ents[i].key, &f.ents[j].key
+		if ki.Timestamp() != kj.Timestamp() {
+			return ki.Timestamp() < kj.Timestamp()
+		} else if ki.Duration() != kj.Duration() {
+			return ki.Duration() < kj.Duration()
+		}
+		return f.ents[i].iter < f.ents[j].iter
+	})
+
+	return len(f.ents) > 0
+}
+
+// load buffers every value for the series.
+func (f *fixIter) load(s fixSeries) error {
+	it := &f.its[s.iter]
+
+	var key histdb.Key
+	*key.HashPtr() = s.old
+	it.Seek(key)
+
+	for it.Err() == nil && it.Key().Hash() == s.old {
+		f.ents = append(f.ents, fixEntry{
+			key:  it.Key(),
+			iter: s.iter,
+			voff: len(f.vals),
+			vlen: len(it.Value()),
+		})
+		f.vals = append(f.vals, it.Value()...)
+
+		if !it.Next() {
+			break
+		}
+	}
+
+	return it.Err()
+}
@@ -4,14 +4,32 @@ import (
 	"github.com/zeebo/errs/v2"
 
 	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/card"
 	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/flathist"
 	"github.com/histdb/histdb/leveln"
 	"github.com/histdb/histdb/memindex"
 	"github.com/histdb/histdb/mergeiter"
 	"github.com/histdb/histdb/rwutils"
 )
 
-func compact(fs *filesystem.T, lns []*levelN) (_ *levelN, err error) {
+// compactSource yields the keys of the levels being compacted in order along
+// with the index of the level each key came from.
+type compactSource interface {
+	Next() bool
+	Key() histdb.Key
+	Value() []byte
+	Iter() int
+	Err() error
+}
+
+// compact merges the levels, which must be in order, into a new level spanning
+// them, dropping the values hidden by their tombstones and applying the
+// retention policy to the values if it is not nil. If the fixer is not nil,
+// the names are passed through it and series that end up with the same name
+// are merged.
+func compact(fs *filesystem.T, lns []*levelN, ret *retention, cf *card.Fixer) (_ *levelN, err error) {
 	if len(lns) == 0 {
 		return nil, errs.Errorf("must compact at least 1 leveln")
 	}
@@ -19,8 +37,8 @@ func compact(fs *filesystem.T, lns []*levelN) (_ *levelN, err error) {
 
 	its := make([]mergeiter.Iterator, len(lns))
 	for i := range lns {
-		if lns[i].low != nextLow {
-			return nil, errs.Errorf("non-contiguous lns: %d != %d", nextLow, lns[i].low)
+		if lns[i].low < nextLow {
+			return nil, errs.Errorf("overlapping lns: %d < %d", lns[i].low, nextLow)
 		}
 		nextLow = lns[i].high
 
@@ -39,38 +57,138 @@ func compact(fs *filesystem.T, lns []*levelN) (_ *levelN, err error) {
 		}
 	}()
 
+	var remap map[histdb.Hash]histdb.Hash
+	var series []fixSeries
+	if cf != nil {
+		remap, series, err = fixRemap(lns, cf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// if the fixer changes any hashes, the keys have to be reordered by the
+	// new hashes so that they are still sorted.
+	var src compactSource
+	if remap != nil {
+		fi := new(fixIter)
+		fi.Init(lns, series)
+		src = fi
+	} else {
+		mi := new(mergeiter.T)
+		mi.Init(its)
+		src = mi
+	}
+
 	var lnw leveln.Writer
-	var mi mergeiter.T
 	var name []byte
 	var w rwutils.W
 	var hash histdb.Hash
 
 	lnw.Init(ln.fh.keys, ln.fh.vals)
-	mi.Init(its)
 
-	for mi.Next() {
-		// TODO: merge values as they age?
-		// TODO: card fix is problematic because it can cause the keys to become
-		// unsorted.
+	// values are held as pending until the next key shows that they will not
+	// be merged with anything else. they are only decoded once a merge
+	// happens.
+	var (
+		pending bool
+		pkey    histdb.Key
+		pold    histdb.Hash // hash of the pending key in its level
+		pval    []byte
+		piter   int
+		merged  bool
+		pst     flathist.S
+		ph      = pst.New()
+		sst     flathist.S
+		sh      = sst.New()
+	)
 
-		key := mi.Key()
-		if key.Hash() != hash {
-			name, ok := lns[mi.Iter()].idx.AppendNameByHash(key.Hash(), name[:0])
+	decode := func(st *flathist.S, h flathist.H, value []byte) error {
+		var r rwutils.R
+		r.Init(buffer.OfLen(value))
+		st.Reset(h)
+		flathist.ReadFrom(st, h, &r)
+		_, err := r.Done()
+		return err
+	}
+
+	flush := func() error {
+		if !pending {
+			return nil
+		}
+		pending = false
+
+		if pkey.Hash() != hash {
+			var ok bool
+			name, ok = lns[piter].idx.AppendNameByHash(pold, name[:0])
 			if !ok {
-				return nil, errs.Errorf("append name failed")
+				return errs.Errorf("append name failed")
 			}
-			ln.idx.Add(name, nil, nil)
-			hash = key.Hash()
+			if added, _, _, _ := ln.idx.Add(name, nil, cf); remap != nil && added != pkey.Hash() {
+				return errs.Errorf("fixed hash mismatch for %q", name)
+			}
+			hash = pkey.Hash()
+		}
+
+		value := pval
+		if merged {
+			pst.Finalize()
+			w.Reset()
+			flathist.AppendTo(&pst, ph, &w)
+			value = w.Done().Prefix()
 		}
 
-		if err := lnw.Append(key, mi.Value()); err != nil {
-			return nil, errs.Errorf("unable to append value: %w", err)
+		if err := lnw.Append(pkey, value); err != nil {
+			return errs.Errorf("unable to append value: %w", err)
 		}
+		return nil
+	}
+
+	for src.Next() {
+		if lns[src.Iter()].deleted(src.Key()) {
+			continue
+		}
+		key, ok := ret.apply(src.Key())
+		if !ok {
+			continue
+		}
+		old := key.Hash()
+		if remap != nil {
+			*key.HashPtr() = remap[old]
+		}
+
+		if pending && absorbs(pkey, key) {
+			if !merged {
+				if err := decode(&pst, ph, pval); err != nil {
+					return nil, errs.Errorf("unable to decode value: %w", err)
+				}
+				merged = true
+			}
+			if err := decode(&sst, sh, src.Value()); err != nil {
+				return nil, errs.Errorf("unable to decode value: %w", err)
+			}
+			flathist.Merge(&pst, ph, &sst, sh)
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return nil, err
+		}
+
+		pending, pkey, pold, piter, merged = true, key, old, src.Iter(), false
+		pval = append(pval[:0], src.Value()...)
+	}
+	if err := src.Err(); err != nil {
+		return nil, errs.Errorf("unable to merge levels: %w", err)
+	}
+	if err := flush(); err != nil {
+		return nil, err
 	}
 	if err := lnw.Finish(); err != nil {
 		return nil, errs.Errorf("unable to finish leveln: %w", err)
 	}
+	ln.tmin, ln.tmax = lnw.TimeRange()
 
+	w.Reset()
 	memindex.AppendTo(&ln.idx, &w)
 	if _, err := ln.fh.indx.Write(w.Done().Prefix()); err != nil {
 		return nil, errs.Errorf("unable to write memindex: %w", err)
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"time"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/query"
+)
+
+// QueryStats is the work done by a query.
+type QueryStats struct {
+	// Levels is the number of levels that were scanned.
+	Levels int
+	// Metrics is the number of metrics the query matched summed over levels.
+	Metrics int
+	// Keys is the number of keys read for the matched metrics, including the
+	// deleted ones.
+	Keys int
+	// ValueBytes is the size of the values that were decoded.
+	ValueBytes int64
+}
+
+// Add adds the work in o to s.
+func (s *QueryStats) Add(o QueryStats) {
+	s.Levels += o.Levels
+	s.Metrics += o.Metrics
+	s.Keys += o.Keys
+	s.ValueBytes += o.ValueBytes
+}
+
+// LevelExplanation is how a query was evaluated against the index of a level.
+type LevelExplanation struct {
+	Range       LevelRange
+	Explanation query.Explanation
+}
+
+// QueryExplanation is how QueryData runs a query.
+type QueryExplanation struct {
+	Levels  []LevelExplanation
+	Stats   QueryStats
+	Elapsed time.Duration
+}
+
+// ExplainData runs the query like QueryData without delivering any values and
+// explains its evaluation against the index of every level it scans.
+func (t *T) ExplainData(q *query.Q, from, to uint32) (*QueryExplanation, error) {
+	t.qmu.RLock()
+	defer t.qmu.RUnlock()
+
+	start := time.Now()
+	qx := new(QueryExplanation)
+
+	olns := t.overlapping(from, to)
+	for _, ln := range olns {
+		qx.Levels = append(qx.Levels, LevelExplanation{
+			Range:       LevelRange{Low: ln.low, High: ln.high},
+			Explanation: q.Explain(&ln.idx),
+		})
+	}
+
+	if len(olns) > 0 {
+		_, err := t.queryLevels(olns, q, from, to, &qx.Stats, func(histdb.Key, []byte, *flathist.S, flathist.H) bool {
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	qx.Elapsed = time.Since(start)
+	return qx, nil
+}
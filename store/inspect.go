@@ -0,0 +1,173 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/leveln"
+	"github.com/histdb/histdb/memindex"
+	"github.com/histdb/histdb/pdqsort"
+	"github.com/histdb/histdb/rwutils"
+)
+
+// LevelRange is the range of generations of a level.
+type LevelRange struct {
+	Low  uint32
+	High uint32
+}
+
+// ListLevels returns the ranges of the levels in the store directory that
+// have every file, sorted by their low generation. Unlike Init, it does not
+// recover interrupted writes or modify the directory.
+func ListLevels(fs *filesystem.T) ([]LevelRange, error) {
+	fh, err := fs.OpenRead(".")
+	if err != nil {
+		return nil, errs.Errorf("unable to read store directory: %w", err)
+	}
+	defer fh.Close()
+
+	kinds := make(map[LevelRange]int)
+	for {
+		names, err := fh.Readdirnames(24)
+		for _, name := range names {
+			if strings.HasSuffix(name, filesystem.TempSuffix) {
+				continue
+			}
+			file, ok := filesystem.ParseFile(name)
+			if !ok {
+				continue
+			}
+			switch file.Kind {
+			case filesystem.KindIndx, filesystem.KindKeys, filesystem.KindVals:
+				kinds[LevelRange{Low: file.Low, High: file.High}]++
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, errs.Errorf("problem reading directory names: %w", err)
+		}
+	}
+
+	var lrs []LevelRange
+	for lr, n := range kinds {
+		if n == len(levelKinds) {
+			lrs = append(lrs, lr)
+		}
+	}
+	pdqsort.Less(lrs, func(i, j int) bool {
+		if lrs[i].Low != lrs[j].Low {
+			return lrs[i].Low < lrs[j].Low
+		}
+		return lrs[i].High < lrs[j].High
+	})
+
+	return lrs, nil
+}
+
+// Level is a level opened read only for inspection.
+type Level struct {
+	_ [0]func() // no equality
+
+	ln *levelN
+}
+
+// OpenLevel opens the level with the range for inspection.
+func OpenLevel(fs *filesystem.T, lr LevelRange) (*Level, error) {
+	ln, err := openLevelN(fs, lr.Low, lr.High)
+	if err != nil {
+		return nil, err
+	}
+	return &Level{ln: ln}, nil
+}
+
+func (l *Level) Close() error { return l.ln.Close() }
+
+func (l *Level) Range() LevelRange { return LevelRange{Low: l.ln.low, High: l.ln.high} }
+func (l *Level) Depth() int        { return l.ln.Depth() }
+
+// Index returns the memindex of the metrics in the level.
+func (l *Level) Index() *memindex.T { return &l.ln.idx }
+
+// Keys returns the keys file of the level.
+func (l *Level) Keys() filesystem.H { return l.ln.fh.keys }
+
+// TimeRange returns the smallest and largest timestamps of the keys in the
+// level. min is larger than max if the level is empty.
+func (l *Level) TimeRange() (min, max uint32) { return l.ln.tmin, l.ln.tmax }
+
+// Sizes returns the sizes of the index, keys and values files.
+func (l *Level) Sizes() (indx, keys, vals int64, err error) {
+	if indx, err = l.ln.fh.indx.Size(); err != nil {
+		return 0, 0, 0, errs.Wrap(err)
+	}
+	if keys, err = l.ln.fh.keys.Size(); err != nil {
+		return 0, 0, 0, errs.Wrap(err)
+	}
+	if vals, err = l.ln.fh.vals.Size(); err != nil {
+		return 0, 0, 0, errs.Wrap(err)
+	}
+	return indx, keys, vals, nil
+}
+
+// Iterator initializes the iterator to walk every value in the level.
+func (l *Level) Iterator(it *leveln.Iterator) { it.Init(l.ln.fh.keys, l.ln.fh.vals) }
+
+// Verify checks the checksums of the keys and values files, the layout
+// checked by leveln.Verify, that every value decodes as a histogram, and that
+// the metrics in the memindex are exactly the metrics with values.
+func (l *Level) Verify() error {
+	if err := verifyChecksum(l.ln.fh.keys, filesystem.KindKeys); err != nil {
+		return l.ln.corrupt(filesystem.KindKeys, err)
+	}
+	if err := verifyChecksum(l.ln.fh.vals, filesystem.KindVals); err != nil {
+		return l.ln.corrupt(filesystem.KindVals, err)
+	}
+
+	if err := leveln.Verify(l.ln.fh.keys, l.ln.fh.vals); err != nil {
+		return l.ln.corrupt(filesystem.KindKeys, err)
+	}
+
+	var it leveln.Iterator
+	var last histdb.Hash
+	var st flathist.S
+	h := st.New()
+	metrics := 0
+
+	for l.Iterator(&it); it.Next(); {
+		key := it.Key()
+
+		var r rwutils.R
+		r.Init(buffer.OfLen(it.Value()))
+		st.Reset(h)
+		flathist.ReadFrom(&st, h, &r)
+		if _, err := r.Done(); err != nil {
+			return l.ln.corrupt(filesystem.KindVals, errs.Errorf("value for %v does not decode: %w", key, err))
+		}
+
+		if hash := key.Hash(); metrics == 0 || hash != last {
+			if _, ok := l.ln.idx.GetIdByHash(hash); !ok {
+				return l.ln.corrupt(filesystem.KindIndx, errs.Errorf("memindex is missing %v", hash))
+			}
+			last = hash
+			metrics++
+		}
+	}
+	if err := it.Err(); err != nil {
+		return l.ln.corrupt(filesystem.KindVals, err)
+	}
+
+	if card := l.ln.idx.Cardinality(); card != metrics {
+		return l.ln.corrupt(filesystem.KindIndx, errs.Errorf("memindex has %d metrics but the keys have %d", card, metrics))
+	}
+
+	return nil
+}
@@ -1,19 +1,67 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"math/bits"
 
 	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
 
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/buffer"
 	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/leveln"
 	"github.com/histdb/histdb/memindex"
+	"github.com/histdb/histdb/rwutils"
 )
 
+// CorruptError is returned when a level file is truncated or does not match
+// its footer. Opening a level checks the checksum of the index and tombstones
+// but only the length of the keys and values, whose checksums are checked by
+// Level.Verify.
+type CorruptError struct {
+	File string
+	Err  error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("corrupt level file %s: %v", e.File, e.Err)
+}
+
+func (e *CorruptError) Unwrap() error { return e.Err }
+
+// LayoutError is returned when a level file was written by an older version
+// of histdb in a layout that can no longer be read. Migrate rewrites the files
+// of such levels in the current layout.
+type LayoutError struct {
+	File string
+}
+
+func (e *LayoutError) Error() string {
+	return fmt.Sprintf("level file %s has an unsupported layout from an older version: "+
+		"run `histdb migrate -dir <store>` while the store is not open to rewrite it", e.File)
+}
+
 type levelN struct {
 	_ [0]func() // no equality
 
-	low  uint32
-	high uint32
+	low     uint32
+	high    uint32
+	fs      *filesystem.T
+	tmp     bool // files still have their temporary names
+	renamed int  // files renamed by an Install that did not finish
+
+	// policy is the current time the retention policy was last applied to
+	// the level at, or zero if it is not known.
+	policy uint32
+
+	// tmin and tmax are the smallest and largest timestamps of the keys in
+	// the level. tmin is larger than tmax if the level is empty.
+	tmin uint32
+	tmax uint32
 
 	fh struct {
 		indx filesystem.H
@@ -22,6 +70,10 @@ type levelN struct {
 	}
 
 	idx memindex.T
+
+	// tombs hide values from queries until compaction drops them. they are
+	// sorted by hash and only replaced while holding qmu.
+	tombs []tombstone
 }
 
 func newLevelN(fs *filesystem.T, low, high uint32) (ln *levelN, err error) {
@@ -36,19 +88,22 @@ func newLevelN(fs *filesystem.T, low, high uint32) (ln *levelN, err error) {
 		}
 	}()
 
-	ln = &levelN{low: low, high: high}
+	// the files are created with temporary names so that a crash while they
+	// are being written does not leave something that looks like a level.
+	// Install renames them once they are complete.
+	ln = &levelN{low: low, high: high, fs: fs, tmp: true}
 
-	ln.fh.indx, err = fs.Create(ln.file(filesystem.KindIndx))
+	ln.fh.indx, err = fs.Create(ln.name(filesystem.KindIndx))
 	if err != nil {
 		return ln, errs.Wrap(err)
 	}
 
-	ln.fh.keys, err = fs.Create(ln.file(filesystem.KindKeys))
+	ln.fh.keys, err = fs.Create(ln.name(filesystem.KindKeys))
 	if err != nil {
 		return ln, errs.Wrap(err)
 	}
 
-	ln.fh.vals, err = fs.Create(ln.file(filesystem.KindVals))
+	ln.fh.vals, err = fs.Create(ln.name(filesystem.KindVals))
 	if err != nil {
 		return ln, errs.Wrap(err)
 	}
@@ -68,11 +123,7 @@ func openLevelN(fs *filesystem.T, low, high uint32) (ln *levelN, err error) {
 		}
 	}()
 
-	// TODO: all of these files should have some suffix block that the
-	// serialization code adds and skips during deserialization so that we
-	// can do a quick sanity check that it was fully written.
-
-	ln = &levelN{low: low, high: high}
+	ln = &levelN{low: low, high: high, fs: fs}
 
 	ln.fh.indx, err = fs.OpenRead(ln.file(filesystem.KindIndx))
 	if err != nil {
@@ -89,13 +140,138 @@ func openLevelN(fs *filesystem.T, low, high uint32) (ln *levelN, err error) {
 		return ln, errs.Wrap(err)
 	}
 
-	return ln, errs.Wrap(loadMemindex(ln.fh.indx, &ln.idx))
+	if err := ln.checkLayout(); err != nil {
+		return ln, err
+	}
+
+	// the keys and values are only checked for truncation because reading
+	// them in full to compute the checksum would make opening very slow. a
+	// changed byte is only found by Level.Verify, which histdb verify runs.
+	if _, err := readFooter(ln.fh.keys, filesystem.KindKeys); err != nil {
+		return ln, ln.corrupt(filesystem.KindKeys, err)
+	}
+	if _, err := readFooter(ln.fh.vals, filesystem.KindVals); err != nil {
+		return ln, ln.corrupt(filesystem.KindVals, err)
+	}
+	ln.tmin, ln.tmax, err = leveln.ReadTimeRange(ln.fh.keys)
+	if err != nil {
+		return ln, ln.corrupt(filesystem.KindKeys, err)
+	}
+	if err := loadMemindex(ln.fh.indx, &ln.idx); err != nil {
+		return ln, ln.corrupt(filesystem.KindIndx, err)
+	}
+	if err := ln.loadTombstones(); err != nil {
+		return ln, ln.corrupt(filesystem.KindTomb, err)
+	}
+
+	return ln, nil
+}
+
+// checkLayout returns a LayoutError if the level was written in a legacy
+// layout. only the keys and values are checked because their sizes tell the
+// layouts apart from a truncated file.
+func (ln *levelN) checkLayout() error {
+	if legacy, err := leveln.LegacyKeys(ln.fh.keys); err != nil {
+		return errs.Wrap(err)
+	} else if legacy {
+		return errs.Wrap(&LayoutError{File: ln.file(filesystem.KindKeys)})
+	}
+	if legacy, err := leveln.LegacyValues(ln.fh.vals); err != nil {
+		return errs.Wrap(err)
+	} else if legacy {
+		return errs.Wrap(&LayoutError{File: ln.file(filesystem.KindVals)})
+	}
+	return nil
+}
+
+func (ln *levelN) corrupt(kind uint8, err error) error {
+	return errs.Wrap(&CorruptError{File: ln.file(kind), Err: err})
+}
+
+// readFooter returns the footer at the end of the file after checking that it
+// is valid and matches the length of the file.
+func readFooter(fh filesystem.H, kind uint8) (histdb.Footer, error) {
+	size, err := fh.Size()
+	if err != nil {
+		return histdb.Footer{}, errs.Wrap(err)
+	} else if size < histdb.FooterSize {
+		return histdb.Footer{}, errs.Errorf("file too small for footer: %d", size)
+	}
+
+	var buf [histdb.FooterSize]byte
+	if _, err := fh.ReadAt(buf[:], size-histdb.FooterSize); err != nil {
+		return histdb.Footer{}, errs.Wrap(err)
+	}
+
+	return parseFooter(buf[:], kind, uint64(size-histdb.FooterSize))
+}
+
+// verifyChecksum checks the footer of the file and the checksum of its
+// contents, which are streamed through the hash instead of read into memory.
+func verifyChecksum(fh filesystem.H, kind uint8) error {
+	f, err := readFooter(fh, kind)
+	if err != nil {
+		return err
+	}
+
+	hasher := xxh3.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(fh, 0, int64(f.Length))); err != nil {
+		return errs.Wrap(err)
+	} else if hasher.Sum64() != f.Checksum {
+		return errs.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+// checkFooter checks that the footer at the end of data is valid and matches
+// the length of data, and optionally, the checksum.
+func checkFooter(data []byte, kind uint8, checksum bool) error {
+	if len(data) < histdb.FooterSize {
+		return errs.Errorf("file too small for footer: %d", len(data))
+	}
+
+	length := len(data) - histdb.FooterSize
+	f, err := parseFooter(data[length:], kind, uint64(length))
+	if err != nil {
+		return err
+	} else if checksum && xxh3.Hash(data[:length]) != f.Checksum {
+		return errs.Errorf("checksum mismatch")
+	}
+
+	return nil
+}
+
+func parseFooter(buf []byte, kind uint8, length uint64) (f histdb.Footer, err error) {
+	var r rwutils.R
+	r.Init(buffer.OfLen(buf))
+	f.ReadFrom(&r)
+	if _, err := r.Done(); err != nil {
+		return f, err
+	} else if f.Kind != kind {
+		return f, errs.Errorf("footer has wrong kind: %d != %d", f.Kind, kind)
+	} else if f.Length != length {
+		return f, errs.Errorf("footer has wrong length: %d != %d", f.Length, length)
+	}
+	return f, nil
 }
 
+var levelKinds = [...]uint8{filesystem.KindIndx, filesystem.KindKeys, filesystem.KindVals}
+
 func (ln *levelN) file(kind uint8) string {
 	return filesystem.File{Low: ln.low, High: ln.high, Kind: kind}.String()
 }
 
+func (ln *levelN) temp(kind uint8) string {
+	return filesystem.File{Low: ln.low, High: ln.high, Kind: kind}.TempString()
+}
+
+func (ln *levelN) name(kind uint8) string {
+	if ln.tmp {
+		return ln.temp(kind)
+	}
+	return ln.file(kind)
+}
+
 func (ln *levelN) all(cb func(h *filesystem.H) error) error {
 	return errs.Wrap(errs.Combine(
 		cb(&ln.fh.indx),
@@ -104,9 +280,84 @@ func (ln *levelN) all(cb func(h *filesystem.H) error) error {
 	))
 }
 
-func (ln *levelN) Sync() error   { return ln.all((*filesystem.H).Sync) }
-func (ln *levelN) Remove() error { return ln.all((*filesystem.H).Remove) }
-func (ln *levelN) Close() error  { return ln.all((*filesystem.H).Close) }
-func (ln *levelN) Depth() int    { return depth(ln.low, ln.high) }
+func (ln *levelN) Sync() error  { return ln.all((*filesystem.H).Sync) }
+func (ln *levelN) Close() error { return ln.all((*filesystem.H).Close) }
+func (ln *levelN) Depth() int   { return depth(ln.low, ln.high) }
+
+// Install syncs the files and atomically renames them to their final names.
+// Once any file has been renamed, Init will finish the install after a crash
+// instead of removing the files.
+func (ln *levelN) Install() error {
+	if !ln.tmp {
+		return nil
+	}
+	if err := ln.Sync(); err != nil {
+		return err
+	}
+	for _, kind := range levelKinds[ln.renamed:] {
+		if err := ln.fs.Rename(ln.temp(kind), ln.file(kind)); err != nil {
+			return errs.Wrap(err)
+		}
+		ln.renamed++
+	}
+	ln.tmp = false
+	return errs.Wrap(ln.fs.SyncDir("."))
+}
+
+// Remove closes and removes the files. Both the temporary and final names are
+// removed for an installed level in case an Install was interrupted. Only the
+// names a level being installed has written are removed so that it does not
+// remove the files of a level it is replacing with the same range.
+func (ln *levelN) Remove() error {
+	var eg errs.Group
+	eg.Add(ln.Close())
+	ln.fh.indx, ln.fh.keys, ln.fh.vals = filesystem.H{}, filesystem.H{}, filesystem.H{}
+
+	remove := func(name string) {
+		if err := ln.fs.Remove(name); !errors.Is(err, fs.ErrNotExist) {
+			eg.Add(err)
+		}
+	}
+
+	if ln.tmp {
+		for i, kind := range levelKinds {
+			if i < ln.renamed {
+				remove(ln.file(kind))
+			} else {
+				remove(ln.temp(kind))
+			}
+		}
+		return errs.Wrap(eg.Err())
+	}
+
+	for _, kind := range append(levelKinds[:], filesystem.KindTomb) {
+		remove(ln.file(kind))
+		remove(ln.temp(kind))
+	}
+
+	return errs.Wrap(eg.Err())
+}
+
+// Expire removes the files of an installed level so that a crash part way
+// through leaves either all of the level or none of it: the files are first
+// renamed to their temporary names, which Init removes once none of the files
+// of the level have their final names.
+func (ln *levelN) Expire() error {
+	for _, kind := range levelKinds {
+		if err := ln.fs.Rename(ln.file(kind), ln.temp(kind)); err != nil {
+			return errs.Wrap(err)
+		}
+	}
+	if err := ln.fs.SyncDir("."); err != nil {
+		return errs.Wrap(err)
+	}
+	return ln.Remove()
+}
+
+// Overlaps returns true if the level may contain keys with a timestamp in
+// [from, to).
+func (ln *levelN) Overlaps(from, to uint32) bool {
+	return ln.tmin <= ln.tmax && ln.tmin < to && from <= ln.tmax
+}
 
 func depth(low, high uint32) int { return bits.Len32(high - low) }
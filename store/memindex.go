@@ -20,6 +20,11 @@ func loadMemindex(fh filesystem.H, idx *memindex.T) error {
 		return errs.Wrap(err)
 	}
 
+	// the whole file is in memory, so we may as well check the checksum.
+	if err := checkFooter(data, filesystem.KindIndx, true); err != nil {
+		return err
+	}
+
 	var r rwutils.R
 	r.Init(buffer.OfLen(data))
 
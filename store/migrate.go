@@ -0,0 +1,155 @@
+package store
+
+import (
+	"io"
+
+	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/leveln"
+	"github.com/histdb/histdb/rwutils"
+)
+
+// migrateSuffix is added to the name of a file being rewritten by Migrate. it
+// is not a temporary name so that Init never installs a partial rewrite.
+const migrateSuffix = ".migrate"
+
+// Migrate rewrites the files of every level written by an older version of
+// histdb, whose opening fails with a LayoutError, in the current layout. The
+// contents are unchanged: only the footers and the time range trailer of the
+// keys file are added. Each file is replaced atomically, so Migrate can be run
+// again after it is interrupted. It must not be run on a store that is open.
+func Migrate(fs *filesystem.T) (migrated int, err error) {
+	lrs, err := ListLevels(fs)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, lr := range lrs {
+		ok, err := migrateLevel(fs, lr)
+		if err != nil {
+			return migrated, errs.Errorf("unable to migrate level %d-%d: %w", lr.Low, lr.High, err)
+		} else if ok {
+			migrated++
+		}
+	}
+
+	return migrated, errs.Wrap(fs.SyncDir("."))
+}
+
+// migrateLevel rewrites the legacy files of the level and returns true if
+// there were any. the keys are rewritten last so that the level is still seen
+// as legacy if Migrate is interrupted, and after the values because reading
+// the keys to find their time range needs the footer of the values.
+func migrateLevel(fs *filesystem.T, lr LevelRange) (migrated bool, err error) {
+	for _, kind := range []uint8{filesystem.KindIndx, filesystem.KindVals, filesystem.KindKeys} {
+		file := filesystem.File{Low: lr.Low, High: lr.High, Kind: kind}.String()
+
+		ok, err := migrateFile(fs, lr, file, kind)
+		if err != nil {
+			return migrated, errs.Errorf("%s: %w", file, err)
+		}
+		migrated = migrated || ok
+	}
+	return migrated, nil
+}
+
+// legacyFile returns true if the level file was written in a legacy layout.
+// the index has no layout to check other than the footer, so it is only
+// rewritten along with legacy keys.
+func legacyFile(fs *filesystem.T, lr LevelRange, fh filesystem.H, kind uint8) (bool, error) {
+	switch kind {
+	case filesystem.KindKeys:
+		return leveln.LegacyKeys(fh)
+	case filesystem.KindVals:
+		return leveln.LegacyValues(fh)
+	}
+
+	keys, err := fs.OpenRead(filesystem.File{Low: lr.Low, High: lr.High, Kind: filesystem.KindKeys}.String())
+	if err != nil {
+		return false, errs.Wrap(err)
+	}
+	defer keys.Close()
+
+	if legacy, err := leveln.LegacyKeys(keys); err != nil || !legacy {
+		return false, err
+	}
+
+	size, err := fh.Size()
+	if err != nil {
+		return false, errs.Wrap(err)
+	} else if size < histdb.FooterSize {
+		return true, nil
+	}
+	var buf [histdb.FooterSize]byte
+	if _, err := fh.ReadAt(buf[:], size-histdb.FooterSize); err != nil {
+		return false, errs.Wrap(err)
+	}
+	return !histdb.IsFooter(buf[:]), nil
+}
+
+func migrateFile(fs *filesystem.T, lr LevelRange, file string, kind uint8) (_ bool, err error) {
+	fh, err := fs.OpenRead(file)
+	if err != nil {
+		return false, errs.Wrap(err)
+	}
+	defer fh.Close()
+
+	if legacy, err := legacyFile(fs, lr, fh, kind); err != nil || !legacy {
+		return false, err
+	}
+
+	tmp := file + migrateSuffix
+	out, err := fs.Create(tmp)
+	if err != nil {
+		return false, errs.Wrap(err)
+	}
+	defer func() {
+		err = errs.Combine(err, out.Close())
+		if err != nil {
+			_ = fs.Remove(tmp)
+		}
+	}()
+
+	if kind == filesystem.KindKeys {
+		vals, err := fs.OpenRead(filesystem.File{Low: lr.Low, High: lr.High, Kind: filesystem.KindVals}.String())
+		if err != nil {
+			return false, errs.Wrap(err)
+		}
+		defer vals.Close()
+
+		if err := leveln.UpgradeKeys(fh, vals, out); err != nil {
+			return false, err
+		}
+	} else if err := appendFooter(fh, out, kind); err != nil {
+		return false, err
+	}
+
+	if err := out.Sync(); err != nil {
+		return false, errs.Wrap(err)
+	}
+	return true, errs.Wrap(fs.Rename(tmp, file))
+}
+
+// appendFooter copies the file into out followed by a footer for it.
+func appendFooter(fh, out filesystem.H, kind uint8) error {
+	hash := xxh3.New()
+	n, err := io.Copy(io.MultiWriter(out, hash), io.NewSectionReader(fh, 0, 1<<62))
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	var w rwutils.W
+	w.Init(buffer.OfCap(make([]byte, 0, histdb.FooterSize)))
+	histdb.Footer{
+		Kind:     kind,
+		Length:   uint64(n),
+		Checksum: hash.Sum64(),
+	}.AppendTo(&w)
+
+	_, err = out.Write(w.Done().Prefix())
+	return errs.Wrap(err)
+}
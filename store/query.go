@@ -0,0 +1,243 @@
+package store
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/leveln"
+	"github.com/histdb/histdb/memindex"
+	"github.com/histdb/histdb/query"
+	"github.com/histdb/histdb/rwutils"
+)
+
+// queryBuffer is the number of results a query worker can have decoded before
+// they have been delivered to the callback.
+const queryBuffer = 32
+
+type queryResult struct {
+	key  histdb.Key
+	name []byte
+	h    flathist.H
+	qw   *queryWorker
+}
+
+// release returns the result to the worker that decoded it.
+func (qr *queryResult) release() { qr.qw.free <- qr }
+
+// queryWorker scans levels for QueryData. Results are decoded into the
+// worker's own histogram store and the number of outstanding results is
+// bounded by the free list so that a worker scanning ahead of the level being
+// delivered cannot use unbounded memory.
+type queryWorker struct {
+	_ [0]func() // no equality
+
+	st   flathist.S
+	free chan *queryResult
+	it   leveln.Iterator
+	name []byte
+}
+
+var queryWorkerPool = sync.Pool{New: func() any { return newQueryWorker() }}
+
+func newQueryWorker() *queryWorker {
+	qw := &queryWorker{free: make(chan *queryResult, queryBuffer)}
+	for range queryBuffer {
+		qw.free <- &queryResult{h: qw.st.New(), qw: qw}
+	}
+	return qw
+}
+
+// scan sends every value matching the query in the level with a timestamp in
+// [from, to) to out in key order and adds the work it did to stats. It stops
+// early if done is closed.
+func (qw *queryWorker) scan(q *query.Q, ln *levelN, from, to uint32, stats *QueryStats, out chan<- *queryResult, done <-chan struct{}) (err error) {
+	it := &qw.it
+	it.Init(ln.fh.keys, ln.fh.vals)
+
+	ids := q.Eval(&ln.idx)
+	stats.Levels++
+	stats.Metrics += int(ids.GetCardinality())
+
+	memindex.Iter(ids, func(id memindex.Id) bool {
+		hash, ok := ln.idx.GetHashById(id)
+		if !ok {
+			return false
+		}
+		qw.name, ok = ln.idx.AppendNameById(id, qw.name[:0])
+		if !ok {
+			return false
+		}
+
+		var key histdb.Key
+		*key.HashPtr() = hash
+		key.SetTimestamp(from)
+
+		// this maybe skips seeks but is maybe an invalid optimization have to think about it.
+		// if something goes wrong, try removing this if statement first lol.
+		if k := it.Key(); string(k[:]) < string(key[:]) {
+			it.Seek(key)
+		}
+
+		for it.Err() == nil {
+			if it.Key().Hash() != hash || it.Key().Timestamp() >= to {
+				break
+			}
+
+			stats.Keys++
+			if ln.deleted(it.Key()) {
+				if !it.Next() {
+					break
+				}
+				continue
+			}
+
+			var qr *queryResult
+			select {
+			case qr = <-qw.free:
+			case <-done:
+				return false
+			}
+
+			stats.ValueBytes += int64(len(it.Value()))
+
+			var r rwutils.R
+			r.Init(buffer.OfLen(it.Value()))
+
+			qw.st.Reset(qr.h)
+			flathist.ReadFrom(&qw.st, qr.h, &r)
+			if _, err = r.Done(); err != nil {
+				qr.release()
+				return false
+			}
+
+			qr.key = it.Key()
+			qr.name = append(qr.name[:0], qw.name...)
+
+			// this never blocks because out has room for every result.
+			out <- qr
+
+			if !it.Next() {
+				break
+			}
+		}
+		err = it.Err()
+
+		return err == nil
+	})
+
+	return err
+}
+
+func (t *T) queryWorkers(levels int) int {
+	n := t.cfg.QueryWorkers
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	return max(1, min(n, levels))
+}
+
+// queryLevels scans the levels concurrently and calls cb with the results in
+// level order. If stats is not nil, the work done is added to it.
+func (t *T) queryLevels(lns []*levelN, q *query.Q, from, to uint32, stats *QueryStats, cb func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool) (bool, error) {
+	outs := make([]chan *queryResult, len(lns))
+	lerrs := make([]error, len(lns))
+	lstats := make([]QueryStats, len(lns))
+	for i := range outs {
+		outs[i] = make(chan *queryResult, queryBuffer)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var next int
+	done := make(chan struct{})
+
+	// workers claim levels in order, so the level being delivered has always
+	// been claimed by a worker that can make progress.
+	workers := t.queryWorkers(len(lns))
+	qws := make([]*queryWorker, workers)
+	for i := range qws {
+		qws[i] = queryWorkerPool.Get().(*queryWorker)
+
+		wg.Add(1)
+		go func(qw *queryWorker) {
+			defer wg.Done()
+
+			for {
+				// levels are not worth scanning once the results are no
+				// longer wanted.
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				mu.Lock()
+				i := next
+				next++
+				mu.Unlock()
+
+				if i >= len(lns) {
+					return
+				}
+
+				lerrs[i] = qw.scan(q, lns[i], from, to, &lstats[i], outs[i], done)
+				close(outs[i])
+			}
+		}(qws[i])
+	}
+
+	ok, err := func() (bool, error) {
+		for i, out := range outs {
+			for qr := range out {
+				cont := cb(qr.key, qr.name, &qr.qw.st, qr.h)
+				qr.release()
+				if !cont {
+					return false, nil
+				}
+			}
+			if lerrs[i] != nil {
+				return false, lerrs[i]
+			}
+		}
+		return true, nil
+	}()
+
+	close(done)
+	wg.Wait()
+
+	// the levels no worker claimed have no results.
+	for _, out := range outs[min(next, len(outs)):] {
+		close(out)
+	}
+
+	if stats != nil {
+		for _, ls := range lstats {
+			stats.Add(ls)
+		}
+	}
+
+	// return any results that were not delivered so that the workers can be
+	// reused by later queries.
+	for _, out := range outs {
+	drain:
+		for {
+			select {
+			case qr, ok := <-out:
+				if !ok {
+					break drain
+				}
+				qr.release()
+			default:
+				break drain
+			}
+		}
+	}
+	for _, qw := range qws {
+		queryWorkerPool.Put(qw)
+	}
+
+	return ok, err
+}
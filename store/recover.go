@@ -0,0 +1,75 @@
+package store
+
+import (
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb/filesystem"
+)
+
+// recoverLevels finishes or rolls back any level installs and compactions that
+// were interrupted by a crash and returns the level files that remain.
+//
+// a level's temporary files are installed if any of its files already have a
+// final name or if a compaction marker exists for its range, and removed
+// otherwise. a marker whose level is complete means that the level replaces
+// every level inside its range, so those are removed before the marker.
+func recoverLevels(fs *filesystem.T, files, temps, markers []filesystem.File) (_ []filesystem.File, err error) {
+	if len(temps) == 0 && len(markers) == 0 {
+		return files, nil
+	}
+
+	type span struct{ low, high uint32 }
+	spanOf := func(f filesystem.File) span { return span{f.Low, f.High} }
+
+	finals := make(map[span]int)
+	for _, file := range files {
+		finals[spanOf(file)]++
+	}
+	marked := make(map[span]bool)
+	for _, marker := range markers {
+		marked[spanOf(marker)] = true
+	}
+
+	for _, file := range temps {
+		if finals[spanOf(file)] > 0 || marked[spanOf(file)] {
+			if err := fs.Rename(file.TempString(), file.String()); err != nil {
+				return nil, errs.Errorf("unable to install leveln file: %w", err)
+			}
+			files = append(files, file)
+			finals[spanOf(file)]++
+		} else if err := fs.Remove(file.TempString()); err != nil {
+			return nil, errs.Errorf("unable to remove temporary leveln file: %w", err)
+		}
+	}
+
+	replaced := func(file filesystem.File) bool {
+		for _, marker := range markers {
+			if finals[spanOf(marker)] == len(levelKinds) &&
+				marker.Low <= file.Low && file.High <= marker.High &&
+				spanOf(marker) != spanOf(file) {
+				return true
+			}
+		}
+		return false
+	}
+
+	kept := files[:0]
+	for _, file := range files {
+		if !replaced(file) {
+			kept = append(kept, file)
+		} else if err := fs.Remove(file.String()); err != nil {
+			return nil, errs.Errorf("unable to remove compacted leveln file: %w", err)
+		}
+	}
+
+	if err := fs.SyncDir("."); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	for _, marker := range markers {
+		if err := fs.Remove(marker.String()); err != nil {
+			return nil, errs.Errorf("unable to remove compaction marker: %w", err)
+		}
+	}
+
+	return kept, errs.Wrap(fs.SyncDir("."))
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"github.com/zeebo/errs/v2"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/leveln"
+	"github.com/histdb/histdb/pdqsort"
+)
+
+// Rollup causes values older than After to be merged into values covering
+// Resolution during compaction.
+type Rollup struct {
+	After      uint32
+	Resolution uint32
+}
+
+// retention applies the rollups and retain duration from the Config to keys
+// relative to a current timestamp.
+type retention struct {
+	_ [0]func() // no equality
+
+	rollups []Rollup // sorted by After
+	retain  uint32
+	now     uint32
+}
+
+func newRetention(cfg Config, now uint32) *retention {
+	if len(cfg.Rollups) == 0 && cfg.Retain == 0 {
+		return nil
+	}
+	return &retention{rollups: cfg.Rollups, retain: cfg.Retain, now: now}
+}
+
+// sortRollups sorts the rollups by After and checks that each resolution is a
+// multiple of the ones before it so that rolled up values are still in order.
+func sortRollups(rollups []Rollup) ([]Rollup, error) {
+	rollups = append([]Rollup(nil), rollups...)
+	pdqsort.Less(rollups, func(i, j int) bool {
+		return rollups[i].After < rollups[j].After
+	})
+
+	for i, r := range rollups {
+		if r.Resolution == 0 {
+			return nil, errs.Errorf("rollup after %d has zero resolution", r.After)
+		} else if i > 0 && r.Resolution%rollups[i-1].Resolution != 0 {
+			return nil, errs.Errorf("rollup resolution %d is not a multiple of %d",
+				r.Resolution, rollups[i-1].Resolution)
+		}
+	}
+
+	return rollups, nil
+}
+
+// apply returns the key the value for key should be written under and false
+// if the value should be dropped.
+func (r *retention) apply(key histdb.Key) (histdb.Key, bool) {
+	if r == nil {
+		return key, true
+	}
+
+	ts := key.Timestamp()
+	age := uint32(0)
+	if ts < r.now {
+		age = r.now - ts
+	}
+
+	if r.retain > 0 && age >= r.retain {
+		return key, false
+	}
+
+	for i := len(r.rollups) - 1; i >= 0; i-- {
+		if rl := r.rollups[i]; age >= rl.After {
+			key.SetTimestamp(ts - ts%rl.Resolution)
+			key.SetDuration(rl.Resolution)
+			break
+		}
+	}
+
+	return key, true
+}
+
+// absorbs returns true if the value for key should be merged into the value
+// for the pending key because it starts inside of the pending key's interval.
+func absorbs(pending, key histdb.Key) bool {
+	if pending.Hash() != key.Hash() {
+		return false
+	} else if pending.Timestamp() == key.Timestamp() && pending.Duration() == key.Duration() {
+		return true
+	}
+	return uint64(key.Timestamp()) < uint64(pending.Timestamp())+uint64(pending.Duration())
+}
+
+// expires returns true if every value in the level is older than Retain.
+func (r *retention) expires(ln *levelN) bool {
+	return r != nil && r.retain > 0 && ln.tmin <= ln.tmax &&
+		ln.tmax < r.now && r.now-ln.tmax >= r.retain
+}
+
+// boundaries calls cb with the ages at which apply changes what it does to a
+// value: the After of every rollup and Retain.
+func (r *retention) boundaries(cb func(age uint32) bool) bool {
+	for _, rl := range r.rollups {
+		if rl.After > 0 && !cb(rl.After) {
+			return false
+		}
+	}
+	return r.retain == 0 || cb(r.retain)
+}
+
+// crosses returns true if a value in the level may have aged past a boundary
+// since the retention policy was applied to it at the current time since.
+func (r *retention) crosses(ln *levelN, since uint32) bool {
+	if r == nil || ln.tmin > ln.tmax {
+		return false
+	}
+
+	// a value at ts has crossed the boundary if it was younger than the
+	// boundary at since and is at least as old now, which is when ts is in
+	// (since-age, now-age].
+	return !r.boundaries(func(age uint32) bool {
+		lo := max(int64(ln.tmin), int64(since)-int64(age)+1)
+		hi := min(int64(ln.tmax), int64(r.now)-int64(age))
+		return lo > hi
+	})
+}
+
+// changes returns true if apply changes or drops any of the values in the
+// level. Levels without values old enough to reach a boundary are not read.
+func (r *retention) changes(ln *levelN) (bool, error) {
+	if r == nil || ln.tmin > ln.tmax {
+		return false, nil
+	} else if !r.crosses(ln, 0) {
+		return false, nil
+	}
+
+	var it leveln.Iterator
+	for it.Init(ln.fh.keys, ln.fh.vals); it.Next(); {
+		if key, ok := r.apply(it.Key()); !ok || key != it.Key() {
+			return true, nil
+		}
+	}
+	return false, it.Err()
+}
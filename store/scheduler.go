@@ -0,0 +1,191 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs/v2"
+)
+
+// the bounds on the delay before retrying a failed compaction.
+const (
+	minCompactBackoff = time.Second
+	maxCompactBackoff = time.Minute
+)
+
+// memoryCheckPeriod is how many new metrics are added to the memstore between
+// checks of its size against the memory limits, and memoryCheckObservations is
+// how many observations are, so that the histograms of known metrics growing
+// is also noticed.
+const (
+	memoryCheckPeriod       = 64
+	memoryCheckObservations = 1 << 16
+)
+
+// fastEntrySize is about how many bytes an entry in the fast table of the
+// memstore uses, not counting its key: the node and its share of the tables.
+const fastEntrySize = 88
+
+// scheduler writes a level at the end of every interval and compacts the
+// levels in the background.
+type scheduler struct {
+	_ [0]func() // no equality
+
+	t        *T
+	interval time.Duration
+	now      func() time.Time
+	after    func(time.Duration) <-chan time.Time
+
+	start   time.Time     // start of the interval being observed
+	stop    chan struct{} // closed to stop the goroutines
+	compact chan struct{} // signaled after a level is written
+	cut     chan struct{} // signaled to write a level early
+	wg      sync.WaitGroup
+
+	mu         sync.Mutex
+	flushErr   error // from the last level written, cleared by a success
+	compactErr error // from the last compaction, cleared by a success
+	stopErr    error // from the level written by Stop
+}
+
+func newScheduler(t *T, cfg *Config) *scheduler {
+	s := &scheduler{
+		t:        t,
+		interval: cfg.FlushInterval,
+		now:      cfg.now,
+		after:    cfg.after,
+		stop:     make(chan struct{}),
+		compact:  make(chan struct{}, 1),
+		cut:      make(chan struct{}, 1),
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	if s.after == nil {
+		s.after = time.After
+	}
+	s.start = s.now().Truncate(s.interval)
+
+	s.wg.Add(2)
+	go s.runFlush()
+	go s.runCompact()
+
+	return s
+}
+
+// Stop stops the goroutines after writing a level for the observations in
+// the current interval and returns any error writing it.
+func (s *scheduler) Stop() error {
+	close(s.stop)
+	s.wg.Wait()
+	return s.stopErr
+}
+
+// Cut causes a level to be written for the observations up to the current
+// second without waiting for the end of the interval. Levels are at least a
+// second long, so a level already cut in the current second makes the next
+// one end a second after it and the following observations land a little
+// ahead of time.
+func (s *scheduler) Cut() {
+	select {
+	case s.cut <- struct{}{}:
+	default:
+	}
+}
+
+// Err returns the errors from the last flush and compaction if either failed.
+func (s *scheduler) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return errors.Join(s.flushErr, s.compactErr)
+}
+
+func (s *scheduler) setErr(dst *error, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	*dst = err
+}
+
+func (s *scheduler) runFlush() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.stop:
+			s.stopErr = s.flush(s.cutEnd(s.now()))
+			return
+		case <-s.cut:
+			s.setErr(&s.flushErr, s.flush(s.cutEnd(s.now().Truncate(time.Second))))
+		case <-s.after(s.start.Truncate(s.interval).Add(s.interval).Sub(s.now())):
+			s.setErr(&s.flushErr, s.flush(s.now().Truncate(s.interval)))
+		}
+	}
+}
+
+// cutEnd returns end, or the second after the start of the interval if end is
+// not after it because a level was already cut in the same second.
+func (s *scheduler) cutEnd(end time.Time) time.Time {
+	if !end.After(s.start) {
+		return s.start.Add(time.Second)
+	}
+	return end
+}
+
+// flush writes the observations since the start of the interval into a level
+// ending at end, unless there are none.
+func (s *scheduler) flush(end time.Time) error {
+	if !end.After(s.start) {
+		return nil
+	}
+
+	ts := uint32(s.start.Unix())
+	dur := uint32((end.Sub(s.start) + time.Second - 1) / time.Second)
+	s.start = end
+
+	if ms := s.t.ms.Load(); ms == nil || s.t.empty(ms) {
+		return nil
+	}
+
+	if err := s.t.WriteLevel(ts, dur); err != nil {
+		return errs.Errorf("unable to write level: %w", err)
+	}
+
+	select {
+	case s.compact <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *scheduler) runCompact() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.compact:
+		}
+
+		for backoff := minCompactBackoff; ; backoff = min(2*backoff, maxCompactBackoff) {
+			err := s.t.CompactSuffix()
+			if err == nil {
+				err = s.t.ApplyRetention()
+			}
+			if err == nil {
+				s.setErr(&s.compactErr, nil)
+				break
+			}
+			s.setErr(&s.compactErr, errs.Errorf("unable to compact: %w", err))
+
+			select {
+			case <-s.stop:
+				return
+			case <-s.after(backoff):
+			}
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+
+	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/rwutils"
+)
+
+// a snapshot is a directory holding hard links to the files of every level
+// and a manifest named like a level spanning all of them with the mnft kind.
+// the manifest is a version, the number of files, the files, and a footer:
+//
+//	file: [low: 4 bytes] [high: 4 bytes] [kind: 1 byte] [size: 8 bytes] [checksum: 8 bytes]
+//
+// the checksum is the one from the footer of the file. the manifest is
+// written last, so a directory without one is an incomplete snapshot.
+
+const manifestVersion = 0
+
+// maxManifestSize bounds the memory used to read a manifest. It is far larger
+// than the manifest of any store, which has an entry for every file.
+const maxManifestSize = 64 << 20
+
+type manifestEntry struct {
+	file     filesystem.File
+	size     int64
+	checksum uint64
+}
+
+// Snapshot hard links the files of every level into dir, creating it if
+// necessary, and writes a manifest listing them. Compaction and Delete are
+// blocked while it runs. The directory can be opened with Init as a copy of
+// the levels at the time of the call, checked with VerifySnapshot, and
+// restored with Restore. Observations in the memstore are not included, so
+// call WriteLevel first to include them. The directory must be empty and on
+// the same filesystem as the store.
+func (t *T) Snapshot(dir string) (err error) {
+	t.cmu.Lock()
+	defer t.cmu.Unlock()
+
+	// SAFETY: t.lns is only either appended to in WriteLevel or fully replaced
+	// in CompactSuffix, so taking a shallow snapshot of the slice is safe.
+	t.lmu.Lock()
+	lns := t.lns
+	t.lmu.Unlock()
+
+	snap := &filesystem.T{Base: dir}
+	if err := snap.Mkdir(""); err != nil {
+		return errs.Errorf("unable to create snapshot directory: %w", err)
+	}
+	if err := checkEmptyDir(snap); err != nil {
+		return err
+	}
+	rel, err := relDir(t.fs.Base, dir)
+	if err != nil {
+		return err
+	}
+
+	var ents []manifestEntry
+	defer func() {
+		if err != nil {
+			for _, ent := range ents {
+				_ = snap.Remove(ent.file.String())
+			}
+		}
+	}()
+
+	var high uint32
+	for _, ln := range lns {
+		kinds := levelKinds[:]
+		if len(ln.tombs) > 0 {
+			kinds = append(kinds, filesystem.KindTomb)
+		}
+
+		for _, kind := range kinds {
+			file := filesystem.File{Low: ln.low, High: ln.high, Kind: kind}
+			if err := t.fs.Link(file.String(), filepath.Join(rel, file.String())); err != nil {
+				return errs.Errorf("unable to link level file: %w", err)
+			}
+			ents = append(ents, manifestEntry{file: file})
+
+			ent, err := readManifestEntry(snap, file)
+			if err != nil {
+				return err
+			}
+			ents[len(ents)-1] = ent
+		}
+		high = ln.high
+	}
+
+	if err := writeManifest(snap, filesystem.File{High: high, Kind: filesystem.KindMnft}, ents); err != nil {
+		return errs.Errorf("unable to write manifest: %w", err)
+	}
+	return nil
+}
+
+// VerifySnapshot checks that the snapshot in dir has a valid manifest, that
+// every file it lists is present with a matching size and checksum, that the
+// files form complete levels in order, and that every level passes
+// Level.Verify. It only opens files for reading, so it can check a snapshot
+// while the store that took it is running.
+func VerifySnapshot(dir string) error {
+	_, err := verifySnapshot(&filesystem.T{Base: dir})
+	return err
+}
+
+func verifySnapshot(snap *filesystem.T) ([]manifestEntry, error) {
+	ents, err := readManifest(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	var next uint32
+	levels := make(map[LevelRange]int)
+	for _, ent := range ents {
+		switch ent.file.Kind {
+		case filesystem.KindIndx, filesystem.KindKeys, filesystem.KindVals:
+		case filesystem.KindTomb:
+			continue
+		default:
+			return nil, errs.Errorf("manifest has file of unknown kind: %s", ent.file)
+		}
+
+		lr := LevelRange{Low: ent.file.Low, High: ent.file.High}
+		if levels[lr] == 0 {
+			// levels removed by the retention policy leave gaps.
+			if lr.Low < next || lr.High <= lr.Low {
+				return nil, errs.Errorf("manifest has overlapping level %d-%d", lr.Low, lr.High)
+			}
+			next = lr.High
+		}
+		levels[lr]++
+	}
+	for lr, n := range levels {
+		if n != len(levelKinds) {
+			return nil, errs.Errorf("manifest has incomplete level %d-%d", lr.Low, lr.High)
+		}
+	}
+	for _, ent := range ents {
+		if ent.file.Kind == filesystem.KindTomb && levels[LevelRange{Low: ent.file.Low, High: ent.file.High}] == 0 {
+			return nil, errs.Errorf("manifest has tombstones without a level: %s", ent.file)
+		}
+	}
+
+	for _, ent := range ents {
+		fh, err := snap.OpenRead(ent.file.String())
+		if err != nil {
+			return nil, errs.Errorf("unable to open snapshot file: %w", err)
+		}
+		err = func() error {
+			defer fh.Close()
+
+			if size, err := fh.Size(); err != nil {
+				return errs.Wrap(err)
+			} else if size != ent.size {
+				return errs.Errorf("size mismatch: %d != %d", size, ent.size)
+			}
+			// the keys and values are checked with their level below.
+			if ent.file.Kind != filesystem.KindKeys && ent.file.Kind != filesystem.KindVals {
+				if err := verifyChecksum(fh, ent.file.Kind); err != nil {
+					return err
+				}
+			}
+
+			got, err := readManifestEntry(snap, ent.file)
+			if err != nil {
+				return err
+			} else if got.checksum != ent.checksum {
+				return errs.Errorf("checksum does not match manifest")
+			}
+			return nil
+		}()
+		if err != nil {
+			return nil, errs.Wrap(&CorruptError{File: ent.file.String(), Err: err})
+		}
+	}
+
+	for _, ent := range ents {
+		if ent.file.Kind != filesystem.KindIndx {
+			continue
+		}
+		l, err := OpenLevel(snap, LevelRange{Low: ent.file.Low, High: ent.file.High})
+		if err != nil {
+			return nil, err
+		}
+		err = l.Verify()
+		_ = l.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ents, nil
+}
+
+// Restore verifies the snapshot in dir and then places its files in the store
+// directory, which must not contain any level or wal files. The files are hard
+// linked if possible and copied otherwise. The store must not be open.
+func Restore(fs *filesystem.T, dir string) (err error) {
+	snap := &filesystem.T{Base: dir}
+
+	ents, err := verifySnapshot(snap)
+	if err != nil {
+		return errs.Errorf("invalid snapshot: %w", err)
+	}
+
+	if err := fs.Mkdir(""); err != nil {
+		return errs.Errorf("unable to create store directory: %w", err)
+	}
+	if err := checkEmptyDir(fs); err != nil {
+		return err
+	}
+	rel, err := relDir(dir, fs.Base)
+	if err != nil {
+		return err
+	}
+
+	var placed []filesystem.File
+	defer func() {
+		if err != nil {
+			for _, file := range placed {
+				_ = fs.Remove(file.String())
+			}
+		}
+	}()
+
+	for _, ent := range ents {
+		name := ent.file.String()
+		if err := snap.Link(name, filepath.Join(rel, name)); err != nil {
+			if err := copyFile(snap, fs, name); err != nil {
+				return errs.Errorf("unable to restore file: %w", err)
+			}
+		}
+		placed = append(placed, ent.file)
+	}
+
+	return errs.Wrap(fs.SyncDir("."))
+}
+
+// checkEmptyDir returns an error if the directory has any files that look
+// like they belong to a store or snapshot.
+func checkEmptyDir(fs *filesystem.T) error {
+	fh, err := fs.OpenRead(".")
+	if err != nil {
+		return errs.Errorf("unable to read directory: %w", err)
+	}
+	defer fh.Close()
+
+	for {
+		names, err := fh.Readdirnames(24)
+		for _, name := range names {
+			if _, ok := filesystem.ParseFile(name); ok {
+				return errs.Errorf("directory %q already contains %s", fs.Base, name)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return errs.Errorf("problem reading directory names: %w", err)
+		}
+	}
+}
+
+// relDir returns the path of dir relative to base so that it can be passed
+// to the methods of a filesystem.T for base.
+func relDir(base, dir string) (string, error) {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	rel, err := filepath.Rel(base, dir)
+	return rel, errs.Wrap(err)
+}
+
+// copyFile copies the file from one directory to another and syncs it.
+func copyFile(src, dst *filesystem.T, name string) (err error) {
+	in, err := src.OpenRead(name)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer in.Close()
+
+	out, err := dst.Create(name)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() {
+		err = errs.Combine(err, out.Close())
+		if err != nil {
+			_ = dst.Remove(name)
+		}
+	}()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return errs.Wrap(err)
+	}
+	return errs.Wrap(out.Sync())
+}
+
+// readManifestEntry returns the size of the file and the checksum from its
+// footer.
+func readManifestEntry(dir *filesystem.T, file filesystem.File) (manifestEntry, error) {
+	ent := manifestEntry{file: file}
+
+	fh, err := dir.OpenRead(file.String())
+	if err != nil {
+		return ent, errs.Wrap(err)
+	}
+	defer fh.Close()
+
+	ent.size, err = fh.Size()
+	if err != nil {
+		return ent, errs.Wrap(err)
+	} else if ent.size < histdb.FooterSize {
+		return ent, errs.Errorf("file too small for footer: %d", ent.size)
+	}
+
+	var buf [histdb.FooterSize]byte
+	if _, err := fh.ReadAt(buf[:], ent.size-histdb.FooterSize); err != nil {
+		return ent, errs.Wrap(err)
+	}
+	f, err := parseFooter(buf[:], file.Kind, uint64(ent.size-histdb.FooterSize))
+	if err != nil {
+		return ent, err
+	}
+	ent.checksum = f.Checksum
+
+	return ent, nil
+}
+
+func writeManifest(dir *filesystem.T, file filesystem.File, ents []manifestEntry) (err error) {
+	var w rwutils.W
+	w.Init(buffer.OfCap(make([]byte, 0, 16+25*len(ents)+histdb.FooterSize)))
+
+	w.Uint64(manifestVersion)
+	w.Varint(uint64(len(ents)))
+	for _, ent := range ents {
+		w.Uint32(ent.file.Low)
+		w.Uint32(ent.file.High)
+		w.Uint8(ent.file.Kind)
+		w.Uint64(uint64(ent.size))
+		w.Uint64(ent.checksum)
+	}
+
+	data := w.Done().Prefix()
+	histdb.Footer{
+		Kind:     filesystem.KindMnft,
+		Length:   uint64(len(data)),
+		Checksum: xxh3.Hash(data),
+	}.AppendTo(&w)
+
+	fh, err := dir.Create(file.String())
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() {
+		err = errs.Combine(err, fh.Close())
+		if err != nil {
+			_ = dir.Remove(file.String())
+		}
+	}()
+
+	if _, err := fh.Write(w.Done().Prefix()); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := fh.Sync(); err != nil {
+		return errs.Wrap(err)
+	}
+	return errs.Wrap(dir.SyncDir("."))
+}
+
+// readManifest finds the manifest in the directory and returns its entries.
+func readManifest(dir *filesystem.T) ([]manifestEntry, error) {
+	fh, err := dir.OpenRead(".")
+	if err != nil {
+		return nil, errs.Errorf("unable to read snapshot directory: %w", err)
+	}
+	defer fh.Close()
+
+	var mfs []filesystem.File
+	for {
+		names, err := fh.Readdirnames(24)
+		for _, name := range names {
+			if file, ok := filesystem.ParseFile(name); ok && file.Kind == filesystem.KindMnft {
+				mfs = append(mfs, file)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, errs.Errorf("problem reading directory names: %w", err)
+		}
+	}
+	if len(mfs) != 1 {
+		return nil, errs.Errorf("snapshot must have exactly one manifest: found %d", len(mfs))
+	}
+
+	mh, err := dir.OpenRead(mfs[0].String())
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	defer mh.Close()
+
+	if err := verifyChecksum(mh, filesystem.KindMnft); err != nil {
+		return nil, errs.Wrap(&CorruptError{File: mfs[0].String(), Err: err})
+	}
+	size, err := mh.Size()
+	if err != nil {
+		return nil, errs.Wrap(err)
+	} else if size > maxManifestSize {
+		return nil, errs.Errorf("manifest is too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := mh.ReadAt(data, 0); err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	var r rwutils.R
+	r.Init(buffer.OfLen(data[:len(data)-histdb.FooterSize]))
+
+	if version := r.Uint64(); version != manifestVersion {
+		return nil, errs.Errorf("manifest has unknown version: %d", version)
+	}
+	n := r.Varint()
+
+	ents := make([]manifestEntry, 0, min(n, uint64(len(data))/25))
+	for range n {
+		ents = append(ents, manifestEntry{
+			file: filesystem.File{
+				Low:  r.Uint32(),
+				High: r.Uint32(),
+				Kind: r.Uint8(),
+			},
+			size:     int64(r.Uint64()),
+			checksum: r.Uint64(),
+		})
+	}
+	if _, err := r.Done(); err != nil {
+		return nil, errs.Wrap(&CorruptError{File: mfs[0].String(), Err: err})
+	}
+
+	return ents, nil
+}
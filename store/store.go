@@ -4,29 +4,97 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
 
 	"github.com/histdb/histdb"
-	"github.com/histdb/histdb/buffer"
 	"github.com/histdb/histdb/card"
 	"github.com/histdb/histdb/filesystem"
 	"github.com/histdb/histdb/flathist"
 	"github.com/histdb/histdb/hashtbl"
 	"github.com/histdb/histdb/leveln"
+	"github.com/histdb/histdb/lfht"
 	"github.com/histdb/histdb/memindex"
 	"github.com/histdb/histdb/pdqsort"
 	"github.com/histdb/histdb/query"
 	"github.com/histdb/histdb/rwutils"
 )
 
+// ErrReadOnly is returned by the methods that change a store opened with
+// Config.ReadOnly.
+var ErrReadOnly = errors.New("store is read only")
+
 type Config struct {
 	_ [0]func() // no equality
 
 	CardFix *card.Fixer
+
+	// ReadOnly opens the store without changing its directory, so that a
+	// snapshot or a copy of a store can be inspected. Observations are
+	// ignored, and WriteLevel, CompactSuffix and Delete return ErrReadOnly.
+	// WAL segments are not replayed, and Init fails if there is an
+	// interrupted level install or compaction to recover. It can not be used
+	// with WAL, FlushInterval or the memory limits.
+	ReadOnly bool
+
+	// WAL causes observations to be appended to a write-ahead log in the
+	// store directory so that they survive a crash before WriteLevel. Logs
+	// left by a previous process are always replayed by Init. Observations
+	// are buffered in a shard per processor, so Observe of a known metric
+	// only contends with others in the same shard.
+	WAL bool
+
+	// WALSyncInterval bounds how long observations are buffered before they
+	// are written to the WAL and synced to disk, and so how many are lost in
+	// a crash. If it is zero, the WAL is synced every second.
+	WALSyncInterval time.Duration
+
+	// Rollups downsample values during compaction as they age, relative to
+	// the newest timestamp in the store. A value uses the rollup with the
+	// largest After that is not newer than it. Each Resolution must be a
+	// multiple of the Resolution of every rollup with a smaller After.
+	// ApplyRetention rewrites the levels compaction does not reach.
+	Rollups []Rollup
+
+	// Retain causes compaction to drop values older than it, relative to the
+	// newest timestamp in the store. ApplyRetention removes levels where every
+	// value is older than it. Zero keeps values forever.
+	Retain uint32
+
+	// QueryWorkers bounds the number of levels QueryData scans concurrently.
+	// If it is zero, GOMAXPROCS is used.
+	QueryWorkers int
+
+	// FlushInterval causes Init to start writing a level at the end of every
+	// interval, aligned to multiples of the interval since the unix epoch,
+	// and compacting after each one in the background. The level for the
+	// interval starting at ts has the timestamp ts and the duration of the
+	// interval. Intervals without observations are skipped, and Close writes
+	// a level for the observations in the current interval. It must be a
+	// whole number of seconds. Zero disables the scheduler.
+	FlushInterval time.Duration
+
+	// MemorySoftLimit causes the scheduler to write a level early, covering
+	// the interval up to the current second, once the memstore uses more
+	// bytes than it. It requires FlushInterval. Zero disables it.
+	MemorySoftLimit uint64
+
+	// MemoryHardLimit causes observations of metrics that are not already in
+	// the memstore to be dropped once it uses more bytes than it, until the
+	// next level is written. They are counted by Shed. Zero disables it.
+	MemoryHardLimit uint64
+
+	// now and after replace the clock of the scheduler in tests.
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
 }
 
 type T struct {
@@ -36,50 +104,150 @@ type T struct {
 	fs  *filesystem.T
 	ms  atomic.Pointer[MemStore]
 
-	imu sync.Mutex   // protects ms.idx
+	imu sync.Mutex   // protects ms.idx/wal/wsegs
 	wmu sync.Mutex   // protects WriteLevel
 	cmu sync.Mutex   // protects Compact
-	lmu sync.Mutex   // protects access to lns/gen/qst
+	lmu sync.Mutex   // protects access to lns/gen
 	qmu sync.RWMutex // protects Query
 
 	lns []*levelN
-	qst *flathist.S
+
+	wal   *wal              // active segment, nil if the wal is disabled
+	wsegs []filesystem.File // older segments for the current memstore
+	wseq  uint32            // next segment sequence number
+	wstop chan struct{}     // closed to stop syncing the wal, nil if not
+	wwg   sync.WaitGroup    // waits for the wal sync goroutine
+
+	sched *scheduler    // nil unless cfg.FlushInterval is set
+	shed  atomic.Uint64 // observations dropped by the memory hard limit
 }
 
 type MemStore struct {
 	I memindex.T
 	S flathist.S
+
+	// fast maps metrics exactly as passed to Observe to their histogram so
+	// that known metrics can be observed without taking imu.
+	fast lfht.T[string, flathist.H]
+
+	// active counts the Observe calls using the fast table so that WriteLevel
+	// can wait for them to finish after swapping the memstore out.
+	active atomic.Int64
+
+	// merging is set while ObserveHistogram merges into S so that Observe
+	// calls take the slow path.
+	merging atomic.Bool
+
+	// wal is the segment observations into the memstore are written to, or
+	// nil if the wal is disabled. It is the same as T.wal while the memstore
+	// is current, but fast path observations only have the memstore.
+	wal *wal
+
+	added    int    // metrics admitted, protected by imu
+	full     bool   // set once over the memory hard limit, protected by imu
+	fastSize uint64 // bytes used by the fast table, protected by imu
+
+	// observed counts observations while there are memory limits so that the
+	// size is checked as the histograms grow.
+	observed atomic.Uint64
+
+	// tombs are added by Delete and written with the level, protected by imu.
+	tombs []tombstone
 }
 
 func (t *T) DebugMemStore() *MemStore { return t.ms.Load() }
 
+// handle returns the histogram for the metric, allocating one if the metric is
+// new to the index. It must not be called concurrently with itself.
+func (ms *MemStore) handle(metric []byte, cf *card.Fixer) flathist.H {
+	_, id, _, ok := ms.I.Add(metric, nil, cf)
+	h := flathist.UnsafeRawH(id + 1)
+	if ok {
+		h = ms.S.New()
+	}
+	ms.fast.Insert(string(metric), xxh3.Hash(metric), func() flathist.H {
+		ms.fastSize += fastEntrySize + uint64(len(metric))
+		return h
+	})
+	return h
+}
+
+// lookup returns the histogram for the metric if it has been passed to handle.
+// It is safe to call concurrently with handle.
+func (ms *MemStore) lookup(metric []byte) (flathist.H, bool) {
+	if len(metric) == 0 {
+		return flathist.H{}, false
+	}
+	return ms.fast.Find(unsafe.String(&metric[0], len(metric)), xxh3.Hash(metric))
+}
+
 // Close cannot be called concurrently with any other method.
 func (t *T) Close() (err error) {
 	var eg errs.Group
 
+	if t.sched != nil {
+		eg.Add(t.sched.Stop())
+		t.sched = nil
+	}
+	t.stopWalSync()
+
 	for _, ln := range t.lns {
 		eg.Add(ln.Close())
 	}
+	if t.wal != nil {
+		eg.Add(t.wal.Close())
+	}
 
 	// free up memory
 	t.lns = nil
+	t.wal = nil
+	t.wsegs = nil
 	t.ms.Store(nil)
-	t.qst = nil
 
 	return eg.Err()
 }
 
 // Init cannot be called concurrently with any other method.
 func (t *T) Init(fs *filesystem.T, cfg Config) (err error) {
+	cfg.Rollups, err = sortRollups(cfg.Rollups)
+	if err != nil {
+		return errs.Errorf("invalid config: %w", err)
+	}
+	if cfg.FlushInterval < 0 || cfg.FlushInterval%time.Second != 0 {
+		return errs.Errorf("invalid config: flush interval is not a whole number of seconds: %v", cfg.FlushInterval)
+	}
+	if cfg.MemorySoftLimit > 0 && cfg.FlushInterval == 0 {
+		return errs.Errorf("invalid config: memory soft limit requires a flush interval")
+	}
+	if cfg.WALSyncInterval < 0 {
+		return errs.Errorf("invalid config: negative wal sync interval: %v", cfg.WALSyncInterval)
+	}
+	if cfg.ReadOnly && (cfg.WAL || cfg.FlushInterval > 0 || cfg.MemorySoftLimit > 0 || cfg.MemoryHardLimit > 0) {
+		return errs.Errorf("invalid config: read only with the wal, a flush interval or memory limits")
+	}
+
+	if t.sched != nil {
+		_ = t.sched.Stop()
+		t.sched = nil
+	}
+	t.stopWalSync()
+
 	for _, ln := range t.lns {
 		_ = ln.Close()
 	}
 	clear(t.lns)
+	if t.wal != nil {
+		_ = t.wal.Close()
+	}
 
 	t.cfg = cfg
 	t.fs = fs
 	t.lns = t.lns[:0]
 	t.ms.Store(new(MemStore))
+	t.wal = nil
+	t.wsegs = nil
+	t.wseq = 0
+	t.shed.Store(0)
 
 	fh, err := fs.OpenRead(".")
 	if err != nil {
@@ -87,14 +255,39 @@ func (t *T) Init(fs *filesystem.T, cfg Config) (err error) {
 	}
 	defer fh.Close()
 
-	var files []filesystem.File
+	var files, wsegs, temps, markers, tombs []filesystem.File
 
 	for {
 		names, err := fh.Readdirnames(24)
 		for _, name := range names {
+			if name, ok := strings.CutSuffix(name, filesystem.TempSuffix); ok {
+				if file, ok := filesystem.ParseFile(name); ok && file.Kind == filesystem.KindTomb {
+					// an interrupted Delete only ever leaves the old file.
+					if cfg.ReadOnly {
+						continue
+					} else if err := fs.Remove(file.TempString()); err != nil {
+						return errs.Errorf("unable to remove temporary tombstones: %w", err)
+					}
+				} else if ok {
+					temps = append(temps, file)
+				}
+				continue
+			}
+
 			file, ok := filesystem.ParseFile(name)
 			if !ok {
 				continue
+			} else if file.Kind == filesystem.KindWlog {
+				wsegs = append(wsegs, file)
+				continue
+			} else if file.Kind == filesystem.KindCmpt {
+				markers = append(markers, file)
+				continue
+			} else if file.Kind == filesystem.KindTomb {
+				tombs = append(tombs, file)
+				continue
+			} else if file.Kind == filesystem.KindMnft {
+				continue // opened as a snapshot
 			}
 			files = append(files, file)
 		}
@@ -106,6 +299,14 @@ func (t *T) Init(fs *filesystem.T, cfg Config) (err error) {
 		}
 	}
 
+	if cfg.ReadOnly && (len(temps) > 0 || len(markers) > 0) {
+		return errs.Errorf("unable to open read only: the store has an interrupted level install or compaction to recover")
+	}
+	files, err = recoverLevels(fs, files, temps, markers)
+	if err != nil {
+		return errs.Errorf("unable to recover levels: %w", err)
+	}
+
 	pdqsort.Less(files, func(i, j int) bool {
 		return files[i].String() < files[j].String()
 	})
@@ -129,8 +330,9 @@ func (t *T) Init(fs *filesystem.T, cfg Config) (err error) {
 			return errs.Errorf("leveln missing keys")
 		} else if vals.Kind != filesystem.KindVals {
 			return errs.Errorf("leveln missing values")
-		} else if indx.Low != nlow {
-			return errs.Errorf("invalid next low gen: expect %d to be %d", indx.Low, nlow)
+		} else if indx.Low < nlow {
+			// levels removed by the retention policy leave gaps.
+			return errs.Errorf("invalid next low gen: expect %d to be at least %d", indx.Low, nlow)
 		}
 		nlow = indx.High
 
@@ -143,10 +345,202 @@ func (t *T) Init(fs *filesystem.T, cfg Config) (err error) {
 		files = files[3:]
 	}
 
+	// tombstones are left behind if a crash happens after a compaction
+	// removes their level.
+	for _, file := range tombs {
+		if !cfg.ReadOnly && !slices.ContainsFunc(t.lns, func(ln *levelN) bool {
+			return ln.low == file.Low && ln.high == file.High
+		}) {
+			if err := fs.Remove(file.String()); err != nil {
+				return errs.Errorf("unable to remove stale tombstones: %w", err)
+			}
+		}
+	}
+
+	// the wal is left alone because only writing a level makes its
+	// observations visible.
+	if !cfg.ReadOnly {
+		if err := t.initWal(wsegs, nlow); err != nil {
+			return err
+		}
+	}
+
+	if cfg.FlushInterval > 0 {
+		t.sched = newScheduler(t, &cfg)
+	}
+
 	return nil
 }
 
-func (t *T) QueryMetrics(q *query.Q, cb func(hash histdb.Hash, name []byte) bool) bool {
+// LastError returns the error from the last level written or compaction run
+// in the background if it failed, or nil once both have succeeded again. It
+// also returns any error writing the wal since the last WriteLevel.
+func (t *T) LastError() error {
+	var err error
+	if t.sched != nil {
+		err = t.sched.Err()
+	}
+
+	t.imu.Lock()
+	defer t.imu.Unlock()
+
+	if t.wal != nil {
+		err = errors.Join(err, t.wal.Err())
+	}
+	return err
+}
+
+// Shed returns the number of observations dropped because the memstore was
+// over the memory hard limit.
+func (t *T) Shed() uint64 { return t.shed.Load() }
+
+// limited returns true if there are any memory limits.
+func (t *T) limited() bool {
+	return t.cfg.MemorySoftLimit > 0 || t.cfg.MemoryHardLimit > 0
+}
+
+// observe counts n observations into the memstore and returns true if that
+// makes it time to check its size against the memory limits.
+func (ms *MemStore) observe(n uint64) bool {
+	now := ms.observed.Add(n)
+	return (now-n)/memoryCheckObservations != now/memoryCheckObservations
+}
+
+// admit returns true if n observations of the metric may be added to the
+// memstore, checking its size against the memory limits every
+// memoryCheckPeriod new metrics or memoryCheckObservations observations. Known
+// metrics are always admitted. It must be called with imu held.
+func (t *T) admit(ms *MemStore, metric []byte, n uint64) bool {
+	if !t.limited() {
+		return true
+	}
+
+	check := ms.observe(n)
+	_, known := ms.lookup(metric)
+	if !known {
+		ms.added++
+		check = check || ms.added%memoryCheckPeriod == 0
+	}
+	if check {
+		t.checkMemory(ms)
+	}
+
+	if !known && ms.full {
+		t.shed.Add(n)
+		return false
+	}
+	return true
+}
+
+// memSize returns the number of bytes used by the memstore along with the
+// buffers of the wal. It must be called with imu held.
+func (t *T) memSize(ms *MemStore) uint64 {
+	size := ms.I.Size() + ms.S.Size() + ms.fastSize
+	if t.wal != nil {
+		size += t.wal.size()
+	}
+	return size
+}
+
+// checkMemory marks the memstore full if it is over the memory hard limit and
+// cuts a level early if it is over the soft limit. It must be called with imu
+// held.
+func (t *T) checkMemory(ms *MemStore) {
+	size := t.memSize(ms)
+	if t.cfg.MemoryHardLimit > 0 && size > t.cfg.MemoryHardLimit {
+		ms.full = true
+	}
+	if t.cfg.MemorySoftLimit > 0 && size > t.cfg.MemorySoftLimit && t.sched != nil {
+		t.sched.Cut()
+	}
+}
+
+// empty returns true if nothing has been observed into the memstore.
+func (t *T) empty(ms *MemStore) bool {
+	t.imu.Lock()
+	defer t.imu.Unlock()
+
+	return ms.I.Cardinality() == 0
+}
+
+// initWal replays any wal segments that were not yet written into a level and
+// opens a new segment for observations if the wal is enabled. gen is the
+// generation the next WriteLevel will create.
+func (t *T) initWal(wsegs []filesystem.File, gen uint32) error {
+	pdqsort.Less(wsegs, func(i, j int) bool {
+		return wsegs[i].String() < wsegs[j].String()
+	})
+
+	ms := t.ms.Load()
+	for _, file := range wsegs {
+		t.wseq = max(t.wseq, file.High+1)
+
+		// segments for older generations were already written into a level
+		// and are only around because the remove after WriteLevel failed.
+		if file.Low < gen {
+			if err := t.fs.Remove(file.String()); err != nil {
+				return errs.Errorf("unable to remove stale wal: %w", err)
+			}
+			continue
+		}
+
+		// a crash during WriteLevel can leave a segment that was rotated for
+		// the next generation. its observations belong to this generation now.
+		if file.Low > gen {
+			nfile := filesystem.File{Low: gen, High: file.High, Kind: filesystem.KindWlog}
+			if err := t.fs.Rename(file.String(), nfile.String()); err != nil {
+				return errs.Errorf("unable to rename wal: %w", err)
+			}
+			file = nfile
+		}
+
+		if err := replayWal(t.fs, file, ms, t.cfg.CardFix); err != nil {
+			return errs.Errorf("unable to replay wal: %w", err)
+		}
+		t.wsegs = append(t.wsegs, file)
+	}
+
+	if !t.cfg.WAL {
+		return nil
+	}
+
+	wl, err := createWal(t.fs, t.nextWalFile(gen))
+	if err != nil {
+		return errs.Errorf("unable to create wal: %w", err)
+	}
+	t.wal = wl
+	ms.wal = wl
+
+	interval := t.cfg.WALSyncInterval
+	if interval == 0 {
+		interval = defaultWalSyncInterval
+	}
+	t.startWalSync(interval)
+
+	return nil
+}
+
+func (t *T) nextWalFile(gen uint32) filesystem.File {
+	t.wseq++
+	return filesystem.File{Low: gen, High: t.wseq - 1, Kind: filesystem.KindWlog}
+}
+
+// SyncWAL writes any buffered observations to the wal and syncs it to disk. It
+// returns any error encountered writing the wal since the last WriteLevel.
+func (t *T) SyncWAL() error {
+	t.imu.Lock()
+	defer t.imu.Unlock()
+
+	if t.wal == nil {
+		return nil
+	}
+	return t.wal.Sync()
+}
+
+// QueryMetrics calls cb with the hash and name of every metric in the levels
+// matching the query that has a value not hidden by a tombstone. It returns
+// false if cb stopped early.
+func (t *T) QueryMetrics(q *query.Q, cb func(hash histdb.Hash, name []byte) bool) (bool, error) {
 	t.qmu.RLock()
 	defer t.qmu.RUnlock()
 
@@ -159,18 +553,29 @@ func (t *T) QueryMetrics(q *query.Q, cb func(hash histdb.Hash, name []byte) bool
 	t.lmu.Unlock()
 
 	var set hashtbl.T[histdb.Hash, int]
+	var it leveln.Iterator
+	var err error
 
 	for i, ln := range lns {
 		ok := memindex.Iter(q.Eval(&ln.idx), func(id memindex.Id) bool {
 			hash, ok := ln.idx.GetHashById(id)
 			if !ok {
+				err = errs.Errorf("memindex inconsistent")
+				return false
+			}
+			// metrics with every value deleted are hidden.
+			var live bool
+			if live, err = ln.live(&it, hash); err != nil {
 				return false
+			} else if live {
+				set.Insert(hash, i)
 			}
-			set.Insert(hash, i)
 			return true
 		})
-		if !ok {
-			return false
+		if err != nil {
+			return false, err
+		} else if !ok {
+			return false, nil
 		}
 	}
 
@@ -179,143 +584,328 @@ func (t *T) QueryMetrics(q *query.Q, cb func(hash histdb.Hash, name []byte) bool
 		ln := lns[v]
 		name, ok := ln.idx.AppendNameByHash(k, name[:0])
 		if !ok {
+			err = errs.Errorf("memindex inconsistent")
 			return false
 		}
-		if !cb(k, name) {
-			return false
-		}
-		return true
-	})
+		return cb(k, name)
+	}), err
+}
+
+// QueryData calls cb with every value in the levels matching the query with a
+// timestamp in [from, to). Levels whose time range does not overlap the window
+// are skipped. The levels are scanned concurrently but cb is called serially
+// in generation and then key order.
+func (t *T) QueryData(q *query.Q, from, to uint32, cb func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool) (bool, error) {
+	return t.QueryDataStats(q, from, to, nil, cb)
 }
 
-func (t *T) QueryData(q *query.Q, after uint32, cb func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool) (bool, error) {
+// QueryDataStats is QueryData that also adds the work it did to stats if
+// stats is not nil.
+func (t *T) QueryDataStats(q *query.Q, from, to uint32, stats *QueryStats, cb func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool) (bool, error) {
 	t.qmu.RLock()
 	defer t.qmu.RUnlock()
 
+	olns := t.overlapping(from, to)
+	if len(olns) == 0 {
+		return true, nil
+	}
+
+	return t.queryLevels(olns, q, from, to, stats, cb)
+}
+
+// overlapping returns the levels that may have values in [from, to). It must
+// be called with qmu held so that the levels stay open.
+func (t *T) overlapping(from, to uint32) (olns []*levelN) {
 	t.lmu.Lock()
 
 	// SAFETY: t.lns is only either appended to in WriteLevel or fully replaced
 	// in CompactSuffix, so taking a shallow snapshot of the slice is safe.
 	lns := t.lns
 
-	if t.qst == nil || t.qst.Count() > 8000 {
-		t.qst = new(flathist.S)
+	t.lmu.Unlock()
+
+	for _, ln := range lns {
+		if ln.Overlaps(from, to) {
+			olns = append(olns, ln)
+		}
 	}
-	h := t.qst.New()
+	return olns
+}
 
-	t.lmu.Unlock()
+// Latest returns the newest timestamp of any value in the levels and false if
+// there are no values.
+func (t *T) Latest() (ts uint32, ok bool) {
+	t.lmu.Lock()
+	defer t.lmu.Unlock()
 
-	var name []byte
-	var err error
-	var it leveln.Iterator
+	for _, ln := range t.lns {
+		if ln.tmin <= ln.tmax {
+			ts, ok = max(ts, ln.tmax), true
+		}
+	}
+	return ts, ok
+}
 
-	for _, ln := range lns {
-		// TODO: this could all be done in parallel
+func (t *T) Observe(metric []byte, val float32) {
+	if t.cfg.ReadOnly {
+		return
+	} else if t.observeFast(metric, 1, func(s *flathist.S, h flathist.H, wl *wal) {
+		s.Observe(h, val)
+		if wl != nil {
+			wl.observe(metric, val)
+		}
+	}) {
+		return
+	}
 
-		it.Init(ln.fh.keys, ln.fh.vals)
+	t.imu.Lock()
+	defer t.imu.Unlock()
 
-		ok := memindex.Iter(q.Eval(&ln.idx), func(id memindex.Id) bool {
-			hash, ok := ln.idx.GetHashById(id)
-			if !ok {
-				return false
-			}
-			name, ok = ln.idx.AppendNameById(id, name[:0])
-			if !ok {
-				return false
-			}
+	ms := t.ms.Load()
+	if ms == nil || !t.admit(ms, metric, 1) {
+		return
+	}
 
-			var key histdb.Key
-			*key.HashPtr() = hash
-			key.SetTimestamp(after)
+	ms.S.Observe(ms.handle(metric, t.cfg.CardFix), val)
 
-			// this maybe skips seeks but is maybe an invalid optimization have to think about it.
-			// if something goes wrong, try removing this if statement first lol.
-			if k := it.Key(); string(k[:]) < string(key[:]) {
-				it.Seek(key)
-			}
+	if t.wal != nil {
+		t.wal.observe(metric, val)
+	}
+}
 
-			for it.Err() == nil {
-				if it.Key().Hash() != hash {
-					break
-				}
+// ObserveN adds the value to the metric n times.
+func (t *T) ObserveN(metric []byte, val float32, n uint64) {
+	if n == 0 || t.cfg.ReadOnly {
+		return
+	}
 
-				var r rwutils.R
-				r.Init(buffer.OfLen(it.Value()))
+	if t.observeFast(metric, n, func(s *flathist.S, h flathist.H, wl *wal) {
+		s.ObserveN(h, val, n)
+		if wl != nil {
+			wl.observeN(metric, val, n)
+		}
+	}) {
+		return
+	}
 
-				t.qst.Reset(h)
-				flathist.ReadFrom(t.qst, h, &r)
-				if _, err = r.Done(); err != nil {
-					return false
-				}
+	t.imu.Lock()
+	defer t.imu.Unlock()
 
-				if !cb(key, name, t.qst, h) {
-					return false
-				}
+	ms := t.ms.Load()
+	if ms == nil || !t.admit(ms, metric, n) {
+		return
+	}
 
-				if !it.Next() {
-					break
-				}
-			}
-			err = it.Err()
+	ms.S.ObserveN(ms.handle(metric, t.cfg.CardFix), val, n)
 
-			return ok && err == nil
-		})
-		if !ok || err != nil {
-			return ok, err
+	if t.wal != nil {
+		t.wal.observeN(metric, val, n)
+	}
+}
+
+// ObserveMany adds all of the values to the metric with a single index lookup.
+func (t *T) ObserveMany(metric []byte, vals []float32) {
+	if len(vals) == 0 || t.cfg.ReadOnly {
+		return
+	}
+
+	if t.observeFast(metric, uint64(len(vals)), func(s *flathist.S, h flathist.H, wl *wal) {
+		for _, val := range vals {
+			s.Observe(h, val)
+		}
+		if wl != nil {
+			wl.observeMany(metric, vals)
 		}
+	}) {
+		return
 	}
 
-	return true, nil
-}
+	t.imu.Lock()
+	defer t.imu.Unlock()
 
-func (t *T) Observe(metric []byte, val float32) {
 	ms := t.ms.Load()
-	if ms == nil {
+	if ms == nil || !t.admit(ms, metric, uint64(len(vals))) {
 		return
 	}
 
-	// TODO: this mutex is going to hurt scalability of writes in the case that
-	// we're not adding a new value to the index but i'm not sure of how to
-	// avoid it because in the case there is a new value it has to coodinate
-	// with all of the people not adding new values in some way that causes
-	// those to not contend with each other. meh. maybe the index can
-	// periodically publish a read-only set of hash->id pairs?
+	h := ms.handle(metric, t.cfg.CardFix)
+	for _, val := range vals {
+		ms.S.Observe(h, val)
+	}
+
+	if t.wal != nil {
+		t.wal.observeMany(metric, vals)
+	}
+}
+
+// ObserveHistogram adds all of the observations in the histogram to the
+// metric with a single index lookup. The histogram is finalized, so it must
+// not be modified concurrently.
+func (t *T) ObserveHistogram(metric []byte, hist *flathist.Histogram) {
+	if t.cfg.ReadOnly {
+		return
+	}
+	hist.Finalize()
+	hs, hh := hist.Handle()
+
 	t.imu.Lock()
 	defer t.imu.Unlock()
 
-	_, id, _, ok := ms.I.Add(metric, nil, t.cfg.CardFix)
+	ms := t.ms.Load()
+	if ms == nil || !t.admit(ms, metric, hs.Total(hh)) {
+		return
+	}
 
-	var h flathist.H
-	if ok {
-		h = ms.S.New()
-	} else {
-		h = flathist.UnsafeRawH(id + 1)
+	h := ms.handle(metric, t.cfg.CardFix)
+
+	// Merge is not safe to call concurrently with Observe on the same
+	// histogram, so send any new fast path observations to the slow path and
+	// wait for the ones in progress to finish.
+	ms.merging.Store(true)
+	for ms.active.Load() != 0 {
+		runtime.Gosched()
 	}
+	flathist.Merge(&ms.S, h, hs, hh)
+	ms.merging.Store(false)
 
-	ms.S.Observe(h, val)
+	if t.wal != nil {
+		t.wal.histogram(metric, hs, hh)
+	}
+}
+
+// observeFast calls fn with the histogram for the metric and the wal segment of
+// the memstore, if any, without taking imu if the metric is already known to
+// the current memstore. It returns false if the slow path must be used. fn
+// runs while registered as active so that WriteLevel does not close the
+// segment until it is done.
+func (t *T) observeFast(metric []byte, n uint64, fn func(s *flathist.S, h flathist.H, wl *wal)) bool {
+	for {
+		ms := t.ms.Load()
+		if ms == nil {
+			return true
+		}
+
+		// register before checking that the memstore is still current so
+		// that WriteLevel and ObserveHistogram either see us in active or we
+		// see their changes.
+		ms.active.Add(1)
+		if t.ms.Load() != ms {
+			ms.active.Add(-1)
+			continue
+		} else if ms.merging.Load() {
+			ms.active.Add(-1)
+			return false
+		}
+
+		h, ok := ms.lookup(metric)
+		if ok {
+			fn(&ms.S, h, ms.wal)
+		}
+		ms.active.Add(-1)
+
+		// the size is checked under imu like on the slow path, but only as
+		// often as observations cross memoryCheckObservations.
+		if ok && t.limited() && ms.observe(n) {
+			t.imu.Lock()
+			if t.ms.Load() == ms {
+				t.checkMemory(ms)
+			}
+			t.imu.Unlock()
+		}
+
+		return ok
+	}
 }
 
 func (t *T) WriteLevel(ts, dur uint32) (err error) {
+	if t.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+
 	t.wmu.Lock()
 	defer t.wmu.Unlock()
 
-	ms, err := func() (*MemStore, error) {
+	var gen uint32
+
+	// SAFETY: the largest generation is the high of the last leveln, if it
+	// exists, and 0 otherwise. it's possible that t.lns is modified immediately
+	// after this mutex by CompactSuffix, but compaction does not change the max
+	// generation: the only function that modifies the last entry's high is
+	// WriteLevel, and it has a mutex.
+	t.lmu.Lock()
+	if len(t.lns) > 0 {
+		gen = t.lns[len(t.lns)-1].high
+	}
+	t.lmu.Unlock()
+
+	ms, wsegs, err := func() (*MemStore, []filesystem.File, error) {
 		t.imu.Lock()
 		defer t.imu.Unlock()
 
 		ms := t.ms.Load()
 		if ms == nil {
-			return nil, errs.Errorf("memstore is nil (store closed or not initialized)")
+			return nil, nil, errs.Errorf("memstore is nil (store closed or not initialized)")
 		}
-		if !t.ms.CompareAndSwap(ms, new(MemStore)) {
-			return nil, errs.Errorf("impossible compare and swap failed")
+
+		// observations after the swap belong to the next generation so they
+		// go into a new segment. the old segments are removed once the level
+		// holding their observations is durable.
+		wsegs := t.wsegs
+		if t.wal != nil {
+			wl, err := createWal(t.fs, t.nextWalFile(gen+1))
+			if err != nil {
+				return nil, nil, errs.Errorf("unable to create wal: %w", err)
+			}
+			wsegs = append(wsegs, t.wal.file)
+			t.wal = wl
+		}
+		t.wsegs = nil
+
+		if !t.ms.CompareAndSwap(ms, &MemStore{wal: t.wal}) {
+			return nil, nil, errs.Errorf("impossible compare and swap failed")
 		}
-		return ms, nil
+		return ms, wsegs, nil
 	}()
 	if err != nil {
 		return err
 	}
 
+	// wait for any fast path observations that loaded the old memstore
+	// before the swap. they may still be writing to its segment.
+	for ms.active.Load() != 0 {
+		runtime.Gosched()
+	}
+	if ms.wal != nil {
+		_ = ms.wal.Close() // errors are only for observations in the old memstore
+	}
+
+	defer func() {
+		if err == nil {
+			for _, file := range wsegs {
+				_ = t.fs.Remove(file.String())
+			}
+			return
+		}
+
+		t.imu.Lock()
+		defer t.imu.Unlock()
+
+		// the observations in the old memstore are dropped, but the level
+		// for this generation will now be written from the new memstore, so
+		// its segment has to be renamed to match. the old segments are kept
+		// so that they are only removed with that level.
+		if t.wal != nil && t.wal.file.Low != gen {
+			nfile := t.wal.file
+			nfile.Low = gen
+			if rerr := t.fs.Rename(t.wal.file.String(), nfile.String()); rerr != nil {
+				t.wal.setErr(errs.Errorf("unable to rename wal: %w", rerr))
+			} else {
+				t.wal.file = nfile
+			}
+		}
+		t.wsegs = append(wsegs, t.wsegs...)
+	}()
+
 	ms.S.Finalize()
 
 	type idHash struct {
@@ -335,19 +925,6 @@ func (t *T) WriteLevel(ts, dur uint32) (err error) {
 		return string(metrics[i].hash[:]) < string(metrics[j].hash[:])
 	})
 
-	var gen uint32
-
-	// SAFETY: the largest generation is the high of the last leveln, if it
-	// exists, and 0 otherwise. it's possible that t.lns is modified immediately
-	// after this mutex by CompactSuffix, but compaction does not change the max
-	// generation: the only function that modifies the last entry's high is
-	// WriteLevel, and it has a mutex.
-	t.lmu.Lock()
-	if len(t.lns) > 0 {
-		gen = t.lns[len(t.lns)-1].high
-	}
-	t.lmu.Unlock()
-
 	ln, err := newLevelN(t.fs, gen, gen+1)
 	if err != nil {
 		return errs.Errorf("unable to create leveln: %w", err)
@@ -392,6 +969,22 @@ func (t *T) WriteLevel(ts, dur uint32) (err error) {
 	if err := lnw.Finish(); err != nil {
 		return errs.Errorf("unable to finish leveln: %w", err)
 	}
+	ln.tmin, ln.tmax = lnw.TimeRange()
+
+	// the tombstones are written before the level is installed because Init
+	// removes the tombstones of a level that was not.
+	if tombs := levelTombstones(ms.tombs, ts); len(tombs) > 0 {
+		tombs = ln.addTombstones(tombs)
+		if err := ln.writeTombstones(tombs); err != nil {
+			return errs.Errorf("unable to write tombstones: %w", err)
+		}
+		defer func() {
+			if err != nil {
+				_ = t.fs.Remove(ln.file(filesystem.KindTomb))
+			}
+		}()
+		ln.tombs = tombs
+	}
 
 	w.Reset()
 	memindex.AppendTo(&ln.idx, &w)
@@ -399,8 +992,8 @@ func (t *T) WriteLevel(ts, dur uint32) (err error) {
 		return errs.Errorf("unable to write memindex: %w", err)
 	}
 
-	if err := ln.Sync(); err != nil {
-		return errs.Errorf("unable to sync leveln: %w", err)
+	if err := ln.Install(); err != nil {
+		return errs.Errorf("unable to install leveln: %w", err)
 	}
 
 	// SAFETY: other functions assume that WriteLevel will only ever append to
@@ -413,6 +1006,10 @@ func (t *T) WriteLevel(ts, dur uint32) (err error) {
 }
 
 func (t *T) CompactSuffix() (err error) {
+	if t.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+
 	t.cmu.Lock()
 	defer t.cmu.Unlock()
 
@@ -440,10 +1037,28 @@ func (t *T) CompactSuffix() (err error) {
 		return nil
 	}
 
-	ln, err := compact(t.fs, clns)
+	ret := newRetention(t.cfg, newest(lns))
+	ln, err := compact(t.fs, clns, ret, t.cfg.CardFix)
 	if err != nil {
 		return errs.Errorf("unable to compact: %w", err)
 	}
+	if ret != nil {
+		ln.policy = ret.now
+	}
+
+	// the marker records that the new level replaces the inputs. once it is
+	// durable, Init will finish installing the level and remove the inputs
+	// after a crash. without it, Init removes the temporary files instead.
+	marker := filesystem.File{Low: ln.low, High: ln.high, Kind: filesystem.KindCmpt}
+	if err := t.createMarker(marker); err != nil {
+		_ = ln.Remove()
+		return errs.Errorf("unable to create compaction marker: %w", err)
+	}
+	if err := ln.Install(); err != nil {
+		_ = ln.Remove()
+		_ = t.fs.Remove(marker.String())
+		return errs.Errorf("unable to install leveln: %w", err)
+	}
 
 	t.lmu.Lock()
 
@@ -461,13 +1076,183 @@ func (t *T) CompactSuffix() (err error) {
 	_ = 0 // staticcheck incorrectly complains about empty critical section
 	t.qmu.Unlock()
 
+	// the marker is only removed once every input is gone so that Init can
+	// finish removing them if any of them fail.
+	var eg errs.Group
 	for _, ln := range clns {
-		_ = ln.Remove()
+		eg.Add(ln.Remove())
+	}
+	eg.Add(t.fs.SyncDir("."))
+	if err := eg.Err(); err != nil {
+		return errs.Errorf("unable to remove compacted levels: %w", err)
+	}
+
+	return errs.Wrap(t.fs.Remove(marker.String()))
+}
+
+// createMarker durably creates the empty marker file after making sure that
+// every file written before it is durable.
+// newest returns the newest timestamp in the levels. It is used as the current
+// time for the retention policy so that it only depends on the data in the
+// store.
+func newest(lns []*levelN) (now uint32) {
+	for _, ln := range lns {
+		if ln.tmin <= ln.tmax {
+			now = max(now, ln.tmax)
+		}
+	}
+	return now
+}
+
+// ApplyRetention applies the retention policy to the levels that compacting
+// the suffix does not reach. Levels whose values are all older than Retain
+// are removed, and the oldest level with values that aged into a rollup or
+// past Retain since the policy was last applied to it is rewritten. Only one
+// level is rewritten per call to bound the work.
+func (t *T) ApplyRetention() error {
+	if t.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+
+	t.cmu.Lock()
+	defer t.cmu.Unlock()
+
+	// SAFETY: t.lns is only either appended to in WriteLevel or fully replaced
+	// in CompactSuffix or here, so taking a shallow snapshot of the slice is
+	// safe.
+	t.lmu.Lock()
+	lns := t.lns
+	t.lmu.Unlock()
+
+	ret := newRetention(t.cfg, newest(lns))
+	if ret == nil {
+		return nil
+	}
+
+	var expired, kept []*levelN
+	for _, ln := range lns {
+		if ret.expires(ln) {
+			expired = append(expired, ln)
+		} else {
+			kept = append(kept, ln)
+		}
+	}
+
+	if len(expired) > 0 {
+		t.replaceLevels(func(ln *levelN) *levelN {
+			if slices.Contains(expired, ln) {
+				return nil
+			}
+			return ln
+		})
+
+		var eg errs.Group
+		for _, ln := range expired {
+			eg.Add(ln.Expire())
+		}
+		if err := eg.Err(); err != nil {
+			return errs.Errorf("unable to remove expired levels: %w", err)
+		}
+	}
+
+	for _, ln := range kept {
+		if ln.policy > 0 && !ret.crosses(ln, ln.policy) {
+			continue
+		} else if ln.policy == 0 {
+			changes, err := ret.changes(ln)
+			if err != nil {
+				return errs.Errorf("unable to check level %d-%d: %w", ln.low, ln.high, err)
+			} else if !changes {
+				ln.policy = ret.now
+				continue
+			}
+		}
+
+		if err := t.rewriteLevel(ln, ret); err != nil {
+			return errs.Errorf("unable to rewrite level %d-%d: %w", ln.low, ln.high, err)
+		}
+		return nil
 	}
 
 	return nil
 }
 
+// rewriteLevel compacts the level by itself to apply the retention policy and
+// installs the result over it. It must be called with cmu held.
+func (t *T) rewriteLevel(old *levelN, ret *retention) error {
+	ln, err := compact(t.fs, []*levelN{old}, ret, t.cfg.CardFix)
+	if err != nil {
+		return err
+	}
+	ln.policy = ret.now
+
+	// the new files replace the old ones as they are renamed, so once the
+	// marker is durable an interrupted install is only ever finished: Init
+	// installs the rest of the files.
+	marker := filesystem.File{Low: ln.low, High: ln.high, Kind: filesystem.KindCmpt}
+	if err := t.createMarker(marker); err != nil {
+		_ = ln.Remove()
+		return errs.Errorf("unable to create compaction marker: %w", err)
+	}
+	if err := ln.Install(); err != nil {
+		return errs.Errorf("unable to install leveln: %w", err)
+	}
+
+	t.replaceLevels(func(cur *levelN) *levelN {
+		if cur == old {
+			return ln
+		}
+		return cur
+	})
+
+	// compaction dropped the values hidden by the tombstones, so they are
+	// not kept for the new level.
+	var eg errs.Group
+	eg.Add(old.Close())
+	if len(old.tombs) > 0 {
+		eg.Add(t.fs.Remove(old.file(filesystem.KindTomb)))
+		eg.Add(t.fs.SyncDir("."))
+	}
+	if err := eg.Err(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	return errs.Wrap(t.fs.Remove(marker.String()))
+}
+
+// replaceLevels replaces every level with the result of fn, dropping it if
+// that is nil, and then waits for any queries using the old levels to finish.
+func (t *T) replaceLevels(fn func(ln *levelN) *levelN) {
+	t.lmu.Lock()
+	var nlns []*levelN
+	for _, ln := range t.lns {
+		if ln = fn(ln); ln != nil {
+			nlns = append(nlns, ln)
+		}
+	}
+	t.lns = nlns
+	t.lmu.Unlock()
+
+	t.qmu.Lock()
+	_ = 0 // staticcheck incorrectly complains about empty critical section
+	t.qmu.Unlock()
+}
+
+func (t *T) createMarker(marker filesystem.File) error {
+	if err := t.fs.SyncDir("."); err != nil {
+		return err
+	}
+	fh, err := t.fs.Create(marker.String())
+	if err != nil {
+		return err
+	}
+	if err := errs.Combine(fh.Sync(), fh.Close()); err != nil {
+		_ = t.fs.Remove(marker.String())
+		return errs.Wrap(err)
+	}
+	return t.fs.SyncDir(".")
+}
+
 func stringLevel(ln *levelN) string {
 	return fmt.Sprintf("(ln %d %d %d)", ln.low, ln.high, ln.Depth())
 }
@@ -1,13 +1,25 @@
 package store
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/aclements/go-perfevent/perfbench"
 	"github.com/zeebo/assert"
 	"github.com/zeebo/mwc"
 
 	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/card"
 	"github.com/histdb/histdb/filesystem"
 	"github.com/histdb/histdb/flathist"
 	"github.com/histdb/histdb/query"
@@ -57,7 +69,7 @@ func TestStore(t *testing.T) {
 	assert.NoError(t, st.WriteLevel(1000, 1))
 
 	called := false
-	ok, err := st.QueryData(&q, 0, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+	ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
 		assert.Equal(t, int(st.Total(h)), numObservations)
 		called = true
 		return true
@@ -98,7 +110,7 @@ func TestStore_Compact(t *testing.T) {
 	assert.NoError(t, query.Parse([]byte("{zzz|}"), &q))
 
 	called := 0
-	ok, err := st.QueryData(&q, 0, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+	ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
 		assert.Equal(t, int(st.Total(h)), numObservations)
 		called++
 		return true
@@ -108,6 +120,1452 @@ func TestStore_Compact(t *testing.T) {
 	assert.Equal(t, called, numMetrics)
 }
 
+func TestStore_WAL(t *testing.T) {
+	const (
+		numMetrics      = 100
+		numObservations = 10
+	)
+
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, query.Parse([]byte("{zzz|}"), &q))
+
+	count := func() (n int) {
+		ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+			assert.Equal(t, int(st.Total(h)), numObservations)
+			n++
+			return true
+		})
+		assert.NoError(t, err)
+		assert.That(t, ok)
+		return n
+	}
+
+	assert.NoError(t, st.Init(fs, Config{WAL: true}))
+	for range numMetrics {
+		m := append(testhelp.Metric(5), ",zzz=1"...)
+		for range numObservations {
+			st.Observe(m, mwc.Float32())
+		}
+	}
+	assert.NoError(t, st.SyncWAL())
+
+	// a torn batch at the end of the segment should be ignored.
+	fh, err := fs.OpenWrite(st.wal.file.String())
+	assert.NoError(t, err)
+	_, err = fh.WriteAt([]byte{1, 2, 3}, 1<<20)
+	assert.NoError(t, err)
+	assert.NoError(t, fh.Close())
+
+	// reopening without writing a level replays the observations.
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, Config{WAL: true}))
+	assert.NoError(t, st.WriteLevel(1, 1))
+	assert.Equal(t, count(), numMetrics)
+
+	// the replayed observations are not replayed again after being written.
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, Config{WAL: true}))
+	assert.NoError(t, st.WriteLevel(2, 1))
+	assert.Equal(t, count(), numMetrics)
+	assert.NoError(t, st.Close())
+
+	// observing many values writes a single entry that is replayed.
+	vals := make([]float32, numObservations)
+	assert.NoError(t, st.Init(fs, Config{WAL: true}))
+	st.ObserveMany([]byte("zzz=3"), vals)
+	assert.NoError(t, st.SyncWAL())
+	size, err := st.wal.fh.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, size, 8+walFrameHeaderSize+1+1+len("zzz=3")+1+4*numObservations)
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, Config{WAL: true}))
+	assert.NoError(t, st.WriteLevel(3, 1))
+	assert.Equal(t, count(), numMetrics+1)
+	assert.NoError(t, st.Close())
+
+	// observations are written to the segment in the background without a
+	// full batch or a call to SyncWAL.
+	assert.NoError(t, st.Init(fs, Config{WAL: true, WALSyncInterval: time.Millisecond}))
+	st.Observe([]byte("zzz=2"), 1)
+	for {
+		var ms MemStore
+		assert.NoError(t, replayWal(fs, st.wal.file, &ms, nil))
+		if ms.I.Cardinality() == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(t, st.LastError())
+
+	// failing to write the segment is reported.
+	assert.NoError(t, st.wal.fh.Close())
+	st.Observe([]byte("zzz=2"), 1)
+	assert.Error(t, st.SyncWAL())
+	assert.Error(t, st.LastError())
+	assert.Error(t, st.Close())
+
+	assert.Error(t, st.Init(fs, Config{WAL: true, WALSyncInterval: -1}))
+}
+
+func TestStore_ReadOnly(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, query.Parse([]byte("{zzz|}"), &q))
+
+	names := func() []string {
+		ents, err := os.ReadDir(fs.Base)
+		assert.NoError(t, err)
+		var names []string
+		for _, ent := range ents {
+			names = append(names, ent.Name())
+		}
+		return names
+	}
+	count := func() (n uint64) {
+		_, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+			n += st.Total(h)
+			return true
+		})
+		assert.NoError(t, err)
+		return n
+	}
+
+	// a level, and a wal segment for the next one.
+	assert.NoError(t, st.Init(fs, Config{WAL: true}))
+	st.Observe([]byte("zzz=1"), 1)
+	assert.NoError(t, st.WriteLevel(1, 1))
+	st.Observe([]byte("zzz=2"), 1)
+	assert.NoError(t, st.Close())
+	before := names()
+
+	assert.Error(t, st.Init(fs, Config{ReadOnly: true, WAL: true}))
+	assert.Error(t, st.Init(fs, Config{ReadOnly: true, FlushInterval: time.Second}))
+
+	// the levels are visible and the wal is left alone, but nothing can be
+	// changed.
+	assert.NoError(t, st.Init(fs, Config{ReadOnly: true}))
+	assert.Equal(t, count(), 1)
+	st.Observe([]byte("zzz=1"), 1)
+	st.Observe([]byte("zzz=3"), 1)
+	st.ObserveMany([]byte("zzz=3"), []float32{1})
+	assert.Equal(t, st.DebugMemStore().I.Cardinality(), 0)
+	assert.That(t, errors.Is(st.WriteLevel(2, 1), ErrReadOnly))
+	assert.That(t, errors.Is(st.CompactSuffix(), ErrReadOnly))
+	assert.That(t, errors.Is(st.Delete(&q, 0, 10), ErrReadOnly))
+	assert.NoError(t, st.Close())
+	assert.Equal(t, names(), before)
+
+	// an interrupted install must be recovered by opening it normally.
+	fh, err := fs.Create(filesystem.File{Low: 1, High: 2, Kind: filesystem.KindIndx}.TempString())
+	assert.NoError(t, err)
+	assert.NoError(t, fh.Close())
+	assert.Error(t, st.Init(fs, Config{ReadOnly: true}))
+	assert.NoError(t, st.Init(fs, Config{}))
+	assert.NoError(t, st.Close())
+}
+
+func TestStore_Corrupt(t *testing.T) {
+	for _, kind := range []uint8{filesystem.KindIndx, filesystem.KindKeys, filesystem.KindVals} {
+		fs, cleanup := testhelp.FS(t)
+		defer cleanup()
+
+		var st T
+
+		assert.NoError(t, st.Init(fs, Config{}))
+		for range 100 {
+			st.Observe(testhelp.Metric(5), mwc.Float32())
+		}
+		assert.NoError(t, st.WriteLevel(1, 1))
+		assert.NoError(t, st.Close())
+
+		name := filesystem.File{Low: 0, High: 1, Kind: kind}.String()
+		fh, err := fs.OpenWrite(name)
+		assert.NoError(t, err)
+		size, err := fh.Size()
+		assert.NoError(t, err)
+		assert.NoError(t, fh.Truncate(size-1))
+		assert.NoError(t, fh.Close())
+
+		var cerr *CorruptError
+		err = st.Init(fs, Config{})
+		assert.That(t, errors.As(err, &cerr))
+		assert.Equal(t, cerr.File, name)
+	}
+}
+
+func TestStore_Migrate(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	for ts := uint32(10); ts <= 20; ts += 10 {
+		for i := range 100 {
+			st.Observe(fmt.Appendf(nil, "a=%d", i), float32(ts))
+		}
+		assert.NoError(t, st.WriteLevel(ts, 10))
+	}
+	assert.NoError(t, st.Close())
+
+	// strip the first level down to the layout from before footers: the same
+	// contents without footers and without the 12 byte keys trailer.
+	for _, kind := range levelKinds {
+		fh, err := fs.OpenWrite(filesystem.File{Low: 0, High: 1, Kind: kind}.String())
+		assert.NoError(t, err)
+		size, err := fh.Size()
+		assert.NoError(t, err)
+		size -= histdb.FooterSize
+		if kind == filesystem.KindKeys {
+			size -= 12
+		}
+		assert.NoError(t, fh.Truncate(size))
+		assert.NoError(t, fh.Close())
+	}
+
+	var lerr *LayoutError
+	err := st.Init(fs, Config{})
+	assert.That(t, errors.As(err, &lerr))
+	assert.That(t, strings.Contains(err.Error(), "histdb migrate"))
+
+	n, err := Migrate(fs)
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+
+	// running it again does nothing.
+	n, err = Migrate(fs)
+	assert.NoError(t, err)
+	assert.Equal(t, n, 0)
+
+	l, err := OpenLevel(fs, LevelRange{Low: 0, High: 1})
+	assert.NoError(t, err)
+	tmin, tmax := l.TimeRange()
+	assert.Equal(t, [2]uint32{tmin, tmax}, [2]uint32{10, 10})
+	assert.NoError(t, l.Verify())
+	assert.NoError(t, l.Close())
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	defer st.Close()
+
+	var q query.Q
+	assert.NoError(t, query.Parse([]byte("{a|}"), &q))
+	counts := make(map[uint32]int)
+	_, err = st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, s *flathist.S, h flathist.H) bool {
+		counts[key.Timestamp()]++
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, counts, map[uint32]int{10: 100, 20: 100})
+}
+
+func TestStore_KeysVersion(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	st.Observe(testhelp.Metric(5), mwc.Float32())
+	assert.NoError(t, st.WriteLevel(1, 1))
+	assert.NoError(t, st.Close())
+
+	// the version is the last field before the footer.
+	name := filesystem.File{Low: 0, High: 1, Kind: filesystem.KindKeys}.String()
+	fh, err := fs.OpenWrite(name)
+	assert.NoError(t, err)
+	size, err := fh.Size()
+	assert.NoError(t, err)
+	_, err = fh.WriteAt([]byte{2, 0, 0, 0}, size-histdb.FooterSize-4)
+	assert.NoError(t, err)
+	assert.NoError(t, fh.Close())
+
+	var cerr *CorruptError
+	err = st.Init(fs, Config{})
+	assert.That(t, errors.As(err, &cerr))
+	assert.Equal(t, cerr.File, name)
+	assert.That(t, strings.Contains(err.Error(), "unknown version: 2"))
+}
+
+func TestStore_CorruptByte(t *testing.T) {
+	for _, kind := range []uint8{filesystem.KindKeys, filesystem.KindVals} {
+		fs, cleanup := testhelp.FS(t)
+		defer cleanup()
+
+		var st T
+
+		assert.NoError(t, st.Init(fs, Config{}))
+		for range 100 {
+			st.Observe(testhelp.Metric(5), mwc.Float32())
+		}
+		assert.NoError(t, st.WriteLevel(1, 1))
+		assert.NoError(t, st.Close())
+
+		name := filesystem.File{Low: 0, High: 1, Kind: kind}.String()
+		fh, err := fs.OpenWrite(name)
+		assert.NoError(t, err)
+		size, err := fh.Size()
+		assert.NoError(t, err)
+		buf := make([]byte, 1)
+		_, err = fh.ReadAt(buf, size/2)
+		assert.NoError(t, err)
+		_, err = fh.WriteAt([]byte{^buf[0]}, size/2)
+		assert.NoError(t, err)
+		assert.NoError(t, fh.Close())
+
+		// opening only checks the length of the keys and values.
+		assert.NoError(t, st.Init(fs, Config{}))
+		assert.NoError(t, st.Close())
+
+		l, err := OpenLevel(fs, LevelRange{Low: 0, High: 1})
+		assert.NoError(t, err)
+
+		var cerr *CorruptError
+		assert.That(t, errors.As(l.Verify(), &cerr))
+		assert.Equal(t, cerr.File, name)
+		assert.NoError(t, l.Close())
+	}
+}
+
+func TestStore_Inspect(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	for gen := range 2 {
+		for range 100 {
+			st.Observe(testhelp.Metric(5), mwc.Float32())
+		}
+		assert.NoError(t, st.WriteLevel(uint32(gen+1), 1))
+	}
+	assert.NoError(t, st.Close())
+
+	// temporary files are not levels.
+	fh, err := fs.Create(filesystem.File{Low: 2, High: 3, Kind: filesystem.KindKeys}.TempString())
+	assert.NoError(t, err)
+	assert.NoError(t, fh.Close())
+
+	lrs, err := ListLevels(fs)
+	assert.NoError(t, err)
+	assert.Equal(t, lrs, []LevelRange{{0, 1}, {1, 2}})
+
+	l, err := OpenLevel(fs, lrs[1])
+	assert.NoError(t, err)
+	assert.Equal(t, l.Range(), lrs[1])
+	assert.Equal(t, l.Index().Cardinality(), 100)
+	tmin, tmax := l.TimeRange()
+	assert.Equal(t, [2]uint32{tmin, tmax}, [2]uint32{2, 2})
+	assert.NoError(t, l.Verify())
+	assert.NoError(t, l.Close())
+
+	// a changed byte in a value is only found by the checksum.
+	name := filesystem.File{Low: 1, High: 2, Kind: filesystem.KindVals}.String()
+	fh, err = fs.OpenWrite(name)
+	assert.NoError(t, err)
+	_, err = fh.WriteAt([]byte{0xff}, histdb.HashSize+12)
+	assert.NoError(t, err)
+	assert.NoError(t, fh.Close())
+
+	l, err = OpenLevel(fs, lrs[1])
+	assert.NoError(t, err)
+	defer l.Close()
+
+	var cerr *CorruptError
+	assert.That(t, errors.As(l.Verify(), &cerr))
+	assert.Equal(t, cerr.File, name)
+}
+
+func TestStore_Recover(t *testing.T) {
+	const numMetrics = 100
+
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, query.Parse([]byte("{zzz|}"), &q))
+
+	count := func() (n int) {
+		ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+			n++
+			return true
+		})
+		assert.NoError(t, err)
+		assert.That(t, ok)
+		return n
+	}
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	for gen := range 2 {
+		for range numMetrics / 2 {
+			st.Observe(append(testhelp.Metric(5), ",zzz=1"...), mwc.Float32())
+		}
+		assert.NoError(t, st.WriteLevel(uint32(gen+1), 1))
+	}
+
+	// a compaction that crashed before its marker is rolled back.
+	ln, err := compact(fs, st.lns, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ln.Close())
+
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, Config{}))
+	assert.Equal(t, stringLevels(st.lns), "(ln 0 1 1) (ln 1 2 1)")
+	assert.Equal(t, count(), numMetrics)
+
+	// a compaction that crashed after its marker is finished.
+	ln, err = compact(fs, st.lns, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ln.Close())
+	assert.NoError(t, st.createMarker(filesystem.File{Low: 0, High: 2, Kind: filesystem.KindCmpt}))
+
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, Config{}))
+	assert.Equal(t, stringLevels(st.lns), "(ln 0 2 2)")
+	assert.Equal(t, count(), numMetrics)
+	assert.NoError(t, st.Close())
+
+	fh, err := fs.OpenRead(".")
+	assert.NoError(t, err)
+	names, err := fh.Readdirnames(-1)
+	assert.NoError(t, err)
+	assert.NoError(t, fh.Close())
+	assert.Equal(t, len(names), 3)
+}
+
+func TestStore_QueryOrder(t *testing.T) {
+	const (
+		numLevels  = 20
+		numMetrics = 50
+	)
+
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, st.Init(fs, Config{QueryWorkers: 4}))
+	defer st.Close()
+
+	for gen := range numLevels {
+		for range numMetrics {
+			st.Observe(fmt.Appendf(testhelp.Metric(5), ",zzz=%02d", gen), mwc.Float32())
+		}
+		assert.NoError(t, st.WriteLevel(uint32(gen+1), 1))
+	}
+
+	assert.NoError(t, query.Parse([]byte("{zzz|}"), &q))
+
+	var last string
+	var lastKey histdb.Key
+	called := 0
+	ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+		gen := string(name[bytes.LastIndex(name, []byte("zzz=")):])
+		assert.That(t, gen >= last)
+		if gen == last {
+			assert.That(t, string(key[:]) >= string(lastKey[:]))
+		}
+		assert.Equal(t, st.Total(h), uint64(1))
+		last, lastKey = gen, key
+		called++
+		return true
+	})
+	assert.NoError(t, err)
+	assert.That(t, ok)
+	assert.Equal(t, called, numLevels*numMetrics)
+
+	// stopping early must not leave workers running or lose results.
+	for range 10 {
+		called = 0
+		ok, err = st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+			called++
+			return called < numMetrics+1
+		})
+		assert.NoError(t, err)
+		assert.That(t, !ok)
+		assert.Equal(t, called, numMetrics+1)
+	}
+
+	// the workers do not scan the remaining levels after stopping early.
+	var stats QueryStats
+	ok, err = st.QueryDataStats(&q, 0, math.MaxUint32, &stats, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+		return false
+	})
+	assert.NoError(t, err)
+	assert.That(t, !ok)
+	assert.That(t, stats.Levels <= 4)
+}
+
+func TestStore_TimeRange(t *testing.T) {
+	const (
+		numLevels  = 8
+		numMetrics = 20
+	)
+
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	defer st.Close()
+
+	_, ok := st.Latest()
+	assert.That(t, !ok)
+
+	metrics := make([][]byte, numMetrics)
+	for i := range metrics {
+		metrics[i] = append(testhelp.Metric(5), ",zzz=1"...)
+	}
+	for gen := range numLevels {
+		for _, m := range metrics {
+			st.Observe(m, mwc.Float32())
+		}
+		assert.NoError(t, st.WriteLevel(uint32(gen+1)*10, 10))
+	}
+
+	assert.NoError(t, query.Parse([]byte("{zzz|}"), &q))
+
+	check := func(from, to uint32, levels int) {
+		called := 0
+		ok, err := st.QueryData(&q, from, to, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+			assert.That(t, from <= key.Timestamp() && key.Timestamp() < to)
+			called++
+			return true
+		})
+		assert.NoError(t, err)
+		assert.That(t, ok)
+		assert.Equal(t, called, levels*numMetrics)
+	}
+
+	check(0, math.MaxUint32, numLevels)
+	check(20, 40, 2)
+	check(25, 40, 1)
+	check(0, 10, 0)
+	check(90, 100, 0)
+
+	// the bounds also apply within a level holding many timestamps.
+	assert.NoError(t, st.CompactSuffix())
+	check(0, math.MaxUint32, numLevels)
+	check(20, 40, 2)
+	check(80, 81, 1)
+
+	latest, ok := st.Latest()
+	assert.That(t, ok)
+	assert.Equal(t, latest, uint32(80))
+}
+
+func TestStore_Explain(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	defer st.Close()
+
+	for gen := range 3 {
+		for i := range 10 {
+			st.Observe(fmt.Appendf(nil, "a=x,n=%d", i), 1)
+		}
+		st.Observe([]byte("b=y"), 1)
+		assert.NoError(t, st.WriteLevel(uint32(gen+1)*10, 10))
+	}
+
+	assert.NoError(t, query.Parse([]byte("{a=x}"), &q))
+
+	var stats QueryStats
+	called := 0
+	ok, err := st.QueryDataStats(&q, 0, 25, &stats, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+		called++
+		return true
+	})
+	assert.NoError(t, err)
+	assert.That(t, ok)
+	assert.Equal(t, called, 20)
+	assert.Equal(t, stats.Levels, 2)
+	assert.Equal(t, stats.Metrics, 20)
+	assert.Equal(t, stats.Keys, 20)
+	assert.That(t, stats.ValueBytes > 0)
+
+	qx, err := st.ExplainData(&q, 0, 25)
+	assert.NoError(t, err)
+	assert.Equal(t, qx.Stats, stats)
+	assert.Equal(t, len(qx.Levels), 2)
+	for _, lx := range qx.Levels {
+		assert.That(t, lx.Range.Low < lx.Range.High)
+		assert.Equal(t, lx.Explanation.Steps[0].Node, "(sel eq a x)")
+		assert.Equal(t, lx.Explanation.Steps[0].Metrics, 10)
+	}
+
+	qx, err = st.ExplainData(&q, 100, 200)
+	assert.NoError(t, err)
+	assert.Equal(t, len(qx.Levels), 0)
+	assert.Equal(t, qx.Stats, QueryStats{})
+}
+
+func TestStore_Aggregate(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	defer st.Close()
+
+	// 4 levels at timestamps 10, 20, 30, 40 each with 3 metrics in region a
+	// and 2 in region b observing their level number.
+	for gen := range 4 {
+		for i := range 5 {
+			region := "a"
+			if i >= 3 {
+				region = "b"
+			}
+			m := fmt.Appendf(nil, "service=api,region=%s,inst=%d", region, i)
+			st.Observe(m, float32(gen))
+		}
+		st.Observe([]byte("service=web,region=a"), 100)
+		assert.NoError(t, st.WriteLevel(uint32(gen+1)*10, 10))
+	}
+
+	assert.NoError(t, query.Parse([]byte("service=api"), &q))
+
+	agg, err := st.QueryAggregate(&q, 10, 50, 20, [][]byte{[]byte("region")})
+	assert.NoError(t, err)
+
+	type result struct {
+		group string
+		start uint32
+		total uint64
+		max   int
+	}
+	var got []result
+	for _, b := range agg.Buckets {
+		got = append(got, result{string(b.Group), b.Start, agg.S.Total(b.H), int(agg.S.Quantile(b.H, 1))})
+	}
+	assert.DeepEqual(t, got, []result{
+		{"region=a", 10, 6, 1},
+		{"region=a", 30, 6, 3},
+		{"region=b", 10, 4, 1},
+		{"region=b", 30, 4, 3},
+	})
+
+	agg, err = st.QueryAggregate(&q, 20, 40, 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(agg.Buckets), 1)
+	assert.Equal(t, string(agg.Buckets[0].Group), "")
+	assert.Equal(t, agg.Buckets[0].Start, 20)
+	assert.Equal(t, agg.S.Total(agg.Buckets[0].H), 10)
+}
+
+func TestStore_Retention(t *testing.T) {
+	const numMetrics = 3
+
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, st.Init(fs, Config{
+		Rollups: []Rollup{{After: 100, Resolution: 50}},
+		Retain:  300,
+	}))
+	defer st.Close()
+
+	for ts := uint32(0); ts < 400; ts += 10 {
+		for i := range numMetrics {
+			st.Observe(fmt.Appendf(nil, "zzz=%d", i), float32(ts))
+		}
+		assert.NoError(t, st.WriteLevel(ts, 10))
+	}
+	assert.NoError(t, st.CompactSuffix())
+	assert.Equal(t, stringLevels(st.lns), "(ln 0 40 6)")
+
+	type value struct {
+		ts, dur uint32
+		total   uint64
+	}
+	var exp []value
+	for ts := uint32(100); ts < 300; ts += 50 {
+		exp = append(exp, value{ts, 50, 5})
+	}
+	for ts := uint32(300); ts < 400; ts += 10 {
+		exp = append(exp, value{ts, 10, 1})
+	}
+
+	assert.NoError(t, query.Parse([]byte("zzz=0"), &q))
+
+	var got []value
+	ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+		got = append(got, value{key.Timestamp(), key.Duration(), st.Total(h)})
+		return true
+	})
+	assert.NoError(t, err)
+	assert.That(t, ok)
+	assert.DeepEqual(t, got, exp)
+
+	// resolutions that are not multiples of each other are rejected.
+	assert.Error(t, st.Init(fs, Config{Rollups: []Rollup{
+		{After: 100, Resolution: 50},
+		{After: 200, Resolution: 75},
+	}}))
+}
+
+func TestStore_RetentionLevels(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	cfg := Config{
+		Rollups: []Rollup{{After: 100, Resolution: 50}},
+		Retain:  300,
+	}
+
+	type value struct {
+		ts, dur uint32
+		total   uint64
+	}
+	values := func() (got []value) {
+		ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+			got = append(got, value{key.Timestamp(), key.Duration(), st.Total(h)})
+			return true
+		})
+		assert.NoError(t, err)
+		assert.That(t, ok)
+		return got
+	}
+	write := func(ts uint32) {
+		st.Observe([]byte("zzz=0"), 1)
+		assert.NoError(t, st.WriteLevel(ts, 10))
+	}
+
+	assert.NoError(t, query.Parse([]byte("zzz=0"), &q))
+	assert.NoError(t, st.Init(fs, cfg))
+	defer st.Close()
+
+	for ts := uint32(0); ts < 40; ts += 10 {
+		write(ts)
+	}
+	assert.NoError(t, st.CompactSuffix())
+	write(150)
+
+	// the first level is not part of the suffix, so only applying the
+	// retention policy rolls it up.
+	assert.NoError(t, st.CompactSuffix())
+	assert.Equal(t, stringLevels(st.lns), "(ln 0 4 3) (ln 4 5 1)")
+	assert.DeepEqual(t, values(), []value{{0, 10, 1}, {10, 10, 1}, {20, 10, 1}, {30, 10, 1}, {150, 10, 1}})
+
+	assert.NoError(t, st.ApplyRetention())
+	assert.Equal(t, stringLevels(st.lns), "(ln 0 4 3) (ln 4 5 1)")
+	assert.DeepEqual(t, values(), []value{{0, 50, 4}, {150, 10, 1}})
+
+	// levels opened by Init are checked and left alone if they are current.
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, cfg))
+	ln := st.lns[0]
+	assert.NoError(t, st.ApplyRetention())
+	assert.That(t, st.lns[0] == ln)
+
+	// once every value of the first level is older than Retain, it is
+	// removed along with its files, and the second level is rolled up.
+	write(400)
+	assert.NoError(t, st.ApplyRetention())
+	assert.Equal(t, stringLevels(st.lns), "(ln 4 5 1) (ln 5 6 1)")
+	assert.DeepEqual(t, values(), []value{{150, 50, 1}, {400, 10, 1}})
+
+	for _, kind := range []uint8{filesystem.KindIndx, filesystem.KindKeys, filesystem.KindVals} {
+		_, err := fs.OpenRead(filesystem.File{Low: 0, High: 4, Kind: kind}.String())
+		assert.That(t, errors.Is(err, os.ErrNotExist))
+	}
+
+	// the levels after the removed ones still open and compact.
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, cfg))
+	assert.Equal(t, stringLevels(st.lns), "(ln 4 5 1) (ln 5 6 1)")
+	assert.NoError(t, st.CompactSuffix())
+	assert.Equal(t, stringLevels(st.lns), "(ln 4 6 2)")
+	assert.DeepEqual(t, values(), []value{{150, 50, 1}, {400, 10, 1}})
+}
+
+func TestStore_CompactCardFix(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	for gen := range 4 {
+		for i := range 10 {
+			st.Observe(fmt.Appendf(nil, "service=api,request_id=%d", i), float32(gen))
+			st.Observe(fmt.Appendf(nil, "service=web,inst=%d", i%2), float32(gen))
+		}
+		assert.NoError(t, st.WriteLevel(uint32(gen+1)*10, 10))
+	}
+	assert.NoError(t, st.Close())
+
+	var cf card.Fixer
+	cf.DropTagKey([]byte("request_id"))
+
+	assert.NoError(t, st.Init(fs, Config{CardFix: &cf}))
+	defer st.Close()
+	assert.NoError(t, st.CompactSuffix())
+	assert.Equal(t, stringLevels(st.lns), "(ln 0 4 3)")
+
+	type value struct {
+		name  string
+		ts    uint32
+		total uint64
+	}
+
+	assert.NoError(t, query.Parse([]byte("{service|}"), &q))
+
+	var got []value
+	var last histdb.Key
+	ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+		assert.That(t, string(last[:]) < string(key[:]))
+		last = key
+		got = append(got, value{string(name), key.Timestamp(), st.Total(h)})
+		return true
+	})
+	assert.NoError(t, err)
+	assert.That(t, ok)
+
+	var apis int
+	for _, v := range got {
+		if v.name == "service=api" {
+			assert.Equal(t, v.total, 10)
+			apis++
+		} else {
+			assert.Equal(t, v.total, 5)
+		}
+	}
+	assert.Equal(t, apis, 4)
+	assert.Equal(t, len(got), 4*3)
+}
+
+func TestStore_CompactCardFixRewriteKey(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	for gen := range 2 {
+		for i := range 4 {
+			st.Observe(fmt.Appendf(nil, "service=web,host=web-%d", i), float32(gen))
+		}
+		assert.NoError(t, st.WriteLevel(uint32(gen+1)*10, 10))
+	}
+	assert.NoError(t, st.Close())
+
+	// the action has a different tag key than the tag it replaces.
+	var cf card.Fixer
+	cf.RewriteTag([]byte("host"), []byte("web-"), []byte("role=frontend"))
+
+	assert.NoError(t, st.Init(fs, Config{CardFix: &cf}))
+	defer st.Close()
+	assert.NoError(t, st.CompactSuffix())
+	assert.Equal(t, stringLevels(st.lns), "(ln 0 2 2)")
+
+	assert.NoError(t, query.Parse([]byte("role=frontend"), &q))
+
+	var names []string
+	var total uint64
+	ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+		names = append(names, string(name))
+		total += st.Total(h)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.That(t, ok)
+	assert.Equal(t, names, []string{"role=frontend,service=web", "role=frontend,service=web"})
+	assert.Equal(t, total, 8)
+}
+
+func TestStore_ConcurrentObserve(t *testing.T) {
+	const (
+		numWorkers      = 8
+		numMetrics      = 10
+		numObservations = 2000
+	)
+
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	var q query.Q
+
+	assert.NoError(t, st.Init(fs, Config{}))
+	defer st.Close()
+
+	var wg sync.WaitGroup
+	for w := range numWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range numObservations {
+				st.Observe(fmt.Appendf(nil, "zzz=%d", (w+i)%numMetrics), 1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+
+	// levels written while observing must not lose or double count values.
+	for gen, finished := uint32(1), false; !finished; gen++ {
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(time.Millisecond):
+		}
+		assert.NoError(t, st.WriteLevel(gen, 1))
+	}
+
+	assert.NoError(t, query.Parse([]byte("{zzz|}"), &q))
+
+	var total uint64
+	ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+		total += st.Total(h)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.That(t, ok)
+	assert.Equal(t, total, numWorkers*numObservations)
+}
+
+func TestStore_Scheduler(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var now atomic.Int64
+	waits := make(chan chan time.Time)
+
+	cfg := Config{FlushInterval: 10 * time.Second}
+	cfg.now = func() time.Time { return time.Unix(now.Load(), 0) }
+	cfg.after = func(time.Duration) <-chan time.Time {
+		c := make(chan time.Time, 1)
+		waits <- c
+		return c
+	}
+
+	// tick advances the clock and waits until the scheduler has handled it
+	// and is waiting for the next interval.
+	var wait chan time.Time
+	tick := func(ts int64) {
+		now.Store(ts)
+		wait <- time.Unix(ts, 0)
+		wait = <-waits
+	}
+
+	var st T
+	now.Store(1005)
+	assert.Error(t, st.Init(fs, Config{FlushInterval: time.Millisecond}))
+	assert.NoError(t, st.Init(fs, cfg))
+	wait = <-waits
+
+	var q query.Q
+	assert.NoError(t, query.Parse([]byte("{a|}"), &q))
+
+	values := func() (out []string) {
+		_, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, s *flathist.S, h flathist.H) bool {
+			out = append(out, fmt.Sprintf("%s@%d+%d=%d", name, key.Timestamp(), key.Duration(), s.Total(h)))
+			return true
+		})
+		assert.NoError(t, err)
+		return out
+	}
+
+	st.Observe([]byte("a=1"), 1)
+	tick(1010)
+	tick(1020)
+	assert.Equal(t, values(), []string{"a=1@1000+10=1"})
+
+	// the empty interval at 1010 was skipped, and a late wakeup covers every
+	// interval that has ended.
+	st.Observe([]byte("a=2"), 1)
+	tick(1047)
+
+	// the levels are compacted in the background.
+	for {
+		lrs, err := ListLevels(fs)
+		assert.NoError(t, err)
+		if len(lrs) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a failed write is reported until a later one succeeds. the
+	// observations of the failed level are dropped.
+	assert.NoError(t, st.LastError())
+	blockLevel(t, fs, 2)
+	st.Observe([]byte("a=3"), 1)
+	tick(1050)
+	assert.Error(t, st.LastError())
+
+	st.Observe([]byte("a=4"), 1)
+	tick(1060)
+	assert.NoError(t, st.LastError())
+
+	// close writes the partial interval.
+	st.Observe([]byte("a=5"), 1)
+	now.Store(1069)
+	assert.NoError(t, st.Close())
+
+	// the order depends on whether the last levels were compacted.
+	assert.NoError(t, st.Init(fs, Config{}))
+	got := values()
+	slices.Sort(got)
+	assert.Equal(t, got, []string{"a=1@1000+10=1", "a=2@1020+20=1", "a=4@1050+10=1", "a=5@1060+9=1"})
+	assert.NoError(t, st.Close())
+
+	// close returns the error writing the partial interval.
+	assert.NoError(t, st.Init(fs, cfg))
+	<-waits
+	blockLevel(t, fs, 4)
+	st.Observe([]byte("a=6"), 1)
+	now.Store(1075)
+	assert.Error(t, st.Close())
+}
+
+// blockLevel causes the next write of the level with the low generation to
+// fail. the failed write removes the directory in the way of its keys file.
+func blockLevel(t *testing.T, fs *filesystem.T, low uint32) {
+	name := filesystem.File{Low: low, High: low + 1, Kind: filesystem.KindKeys}.TempString()
+	assert.NoError(t, fs.Mkdir(name))
+}
+
+func TestStore_MemoryLimits(t *testing.T) {
+	t.Run("Hard", func(t *testing.T) {
+		fs, cleanup := testhelp.FS(t)
+		defer cleanup()
+
+		var st T
+		assert.Error(t, st.Init(fs, Config{MemorySoftLimit: 1}))
+		assert.NoError(t, st.Init(fs, Config{MemoryHardLimit: 1}))
+		defer st.Close()
+
+		// the size is checked when the memoryCheckPeriod'th metric is added,
+		// so it is the first one dropped.
+		for i := range 100 {
+			st.Observe(fmt.Appendf(nil, "a=%d", i), 1)
+		}
+		assert.Equal(t, st.Shed(), uint64(100-memoryCheckPeriod+1))
+		assert.Equal(t, st.DebugMemStore().I.Cardinality(), memoryCheckPeriod-1)
+
+		// known metrics are still observed.
+		st.ObserveN([]byte("a=0"), 1, 5)
+		st.ObserveMany([]byte("a=1"), []float32{1, 2})
+		st.ObserveN([]byte("b=0"), 1, 5)
+		st.ObserveMany([]byte("b=1"), []float32{1, 2})
+		assert.Equal(t, st.Shed(), uint64(100-memoryCheckPeriod+1+7))
+
+		// writing a level empties the memstore.
+		assert.NoError(t, st.WriteLevel(1, 1))
+		st.Observe([]byte("b=0"), 1)
+		assert.Equal(t, st.DebugMemStore().I.Cardinality(), 1)
+		assert.Equal(t, st.Shed(), uint64(100-memoryCheckPeriod+1+7))
+	})
+
+	t.Run("Observations", func(t *testing.T) {
+		fs, cleanup := testhelp.FS(t)
+		defer cleanup()
+
+		var st T
+		assert.NoError(t, st.Init(fs, Config{MemoryHardLimit: 1}))
+		defer st.Close()
+
+		// observations of a known metric on the fast path check the size
+		// once they cross memoryCheckObservations.
+		st.Observe([]byte("a=0"), 1)
+		st.ObserveN([]byte("a=0"), 1, memoryCheckObservations-3)
+		st.Observe([]byte("a=1"), 1)
+		assert.Equal(t, st.Shed(), uint64(0))
+
+		st.Observe([]byte("a=0"), 1)
+		st.Observe([]byte("a=2"), 1)
+		assert.Equal(t, st.Shed(), uint64(1))
+		assert.Equal(t, st.DebugMemStore().I.Cardinality(), 2)
+	})
+
+	t.Run("Size", func(t *testing.T) {
+		fs, cleanup := testhelp.FS(t)
+		defer cleanup()
+
+		var st T
+		assert.NoError(t, st.Init(fs, Config{WAL: true}))
+		defer st.Close()
+
+		// the size includes the fast table and the wal buffer.
+		for i := range 100 {
+			st.Observe(fmt.Appendf(nil, "a=%d", i), 1)
+		}
+		ms := st.DebugMemStore()
+		assert.That(t, st.memSize(ms) >= ms.I.Size()+ms.S.Size()+100*fastEntrySize+walBatchSize)
+	})
+
+	t.Run("Soft", func(t *testing.T) {
+		fs, cleanup := testhelp.FS(t)
+		defer cleanup()
+
+		var now atomic.Int64
+		waits := make(chan chan time.Time)
+
+		cfg := Config{FlushInterval: 10 * time.Second, MemorySoftLimit: 1}
+		cfg.now = func() time.Time { return time.Unix(now.Load(), 0) }
+		cfg.after = func(time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			waits <- c
+			return c
+		}
+
+		var st T
+		now.Store(1005)
+		assert.NoError(t, st.Init(fs, cfg))
+		defer st.Close()
+		wait := <-waits
+
+		// crossing the limit writes a level up to the current second.
+		now.Store(1007)
+		for i := range memoryCheckPeriod {
+			st.Observe(fmt.Appendf(nil, "a=%d", i), 1)
+		}
+		wait = <-waits
+
+		// crossing it again in the same second writes a level for the next
+		// second instead of doing nothing.
+		for i := range memoryCheckPeriod {
+			st.Observe(fmt.Appendf(nil, "a=%d", memoryCheckPeriod+i), 1)
+		}
+		wait = <-waits
+
+		// the next level covers the rest of the interval.
+		st.Observe([]byte("a=0"), 1)
+		now.Store(1010)
+		wait <- time.Unix(1010, 0)
+		<-waits
+
+		var q query.Q
+		assert.NoError(t, query.Parse([]byte("{a|}"), &q))
+
+		counts := make(map[string]int)
+		_, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, s *flathist.S, h flathist.H) bool {
+			counts[fmt.Sprintf("%d+%d", key.Timestamp(), key.Duration())]++
+			return true
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, counts, map[string]int{"1000+7": memoryCheckPeriod, "1007+1": memoryCheckPeriod, "1008+2": 1})
+		assert.Equal(t, st.Shed(), uint64(0))
+	})
+}
+
+func TestStore_Delete(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+
+	var st T
+	assert.NoError(t, st.Init(fs, Config{}))
+	defer st.Close()
+
+	for ts := uint32(10); ts <= 30; ts += 10 {
+		st.Observe([]byte("customer=acme,svc=x"), 1)
+		st.Observe([]byte("customer=acme,svc=y"), 1)
+		st.Observe([]byte("customer=other,svc=x"), 1)
+		assert.NoError(t, st.WriteLevel(ts, 10))
+	}
+
+	parse := func(s string) *query.Q {
+		var q query.Q
+		assert.NoError(t, query.Parse([]byte(s), &q))
+		return &q
+	}
+
+	values := func() (out []string) {
+		_, err := st.QueryData(parse("{svc|}"), 0, math.MaxUint32, func(key histdb.Key, name []byte, s *flathist.S, h flathist.H) bool {
+			out = append(out, fmt.Sprintf("%s@%d", name, key.Timestamp()))
+			return true
+		})
+		assert.NoError(t, err)
+		slices.Sort(out)
+		return out
+	}
+
+	metrics := func() (out []string) {
+		_, err := st.QueryMetrics(parse("{svc|}"), func(hash histdb.Hash, name []byte) bool {
+			out = append(out, string(name))
+			return true
+		})
+		assert.NoError(t, err)
+		slices.Sort(out)
+		return out
+	}
+
+	assert.NoError(t, st.Delete(parse("customer=acme"), 15, 30))
+	assert.NoError(t, st.Delete(parse("svc=y"), 0, math.MaxUint32))
+
+	check := func() {
+		t.Helper()
+		assert.Equal(t, values(), []string{
+			"customer=acme,svc=x@10",
+			"customer=acme,svc=x@30",
+			"customer=other,svc=x@10",
+			"customer=other,svc=x@20",
+			"customer=other,svc=x@30",
+		})
+		assert.Equal(t, metrics(), []string{"customer=acme,svc=x", "customer=other,svc=x"})
+	}
+
+	// the tombstones apply immediately and survive reopening.
+	check()
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, Config{}))
+	check()
+
+	// compaction drops the values and the tombstones.
+	assert.NoError(t, st.CompactSuffix())
+	assert.Equal(t, stringLevels(st.lns), "(ln 0 3 2)")
+	check()
+
+	ents, err := os.ReadDir(fs.Base)
+	assert.NoError(t, err)
+	for _, ent := range ents {
+		assert.That(t, !strings.HasSuffix(ent.Name(), ".tomb"))
+	}
+
+	// a deleted metric that is observed again is visible.
+	st.Observe([]byte("customer=acme,svc=y"), 1)
+	assert.NoError(t, st.WriteLevel(40, 10))
+	assert.Equal(t, len(metrics()), 3)
+
+	// metrics in the memstore are hidden in the level it is written to if
+	// its timestamp is deleted. the tombstones are replayed from the wal.
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, Config{WAL: true}))
+	st.Observe([]byte("customer=acme,svc=z"), 1)
+	st.Observe([]byte("customer=other,svc=z"), 1)
+	st.Observe([]byte("customer=other,svc=w"), 1)
+	assert.NoError(t, st.Delete(parse("{customer=acme & svc=z}"), 50, 60))
+	assert.NoError(t, st.Delete(parse("svc=w"), 0, 50))
+
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, Config{WAL: true}))
+	assert.NoError(t, st.WriteLevel(50, 10))
+	assert.That(t, !slices.Contains(values(), "customer=acme,svc=z@50"))
+	assert.That(t, slices.Contains(values(), "customer=other,svc=z@50"))
+	assert.That(t, slices.Contains(values(), "customer=other,svc=w@50"))
+
+	// and stay hidden after reopening and compacting.
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Init(fs, Config{}))
+	assert.That(t, !slices.Contains(values(), "customer=acme,svc=z@50"))
+	assert.NoError(t, st.CompactSuffix())
+	assert.That(t, !slices.Contains(values(), "customer=acme,svc=z@50"))
+	assert.That(t, !slices.Contains(metrics(), "customer=acme,svc=z"))
+
+	// an error reading the keys to check the tombstones is returned.
+	st.Observe([]byte("customer=acme,svc=v"), 1)
+	assert.NoError(t, st.WriteLevel(60, 10))
+	assert.NoError(t, st.Delete(parse("svc=v"), 0, 61))
+
+	ln := st.lns[len(st.lns)-1]
+	size, err := ln.fh.keys.Size()
+	assert.NoError(t, err)
+	fh, err := fs.OpenWrite(ln.file(filesystem.KindKeys))
+	assert.NoError(t, err)
+	_, err = fh.WriteAt(bytes.Repeat([]byte{0xff}, int(size-histdb.FooterSize)), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fh.Close())
+
+	_, err = st.QueryMetrics(parse("svc=v"), func(hash histdb.Hash, name []byte) bool { return true })
+	assert.Error(t, err)
+}
+
+func TestStore_Snapshot(t *testing.T) {
+	fs, cleanup := testhelp.FS(t)
+	defer cleanup()
+	sfs, scleanup := testhelp.FS(t)
+	defer scleanup()
+	rfs, rcleanup := testhelp.FS(t)
+	defer rcleanup()
+
+	var st T
+	assert.NoError(t, st.Init(fs, Config{}))
+	defer st.Close()
+
+	for ts := uint32(10); ts <= 30; ts += 10 {
+		st.Observe([]byte("svc=x"), 1)
+		st.Observe([]byte("svc=y"), 1)
+		assert.NoError(t, st.WriteLevel(ts, 10))
+	}
+
+	var q query.Q
+	assert.NoError(t, query.Parse([]byte("svc=y"), &q))
+	assert.NoError(t, st.Delete(&q, 20, 30))
+	assert.NoError(t, query.Parse([]byte("{svc|}"), &q))
+
+	values := func(st *T) (out []string) {
+		_, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, s *flathist.S, h flathist.H) bool {
+			out = append(out, fmt.Sprintf("%s@%d", name, key.Timestamp()))
+			return true
+		})
+		assert.NoError(t, err)
+		slices.Sort(out)
+		return out
+	}
+	exp := values(&st)
+	assert.Equal(t, len(exp), 5)
+
+	assert.NoError(t, st.Snapshot(sfs.Base))
+	assert.Error(t, st.Snapshot(sfs.Base)) // not empty
+	assert.NoError(t, VerifySnapshot(sfs.Base))
+
+	// changes to the store after the snapshot do not affect it.
+	assert.NoError(t, st.CompactSuffix())
+	st.Observe([]byte("svc=z"), 1)
+	assert.NoError(t, st.WriteLevel(40, 10))
+
+	var ss T
+	assert.NoError(t, ss.Init(sfs, Config{}))
+	assert.Equal(t, values(&ss), exp)
+	assert.NoError(t, ss.Close())
+
+	// restoring checks the destination is empty and makes an equivalent store.
+	assert.Error(t, Restore(fs, sfs.Base))
+	assert.NoError(t, Restore(rfs, sfs.Base))
+
+	var rs T
+	assert.NoError(t, rs.Init(rfs, Config{}))
+	assert.Equal(t, values(&rs), exp)
+	assert.NoError(t, rs.Close())
+
+	// a changed byte is detected. the file is replaced instead of modified
+	// because it is a hard link to the file in the store.
+	keys := filesystem.File{Low: 0, High: 1, Kind: filesystem.KindKeys}.String()
+	data, err := os.ReadFile(filepath.Join(sfs.Base, keys))
+	assert.NoError(t, err)
+	assert.NoError(t, sfs.Remove(keys))
+	data[len(data)/2] ^= 1
+	assert.NoError(t, os.WriteFile(filepath.Join(sfs.Base, keys), data, 0o644))
+	assert.Error(t, VerifySnapshot(sfs.Base))
+	data[len(data)/2] ^= 1
+	assert.NoError(t, os.WriteFile(filepath.Join(sfs.Base, keys), data, 0o644))
+	assert.NoError(t, VerifySnapshot(sfs.Base))
+
+	// a corrupt file in the snapshot is detected before restoring.
+	name := filesystem.File{Low: 1, High: 2, Kind: filesystem.KindVals}.String()
+	assert.NoError(t, sfs.Remove(name))
+	fh, err := sfs.Create(name)
+	assert.NoError(t, err)
+	assert.NoError(t, fh.Close())
+	assert.Error(t, VerifySnapshot(sfs.Base))
+
+	nfs, ncleanup := testhelp.FS(t)
+	defer ncleanup()
+	assert.Error(t, Restore(nfs, sfs.Base))
+	assert.NoError(t, checkEmptyDir(nfs))
+}
+
+func TestStore_ObserveBatch(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		fs, cleanup := testhelp.FS(t)
+		defer cleanup()
+
+		var st T
+		var q query.Q
+
+		assert.NoError(t, st.Init(fs, Config{WAL: wal}))
+
+		hist := flathist.NewHistogram()
+		for i := range 100 {
+			hist.Observe(float32(i))
+		}
+
+		st.Observe([]byte("zzz=a"), 1) // make the metric known for the fast path
+		st.ObserveMany([]byte("zzz=a"), []float32{1, 2, 3})
+		st.ObserveHistogram([]byte("zzz=a"), hist)
+		st.ObserveMany([]byte("zzz=b"), []float32{1, 2, 3})
+		st.ObserveHistogram([]byte("zzz=c"), hist)
+		st.ObserveN([]byte("zzz=a"), 5, 10)
+		st.ObserveN([]byte("zzz=d"), 5, 1000)
+
+		if wal {
+			// the observations should survive being replayed.
+			assert.NoError(t, st.Close())
+			assert.NoError(t, st.Init(fs, Config{WAL: wal}))
+		}
+		assert.NoError(t, st.WriteLevel(1, 1))
+
+		assert.NoError(t, query.Parse([]byte("{zzz|}"), &q))
+
+		totals := make(map[string]uint64)
+		ok, err := st.QueryData(&q, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+			totals[string(name)] = st.Total(h)
+			return true
+		})
+		assert.NoError(t, err)
+		assert.That(t, ok)
+		assert.DeepEqual(t, totals, map[string]uint64{
+			"zzz=a": 114,
+			"zzz=b": 3,
+			"zzz=c": 100,
+			"zzz=d": 1000,
+		})
+		assert.NoError(t, st.Close())
+	}
+}
+
+func BenchmarkStore_Observe(b *testing.B) {
+	const numMetrics = 1000
+
+	run := func(b *testing.B, cfg Config) {
+		fs, cleanup := testhelp.FS(b)
+		defer cleanup()
+
+		var st T
+		assert.NoError(b, st.Init(fs, cfg))
+		defer st.Close()
+
+		metrics := make([][]byte, numMetrics)
+		for i := range metrics {
+			metrics[i] = fmt.Appendf(nil, "zzz=%d", i)
+			st.Observe(metrics[i], 1)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for i := mwc.Intn(numMetrics); pb.Next(); i = (i + 1) % numMetrics {
+				st.Observe(metrics[i], 1)
+			}
+		})
+	}
+
+	b.Run("Memory", func(b *testing.B) { run(b, Config{}) })
+	b.Run("WAL", func(b *testing.B) { run(b, Config{WAL: true}) })
+}
+
 func BenchmarkStore_Query(b *testing.B) {
 	const (
 		numMetrics = 10000
@@ -146,7 +1604,7 @@ func BenchmarkStore_Query(b *testing.B) {
 
 		for b.Loop() {
 			calls := 0
-			st.QueryData(&qOne, 0, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+			st.QueryData(&qOne, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
 				calls++
 				return true
 			})
@@ -161,7 +1619,7 @@ func BenchmarkStore_Query(b *testing.B) {
 
 		for b.Loop() {
 			calls := 0
-			st.QueryData(&qAll, 0, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
+			st.QueryData(&qAll, 0, math.MaxUint32, func(key histdb.Key, name []byte, st *flathist.S, h flathist.H) bool {
 				calls++
 				return true
 			})
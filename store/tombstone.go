@@ -0,0 +1,307 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+
+	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
+
+	"github.com/histdb/histdb"
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/leveln"
+	"github.com/histdb/histdb/memindex"
+	"github.com/histdb/histdb/pdqsort"
+	"github.com/histdb/histdb/query"
+	"github.com/histdb/histdb/rwutils"
+)
+
+// the tombstones of a level are stored in a file named like the level's files
+// with the tomb kind. the file is a version, the number of tombstones, the
+// tombstones sorted by hash, and a footer:
+//
+//	tombstone: [hash: 24 bytes] [from: 4 bytes] [to: 4 bytes]
+//
+// it is replaced by writing a temporary file and renaming it over the old one,
+// so Init removes temporary tombstone files instead of installing them.
+
+const tombVersion = 0
+
+// tombstone hides the values of the metric with a timestamp in [from, to).
+type tombstone struct {
+	hash histdb.Hash
+	from uint32
+	to   uint32
+}
+
+func compareTombHash(tb tombstone, hash histdb.Hash) int {
+	return bytes.Compare(tb.hash[:], hash[:])
+}
+
+// loadTombstones reads the tombstones of the level if it has any.
+func (ln *levelN) loadTombstones() error {
+	fh, err := ln.fs.OpenRead(ln.file(filesystem.KindTomb))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errs.Wrap(err)
+	}
+	defer fh.Close()
+
+	data, err := io.ReadAll(fh)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if err := checkFooter(data, filesystem.KindTomb, true); err != nil {
+		return err
+	}
+
+	var r rwutils.R
+	r.Init(buffer.OfLen(data[:len(data)-histdb.FooterSize]))
+
+	if version := r.Uint64(); version != tombVersion {
+		return errs.Errorf("tombstones have unknown version: %d", version)
+	}
+	n := r.Varint()
+
+	tombs := make([]tombstone, 0, min(n, uint64(len(data))/32))
+	for range n {
+		tombs = append(tombs, tombstone{
+			hash: r.Bytes24(),
+			from: r.Uint32(),
+			to:   r.Uint32(),
+		})
+	}
+	if _, err := r.Done(); err != nil {
+		return errs.Wrap(err)
+	}
+
+	ln.tombs = tombs
+	return nil
+}
+
+// writeTombstones durably replaces the tombstone file of the level. The
+// tombstones must be sorted by hash.
+func (ln *levelN) writeTombstones(tombs []tombstone) (err error) {
+	var w rwutils.W
+	w.Init(buffer.OfCap(make([]byte, 0, 16+32*len(tombs)+histdb.FooterSize)))
+
+	w.Uint64(tombVersion)
+	w.Varint(uint64(len(tombs)))
+	for _, tb := range tombs {
+		w.Bytes24(tb.hash)
+		w.Uint32(tb.from)
+		w.Uint32(tb.to)
+	}
+
+	data := w.Done().Prefix()
+	histdb.Footer{
+		Kind:     filesystem.KindTomb,
+		Length:   uint64(len(data)),
+		Checksum: xxh3.Hash(data),
+	}.AppendTo(&w)
+
+	tmp := ln.temp(filesystem.KindTomb)
+	fh, err := ln.fs.Create(tmp)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() {
+		if err != nil {
+			_ = ln.fs.Remove(tmp)
+		}
+	}()
+
+	if _, err := fh.Write(w.Done().Prefix()); err != nil {
+		_ = fh.Close()
+		return errs.Wrap(err)
+	}
+	if err := fh.Sync(); err != nil {
+		_ = fh.Close()
+		return errs.Wrap(err)
+	}
+	if err := fh.Close(); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := ln.fs.Rename(tmp, ln.file(filesystem.KindTomb)); err != nil {
+		return errs.Wrap(err)
+	}
+	return errs.Wrap(ln.fs.SyncDir("."))
+}
+
+// addTombstones returns the tombstones of the level with the new ones merged
+// in, sorted by hash.
+func (ln *levelN) addTombstones(tombs []tombstone) []tombstone {
+	tombs = append(slices.Clip(ln.tombs), tombs...)
+	pdqsort.Less(tombs, func(i, j int) bool {
+		if c := bytes.Compare(tombs[i].hash[:], tombs[j].hash[:]); c != 0 {
+			return c < 0
+		}
+		return tombs[i].from < tombs[j].from
+	})
+	return tombs
+}
+
+// deleted returns true if a tombstone hides the value for the key.
+func (ln *levelN) deleted(key histdb.Key) bool {
+	if len(ln.tombs) == 0 {
+		return false
+	}
+
+	hash, ts := key.Hash(), key.Timestamp()
+	i, _ := slices.BinarySearchFunc(ln.tombs, hash, compareTombHash)
+	for ; i < len(ln.tombs) && ln.tombs[i].hash == hash; i++ {
+		if tb := ln.tombs[i]; tb.from <= ts && ts < tb.to {
+			return true
+		}
+	}
+	return false
+}
+
+// live returns true if the level has a value for the metric that is not
+// hidden by a tombstone. The iterator is only used if the metric has any.
+func (ln *levelN) live(it *leveln.Iterator, hash histdb.Hash) (bool, error) {
+	if _, ok := slices.BinarySearchFunc(ln.tombs, hash, compareTombHash); !ok {
+		return true, nil
+	}
+
+	var key histdb.Key
+	*key.HashPtr() = hash
+
+	it.Init(ln.fh.keys, ln.fh.vals)
+	it.Seek(key)
+
+	for it.Err() == nil && it.Key().Hash() == hash {
+		if !ln.deleted(it.Key()) {
+			return true, nil
+		}
+		if !it.Next() {
+			break
+		}
+	}
+
+	return false, it.Err()
+}
+
+// levelTombstones returns the tombstones of the memstore that hide values
+// written with the timestamp.
+func levelTombstones(tombs []tombstone, ts uint32) (out []tombstone) {
+	for _, tb := range tombs {
+		if tb.from <= ts && ts < tb.to {
+			out = append(out, tb)
+		}
+	}
+	return out
+}
+
+// Delete hides the values with a timestamp in [from, to) of every metric
+// matching the query from QueryMetrics and QueryData. The values are removed
+// when compaction rewrites the levels holding them. Metrics in the memstore
+// that match are hidden in the level it is written to if the timestamp of the
+// level is in [from, to), including observations made after Delete.
+func (t *T) Delete(q *query.Q, from, to uint32) error {
+	if t.cfg.ReadOnly {
+		return ErrReadOnly
+	} else if from >= to {
+		return nil
+	}
+
+	// compaction is excluded so that the levels being marked are not
+	// replaced by ones without the tombstones, and writing a level is
+	// excluded so that the memstore being marked is not being written.
+	t.cmu.Lock()
+	defer t.cmu.Unlock()
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	if err := t.deleteMemStore(q, from, to); err != nil {
+		return err
+	}
+
+	// SAFETY: t.lns is only either appended to in WriteLevel or fully replaced
+	// in CompactSuffix, so taking a shallow snapshot of the slice is safe.
+	t.lmu.Lock()
+	lns := t.lns
+	t.lmu.Unlock()
+
+	type update struct {
+		ln    *levelN
+		tombs []tombstone
+	}
+	var updates []update
+
+	// the tombstones that were written are installed even if a later level
+	// fails so that queries match what Init would load. queries read the
+	// tombstones without any locks other than qmu.
+	defer func() {
+		t.qmu.Lock()
+		defer t.qmu.Unlock()
+
+		for _, u := range updates {
+			u.ln.tombs = u.tombs
+		}
+	}()
+
+	for _, ln := range lns {
+		if !ln.Overlaps(from, to) {
+			continue
+		}
+
+		var tombs []tombstone
+		if !memindex.Iter(q.Eval(&ln.idx), func(id memindex.Id) bool {
+			hash, ok := ln.idx.GetHashById(id)
+			tombs = append(tombs, tombstone{hash: hash, from: from, to: to})
+			return ok
+		}) {
+			return errs.Errorf("memindex inconsistent")
+		}
+		if len(tombs) == 0 {
+			continue
+		}
+
+		tombs = ln.addTombstones(tombs)
+		if err := ln.writeTombstones(tombs); err != nil {
+			return errs.Errorf("unable to write tombstones: %w", err)
+		}
+		updates = append(updates, update{ln: ln, tombs: tombs})
+	}
+
+	return nil
+}
+
+// deleteMemStore records tombstones for the metrics in the memstore matching
+// the query so that WriteLevel can write them with the level. They are
+// synced to the wal so that they are replayed with the observations.
+func (t *T) deleteMemStore(q *query.Q, from, to uint32) error {
+	t.imu.Lock()
+	defer t.imu.Unlock()
+
+	ms := t.ms.Load()
+	if ms == nil {
+		return errs.Errorf("memstore is nil (store closed or not initialized)")
+	}
+
+	n := len(ms.tombs)
+	if !memindex.Iter(q.Eval(&ms.I), func(id memindex.Id) bool {
+		hash, ok := ms.I.GetHashById(id)
+		ms.tombs = append(ms.tombs, tombstone{hash: hash, from: from, to: to})
+		return ok
+	}) {
+		return errs.Errorf("memindex inconsistent")
+	}
+
+	if t.wal == nil || n == len(ms.tombs) {
+		return nil
+	}
+	for _, tb := range ms.tombs[n:] {
+		t.wal.delete(tb)
+	}
+	if err := t.wal.Sync(); err != nil {
+		return errs.Errorf("unable to sync wal: %w", err)
+	}
+	return nil
+}
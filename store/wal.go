@@ -0,0 +1,381 @@
+package store
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs/v2"
+	"github.com/zeebo/xxh3"
+
+	"github.com/histdb/histdb/buffer"
+	"github.com/histdb/histdb/card"
+	"github.com/histdb/histdb/filesystem"
+	"github.com/histdb/histdb/flathist"
+	"github.com/histdb/histdb/rwutils"
+)
+
+var le = binary.LittleEndian
+
+// wal segments are named like leveln files except that the low is the
+// generation of the level the observations will be written into and the high
+// is a sequence number that is unique across all segments. the file is a
+// version followed by a sequence of frames that each hold a batch of entries:
+//
+//	frame: [len: 4 bytes] [xxh3(payload): 8 bytes] [payload: len bytes]
+//	entry: [kind: 1 byte] [metric: varint len + bytes] [kind specific data]
+//
+// a frame that is truncated or fails its checksum ends the segment so that a
+// partially written batch from a crash is ignored.
+
+const (
+	walVersion         = 0
+	walFrameHeaderSize = 4 + 8
+	walBatchSize       = 64 << 10
+
+	defaultWalSyncInterval = time.Second
+
+	walEntryObserve   = 1 // float32 value
+	walEntryHistogram = 2 // flathist serialized histogram
+	walEntryObserveN  = 3 // float32 value, varint count
+	walEntryDelete    = 4 // empty metric, hash, from and to of a tombstone
+	walEntryMany      = 5 // varint count, that many float32 values
+)
+
+// the wal buffers entries in shards so that observations on the fast path do
+// not all contend on one lock. each shard writes its own frames, so entries
+// are not in the order they were made, which is fine because replaying them
+// into a memstore gives the same result in any order.
+type wal struct {
+	_ [0]func() // no equality
+
+	file   filesystem.File
+	fh     filesystem.H
+	shards []walShard
+
+	mu  sync.Mutex // serializes writes to fh and protects err
+	err error
+}
+
+type walShard struct {
+	_ [0]func() // no equality
+
+	mu sync.Mutex
+	w  rwutils.W
+	_  [64]byte // keep shards on separate cache lines
+}
+
+func createWal(fs *filesystem.T, file filesystem.File) (_ *wal, err error) {
+	fh, err := fs.Create(file.String())
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	var hdr [8]byte
+	le.PutUint64(hdr[:], walVersion)
+	if _, err := fh.Write(hdr[:]); err != nil {
+		_ = fh.Remove()
+		return nil, errs.Wrap(err)
+	}
+
+	wl := &wal{file: file, fh: fh}
+	wl.shards = make([]walShard, runtime.GOMAXPROCS(0))
+	for i := range wl.shards {
+		ws := &wl.shards[i]
+		ws.w.Init(buffer.OfCap(make([]byte, 0, walBatchSize+walFrameHeaderSize)))
+		ws.begin()
+	}
+
+	return wl, nil
+}
+
+// size returns the number of bytes buffered by the wal.
+func (wl *wal) size() (n uint64) {
+	for i := range wl.shards {
+		ws := &wl.shards[i]
+		ws.mu.Lock()
+		n += uint64(ws.w.Done().Cap())
+		ws.mu.Unlock()
+	}
+	return n
+}
+
+// shard locks and returns a shard to buffer an entry into. The caller must
+// call done with it.
+func (wl *wal) shard() *walShard {
+	ws := &wl.shards[rand.IntN(len(wl.shards))]
+	ws.mu.Lock()
+	return ws
+}
+
+// done flushes the shard if it holds a full batch and unlocks it.
+func (wl *wal) done(ws *walShard) {
+	if ws.w.Done().Pos() >= walBatchSize {
+		_ = wl.flush(ws)
+	}
+	ws.mu.Unlock()
+}
+
+func (ws *walShard) begin() {
+	ws.w.Reset()
+	ws.w.Uint32(0) // length
+	ws.w.Uint64(0) // checksum
+}
+
+func (ws *walShard) entry(kind byte, metric []byte) {
+	ws.w.Uint8(kind)
+	ws.w.Varint(uint64(len(metric)))
+	ws.w.Bytes(metric)
+}
+
+// observe buffers an observation.
+func (wl *wal) observe(metric []byte, val float32) {
+	ws := wl.shard()
+	ws.entry(walEntryObserve, metric)
+	ws.w.Uint32(math.Float32bits(val))
+	wl.done(ws)
+}
+
+// observeN buffers an observation made n times.
+func (wl *wal) observeN(metric []byte, val float32, n uint64) {
+	ws := wl.shard()
+	ws.entry(walEntryObserveN, metric)
+	ws.w.Uint32(math.Float32bits(val))
+	ws.w.Varint(n)
+	wl.done(ws)
+}
+
+// observeMany buffers all of the observations of the metric as a single
+// entry.
+func (wl *wal) observeMany(metric []byte, vals []float32) {
+	ws := wl.shard()
+	ws.entry(walEntryMany, metric)
+	ws.w.Varint(uint64(len(vals)))
+	for _, val := range vals {
+		ws.w.Uint32(math.Float32bits(val))
+	}
+	wl.done(ws)
+}
+
+// histogram buffers all of the observations in the histogram.
+func (wl *wal) histogram(metric []byte, s *flathist.S, h flathist.H) {
+	ws := wl.shard()
+	ws.entry(walEntryHistogram, metric)
+	flathist.AppendTo(s, h, &ws.w)
+	wl.done(ws)
+}
+
+// delete buffers a tombstone for the memstore.
+func (wl *wal) delete(tb tombstone) {
+	ws := wl.shard()
+	ws.entry(walEntryDelete, nil)
+	ws.w.Bytes24(tb.hash)
+	ws.w.Uint32(tb.from)
+	ws.w.Uint32(tb.to)
+	wl.done(ws)
+}
+
+// flush writes the batch in the shard, which must be locked, to the segment.
+// Once a write fails, no more batches are written so that a torn frame is
+// always the end of the segment.
+func (wl *wal) flush(ws *walShard) error {
+	buf := ws.w.Done().Prefix()
+	if len(buf) <= walFrameHeaderSize {
+		return wl.Err()
+	}
+	defer ws.begin()
+
+	le.PutUint32(buf[0:4], uint32(len(buf)-walFrameHeaderSize))
+	le.PutUint64(buf[4:12], xxh3.Hash(buf[walFrameHeaderSize:]))
+
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.err != nil {
+		return wl.err
+	}
+	if _, err := wl.fh.Write(buf); err != nil {
+		wl.err = errs.Errorf("unable to write wal: %w", err)
+	}
+	return wl.err
+}
+
+// flushAll writes the batches in every shard to the segment.
+func (wl *wal) flushAll() error {
+	for i := range wl.shards {
+		ws := &wl.shards[i]
+		ws.mu.Lock()
+		_ = wl.flush(ws)
+		ws.mu.Unlock()
+	}
+	return wl.Err()
+}
+
+// Err returns the error from the first failed write or sync of the segment.
+func (wl *wal) Err() error {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	return wl.err
+}
+
+// setErr records an error that makes the segment unusable.
+func (wl *wal) setErr(err error) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.err == nil {
+		wl.err = err
+	}
+}
+
+// Sync writes the buffered batches and syncs the segment. A failed sync is
+// kept like a failed write because the written batches may not be durable.
+func (wl *wal) Sync() error {
+	if err := wl.flushAll(); err != nil {
+		return err
+	}
+
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if err := wl.fh.Sync(); err != nil {
+		wl.err = errs.Errorf("unable to sync wal: %w", err)
+	}
+	return wl.err
+}
+
+// startWalSync syncs the wal every interval until stopWalSync is called. The
+// errors are kept by the wal for LastError.
+func (t *T) startWalSync(interval time.Duration) {
+	t.wstop = make(chan struct{})
+	t.wwg.Add(1)
+
+	go func(stop chan struct{}) {
+		defer t.wwg.Done()
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				_ = t.SyncWAL()
+			}
+		}
+	}(t.wstop)
+}
+
+func (t *T) stopWalSync() {
+	if t.wstop != nil {
+		close(t.wstop)
+		t.wwg.Wait()
+		t.wstop = nil
+	}
+}
+
+func (wl *wal) Close() error {
+	return errs.Combine(wl.flushAll(), wl.fh.Close())
+}
+
+// replayWal reads every complete frame from the segment and adds the
+// observations into the memstore.
+func replayWal(fs *filesystem.T, file filesystem.File, ms *MemStore, cf *card.Fixer) error {
+	fh, err := fs.OpenRead(file.String())
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() { _ = fh.Close() }()
+
+	data, err := io.ReadAll(fh)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	if len(data) < 8 {
+		// the segment was created but the version never made it to disk.
+		return nil
+	} else if version := le.Uint64(data[0:8]); version != walVersion {
+		return errs.Errorf("wal %s has unknown version: %d", file, version)
+	}
+	data = data[8:]
+
+	var vals []float32
+	for len(data) >= walFrameHeaderSize {
+		size := uint64(le.Uint32(data[0:4]))
+		if size > uint64(len(data)-walFrameHeaderSize) {
+			break
+		}
+		payload := data[walFrameHeaderSize : walFrameHeaderSize+size]
+		if xxh3.Hash(payload) != le.Uint64(data[4:12]) {
+			break
+		}
+		data = data[walFrameHeaderSize+size:]
+
+		var r rwutils.R
+		r.Init(buffer.OfLen(payload))
+
+		for r.Remaining() > 0 {
+			kind := r.Uint8()
+			metric := r.Bytes(int(r.Varint()))
+
+			switch kind {
+			case walEntryObserve:
+				val := math.Float32frombits(r.Uint32())
+				if _, err := r.Done(); err == nil {
+					ms.S.Observe(ms.handle(metric, cf), val)
+				}
+
+			case walEntryObserveN:
+				val := math.Float32frombits(r.Uint32())
+				n := r.Varint()
+				if _, err := r.Done(); err == nil {
+					ms.S.ObserveN(ms.handle(metric, cf), val, n)
+				}
+
+			case walEntryMany:
+				n := r.Varint()
+				if n > uint64(r.Remaining()/4) {
+					r.Invalid(errs.Errorf("too many values: %d", n))
+					break
+				}
+				vals = vals[:0]
+				for range n {
+					vals = append(vals, math.Float32frombits(r.Uint32()))
+				}
+				if _, err := r.Done(); err == nil {
+					h := ms.handle(metric, cf)
+					for _, val := range vals {
+						ms.S.Observe(h, val)
+					}
+				}
+
+			case walEntryHistogram:
+				if _, err := r.Done(); err == nil {
+					flathist.ReadFrom(&ms.S, ms.handle(metric, cf), &r)
+				}
+
+			case walEntryDelete:
+				tb := tombstone{hash: r.Bytes24(), from: r.Uint32(), to: r.Uint32()}
+				if _, err := r.Done(); err == nil {
+					ms.tombs = append(ms.tombs, tb)
+				}
+
+			default:
+				r.Invalid(errs.Errorf("unknown entry kind: %d", kind))
+			}
+		}
+
+		if _, err := r.Done(); err != nil {
+			return errs.Errorf("wal %s is corrupt: %w", file, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package val
+
+import "bytes"
+
+// Parse types a literal. Integers are Int and other decimal numbers are
+// Float. Values with a leading 'v' or at least two dots that ParseVersion
+// accepts are Version. Anything else is a Str aliasing s.
+func Parse(s []byte) T {
+	if v, ok := ParseInt(s); ok {
+		return Int(v)
+	}
+	if versionLike(s) {
+		if v, ok := ParseVersion(s); ok {
+			return Version(v)
+		}
+	}
+	if v, ok := ParseFloat(s); ok {
+		return Float(v)
+	}
+	return Bytes(s)
+}
+
+// versionLike returns true if s can only be a version, which is when it has a
+// leading 'v' or at least two dots. values like 1.12 are also numbers.
+func versionLike(s []byte) bool {
+	return len(s) > 0 && (s[0] == 'v' || bytes.Count(s, []byte{'.'}) >= 2)
+}
+
+// Like is a literal typed for comparisons by ParseLiteral.
+type Like struct {
+	T T // the literal typed by Parse
+	V T // the literal as a Version if it reads as one, or invalid
+}
+
+// ParseLiteral types the literal with Parse and also keeps it as a Version if
+// it reads as one, so that a literal like 1.12 compares as a version to values
+// that can only be versions.
+func ParseLiteral(s []byte) (like Like) {
+	like.T = Parse(s)
+	if like.T.Tag() == TagVersion {
+		like.V = like.T
+	} else if like.T.Tag() != TagStr {
+		if v, ok := ParseVersion(s); ok {
+			like.V = Version(v)
+		}
+	}
+	return like
+}
+
+// ParseLike parses s as a value that can be compared to the literal with GT,
+// GTE, LT and LTE. Values that can only be versions are compared as versions
+// if the literal reads as one. Otherwise, numbers are parsed for Int and
+// Float, with both values converted to Float if either one is, versions are
+// parsed for Version, and any s is a Str for Str. It returns false if s can
+// not be compared to the literal.
+func ParseLike(s []byte, lit Like) (v, l T, ok bool) {
+	if lit.V.Tag() == TagVersion && versionLike(s) {
+		x, ok := ParseVersion(s)
+		return Version(x), lit.V, ok
+	}
+
+	like := lit.T
+	switch like.Tag() {
+	case TagInt, TagFloat:
+		if x, ok := ParseInt(s); ok {
+			v = Int(x)
+		} else if x, ok := ParseFloat(s); ok {
+			v = Float(x)
+		} else {
+			return T{}, T{}, false
+		}
+		if v.Tag() != like.Tag() {
+			v, like = toFloat(v), toFloat(like)
+		}
+		return v, like, true
+
+	case TagVersion:
+		x, ok := ParseVersion(s)
+		return Version(x), like, ok
+
+	case TagStr:
+		return Bytes(s), like, true
+
+	default:
+		return T{}, T{}, false
+	}
+}
+
+func toFloat(v T) T {
+	if v.Tag() == TagInt {
+		return Float(float64(v.AsInt()))
+	}
+	return v
+}
@@ -1,5 +1,10 @@
 package val
 
+import (
+	"bytes"
+	"strconv"
+)
+
 func ParseInt(s []byte) (v int64, ok bool) {
 	if len(s) == 0 {
 		return 0, false
@@ -57,3 +62,50 @@ func ParseUint(s []byte) (v uint64, ok bool) {
 	}
 	return v, true
 }
+
+// ParseFloat parses a decimal number with an optional sign, fraction and
+// exponent. Unlike strconv, it does not accept infinities, NaNs, hex floats or
+// underscores, so that tag values like "inf" are not mistaken for numbers.
+func ParseFloat(s []byte) (v float64, ok bool) {
+	if len(s) == 0 {
+		return 0, false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && c != '.' && c != '-' && c != '+' && c != 'e' && c != 'E' {
+			return 0, false
+		}
+	}
+	v, err := strconv.ParseFloat(string(s), 64)
+	return v, err == nil
+}
+
+// ParseVersion parses a version of one to four dot separated components, each
+// at most 65535, with an optional leading 'v'. The components are packed 16
+// bits each from the most significant end so that versions compare as
+// integers and missing components are zero.
+func ParseVersion(s []byte) (v uint64, ok bool) {
+	if len(s) > 0 && s[0] == 'v' {
+		s = s[1:]
+	}
+
+	for n := 0; n < 4; n++ {
+		part := s
+		if i := bytes.IndexByte(s, '.'); i >= 0 {
+			part, s = s[:i], s[i+1:]
+		} else {
+			s = nil
+		}
+
+		c, ok := ParseUint(part)
+		if !ok || c > 0xffff {
+			return 0, false
+		}
+		v |= c << (48 - 16*n)
+
+		if s == nil {
+			return v, true
+		}
+	}
+
+	return 0, false
+}
@@ -12,14 +12,15 @@ type (
 	i64 = int64
 )
 
-var tags [4]byte
+var tags [5]byte
 
 var (
 	TagInvalid = ptr(nil)
 	TagInt     = ptr(&tags[0])
 	TagBool    = ptr(&tags[1])
 	TagFloat   = ptr(&tags[2])
-	TagStr     = ptr(&tags[3])
+	TagVersion = ptr(&tags[3])
+	TagStr     = ptr(&tags[4])
 )
 
 var emptyStrPtr = func() ptr {
@@ -33,7 +34,7 @@ type T struct {
 }
 
 func (v T) Tag() ptr {
-	if v.p == nil || uintptr(v.p)-uintptr(TagInt) < 3 {
+	if v.p == nil || uintptr(v.p)-uintptr(TagInt) < 4 {
 		return v.p
 	}
 	return TagStr
@@ -73,6 +74,19 @@ func Float(val float64) T {
 
 func (v T) AsFloat() float64 { return math.Float64frombits(v.v) }
 
+// Version is a dotted version packed by ParseVersion so that versions
+// compare as integers.
+func Version(packed u64) T {
+	return T{p: TagVersion, v: packed}
+}
+
+func (v T) AsVersion() u64 {
+	if v.p == TagVersion {
+		return v.v
+	}
+	return 0
+}
+
 func Str(val string) T {
 	v := T{p: ptr(unsafe.StringData(val)), v: u64(len(val))}
 	if v.p == nil {
@@ -106,6 +120,13 @@ func (v T) String() string {
 		return fmt.Sprintf("bool(%t)", v.AsBool())
 	case TagFloat:
 		return fmt.Sprintf("float(%f)", v.AsFloat())
+	case TagVersion:
+		x := v.AsVersion()
+		s := fmt.Sprintf("version(%d.%d.%d", x>>48, x>>32&0xffff, x>>16&0xffff)
+		if x&0xffff != 0 {
+			s += fmt.Sprintf(".%d", x&0xffff)
+		}
+		return s + ")"
 	case TagStr:
 		return fmt.Sprintf("str(%q)", v.AsString())
 	default:
@@ -119,6 +140,8 @@ func GT(x, y T) bool {
 		return x.AsInt() > y.AsInt()
 	case TagFloat:
 		return x.AsFloat() > y.AsFloat()
+	case TagVersion:
+		return x.AsVersion() > y.AsVersion()
 	default:
 		return x.AsString() > y.AsString()
 	}
@@ -130,6 +153,8 @@ func GTE(x, y T) bool {
 		return x.AsInt() >= y.AsInt()
 	case TagFloat:
 		return x.AsFloat() >= y.AsFloat()
+	case TagVersion:
+		return x.AsVersion() >= y.AsVersion()
 	default:
 		return x.AsString() >= y.AsString()
 	}
@@ -141,6 +166,8 @@ func LT(x, y T) bool {
 		return x.AsInt() < y.AsInt()
 	case TagFloat:
 		return x.AsFloat() < y.AsFloat()
+	case TagVersion:
+		return x.AsVersion() < y.AsVersion()
 	default:
 		return x.AsString() < y.AsString()
 	}
@@ -152,6 +179,8 @@ func LTE(x, y T) bool {
 		return x.AsInt() <= y.AsInt()
 	case TagFloat:
 		return x.AsFloat() <= y.AsFloat()
+	case TagVersion:
+		return x.AsVersion() <= y.AsVersion()
 	default:
 		return x.AsString() <= y.AsString()
 	}
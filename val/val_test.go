@@ -40,3 +40,55 @@ func TestValue(t *testing.T) {
 	assert.Equal(t, Str("bar").AsInt(), 0)
 	assert.Equal(t, T{}.AsInt(), 0)
 }
+
+func TestParse(t *testing.T) {
+	assert.Equal(t, Parse([]byte("500")), Int(500))
+	assert.Equal(t, Parse([]byte("-2")), Int(-2))
+	assert.Equal(t, Parse([]byte("1.5")), Float(1.5))
+	assert.Equal(t, Parse([]byte("1e3")), Float(1000))
+	assert.Equal(t, Parse([]byte("1.12.0")), Version(1<<48|12<<32))
+	assert.Equal(t, Parse([]byte("v1.2")), Version(1<<48|2<<32))
+	assert.Equal(t, Parse([]byte("inf")).Tag(), TagStr)
+	assert.Equal(t, Parse([]byte("1.2.3.4.5")).Tag(), TagStr)
+	assert.Equal(t, Parse([]byte("1.70000.0")).Tag(), TagStr)
+	assert.Equal(t, Parse([]byte("")).Tag(), TagStr)
+
+	assert.Equal(t, Version(1<<48|12<<32).String(), "version(1.12.0)")
+	assert.Equal(t, Version(1<<48|2<<32|3<<16|4).String(), "version(1.2.3.4)")
+
+	cmp := func(s, lit string) (bool, bool) {
+		v, l, ok := ParseLike([]byte(s), ParseLiteral([]byte(lit)))
+		return ok && GT(v, l), ok
+	}
+
+	gt, ok := cmp("1.12.0", "1.2.0")
+	assert.That(t, ok && gt)
+	gt, ok = cmp("1.9", "1.12.0")
+	assert.That(t, ok && !gt)
+	gt, ok = cmp("10", "9")
+	assert.That(t, ok && gt)
+	gt, ok = cmp("9.5", "9")
+	assert.That(t, ok && gt)
+	gt, ok = cmp("10", "9.5")
+	assert.That(t, ok && gt)
+	gt, ok = cmp("b", "a")
+	assert.That(t, ok && gt)
+	_, ok = cmp("abc", "9")
+	assert.That(t, !ok)
+	_, ok = cmp("1.x", "1.2.3")
+	assert.That(t, !ok)
+
+	// a literal like 1.12 is a number, but compares as a version to values
+	// that can only be versions, and a leading v makes it a version for
+	// every value.
+	gt, ok = cmp("1.9.0", "1.12")
+	assert.That(t, ok && !gt)
+	gt, ok = cmp("v1.13", "1.12")
+	assert.That(t, ok && gt)
+	gt, ok = cmp("1.9", "v1.12")
+	assert.That(t, ok && !gt)
+	gt, ok = cmp("1.25", "1.5")
+	assert.That(t, ok && !gt)
+	gt, ok = cmp("1.12.0", "2")
+	assert.That(t, ok && !gt)
+}
@@ -58,27 +58,28 @@ func Consume(buf buffer.T) (uint64, buffer.T, bool) {
 		return 0, buf, false
 	}
 
+	pos := buf.Pos()
 	switch nbytes {
 	case 9:
-		out |= le.Uint64(buf.Index8(1)[:])
+		out |= le.Uint64(buf.Index8(pos + 1)[:])
 	case 8:
-		out |= uint64(le.Uint32(buf.Index4(1)[:]))
-		out |= uint64(le.Uint32(buf.Index4(4)[:])) << 24
+		out |= uint64(le.Uint32(buf.Index4(pos + 1)[:]))
+		out |= uint64(le.Uint32(buf.Index4(pos + 4)[:])) << 24
 	case 7:
-		out |= uint64(le.Uint32(buf.Index4(1)[:])) << 1
-		out |= uint64(le.Uint16(buf.Index2(5)[:])) << 33
+		out |= uint64(le.Uint32(buf.Index4(pos + 1)[:])) << 1
+		out |= uint64(le.Uint16(buf.Index2(pos + 5)[:])) << 33
 	case 6:
-		out |= uint64(le.Uint32(buf.Index4(1)[:])) << 2
-		out |= uint64(*buf.Index(5)) << 34
+		out |= uint64(le.Uint32(buf.Index4(pos + 1)[:])) << 2
+		out |= uint64(*buf.Index(pos + 5)) << 34
 	case 5:
-		out |= uint64(le.Uint32(buf.Index4(1)[:])) << 3
+		out |= uint64(le.Uint32(buf.Index4(pos + 1)[:])) << 3
 	case 4:
-		out |= uint64(le.Uint16(buf.Index2(1)[:])) << 4
-		out |= uint64(*buf.Index(3)) << 20
+		out |= uint64(le.Uint16(buf.Index2(pos + 1)[:])) << 4
+		out |= uint64(*buf.Index(pos + 3)) << 20
 	case 3:
-		out |= uint64(le.Uint16(buf.Index2(1)[:])) << 5
+		out |= uint64(le.Uint16(buf.Index2(pos + 1)[:])) << 5
 	case 2:
-		out |= uint64(*buf.Index(1)) << 6
+		out |= uint64(*buf.Index(pos + 1)) << 6
 	}
 
 	return out, buf.Advance(uintptr(nbytes)), true
@@ -114,6 +114,20 @@ func TestVarint(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("SafeOffset", func(t *testing.T) {
+		for i := uint(0); i <= 64; i++ {
+			buf := buffer.OfCap(make([]byte, 10))
+
+			nbytes := Append(buf.Advance(1).Front9(), 1<<i-1)
+			assert.That(t, nbytes <= 9)
+			buf = buffer.OfLen(buf.Advance(1 + nbytes).Prefix()).Advance(1)
+			dec, _, ok := Consume(buf)
+
+			assert.That(t, ok)
+			assert.Equal(t, uint64(1<<i-1), dec)
+		}
+	})
 }
 
 func BenchmarkVarint(b *testing.B) {